@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"os"
 	"testing"
 
 	"github.com/gdamore/tcell/v2"
 	"tked/internal/app"
+	"tked/internal/lsp"
 )
 
 // dummyApp implements app.App for testing openFiles.
@@ -13,15 +15,32 @@ type dummyApp struct {
 	opened []string
 }
 
-func (d *dummyApp) OpenFile(name string) error  { d.opened = append(d.opened, name); return nil }
-func (d *dummyApp) Run(tcell.Screen)            {}
-func (d *dummyApp) Settings() app.Settings      { return app.NewSettings() }
-func (d *dummyApp) LoadSettings(string) error   { return nil }
-func (d *dummyApp) GetStatusBar() app.StatusBar { return nil }
-func (d *dummyApp) GetCurrentView() app.View    { return nil }
-func (d *dummyApp) SetCurrentView(app.View)     {}
-func (d *dummyApp) Views() []app.View           { return nil }
-func (d *dummyApp) CloseView(app.View) bool     { return true }
+func (d *dummyApp) OpenFile(name string) error                        { d.opened = append(d.opened, name); return nil }
+func (d *dummyApp) Run(tcell.Screen)                                  {}
+func (d *dummyApp) Settings() app.Settings                            { return app.NewSettings() }
+func (d *dummyApp) LoadSettings(string) error                         { return nil }
+func (d *dummyApp) GetStatusBar() app.StatusBar                       { return nil }
+func (d *dummyApp) GetCurrentView() app.View                          { return nil }
+func (d *dummyApp) SetCurrentView(app.View)                           {}
+func (d *dummyApp) Views() []app.View                                 { return nil }
+func (d *dummyApp) CloseView(app.View) bool                           { return true }
+func (d *dummyApp) Pick(string, []string, int, func(int)) (int, bool) { return -1, false }
+func (d *dummyApp) JumpTo(string, lsp.Position) error                 { return nil }
+func (d *dummyApp) JumpBack() bool                                    { return false }
+func (d *dummyApp) JumpForward() bool                                 { return false }
+func (d *dummyApp) ShowResults(string, []lsp.Location)                {}
+func (d *dummyApp) ShowOutline(string, []lsp.Symbol)                  {}
+func (d *dummyApp) StepResult(int) bool                               { return false }
+func (d *dummyApp) FocusResults() bool                                { return false }
+
+func (d *dummyApp) Search(string, func(context.Context, string) func() []string) (int, bool) {
+	return -1, false
+}
+
+func (d *dummyApp) Complete(string)                                     {}
+func (d *dummyApp) ApplyWorkspaceEdit(*lsp.WorkspaceEdit) error         { return nil }
+func (d *dummyApp) ShowText(string, string)                             {}
+func (d *dummyApp) Background(string, func(ctx context.Context) func()) {}
 
 func TestOpenFiles(t *testing.T) {
 	app := &dummyApp{}
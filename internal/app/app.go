@@ -1,8 +1,12 @@
 package app
 
 import (
+	"context"
+	"io"
 	"os"
+	"path/filepath"
 	"slices"
+	"time"
 
 	"github.com/gdamore/tcell/v2"
 
@@ -30,14 +34,95 @@ type App interface {
 	// CloseView closes the given view. Returns true if the view was closed,
 	// false if the user cancelled the close.
 	CloseView(view View) bool
+	// Pick shows a list of items and returns the index of the one the user
+	// chose. The boolean return is false if the user cancelled. onHighlight,
+	// if not nil, is called with the index of each item as it is highlighted.
+	Pick(title string, items []string, initial int, onHighlight func(int)) (int, bool)
+	// Search shows a picker whose items are found as the user types. search
+	// is run in the background with the text typed, and the function it
+	// returns is run on the main goroutine to give the items found, which are
+	// filtered fuzzily. It returns the index of the item chosen among the
+	// latest items found.
+	Search(title string, search func(ctx context.Context, query string) func() []string) (int, bool)
+	// JumpTo moves the cursor to a position in a file, opening the file or
+	// switching to its view, and records the jump on the jump stack.
+	JumpTo(filename string, pos lsp.Position) error
+	// JumpBack and JumpForward move through the jump stack. They return
+	// false if there is nowhere to go.
+	JumpBack() bool
+	JumpForward() bool
+	// ShowResults opens the results pane listing the locations, replacing
+	// any results already shown. No locations closes the pane.
+	ShowResults(title string, locations []lsp.Location)
+	// ShowOutline opens the results pane listing symbols as a tree, with the
+	// symbol at the cursor selected.
+	ShowOutline(title string, symbols []lsp.Symbol)
+	// StepResult jumps to the next result in the results pane, or the
+	// previous one if delta is negative. It returns false if the pane isn't
+	// open.
+	StepResult(delta int) bool
+	// FocusResults lets the user choose a result from the results pane with
+	// the keyboard. It returns false if the pane isn't open.
+	FocusResults() bool
+	// Complete asks the language server for completions at the cursor and
+	// shows them in a menu when they arrive. trigger is the character typed
+	// that asked for them, or "" if the user asked.
+	Complete(trigger string)
+	// ApplyWorkspaceEdit makes edits from a language server, opening the
+	// files that aren't open. The edits to each buffer are undone in one
+	// step.
+	ApplyWorkspaceEdit(edit *lsp.WorkspaceEdit) error
+	// ShowText shows text in a view of its own, such as a log, replacing the
+	// view already showing text with the same title.
+	ShowText(title, text string)
+	// Background runs work off the main goroutine, such as waiting for a
+	// language server, and then runs the function it returns on the main
+	// goroutine. Starting work with the same key as work still running
+	// cancels the earlier work, and Escape cancels all but the work started
+	// for the lightbulb and semantic tokens. Cancelled work's result is
+	// dropped.
+	Background(key string, work func(ctx context.Context) func())
 }
 
 type app struct {
+	screen      tcell.Screen
 	views       []View
 	statusBar   StatusBar
 	tabBar      TabBar
 	currentView int
 	settings    Settings
+
+	// jumps holds the places jumped from, and where JumpBack was last used.
+	// jumpIndex is the position in jumps that JumpBack and JumpForward move
+	// from, which is len(jumps) when they haven't been used since the last
+	// jump.
+	jumps     []jumpLocation
+	jumpIndex int
+
+	// results is the results pane, or nil when it is closed.
+	results *resultsPane
+
+	// completion is the completion menu, or nil when it is closed, and
+	// snippet the tab stops of the last snippet inserted while Tab moves
+	// between them.
+	completion *completionMenu
+	snippet    *snippetSession
+
+	// lightBulb is where the cursor was last seen and lightBulbOn whether the
+	// language server has code actions there. lightBulbTimer waits for the
+	// cursor to rest before asking.
+	lightBulb      codeActionPlace
+	lightBulbOn    bool
+	lightBulbTimer *time.Timer
+
+	// semanticTokensAsked is the place whose semantic tokens were last asked
+	// for, and semanticTokens the last the server answered for.
+	semanticTokensAsked semanticTokensPlace
+	semanticTokens      semanticTokensPlace
+
+	// background holds the work started with Background that hasn't
+	// finished, by key.
+	background map[string]*backgroundTask
 }
 
 func (a *app) OpenFile(filename string) error {
@@ -51,7 +136,20 @@ func (a *app) OpenFile(filename string) error {
 		}
 		defer file.Close()
 
-		view, err = NewViewFromReader(filename, file)
+		// Report progress on the status bar while large files load
+		var total int64
+		if info, err := file.Stat(); err == nil {
+			total = info.Size()
+		}
+		reader := &progressReader{
+			r:     file,
+			total: total,
+			report: func(done, total int64) {
+				a.statusBar.Progress("Loading "+filepath.Base(filename), done, total)
+			},
+		}
+
+		view, err = NewViewFromReader(filename, reader)
 		if err != nil {
 			return err
 		}
@@ -77,16 +175,19 @@ func (a *app) Run(screen tcell.Screen) {
 	defStyle := tcell.StyleDefault.Background(tcell.ColorReset).Foreground(tcell.ColorReset)
 
 	// Initialize screen
+	a.screen = screen
+	lsp.SetDispatcher(func(fn func()) {
+		screen.PostEvent(tcell.NewEventInterrupt(fn))
+	})
+	lsp.SetEditHandler(a.ApplyWorkspaceEdit)
+	lsp.SetMessageHandler(a.showServerMessage)
 	screen.SetStyle(defStyle)
 	screen.EnableMouse()
 	screen.EnablePaste()
 	screen.Clear()
 
 	// Get the initial screen size and update each view to match
-	width, height := screen.Size()
-	for _, view := range a.views {
-		view.Resize(height-1, width)
-	}
+	a.layoutViews()
 
 	// Draw initial status bar
 	a.statusBar.SetScreen(screen) // status bar needs to know the screen to draw on
@@ -120,16 +221,16 @@ eventLoop:
 			}
 		case *tcell.EventMouse:
 			a.handleMouse(ev)
+		case *tcell.EventInterrupt:
+			runDispatched(ev)
 		}
 
-		screen.Clear()
-		if a.tabBar != nil {
-			a.tabBar.Draw(a.views, a.currentView)
-		}
-		a.GetCurrentView().Draw(screen, 1, 0)
-		a.statusBar.Draw(a.GetCurrentView())
+		a.updateLightBulb()
+		a.updateSemanticTokens()
+		a.draw()
 	}
 
+	a.cancelAllBackground()
 	for _, view := range a.views {
 		view.Buffer().Close()
 	}
@@ -137,6 +238,46 @@ eventLoop:
 	lsp.ShutdownAll()
 }
 
+// runDispatched runs a function posted to the event loop by lsp.SetDispatcher.
+func runDispatched(ev *tcell.EventInterrupt) {
+	if fn, ok := ev.Data().(func()); ok {
+		fn()
+	}
+}
+
+// draw redraws the whole screen.
+func (a *app) draw() {
+	a.screen.Clear()
+	if a.tabBar != nil {
+		a.tabBar.Draw(a.views, a.currentView)
+	}
+	a.GetCurrentView().Draw(a.screen, 1, 0)
+	a.drawLightBulb(1, 0)
+	if a.completion != nil {
+		a.completion.draw(a.screen)
+	}
+	if a.results != nil {
+		_, height := a.screen.Size()
+		a.results.draw(a.screen, height-1-a.results.rows(), false)
+	}
+	a.statusBar.Draw(a.GetCurrentView())
+}
+
+// layoutViews sizes the views to fill the screen between the tab bar and the
+// results pane or status bar.
+func (a *app) layoutViews() {
+	if a.screen == nil {
+		return
+	}
+	width, height := a.screen.Size()
+	if a.results != nil {
+		height -= a.results.rows()
+	}
+	for _, view := range a.views {
+		view.Resize(height-1, width)
+	}
+}
+
 func (a *app) Settings() Settings { return a.settings }
 
 func (a *app) LoadSettings(filename string) error {
@@ -145,6 +286,7 @@ func (a *app) LoadSettings(filename string) error {
 		return err
 	}
 	a.settings = settings
+	lsp.SetServers(settings.LanguageServers())
 
 	return nil
 }
@@ -176,10 +318,7 @@ func (a *app) Views() []View { return a.views }
 
 func (a *app) handleResize(screen tcell.Screen) {
 	// TODO: This will have to be smarter about resizing views- not all are full screen
-	width, height := screen.Size()
-	for _, view := range a.views {
-		view.Resize(height-1, width)
-	}
+	a.layoutViews()
 
 	if a.tabBar != nil {
 		a.tabBar.Draw(a.views, a.currentView)
@@ -189,6 +328,19 @@ func (a *app) handleResize(screen tcell.Screen) {
 }
 
 func (a *app) handleKey(ev *tcell.EventKey) bool {
+	// Any key closes a popup, and then does what it normally does
+	a.GetCurrentView().ClosePopup()
+	a.cancelBackground(popupRequest)
+
+	if a.completionKey(ev) || a.snippetKey(ev) {
+		return false
+	}
+	if ev.Key() == tcell.KeyEscape && a.cancelRequested() > 0 {
+		a.statusBar.Notify("Cancelled", tcell.StyleDefault)
+		return false
+	}
+
+	quit := false
 	if ev.Key() == tcell.KeyRune || ev.Key() == tcell.KeyEnter || ev.Key() == tcell.KeyTab {
 		view := a.GetCurrentView()
 		r := ev.Rune()
@@ -205,11 +357,12 @@ func (a *app) handleKey(ev *tcell.EventKey) bool {
 			if err != nil {
 				a.statusBar.Errorf("Error executing command: %v", err)
 			}
-			return ret
+			quit = ret
 		}
 	}
 
-	return false
+	a.updateCompletion(ev)
+	return quit
 }
 
 func (a *app) handleMouse(ev *tcell.EventMouse) {
@@ -218,6 +371,14 @@ func (a *app) handleMouse(ev *tcell.EventMouse) {
 
 	switch ev.Buttons() {
 	case tcell.Button1:
+		a.completion = nil
+		if a.results != nil {
+			if idx, ok := a.results.indexAt(y); ok {
+				a.results.selected = idx
+				a.gotoResult()
+				return
+			}
+		}
 		if a.tabBar != nil {
 			if idx, ok := a.tabBar.CloseIndexAt(x, y); ok {
 				a.CloseView(a.views[idx])
@@ -240,7 +401,7 @@ func (a *app) handleMouse(ev *tcell.EventMouse) {
 				view.SetAnchor(oldRow, oldCol)
 				aRow, aCol = oldRow, oldCol
 			}
-			view.SetCursor(top+y-1, left+x)
+			view.SetCursor(top+y-1, left+x-view.GutterWidth())
 			row, col := view.Cursor()
 
 			// Use the same selection logic as keyboard: always include character under anchor
@@ -253,7 +414,7 @@ func (a *app) handleMouse(ev *tcell.EventMouse) {
 			sel := orderedSelection(startRow, startCol, endRow, endCol)
 			view.SetSelections([]Selection{sel})
 		} else {
-			view.SetCursor(top+y-1, left+x)
+			view.SetCursor(top+y-1, left+x-view.GutterWidth())
 			view.ClearAnchor()
 			view.SetSelections(nil)
 		}
@@ -310,6 +471,29 @@ func (a *app) CloseView(v View) bool {
 	return true
 }
 
+// progressReportInterval is the number of bytes read between progress reports.
+const progressReportInterval = 4 * 1024 * 1024
+
+// progressReader wraps a reader and periodically reports how much of it has
+// been read.
+type progressReader struct {
+	r        io.Reader
+	total    int64
+	done     int64
+	reported int64
+	report   func(done, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if p.done-p.reported >= progressReportInterval {
+		p.reported = p.done
+		p.report(p.done, p.total)
+	}
+	return n, err
+}
+
 var theApp App
 
 func NewApp() (App, error) {
@@ -1,7 +1,9 @@
 package app
 
 import (
+	"io"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/gdamore/tcell/v2"
@@ -91,13 +93,17 @@ func TestHandleMouseTabClick(t *testing.T) {
 
 type stubStatusBarClose struct{}
 
-func (stubStatusBarClose) SetScreen(tcell.Screen)      {}
-func (stubStatusBarClose) Draw(View)                   {}
-func (stubStatusBarClose) Message(string)              {}
-func (stubStatusBarClose) Messagef(string, ...any)     {}
-func (stubStatusBarClose) Error(string)                {}
-func (stubStatusBarClose) Errorf(string, ...any)       {}
-func (stubStatusBarClose) Input(string) (string, bool) { return "n", true }
+func (stubStatusBarClose) SetScreen(tcell.Screen)        {}
+func (stubStatusBarClose) Draw(View)                     {}
+func (stubStatusBarClose) Message(string)                {}
+func (stubStatusBarClose) Messagef(string, ...any)       {}
+func (stubStatusBarClose) Error(string)                  {}
+func (stubStatusBarClose) Errorf(string, ...any)         {}
+func (stubStatusBarClose) Input(string) (string, bool)   { return "n", true }
+func (stubStatusBarClose) Progress(string, int64, int64) {}
+func (stubStatusBarClose) Notify(string, tcell.Style)    {}
+
+func (stubStatusBarClose) InputDefault(string, string) (string, bool) { return "n", true }
 
 func TestHandleMouseTabClose(t *testing.T) {
 	commands = make(map[string]Command)
@@ -114,6 +120,7 @@ func TestHandleMouseTabClose(t *testing.T) {
 	a.statusBar.SetScreen(screen)
 	a.tabBar.SetScreen(screen)
 	a.statusBar = stubStatusBarClose{}
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
 
 	v2 := NewView("second.txt", nil)
 	v2.InsertRune('a')
@@ -207,3 +214,25 @@ func TestHandleMouseShiftSelectReverse(t *testing.T) {
 		t.Fatalf("unexpected selection %#v", sels)
 	}
 }
+
+func TestProgressReader(t *testing.T) {
+	data := strings.Repeat("x", 3*progressReportInterval+10)
+	var reports []int64
+	pr := &progressReader{
+		r:     strings.NewReader(data),
+		total: int64(len(data)),
+		report: func(done, total int64) {
+			if total != int64(len(data)) {
+				t.Fatalf("unexpected total %d", total)
+			}
+			reports = append(reports, done)
+		},
+	}
+	n, err := io.Copy(io.Discard, pr)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("unexpected copy result %d %v", n, err)
+	}
+	if len(reports) != 3 {
+		t.Fatalf("expected 3 progress reports got %v", reports)
+	}
+}
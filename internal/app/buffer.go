@@ -1,12 +1,21 @@
 package app
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
 
 	"tked/internal/lsp"
 	"tked/internal/rope"
+	"tked/internal/tklog"
 )
 
 type Buffer interface {
@@ -50,11 +59,30 @@ type Buffer interface {
 	// redone, false if nothing to redo.
 	Redo() bool
 
+	// BeginEdit starts a group of edits that are undone and redone as a single
+	// step. Groups may be nested; the group ends at the outermost EndEdit.
+	BeginEdit()
+	// EndEdit ends a group of edits started by BeginEdit.
+	EndEdit()
+
+	// UndoStates returns every state in the undo tree, in the order they were
+	// created. Editing after an undo starts a new branch, so no state is ever
+	// lost.
+	UndoStates() []UndoState
+	// GotoUndoState makes the state with the given sequence number current.
+	// Returns false if there is no such state.
+	GotoUndoState(seq int) bool
+
 	// Write writes the buffer contents to the writer. It returns the number of
 	// bytes written and any error that occurred.
 	Write(w io.Writer) (int64, error)
 
-	// Close closes the buffer.
+	// SaveHistory writes the undo history to the history store, so that it is
+	// restored when the file is next opened. It does nothing for unnamed
+	// buffers or when undo history is disabled in the settings.
+	SaveHistory() error
+
+	// Close closes the buffer, saving its undo history.
 	Close()
 
 	// GetProperty gets a custom property from the buffer.
@@ -63,8 +91,44 @@ type Buffer interface {
 	// each buffer state, so undo/redo will restore the property values.
 	SetProperty(prop PropKey, value any)
 
-	// OnChange registers a callback function to be called when the buffer changes.
-	OnChange(callback func(buffer Buffer, start, end int, context any), context any) ChangeRegistration
+	// OnChange registers a callback function to be called when the buffer
+	// changes. It is called once for each edit, in order, including those
+	// made by undo and redo.
+	OnChange(callback func(buffer Buffer, ev ChangeEvent, context any), context any) ChangeRegistration
+}
+
+// ChangeEvent describes an edit to a buffer's contents: the text between Start
+// and OldEnd in the old contents was replaced by the text between Start and
+// NewEnd in the new contents.
+type ChangeEvent struct {
+	// Start, OldEnd and NewEnd are byte indexes.
+	Start  int
+	OldEnd int
+	NewEnd int
+	// StartPos and OldEndPos are the positions of Start and OldEnd in the old
+	// contents, and NewEndPos the position of NewEnd in the new contents.
+	StartPos  Position
+	OldEndPos Position
+	NewEndPos Position
+	// Removed is the text that was removed and Inserted the text that
+	// replaced it.
+	Removed  string
+	Inserted string
+	// Version is the buffer's version after the change. All of the edits
+	// made by a single undo or redo have the same version.
+	Version int32
+	// OldContents and NewContents are the contents before and after the
+	// edit. When an undo or redo makes several edits, these are the contents
+	// between them rather than those of the buffer.
+	OldContents rope.Rope
+	NewContents rope.Rope
+}
+
+// Position is a location in a buffer's contents as a row and a byte offset
+// from the start of the row.
+type Position struct {
+	Row    int
+	Offset int
 }
 
 // PropKey is a unique identifier for a property.
@@ -75,22 +139,90 @@ type ChangeRegistration interface {
 	Remove()
 }
 
+// UndoState describes a state in a buffer's undo tree.
+type UndoState struct {
+	// Seq is the sequence number of the state. States are numbered in the
+	// order they were created, starting with 0 for the initial state.
+	Seq int
+	// Parent is the sequence number of the state this one was created from,
+	// or -1 for the initial state.
+	Parent int
+	// Time is when the state was created.
+	Time time.Time
+	// Current is true for the buffer's current state.
+	Current bool
+}
+
 type buffer struct {
 	version         int32
 	filename        string
 	title           string
 	contents        *bufferContents
-	changeCallbacks []changeCallback
+	changeCallbacks []*changeCallback
+	// states holds every state in the undo tree, indexed by sequence number.
+	states []*bufferContents
+	// editDepth is the nesting depth of BeginEdit calls, and group the state
+	// created by the first edit in the current group.
+	editDepth int
+	group     *bufferContents
+	// saved is the state that was last loaded from or written to the file,
+	// and savedHash the hash of its contents, which the undo history is
+	// saved with.
+	saved     *bufferContents
+	savedHash ropeHash
 }
 
 type bufferContents struct {
-	rope             rope.Rope
-	dirty            bool
-	properties       []propValue
-	subsequentState  *bufferContents
-	previousContents *bufferContents
+	rope       rope.Rope
+	dirty      bool
+	properties []propValue
+	// parent is the state this one was created from, and children the states
+	// created from it. redo is the child that Redo moves to, which is the
+	// most recently created or visited one.
+	parent   *bufferContents
+	children []*bufferContents
+	redo     *bufferContents
+	seq      int
+	time     time.Time
+	// edits turn the parent's contents into this state's.
+	edits []edit
+	// lastEdit describes the most recent edit made in this state, so that
+	// following edits can be coalesced into it.
+	lastEdit editInfo
+}
+
+// edit replaces the text removed at start with the text inserted.
+type edit struct {
+	start    int
+	removed  string
+	inserted string
+}
+
+// editKind is the kind of an edit, for deciding whether edits coalesce.
+type editKind int
+
+const (
+	// editNone is an edit that later edits must not be coalesced into.
+	editNone editKind = iota
+	editInsert
+	editDelete
+)
+
+// editInfo describes an edit that later edits may be coalesced into.
+type editInfo struct {
+	kind editKind
+	// pos is where a following edit must start to continue the run: the end
+	// of inserted text, or the start of deleted text.
+	pos int
+	// r is the last rune inserted or deleted, for finding word boundaries.
+	r    rune
+	time time.Time
 }
 
+// coalesceIdleTime is how long typing may pause before the next character
+// starts a new undo step.
+const coalesceIdleTime = time.Second
+
 type propKey struct {
 	id int
 }
@@ -102,12 +234,25 @@ type propValue struct {
 
 type changeCallback struct {
 	buffer   *buffer
-	callback func(buffer Buffer, start, end int, context any)
+	callback func(buffer Buffer, ev ChangeEvent, context any)
 	context  any
 }
 
 var untitledCounter int = 0
 
+// now returns the current time. Tests replace it to control state times.
+var now = time.Now
+
+// getLSP returns the language server client for a file, and documentLSP the
+// client told about the file's edits, which includes servers that have
+// failed. hasServers reports whether a file has servers configured, whether
+// or not they are running. Tests replace them with a fake client.
+var (
+	getLSP      = lsp.GetLSP
+	documentLSP = lsp.DocumentLSP
+	hasServers  = lsp.HasServers
+)
+
 func (b *buffer) GetVersion() int32 {
 	return b.version
 }
@@ -142,42 +287,26 @@ func (b *buffer) IsDirty() bool {
 }
 
 func (b *buffer) IndexForRow(row int) (int, int) {
-	if row < 0 {
-		row = 0
-	}
-
-	// TODO: This is very slow. We should use a more efficient algorithm.
-	idxRowStart := 0
-	idx := 0
-	currRow := 0
-	for {
-		if currRow == row {
-			return idxRowStart, currRow
-		}
-
-		ch, ok := b.contents.rope.Index(idx)
-		if !ok {
-			return idxRowStart, currRow
-		}
-		if ch == '\n' {
-			currRow++
-			idxRowStart = idx + 1
-		}
-		idx++
-	}
+	row = max(0, min(row, b.contents.rope.LineCount()-1))
+	idx, _ := b.contents.rope.LineStart(row)
+	return idx, row
 }
 
 func (b *buffer) Insert(idx int, text string) {
 	// Ensure idx is within bounds of the rope.
 	idx = max(0, min(idx, b.contents.rope.Len()))
 
-	// Create a new buffer contents with the new text.
-	nc := b.newContents()
+	// Create a new buffer contents with the new text, unless it continues the
+	// edit that made the current one.
+	nc := b.editContents(editInsert, idx, idx, text)
+	old := nc.rope
+	e := edit{start: idx, inserted: text}
 	nc.rope = nc.rope.Insert(idx, text)
+	nc.addEdit(e)
 	nc.dirty = true
 	b.version++
 
-	b.notifyChange(idx, idx+len(text))
+	b.notifyChange([]ChangeEvent{newChangeEvent(old, nc.rope, e, b.version)})
 }
 
 func (b *buffer) Delete(start, end int) {
@@ -189,47 +318,156 @@ func (b *buffer) Delete(start, end int) {
 		start, end = end, start
 	}
 	if start != end { // Create a new buffer contents with the deleted text.
-		nc := b.newContents()
+		removed := b.contents.rope.Slice(start, end)
+		nc := b.editContents(editDelete, start, end, removed)
+		old := nc.rope
+		e := edit{start: start, removed: removed}
 		nc.rope = nc.rope.Delete(start, end)
+		nc.addEdit(e)
 		nc.dirty = true
 		b.version++
 
-		b.notifyChange(start, end)
+		b.notifyChange([]ChangeEvent{newChangeEvent(old, nc.rope, e, b.version)})
 	}
 }
 
 func (b *buffer) Undo() bool {
-	if b.contents.previousContents == nil {
+	if b.contents.parent == nil {
 		return false
 	}
 
-	b.contents = b.contents.previousContents
-	b.version++
-	b.notifyChange(0, b.contents.rope.Len())
+	// Remember the branch we came from so Redo returns to it
+	b.contents.parent.redo = b.contents
+	b.moveTo(b.contents.parent)
 	return true
 }
 
 func (b *buffer) Redo() bool {
-	if b.contents.subsequentState == nil {
+	if b.contents.redo == nil {
 		return false
 	}
 
-	b.contents = b.contents.subsequentState
-	b.version++
-	b.notifyChange(0, b.contents.rope.Len())
+	b.moveTo(b.contents.redo)
+	return true
+}
+
+func (b *buffer) BeginEdit() {
+	if b.editDepth == 0 {
+		b.group = nil
+	}
+	b.editDepth++
+}
+
+func (b *buffer) EndEdit() {
+	if b.editDepth == 0 {
+		tklog.Panic("EndEdit called without BeginEdit") // this is a bug not an error!
+	}
+	b.editDepth--
+	if b.editDepth == 0 && b.group != nil {
+		// Typing after a group starts a new step rather than joining it
+		b.group.lastEdit = editInfo{}
+		b.group = nil
+	}
+}
+
+func (b *buffer) UndoStates() []UndoState {
+	states := make([]UndoState, len(b.states))
+	for i, c := range b.states {
+		states[i] = UndoState{Seq: c.seq, Parent: -1, Time: c.time, Current: c == b.contents}
+		if c.parent != nil {
+			states[i].Parent = c.parent.seq
+		}
+	}
+	return states
+}
+
+func (b *buffer) GotoUndoState(seq int) bool {
+	if seq < 0 || seq >= len(b.states) {
+		return false
+	}
+	target := b.states[seq]
+	if target == b.contents {
+		return true
+	}
+
+	// Point the redo links along the path to the target at it, so that undo
+	// and redo follow the branch it is on.
+	for c := target; c.parent != nil; c = c.parent {
+		c.parent.redo = c
+	}
+
+	b.moveTo(target)
 	return true
 }
 
+// moveTo makes target the current state. The changes are reported as the
+// edits that lead back from the current state to the nearest state the two
+// share, undone in reverse order, followed by the edits that lead from there
+// to the target.
+func (b *buffer) moveTo(target *bufferContents) {
+	onPath := make(map[*bufferContents]bool)
+	for c := target; c != nil; c = c.parent {
+		onPath[c] = true
+	}
+
+	var events []ChangeEvent
+	r := b.contents.rope
+	apply := func(e edit) {
+		next := replace(r, e.start, e.start+len(e.removed), e.inserted)
+		events = append(events, newChangeEvent(r, next, e, 0))
+		r = next
+	}
+
+	c := b.contents
+	for ; !onPath[c]; c = c.parent {
+		for i := len(c.edits) - 1; i >= 0; i-- {
+			e := c.edits[i]
+			apply(edit{start: e.start, removed: e.inserted, inserted: e.removed})
+		}
+	}
+	var down []*bufferContents
+	for t := target; t != c; t = t.parent {
+		down = append(down, t)
+	}
+	for i := len(down) - 1; i >= 0; i-- {
+		for _, e := range down[i].edits {
+			apply(e)
+		}
+	}
+
+	b.contents = target
+	b.version++
+	for i := range events {
+		events[i].Version = b.version
+	}
+	b.notifyChange(events)
+}
+
 func (b *buffer) Write(w io.Writer) (int64, error) {
-	n, err := b.contents.rope.Write(w)
+	hash := sha256.New()
+	n, err := b.contents.rope.Write(io.MultiWriter(w, hash))
 	if err == nil {
 		b.contents.dirty = false
+		b.saved = b.contents
+		b.savedHash = ropeHash{rope: b.saved.rope, hash: hex.EncodeToString(hash.Sum(nil))}
 	}
 	return n, err
 }
 
+func (b *buffer) SaveHistory() error {
+	settings := undoHistorySettings()
+	if b.filename == "" || !settings.Enabled {
+		return nil
+	}
+	return saveHistory(b.filename, b.states, b.saved, b.savedHash.of(b.saved.rope), settings)
+}
+
 func (b *buffer) Close() {
-	lspClient := lsp.GetLSP(b.GetFilename())
+	if err := b.SaveHistory(); err != nil {
+		tklog.Error("Error saving undo history for %s: %v", b.filename, err)
+	}
+
+	lspClient := documentLSP(b.GetFilename())
 	if lspClient != nil {
 		lspClient.DidClose(b.GetFilename())
 	}
@@ -256,45 +494,191 @@ func (b *buffer) SetProperty(prop PropKey, value any) {
 	b.contents.properties = append(b.contents.properties, propValue{key: privatePropKey, value: value})
 }
 
-func (b *buffer) OnChange(callback func(buffer Buffer, start, end int, context any), context any) ChangeRegistration {
-	cb := changeCallback{
+func (b *buffer) OnChange(callback func(buffer Buffer, ev ChangeEvent, context any), context any) ChangeRegistration {
+	cb := &changeCallback{
 		buffer:   b,
 		callback: callback,
 		context:  context,
 	}
 
+	// Callbacks are kept as pointers so that Remove can find them after the
+	// slice grows
 	b.changeCallbacks = append(b.changeCallbacks, cb)
-	return &b.changeCallbacks[len(b.changeCallbacks)-1]
+	return cb
 }
 
-func (b *buffer) notifyChange(start, end int) {
-	for _, cb := range b.changeCallbacks {
-		cb.callback(b, start, end, cb.context)
+func (b *buffer) notifyChange(events []ChangeEvent) {
+	for _, ev := range events {
+		for _, cb := range b.changeCallbacks {
+			cb.callback(b, ev, cb.context)
+		}
 	}
 
-	lspClient := lsp.GetLSP(b.GetFilename())
+	lspClient := documentLSP(b.GetFilename())
 	if lspClient != nil {
-		lspClient.DidChangeFull(b.GetFilename(), b.GetVersion(), b.Contents().String())
+		for _, ev := range events {
+			lspClient.DidChange(b.GetFilename(), ev.Version, lsp.Change{
+				Start:  lsp.Position{Line: ev.StartPos.Row, Offset: ev.StartPos.Offset},
+				End:    lsp.Position{Line: ev.OldEndPos.Row, Offset: ev.OldEndPos.Offset},
+				Text:   ev.Inserted,
+				Before: ev.OldContents,
+				After:  ev.NewContents,
+			})
+		}
 	}
 }
 
 func (b *buffer) newContents() *bufferContents {
 	nc := &bufferContents{
-		rope:             b.contents.rope,
-		dirty:            b.contents.dirty,
-		properties:       append([]propValue{}, b.contents.properties...),
-		subsequentState:  nil,
-		previousContents: b.contents,
+		rope:       b.contents.rope,
+		dirty:      b.contents.dirty,
+		properties: append([]propValue{}, b.contents.properties...),
+		parent:     b.contents,
+		seq:        len(b.states),
+		time:       now(),
 	}
-	b.contents.subsequentState = nc
+	b.contents.children = append(b.contents.children, nc)
+	b.contents.redo = nc
 	b.contents = nc
+	b.states = append(b.states, nc)
 
 	return nc
 }
 
+// editContents returns the state an edit should be made in. This is the
+// current state if the edit is part of the current group or continues the run
+// of typing that made it, and otherwise a new state. start and end are the
+// range the edit replaces and text is the text inserted or deleted.
+func (b *buffer) editContents(kind editKind, start, end int, text string) *bufferContents {
+	t := now()
+	c := b.contents
+	switch {
+	case b.editDepth > 0 && b.group == c:
+	case b.editDepth == 0 && b.continuesEdit(kind, start, end, text, t):
+	default:
+		c = b.newContents()
+		if b.editDepth > 0 {
+			b.group = c
+		}
+	}
+
+	c.lastEdit = editInfo{}
+	if b.editDepth == 0 && coalescable(text) {
+		r, _ := utf8.DecodeLastRuneInString(text)
+		pos := start
+		if kind == editInsert {
+			pos += len(text)
+		}
+		c.lastEdit = editInfo{kind: kind, pos: pos, r: r, time: t}
+	}
+	return c
+}
+
+// continuesEdit returns true if an edit of the given kind can be coalesced
+// into the current state. Only single character edits next to the previous
+// one coalesce, and a run is broken by a pause in typing or by the start of a
+// new word.
+func (b *buffer) continuesEdit(kind editKind, start, end int, text string, t time.Time) bool {
+	c := b.contents
+	last := c.lastEdit
+	if last.kind != kind || !coalescable(text) {
+		return false
+	}
+	// Only the newest state can grow, otherwise the edit would change a state
+	// that was undone to, or that other states were created from.
+	if c.parent == nil || len(c.children) > 0 || c != b.states[len(b.states)-1] {
+		return false
+	}
+	if t.Sub(last.time) > coalesceIdleTime {
+		return false
+	}
+	switch kind {
+	case editInsert:
+		if start != last.pos {
+			return false
+		}
+	case editDelete:
+		// Backspace deletes before the previous deletion and delete after it
+		if end != last.pos && start != last.pos {
+			return false
+		}
+	}
+	r, _ := utf8.DecodeRuneInString(text)
+	return !isWordRune(r) || isWordRune(last.r)
+}
+
+// coalescable returns true if text is a single character that may be part of
+// a run of typing.
+func coalescable(text string) bool {
+	return text != "" && !strings.ContainsRune(text, '\n') && uniseg.GraphemeClusterCount(text) == 1
+}
+
+// isWordRune returns true if r is part of a word.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// newChangeEvent returns the event for an edit that turned before into after.
+func newChangeEvent(before, after rope.Rope, e edit, version int32) ChangeEvent {
+	oldEnd := e.start + len(e.removed)
+	newEnd := e.start + len(e.inserted)
+	return ChangeEvent{
+		Start:       e.start,
+		OldEnd:      oldEnd,
+		NewEnd:      newEnd,
+		StartPos:    positionOf(before, e.start),
+		OldEndPos:   positionOf(before, oldEnd),
+		NewEndPos:   positionOf(after, newEnd),
+		Removed:     e.removed,
+		Inserted:    e.inserted,
+		Version:     version,
+		OldContents: before,
+		NewContents: after,
+	}
+}
+
+// positionOf returns the position of the byte at idx in r.
+func positionOf(r rope.Rope, idx int) Position {
+	row := r.LineAt(idx)
+	start, _ := r.LineStart(row)
+	return Position{Row: row, Offset: idx - start}
+}
+
+// replace returns r with the text between start and end replaced by text.
+func replace(r rope.Rope, start, end int, text string) rope.Rope {
+	if start != end {
+		r = r.Delete(start, end)
+	}
+	if text != "" {
+		r = r.Insert(start, text)
+	}
+	return r
+}
+
+// addEdit records an edit made in the state, merging it with the previous
+// edit when it continues it.
+func (c *bufferContents) addEdit(e edit) {
+	if n := len(c.edits); n > 0 {
+		last := &c.edits[n-1]
+		switch {
+		case e.removed == "" && last.removed == "" && e.start == last.start+len(last.inserted):
+			last.inserted += e.inserted
+			return
+		case e.inserted == "" && last.inserted == "" && e.start+len(e.removed) == last.start:
+			last.start = e.start
+			last.removed = e.removed + last.removed
+			return
+		case e.inserted == "" && last.inserted == "" && e.start == last.start:
+			last.removed += e.removed
+			return
+		}
+	}
+	c.edits = append(c.edits, e)
+}
+
 func (c *changeCallback) Remove() {
 	for i := range c.buffer.changeCallbacks {
-		if &c.buffer.changeCallbacks[i] == c {
+		if c.buffer.changeCallbacks[i] == c {
 			c.buffer.changeCallbacks = append(c.buffer.changeCallbacks[:i], c.buffer.changeCallbacks[i+1:]...)
 			return
 		}
@@ -308,28 +692,50 @@ func NewBuffer(filename string, contents rope.Rope) Buffer {
 
 	var b *buffer = &buffer{
 		contents: &bufferContents{
-			rope:             contents,
-			dirty:            false,
-			properties:       []propValue{},
-			subsequentState:  nil,
-			previousContents: nil,
+			rope:       contents,
+			dirty:      false,
+			properties: []propValue{},
+			time:       now(),
 		},
 	}
+	b.states = []*bufferContents{b.contents}
+	b.saved = b.contents
 	b.SetFilename(filename)
 
-	lspClient := lsp.GetLSP(filename)
+	lspClient := documentLSP(filename)
 	if lspClient != nil {
-		lspClient.DidOpen(filename, b.version, b.contents.rope.String())
+		lspClient.DidOpen(filename, b.version, b.contents.rope)
 	}
 	return b
 }
 
+// NewBufferFromReader creates a buffer with the contents read from r. If undo
+// history was saved for the file when it had the same contents, it is
+// restored.
 func NewBufferFromReader(filename string, r io.Reader) (Buffer, error) {
+	settings := undoHistorySettings()
+	hash := sha256.New()
+	if settings.Enabled && filename != "" {
+		r = io.TeeReader(r, hash)
+	}
 	contents, err := rope.NewFromReader(r)
 	if err != nil {
 		return nil, err
 	}
-	return NewBuffer(filename, contents), nil
+
+	b := NewBuffer(filename, contents).(*buffer)
+	if settings.Enabled && filename != "" {
+		b.savedHash = ropeHash{rope: contents, hash: hex.EncodeToString(hash.Sum(nil))}
+		states, anchor, err := loadHistory(filename, contents, b.savedHash.hash, settings)
+		if err != nil {
+			tklog.Error("Error loading undo history for %s: %v", filename, err)
+		} else if states != nil {
+			b.states = states
+			b.contents = states[anchor]
+			b.saved = b.contents
+		}
+	}
+	return b, nil
 }
 
 var propIdCounter int = 0
@@ -3,7 +3,9 @@ package app
 import (
 	"os"
 	"testing"
+	"time"
 
+	"tked/internal/lsp"
 	"tked/internal/rope"
 )
 
@@ -171,29 +173,302 @@ func TestBufferUndoRedoAndProperties(t *testing.T) {
 
 func TestBufferOnChange(t *testing.T) {
 	b := NewBuffer("", rope.NewRope("abc"))
-	calls := 0
-	var lastStart, lastEnd int
-	reg := b.OnChange(func(_ Buffer, start, end int, _ any) {
-		calls++
-		lastStart = start
-		lastEnd = end
+	var events []ChangeEvent
+	reg := b.OnChange(func(_ Buffer, ev ChangeEvent, _ any) {
+		events = append(events, ev)
 	}, nil)
 
 	b.Insert(1, "x")
-	if calls != 1 || lastStart != 1 || lastEnd != 2 {
-		t.Fatalf("callback values unexpected: calls %d start %d end %d", calls, lastStart, lastEnd)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event got %d", len(events))
+	}
+	ev := events[0]
+	if ev.Start != 1 || ev.OldEnd != 1 || ev.NewEnd != 2 || ev.Inserted != "x" || ev.Removed != "" {
+		t.Fatalf("unexpected insert event %+v", ev)
+	}
+	if ev.Version != b.GetVersion() || ev.OldContents.String() != "abc" || ev.NewContents.String() != "axbc" {
+		t.Fatalf("unexpected insert event %+v", ev)
 	}
 
 	b.Delete(0, 1)
-	if calls != 2 || lastStart != 0 || lastEnd != 1 {
-		t.Fatalf("callback after delete unexpected: calls %d start %d end %d", calls, lastStart, lastEnd)
+	ev = events[1]
+	if len(events) != 2 || ev.Start != 0 || ev.OldEnd != 1 || ev.NewEnd != 0 || ev.Removed != "a" {
+		t.Fatalf("unexpected delete event %+v", ev)
 	}
 
 	reg.Remove()
 	b.Insert(0, "y")
-	if calls != 2 {
+	if len(events) != 2 {
+		t.Fatalf("callback not removed")
+	}
+}
+
+func TestBufferTellsFailedServers(t *testing.T) {
+	// Servers that have failed aren't asked anything, but still follow the
+	// buffer so they have it as it is if they are restarted
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	client := &fakeLSPClient{}
+	withFakeLSP(t, client)
+	getLSP = func(string) lsp.LSPClient { return nil }
+
+	b := NewBuffer("a.go", rope.NewRope("abc"))
+	b.Insert(1, "x")
+	b.Close()
+	if len(client.changes) != 1 || client.changes[0].Text != "x" || len(client.closed) != 1 {
+		t.Fatalf("expected the edit and close sent got %+v %v", client.changes, client.closed)
+	}
+}
+
+func TestBufferOnChangeRemoveAfterMore(t *testing.T) {
+	b := NewBuffer("", rope.NewRope("abc"))
+	calls := 0
+	reg := b.OnChange(func(Buffer, ChangeEvent, any) { calls++ }, nil)
+	for range 4 {
+		b.OnChange(func(Buffer, ChangeEvent, any) {}, nil)
+	}
+
+	// Registering more callbacks must not lose track of the first
+	reg.Remove()
+	b.Insert(0, "x")
+	if calls != 0 {
 		t.Fatalf("callback not removed")
 	}
-	_ = lastStart
-	_ = lastEnd
+}
+
+func TestBufferChangeEventPositions(t *testing.T) {
+	b := NewBuffer("", rope.NewRope("one\ntwo\n"))
+	var events []ChangeEvent
+	b.OnChange(func(_ Buffer, ev ChangeEvent, _ any) {
+		events = append(events, ev)
+	}, nil)
+
+	b.Delete(2, 6) // "e\ntw"
+	ev := events[0]
+	if ev.StartPos != (Position{0, 2}) || ev.OldEndPos != (Position{1, 2}) || ev.NewEndPos != (Position{0, 2}) {
+		t.Fatalf("unexpected positions %+v %+v %+v", ev.StartPos, ev.OldEndPos, ev.NewEndPos)
+	}
+
+	b.Insert(3, "\nthree")
+	ev = events[1]
+	if ev.StartPos != (Position{0, 3}) || ev.NewEndPos != (Position{1, 5}) {
+		t.Fatalf("unexpected positions %+v %+v", ev.StartPos, ev.NewEndPos)
+	}
+}
+
+func TestBufferUndoRedoEvents(t *testing.T) {
+	b := NewBuffer("", rope.NewRope("hello"))
+	b.BeginEdit()
+	b.Delete(0, 5)
+	b.Insert(0, "bye")
+	b.EndEdit()
+
+	var events []ChangeEvent
+	b.OnChange(func(_ Buffer, ev ChangeEvent, _ any) {
+		events = append(events, ev)
+	}, nil)
+
+	// Undo reverts the edits in reverse order
+	b.Undo()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events got %d", len(events))
+	}
+	if events[0].Removed != "bye" || events[0].Inserted != "" || events[1].Inserted != "hello" {
+		t.Fatalf("unexpected undo events %+v", events)
+	}
+	if events[0].Version != b.GetVersion() || events[1].Version != b.GetVersion() {
+		t.Fatalf("expected undo events to share the buffer version")
+	}
+	if events[1].OldContents.String() != "" || events[1].NewContents.String() != "hello" {
+		t.Fatalf("expected intermediate contents in events")
+	}
+
+	// Replaying events on the old text gives the new text
+	events = nil
+	b.Redo()
+	text := "hello"
+	for _, ev := range events {
+		text = text[:ev.Start] + ev.Inserted + text[ev.OldEnd:]
+	}
+	if text != b.Contents().String() {
+		t.Fatalf("expected events to replay to %q got %q", b.Contents().String(), text)
+	}
+
+	// Moving across branches undoes one branch and redoes the other
+	b.Undo()
+	b.Insert(5, "!")
+	events = nil
+	b.GotoUndoState(1)
+	text = "hello!"
+	for _, ev := range events {
+		text = text[:ev.Start] + ev.Inserted + text[ev.OldEnd:]
+	}
+	if text != "bye" || len(events) != 3 {
+		t.Fatalf("expected 3 events replaying to bye got %d events and %q", len(events), text)
+	}
+}
+
+func TestBufferUndoTreeKeepsBranches(t *testing.T) {
+	b := NewBuffer("", rope.NewRope(""))
+	b.Insert(0, "ab") // state 1
+	b.Insert(2, "cd") // state 2
+	b.Undo()          // back to 1
+	b.Insert(2, "ef") // state 3, a new branch from 1
+	if got := b.Contents().String(); got != "abef" {
+		t.Fatalf("expected abef got %q", got)
+	}
+
+	states := b.UndoStates()
+	if len(states) != 4 {
+		t.Fatalf("expected 4 states got %d", len(states))
+	}
+	if states[2].Parent != 1 || states[3].Parent != 1 || !states[3].Current {
+		t.Fatalf("unexpected tree %+v", states)
+	}
+
+	// The old branch is still reachable
+	if !b.GotoUndoState(2) || b.Contents().String() != "abcd" {
+		t.Fatalf("expected abcd after going to state 2 got %q", b.Contents().String())
+	}
+
+	// Undo and redo follow the branch we moved to
+	b.Undo()
+	b.Redo()
+	if got := b.Contents().String(); got != "abcd" {
+		t.Fatalf("expected redo to follow branch, got %q", got)
+	}
+
+	if b.GotoUndoState(10) || b.GotoUndoState(-1) {
+		t.Fatalf("expected false for unknown states")
+	}
+}
+
+func TestBufferUndoStateTimes(t *testing.T) {
+	oldNow := now
+	defer func() { now = oldNow }()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+
+	b := NewBuffer("", rope.NewRope(""))
+	now = func() time.Time { return start.Add(time.Minute) }
+	b.Insert(0, "a")
+	now = func() time.Time { return start.Add(10 * time.Minute) }
+	b.Insert(1, "b")
+
+	states := b.UndoStates()
+	if !states[1].Time.Equal(start.Add(time.Minute)) {
+		t.Fatalf("unexpected state time %v", states[1].Time)
+	}
+	if seq := undoStateAt(states, start.Add(5*time.Minute)); seq != 1 {
+		t.Fatalf("expected state 1 as of 5 minutes got %d", seq)
+	}
+}
+
+// typeText inserts text one character at a time, as if typed.
+func typeText(b Buffer, idx int, text string) {
+	for _, r := range text {
+		b.Insert(idx, string(r))
+		idx += len(string(r))
+	}
+}
+
+func TestBufferCoalescesTyping(t *testing.T) {
+	b := NewBuffer("", rope.NewRope(""))
+	typeText(b, 0, "hello world")
+
+	// Each word, with the space after it, is one step
+	b.Undo()
+	if got := b.Contents().String(); got != "hello " {
+		t.Fatalf("expected hello  got %q", got)
+	}
+	b.Undo()
+	if got := b.Contents().String(); got != "" {
+		t.Fatalf("expected empty buffer got %q", got)
+	}
+	b.Redo()
+	b.Redo()
+	if got := b.Contents().String(); got != "hello world" {
+		t.Fatalf("expected hello world got %q", got)
+	}
+
+	// Backspacing is coalesced too
+	for i := len("hello world"); i > len("hello"); i-- {
+		b.Delete(i-1, i)
+	}
+	b.Undo()
+	if got := b.Contents().String(); got != "hello world" {
+		t.Fatalf("expected deletes undone in one step got %q", got)
+	}
+
+	// As is deleting forwards
+	b.Redo()
+	b.Delete(0, 1)
+	b.Delete(0, 1)
+	b.Undo()
+	if got := b.Contents().String(); got != "hello" {
+		t.Fatalf("expected forward deletes undone in one step got %q", got)
+	}
+}
+
+func TestBufferCoalescingBreaks(t *testing.T) {
+	oldNow := now
+	defer func() { now = oldNow }()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+
+	b := NewBuffer("", rope.NewRope(""))
+	typeText(b, 0, "ab")
+
+	// A pause starts a new step
+	now = func() time.Time { return start.Add(5 * time.Second) }
+	typeText(b, 2, "cd")
+	// So does a newline, and an edit somewhere else
+	b.Insert(4, "\n")
+	b.Insert(5, "e")
+	b.Insert(0, "f")
+	if got := b.Contents().String(); got != "fabcd\ne" {
+		t.Fatalf("expected fabcd\\ne got %q", got)
+	}
+	if n := len(b.UndoStates()); n != 6 {
+		t.Fatalf("expected 6 states got %d", n)
+	}
+
+	// Typing after an undo starts a new branch rather than changing the state
+	// that was undone to
+	b.Undo()
+	b.Insert(0, "g")
+	if n := len(b.UndoStates()); n != 7 {
+		t.Fatalf("expected 7 states got %d", n)
+	}
+}
+
+func TestBufferEditGroup(t *testing.T) {
+	b := NewBuffer("", rope.NewRope("hello"))
+	b.BeginEdit()
+	b.Delete(0, 5)
+	b.BeginEdit()
+	b.Insert(0, "goodbye")
+	b.EndEdit()
+	b.Insert(7, "!")
+	b.EndEdit()
+	if got := b.Contents().String(); got != "goodbye!" {
+		t.Fatalf("expected goodbye! got %q", got)
+	}
+
+	// Typing after the group is a step of its own
+	b.Insert(8, "!")
+	b.Undo()
+	if got := b.Contents().String(); got != "goodbye!" {
+		t.Fatalf("expected goodbye! got %q", got)
+	}
+	b.Undo()
+	if got := b.Contents().String(); got != "hello" {
+		t.Fatalf("expected group undone in one step got %q", got)
+	}
+
+	// An empty group makes no state
+	b.BeginEdit()
+	b.EndEdit()
+	if n := len(b.UndoStates()); n != 3 {
+		t.Fatalf("expected 3 states got %d", n)
+	}
 }
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+
+	"tked/internal/lsp"
+)
+
+// lightBulbDelay is how long the cursor must rest before the language server
+// is asked whether it has code actions there.
+const lightBulbDelay = 300 * time.Millisecond
+
+// lightBulbMarker is drawn in the gutter on the cursor's row when there are
+// code actions for it.
+const lightBulbMarker = '*'
+
+var lightBulbStyle = tcell.StyleDefault.Foreground(tcell.ColorYellow).Bold(true)
+
+// codeActionPlace is the range of a view's text that code actions are
+// requested for, at a version of its buffer.
+type codeActionPlace struct {
+	view       View
+	version    int32
+	start, end int
+}
+
+// codeActionRange returns the range code actions are requested for: the
+// selection, or else the cursor.
+func codeActionRange(view View) (lsp.Position, lsp.Position) {
+	if sel := view.Selections(); len(sel) > 0 {
+		return lspPosition(view.Buffer(), sel[0].StartRow, sel[0].StartCol), lspPosition(view.Buffer(), sel[0].EndRow, sel[0].EndCol)
+	}
+	pos := cursorLSPPosition(view)
+	return pos, pos
+}
+
+// enabledCodeActions returns the actions that can be applied, and the index
+// of the first the server prefers, or 0.
+func enabledCodeActions(actions []lsp.CodeAction) ([]lsp.CodeAction, int) {
+	var enabled []lsp.CodeAction
+	preferred := -1
+	for _, action := range actions {
+		if action.Disabled != "" {
+			continue
+		}
+		if action.Preferred && preferred == -1 {
+			preferred = len(enabled)
+		}
+		enabled = append(enabled, action)
+	}
+	return enabled, max(0, preferred)
+}
+
+// applyCodeAction makes a code action's edit and then runs its command, which
+// finishes in the background.
+func applyCodeAction(app App, client lsp.LSPClient, action lsp.CodeAction) error {
+	if action.Edit != nil {
+		if err := app.ApplyWorkspaceEdit(action.Edit); err != nil {
+			return err
+		}
+	}
+	if action.Command != nil {
+		client.ExecuteCommand(action.Command, func(err error) {
+			if err != nil {
+				app.GetStatusBar().Errorf("Error running %q: %v", action.Title, err)
+			}
+		})
+	}
+	return nil
+}
+
+// updateLightBulb turns the light bulb off when the cursor moves or the text
+// changes, and asks the language server about the new place once the cursor
+// has rested there.
+func (a *app) updateLightBulb() {
+	view := a.GetCurrentView()
+	start, end := codeActionRange(view)
+	at := codeActionPlace{
+		view:    view,
+		version: view.Buffer().GetVersion(),
+		start:   indexForLSPPosition(view.Buffer(), start),
+		end:     indexForLSPPosition(view.Buffer(), end),
+	}
+	if at == a.lightBulb {
+		return
+	}
+	a.lightBulb = at
+	a.lightBulbOn = false
+	if a.lightBulbTimer != nil {
+		a.lightBulbTimer.Stop()
+	}
+	if getLSP(view.Buffer().GetFilename()) == nil || a.screen == nil {
+		return
+	}
+	screen := a.screen
+	a.lightBulbTimer = time.AfterFunc(lightBulbDelay, func() {
+		screen.PostEvent(tcell.NewEventInterrupt(func() { a.checkLightBulb(at) }))
+	})
+}
+
+// checkLightBulb asks the language server whether there are code actions at
+// a place, unless the cursor has moved on.
+func (a *app) checkLightBulb(at codeActionPlace) {
+	if at != a.lightBulb {
+		return
+	}
+	filename := at.view.Buffer().GetFilename()
+	client := getLSP(filename)
+	if client == nil {
+		return
+	}
+	start, end := codeActionRange(at.view)
+	request(a, lightBulbRequest, func(ctx context.Context) ([]lsp.CodeAction, error) {
+		return client.CodeActions(ctx, filename, start, end)
+	}, func(actions []lsp.CodeAction, err error) error {
+		if err != nil || at != a.lightBulb {
+			return nil
+		}
+		enabled, _ := enabledCodeActions(actions)
+		a.lightBulbOn = len(enabled) > 0
+		return nil
+	})
+}
+
+// drawLightBulb draws the light bulb in the gutter of the current view, next
+// to any diagnostic marker, when there are code actions at the cursor.
+func (a *app) drawLightBulb(topOffset, leftOffset int) {
+	view := a.GetCurrentView()
+	if !a.lightBulbOn || a.lightBulb.view != view || view.GutterWidth() < 2 {
+		return
+	}
+	row, _ := view.Cursor()
+	top, _ := view.TopLeft()
+	height, _ := view.Size()
+	if row < top || row >= top+height {
+		return
+	}
+	a.screen.SetContent(leftOffset+1, topOffset+row-top, lightBulbMarker, nil, lightBulbStyle)
+}
@@ -0,0 +1,135 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+	"go.lsp.dev/protocol"
+
+	"tked/internal/lsp"
+	"tked/internal/rope"
+)
+
+// pickApp is a dummyApp whose picker chooses an item.
+type pickApp struct {
+	dummyApp
+	choice  int
+	items   []string
+	initial int
+	// query is what Search is told the user typed.
+	query string
+}
+
+func (p *pickApp) Pick(_ string, items []string, initial int, _ func(int)) (int, bool) {
+	p.items, p.initial = items, initial
+	return p.choice, p.choice >= 0
+}
+
+func (p *pickApp) Search(_ string, search func(ctx context.Context, query string) func() []string) (int, bool) {
+	p.items = search(context.Background(), p.query)()
+	return p.choice, p.choice >= 0
+}
+
+func TestCommandCodeActions(t *testing.T) {
+	edit := &lsp.WorkspaceEdit{Files: []lsp.FileEdit{{Filename: "a.go"}}}
+	client := &fakeLSPClient{actions: []lsp.CodeAction{
+		{Title: "Extract function", Disabled: "nothing selected"},
+		{Title: "Organize imports", Command: &protocol.Command{Command: "organize"}},
+		{Title: "Remove x", Preferred: true, Edit: edit, Command: &protocol.Command{Command: "cleanup"}},
+	}}
+	withFakeLSP(t, client)
+	v := NewView("a.go", rope.NewRope("x := 1\ny := 2"))
+	v.SetCursor(1, 2)
+	sb := &inputStatusBar{}
+	d := &pickApp{dummyApp: dummyApp{view: v, sb: sb}, choice: 1}
+
+	if _, err := (&CommandCodeActions{}).Execute(d, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []lsp.Position{{Line: 1, Offset: 2}, {Line: 1, Offset: 2}}
+	if got := client.positions; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected actions for the cursor got %v", got)
+	}
+	// Disabled actions are left out and the preferred one is highlighted
+	if len(d.items) != 2 || d.items[0] != "Organize imports" || d.initial != 1 {
+		t.Fatalf("unexpected picker items %v initial %d", d.items, d.initial)
+	}
+	// The edit is made before the command runs
+	if len(d.edits) != 1 || d.edits[0] != edit || len(client.commands) != 1 || client.commands[0] != "cleanup" {
+		t.Fatalf("expected the action applied got %v %v", d.edits, client.commands)
+	}
+
+	// The selection is sent when there is one
+	client.positions = nil
+	v.SetSelections([]Selection{{StartRow: 0, StartCol: 0, EndRow: 0, EndCol: 1}})
+	d.choice = 0
+	(&CommandCodeActions{}).Execute(d, nil)
+	want = []lsp.Position{{Line: 0, Offset: 0}, {Line: 0, Offset: 1}}
+	if got := client.positions; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected actions for the selection got %v", got)
+	}
+	if len(client.commands) != 2 || client.commands[1] != "organize" || len(d.edits) != 1 {
+		t.Fatalf("expected only the command run got %v %v", d.edits, client.commands)
+	}
+
+	// Nothing to choose from
+	client.actions = client.actions[:1]
+	(&CommandCodeActions{}).Execute(d, nil)
+	if len(sb.messages) != 1 {
+		t.Fatalf("expected a message got %v", sb.messages)
+	}
+}
+
+func TestLightBulb(t *testing.T) {
+	client := &fakeLSPClient{}
+	a := newCompletionApp(t, client, "x := 1\ny := 2\n", 1, 0)
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(40, 10)
+	a.screen = screen
+	a.statusBar.SetScreen(screen)
+	a.tabBar.SetScreen(screen)
+	a.layoutViews()
+
+	a.updateLightBulb()
+	place := a.lightBulb
+	if a.lightBulbTimer == nil {
+		t.Fatalf("expected a check to be scheduled")
+	}
+	a.lightBulbTimer.Stop()
+
+	// Nothing is shown without actions
+	a.checkLightBulb(place)
+	finishBackground(a)
+	if a.lightBulbOn {
+		t.Fatalf("expected no light bulb without actions")
+	}
+
+	client.actions = []lsp.CodeAction{{Title: "Remove y"}}
+	a.checkLightBulb(place)
+	finishBackground(a)
+	a.draw()
+	screen.Show()
+	if got := screenRow(screen, 2); got != " *y := 2" {
+		t.Fatalf("expected the light bulb on the cursor row got %q", got)
+	}
+
+	// Moving the cursor turns it off, and old checks are ignored
+	a.GetCurrentView().SetCursor(0, 0)
+	a.updateLightBulb()
+	a.lightBulbTimer.Stop()
+	a.checkLightBulb(place)
+	finishBackground(a)
+	if a.lightBulbOn {
+		t.Fatalf("expected the light bulb off after moving")
+	}
+
+	// Errors leave it off
+	client.err = errors.New("failed")
+	a.checkLightBulb(a.lightBulb)
+	if a.lightBulbOn {
+		t.Fatalf("expected the light bulb off after an error")
+	}
+}
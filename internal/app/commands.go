@@ -1,10 +1,14 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"slices"
+	"strings"
 
 	"github.com/gdamore/tcell/v2"
 
+	"tked/internal/lsp"
 	"tked/internal/tklog"
 )
 
@@ -52,6 +56,126 @@ func (c *CommandRedo) Execute(app App, ev *tcell.EventKey) (bool, error) {
 	return false, nil
 }
 
+type CommandUndoTree struct{}
+
+func (c *CommandUndoTree) Name() string { return "undoTree" }
+
+func (c *CommandUndoTree) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	if view == nil {
+		return false, nil
+	}
+
+	buffer := view.Buffer()
+	states := buffer.UndoStates()
+	original := currentUndoState(states).Seq
+
+	// Preview each state as it is highlighted, going back to the original
+	// state if the user cancels.
+	idx, ok := app.Pick("Undo tree", undoTreeItems(states, now()), original, func(i int) {
+		buffer.GotoUndoState(states[i].Seq)
+	})
+	if !ok {
+		buffer.GotoUndoState(original)
+		return false, nil
+	}
+	buffer.GotoUndoState(states[idx].Seq)
+	return false, nil
+}
+
+// CommandUndoChronological moves through the undo states in the order they
+// were created, regardless of the branch they are on.
+type CommandUndoChronological struct {
+	delta int
+}
+
+func (c *CommandUndoChronological) Name() string {
+	if c.delta < 0 {
+		return "undoEarlier"
+	}
+	return "undoLater"
+}
+
+func (c *CommandUndoChronological) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	if view != nil {
+		buffer := view.Buffer()
+		buffer.GotoUndoState(currentUndoState(buffer.UndoStates()).Seq + c.delta)
+	}
+	return false, nil
+}
+
+// CommandUndoBranch switches to the next or previous branch of the undo tree
+// by moving to a sibling of the current state.
+type CommandUndoBranch struct {
+	delta int
+}
+
+func (c *CommandUndoBranch) Name() string {
+	if c.delta < 0 {
+		return "undoBranchPrev"
+	}
+	return "undoBranchNext"
+}
+
+func (c *CommandUndoBranch) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	if view == nil {
+		return false, nil
+	}
+
+	buffer := view.Buffer()
+	states := buffer.UndoStates()
+	current := currentUndoState(states)
+	if current.Parent < 0 {
+		return false, nil
+	}
+
+	siblings := []int{}
+	idx := 0
+	for _, s := range states {
+		if s.Parent == current.Parent {
+			if s.Seq == current.Seq {
+				idx = len(siblings)
+			}
+			siblings = append(siblings, s.Seq)
+		}
+	}
+	if len(siblings) < 2 {
+		app.GetStatusBar().Message("No other branches")
+		return false, nil
+	}
+
+	idx = (idx + c.delta + len(siblings)) % len(siblings)
+	buffer.GotoUndoState(siblings[idx])
+	return false, nil
+}
+
+type CommandUndoTime struct{}
+
+func (c *CommandUndoTime) Name() string { return "undoTime" }
+
+func (c *CommandUndoTime) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	if view == nil {
+		return false, nil
+	}
+
+	input, ok := app.GetStatusBar().Input("Go back by (e.g. 5m, +1h to go forward): ")
+	if !ok || input == "" {
+		return false, nil
+	}
+	offset, err := parseUndoTime(input)
+	if err != nil {
+		return false, err
+	}
+
+	buffer := view.Buffer()
+	states := buffer.UndoStates()
+	buffer.GotoUndoState(undoStateAt(states, currentUndoState(states).Time.Add(offset)))
+	return false, nil
+}
+
 type CommandNewFile struct{}
 
 func (c *CommandNewFile) Name() string { return "newFile" }
@@ -160,6 +284,10 @@ func (c *CommandMove) Execute(app App, ev *tcell.EventKey) (bool, error) {
 	oldRow, oldCol := view.Cursor()
 	row := oldRow + c.dRow
 	col := oldCol + c.dCol
+	if c.dCol > 0 {
+		// Step over characters that span several columns
+		col = columnAfter(view.Buffer(), oldRow, oldCol) + c.dCol - 1
+	}
 	row = max(0, row)
 	col = max(0, col)
 	view.SetCursor(row, col)
@@ -259,6 +387,448 @@ func (c *CommandPrevView) Execute(app App, ev *tcell.EventKey) (bool, error) {
 	return false, nil
 }
 
+// CommandDiagnostic moves the cursor to the next or previous diagnostic,
+// wrapping around at the ends of the buffer.
+type CommandDiagnostic struct {
+	delta int
+}
+
+func (c *CommandDiagnostic) Name() string {
+	if c.delta < 0 {
+		return "prevDiagnostic"
+	}
+	return "nextDiagnostic"
+}
+
+func (c *CommandDiagnostic) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	if view == nil {
+		return false, nil
+	}
+	diagnostics := view.Diagnostics()
+	if len(diagnostics) == 0 {
+		app.GetStatusBar().Message("No diagnostics")
+		return false, nil
+	}
+
+	buffer := view.Buffer()
+	row, col := view.Cursor()
+	cursorIdx := indexForPosition(buffer, row, col)
+
+	// Diagnostics are sorted, so search from the end when going backwards
+	target := diagnostics[0]
+	if c.delta < 0 {
+		target = diagnostics[len(diagnostics)-1]
+		slices.Reverse(diagnostics)
+	}
+	for _, d := range diagnostics {
+		idx := indexForLSPPosition(buffer, d.Start)
+		if (c.delta > 0 && idx > cursorIdx) || (c.delta < 0 && idx < cursorIdx) {
+			target = d
+			break
+		}
+	}
+	view.SetCursor(positionForIndex(buffer, indexForLSPPosition(buffer, target.Start)))
+	return false, nil
+}
+
+// CommandDiagnosticList lists the buffer's diagnostics and moves the cursor
+// to the chosen one.
+type CommandDiagnosticList struct{}
+
+func (c *CommandDiagnosticList) Name() string { return "diagnostics" }
+
+func (c *CommandDiagnosticList) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	if view == nil {
+		return false, nil
+	}
+	diagnostics := view.Diagnostics()
+	if len(diagnostics) == 0 {
+		app.GetStatusBar().Message("No diagnostics")
+		return false, nil
+	}
+
+	// Show each diagnostic as it is highlighted, going back to where the
+	// cursor was if the user cancels.
+	buffer := view.Buffer()
+	row, col := view.Cursor()
+	gotoDiagnostic := func(i int) {
+		view.SetCursor(positionForIndex(buffer, indexForLSPPosition(buffer, diagnostics[i].Start)))
+	}
+	idx, ok := app.Pick("Diagnostics", diagnosticItems(diagnostics), 0, gotoDiagnostic)
+	if !ok {
+		view.SetCursor(row, col)
+		return false, nil
+	}
+	gotoDiagnostic(idx)
+	return false, nil
+}
+
+// CommandHover shows the language server's description of the symbol at the
+// cursor in a popup.
+type CommandHover struct{}
+
+func (c *CommandHover) Name() string { return "hover" }
+
+func (c *CommandHover) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	client := getLSP(view.Buffer().GetFilename())
+	if client == nil {
+		app.GetStatusBar().Message("No language server")
+		return false, nil
+	}
+	filename, pos := view.Buffer().GetFilename(), cursorLSPPosition(view)
+	viewRequest(app, popupRequest, func(ctx context.Context) (string, error) {
+		return client.Hover(ctx, filename, pos)
+	}, func(text string, err error) error {
+		if err != nil {
+			return err
+		}
+		popup := NewMarkdownPopup(text)
+		if len(popup.lines) == 0 {
+			app.GetStatusBar().Message("No information at the cursor")
+			return nil
+		}
+		view.ShowPopup(popup)
+		return nil
+	})
+	return false, nil
+}
+
+// CommandSignatureHelp shows the signature of the function being called at
+// the cursor in a popup, with the current parameter highlighted.
+type CommandSignatureHelp struct{}
+
+func (c *CommandSignatureHelp) Name() string { return "signatureHelp" }
+
+func (c *CommandSignatureHelp) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	client := getLSP(view.Buffer().GetFilename())
+	if client == nil {
+		app.GetStatusBar().Message("No language server")
+		return false, nil
+	}
+	filename, pos := view.Buffer().GetFilename(), cursorLSPPosition(view)
+	viewRequest(app, popupRequest, func(ctx context.Context) (*lsp.Signature, error) {
+		return client.SignatureHelp(ctx, filename, pos)
+	}, func(sig *lsp.Signature, err error) error {
+		if err != nil {
+			return err
+		}
+		if sig == nil {
+			app.GetStatusBar().Message("No signature at the cursor")
+			return nil
+		}
+		view.ShowPopup(newSignaturePopup(sig))
+		return nil
+	})
+	return false, nil
+}
+
+// CommandGotoLocation jumps to where the symbol at the cursor is defined,
+// declared, has its type defined, or is implemented, as found by the language
+// server. If there are several places, the user picks one.
+type CommandGotoLocation struct {
+	kind string
+}
+
+// locationKinds describes each kind of location CommandGotoLocation finds.
+var locationKinds = map[string]struct {
+	title  string
+	lookup func(client lsp.LSPClient, ctx context.Context, filename string, pos lsp.Position) ([]lsp.Location, error)
+}{
+	"definition":     {"Definitions", lsp.LSPClient.Definition},
+	"declaration":    {"Declarations", lsp.LSPClient.Declaration},
+	"typeDefinition": {"Type definitions", lsp.LSPClient.TypeDefinition},
+	"implementation": {"Implementations", lsp.LSPClient.Implementation},
+}
+
+func (c *CommandGotoLocation) Name() string { return c.kind }
+
+func (c *CommandGotoLocation) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	kind, ok := locationKinds[c.kind]
+	if !ok {
+		tklog.Panic("unknown location kind %s", c.kind) // this is a bug not an error!
+	}
+	view := app.GetCurrentView()
+	client := getLSP(view.Buffer().GetFilename())
+	if client == nil {
+		app.GetStatusBar().Message("No language server")
+		return false, nil
+	}
+	filename, pos := view.Buffer().GetFilename(), cursorLSPPosition(view)
+	viewRequest(app, c.kind, func(ctx context.Context) ([]lsp.Location, error) {
+		return kind.lookup(client, ctx, filename, pos)
+	}, func(locations []lsp.Location, err error) error {
+		if err != nil {
+			return err
+		}
+		switch len(locations) {
+		case 0:
+			app.GetStatusBar().Message("No " + strings.ToLower(kind.title) + " found")
+			return nil
+		case 1:
+			return app.JumpTo(locations[0].Filename, locations[0].Start)
+		}
+		idx, ok := app.Pick(kind.title, locationItems(app, locations), 0, nil)
+		if !ok {
+			return nil
+		}
+		return app.JumpTo(locations[idx].Filename, locations[idx].Start)
+	})
+	return false, nil
+}
+
+// CommandJump moves back or forward through the jump stack.
+type CommandJump struct {
+	delta int
+}
+
+func (c *CommandJump) Name() string {
+	if c.delta < 0 {
+		return "jumpBack"
+	}
+	return "jumpForward"
+}
+
+func (c *CommandJump) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	if c.delta < 0 && !app.JumpBack() {
+		app.GetStatusBar().Message("No earlier jumps")
+	} else if c.delta > 0 && !app.JumpForward() {
+		app.GetStatusBar().Message("No later jumps")
+	}
+	return false, nil
+}
+
+// CommandReferences lists the uses of the symbol at the cursor in the
+// results pane.
+type CommandReferences struct{}
+
+func (c *CommandReferences) Name() string { return "references" }
+
+func (c *CommandReferences) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	client := getLSP(view.Buffer().GetFilename())
+	if client == nil {
+		app.GetStatusBar().Message("No language server")
+		return false, nil
+	}
+	filename, pos := view.Buffer().GetFilename(), cursorLSPPosition(view)
+	viewRequest(app, "references", func(ctx context.Context) ([]lsp.Location, error) {
+		return client.References(ctx, filename, pos, true)
+	}, func(locations []lsp.Location, err error) error {
+		if err != nil {
+			return err
+		}
+		if len(locations) == 0 {
+			app.GetStatusBar().Message("No references found")
+			return nil
+		}
+		app.ShowResults("References", locations)
+		return nil
+	})
+	return false, nil
+}
+
+// CommandStepResult jumps to the next or previous result in the results
+// pane, wrapping around at the ends.
+type CommandStepResult struct {
+	delta int
+}
+
+func (c *CommandStepResult) Name() string {
+	if c.delta < 0 {
+		return "prevResult"
+	}
+	return "nextResult"
+}
+
+func (c *CommandStepResult) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	if !app.StepResult(c.delta) {
+		app.GetStatusBar().Message("No results")
+	}
+	return false, nil
+}
+
+// CommandFocusResults moves the keyboard focus to the results pane to choose
+// a result.
+type CommandFocusResults struct{}
+
+func (c *CommandFocusResults) Name() string { return "results" }
+
+func (c *CommandFocusResults) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	if !app.FocusResults() {
+		app.GetStatusBar().Message("No results")
+	}
+	return false, nil
+}
+
+// CommandComplete shows the language server's completions at the cursor.
+type CommandComplete struct{}
+
+func (c *CommandComplete) Name() string { return "complete" }
+
+func (c *CommandComplete) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	app.Complete("")
+	return false, nil
+}
+
+// CommandRename renames the symbol at the cursor everywhere it is used, as
+// the language server finds it.
+type CommandRename struct{}
+
+func (c *CommandRename) Name() string { return "rename" }
+
+func (c *CommandRename) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	filename := view.Buffer().GetFilename()
+	client := getLSP(filename)
+	if client == nil {
+		app.GetStatusBar().Message("No language server")
+		return false, nil
+	}
+	pos := cursorLSPPosition(view)
+
+	// Suggest the current name, as the server sees it if it can say
+	viewRequest(app, "rename", func(ctx context.Context) (*lsp.RenameTarget, error) {
+		return client.PrepareRename(ctx, filename, pos)
+	}, func(target *lsp.RenameTarget, err error) error {
+		var name string
+		switch {
+		case errors.Is(err, lsp.ErrNotSupported):
+			name = wordAt(view.Buffer(), cursorIndex(view))
+		case err != nil:
+			return err
+		case target == nil:
+			app.GetStatusBar().Message("Nothing to rename at the cursor")
+			return nil
+		default:
+			name = target.Placeholder
+		}
+
+		newName, ok := app.GetStatusBar().InputDefault("Rename to: ", name)
+		if !ok || newName == "" || newName == name {
+			return nil
+		}
+		viewRequest(app, "rename", func(ctx context.Context) (*lsp.WorkspaceEdit, error) {
+			return client.Rename(ctx, filename, pos, newName)
+		}, func(edit *lsp.WorkspaceEdit, err error) error {
+			if err != nil {
+				return err
+			}
+			if len(edit.Files) == 0 {
+				app.GetStatusBar().Message("Nothing to rename at the cursor")
+				return nil
+			}
+			if err := app.ApplyWorkspaceEdit(edit); err != nil {
+				return err
+			}
+			count := 0
+			for _, file := range edit.Files {
+				count += len(file.Edits)
+			}
+			app.GetStatusBar().Messagef("Renamed %d occurrences in %d files", count, len(edit.Files))
+			return nil
+		})
+		return nil
+	})
+	return false, nil
+}
+
+// CommandFormat formats the current buffer, or the selected text, with its
+// language server.
+type CommandFormat struct{}
+
+func (c *CommandFormat) Name() string { return "format" }
+
+func (c *CommandFormat) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	client := getLSP(view.Buffer().GetFilename())
+	if client == nil {
+		app.GetStatusBar().Message("No language server")
+		return false, nil
+	}
+	viewRequest(app, "format", formatRequest(client, view, app.Settings()), func(edits []lsp.TextEdit, err error) error {
+		if errors.Is(err, lsp.ErrNotSupported) {
+			app.GetStatusBar().Message("The language server can't format this")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		applyFormatting(view, edits)
+		return nil
+	})
+	return false, nil
+}
+
+// CommandRestartServers restarts the language servers for the current
+// buffer, including those given up on after crashing too often.
+type CommandRestartServers struct{}
+
+func (c *CommandRestartServers) Name() string { return "restartServers" }
+
+// restartServers restarts the language servers for a file. Tests replace it.
+var restartServers = lsp.RestartServers
+
+func (c *CommandRestartServers) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	filename := app.GetCurrentView().Buffer().GetFilename()
+	app.Background("restartServers", func(ctx context.Context) func() {
+		n := restartServers(filename)
+		return func() {
+			if n == 0 {
+				app.GetStatusBar().Message("No language server")
+			} else {
+				app.GetStatusBar().Messagef("Restarted %d language servers", n)
+			}
+		}
+	})
+	return false, nil
+}
+
+// CommandCodeActions lists the language server's code actions for the
+// selection or cursor, such as quick fixes, and applies the one chosen.
+type CommandCodeActions struct{}
+
+func (c *CommandCodeActions) Name() string { return "codeActions" }
+
+func (c *CommandCodeActions) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	filename := view.Buffer().GetFilename()
+	client := getLSP(filename)
+	if client == nil {
+		app.GetStatusBar().Message("No language server")
+		return false, nil
+	}
+	start, end := codeActionRange(view)
+	viewRequest(app, "codeActions", func(ctx context.Context) ([]lsp.CodeAction, error) {
+		return client.CodeActions(ctx, filename, start, end)
+	}, func(actions []lsp.CodeAction, err error) error {
+		if errors.Is(err, lsp.ErrNotSupported) {
+			app.GetStatusBar().Message("The language server has no code actions")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		actions, preferred := enabledCodeActions(actions)
+		if len(actions) == 0 {
+			app.GetStatusBar().Message("No code actions here")
+			return nil
+		}
+
+		titles := make([]string, len(actions))
+		for i, action := range actions {
+			titles[i] = action.Title
+		}
+		idx, ok := app.Pick("Code actions", titles, preferred, nil)
+		if !ok {
+			return nil
+		}
+		return applyCodeAction(app, client, actions[idx])
+	})
+	return false, nil
+}
+
 func nextview(app App, direction int) {
 	views := app.Views()
 	if len(views) > 1 {
@@ -291,6 +861,12 @@ func registerCommands() {
 	registerCommand("exit", &CommandExit{})
 	registerCommand("undo", &CommandUndo{})
 	registerCommand("redo", &CommandRedo{})
+	registerCommand("undoTree", &CommandUndoTree{})
+	registerCommand("undoEarlier", &CommandUndoChronological{delta: -1})
+	registerCommand("undoLater", &CommandUndoChronological{delta: 1})
+	registerCommand("undoBranchPrev", &CommandUndoBranch{delta: -1})
+	registerCommand("undoBranchNext", &CommandUndoBranch{delta: 1})
+	registerCommand("undoTime", &CommandUndoTime{})
 	registerCommand("new", &CommandNewFile{})
 	registerCommand("save", &CommandSave{})
 	registerCommand("saveAs", &CommandSaveAs{})
@@ -306,4 +882,27 @@ func registerCommands() {
 	registerCommand("pagedown", &CommandPageDown{})
 	registerCommand("nextView", &CommandNextView{})
 	registerCommand("prevView", &CommandPrevView{})
+	registerCommand("nextDiagnostic", &CommandDiagnostic{delta: 1})
+	registerCommand("prevDiagnostic", &CommandDiagnostic{delta: -1})
+	registerCommand("diagnostics", &CommandDiagnosticList{})
+	registerCommand("hover", &CommandHover{})
+	registerCommand("signatureHelp", &CommandSignatureHelp{})
+	registerCommand("definition", &CommandGotoLocation{kind: "definition"})
+	registerCommand("declaration", &CommandGotoLocation{kind: "declaration"})
+	registerCommand("typeDefinition", &CommandGotoLocation{kind: "typeDefinition"})
+	registerCommand("implementation", &CommandGotoLocation{kind: "implementation"})
+	registerCommand("jumpBack", &CommandJump{delta: -1})
+	registerCommand("jumpForward", &CommandJump{delta: 1})
+	registerCommand("references", &CommandReferences{})
+	registerCommand("nextResult", &CommandStepResult{delta: 1})
+	registerCommand("prevResult", &CommandStepResult{delta: -1})
+	registerCommand("results", &CommandFocusResults{})
+	registerCommand("complete", &CommandComplete{})
+	registerCommand("rename", &CommandRename{})
+	registerCommand("format", &CommandFormat{})
+	registerCommand("codeActions", &CommandCodeActions{})
+	registerCommand("restartServers", &CommandRestartServers{})
+	registerCommand("serverLog", &CommandServerLog{})
+	registerCommand("outline", &CommandOutline{})
+	registerCommand("workspaceSymbols", &CommandWorkspaceSymbols{})
 }
@@ -1,39 +1,83 @@
 package app
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"testing"
 
 	"github.com/gdamore/tcell/v2"
 
+	"tked/internal/lsp"
 	"tked/internal/rope"
 )
 
 type dummyApp struct {
-	opened string
-	sb     StatusBar
-	view   View
+	opened  string
+	sb      StatusBar
+	view    View
+	jumps   []lsp.Location
+	results []lsp.Location
+	trigger *string
+	edits   []*lsp.WorkspaceEdit
+	text    [2]string
+	symbols []lsp.Symbol
 }
 
-func (d *dummyApp) OpenFile(name string) error { d.opened = name; return nil }
-func (d *dummyApp) Run(tcell.Screen)           {}
-func (d *dummyApp) Settings() Settings         { return NewSettings() }
-func (d *dummyApp) GetStatusBar() StatusBar    { return d.sb }
-func (d *dummyApp) LoadSettings(string) error  { return nil }
-func (d *dummyApp) GetCurrentView() View       { return d.view }
-func (d *dummyApp) SetCurrentView(v View)      { d.view = v }
-func (d *dummyApp) Views() []View              { return []View{d.view} }
-func (d *dummyApp) CloseView(View) bool        { return true }
+func (d *dummyApp) OpenFile(name string) error                        { d.opened = name; return nil }
+func (d *dummyApp) Run(tcell.Screen)                                  {}
+func (d *dummyApp) Settings() Settings                                { return NewSettings() }
+func (d *dummyApp) GetStatusBar() StatusBar                           { return d.sb }
+func (d *dummyApp) LoadSettings(string) error                         { return nil }
+func (d *dummyApp) GetCurrentView() View                              { return d.view }
+func (d *dummyApp) SetCurrentView(v View)                             { d.view = v }
+func (d *dummyApp) Views() []View                                     { return []View{d.view} }
+func (d *dummyApp) CloseView(View) bool                               { return true }
+func (d *dummyApp) Pick(string, []string, int, func(int)) (int, bool) { return -1, false }
+
+func (d *dummyApp) Search(string, func(context.Context, string) func() []string) (int, bool) {
+	return -1, false
+}
+
+func (d *dummyApp) JumpTo(filename string, pos lsp.Position) error {
+	d.jumps = append(d.jumps, lsp.Location{Filename: filename, Start: pos})
+	return nil
+}
+func (d *dummyApp) JumpBack() bool    { return false }
+func (d *dummyApp) JumpForward() bool { return false }
+
+func (d *dummyApp) ShowResults(title string, locations []lsp.Location) { d.results = locations }
+func (d *dummyApp) ShowOutline(title string, symbols []lsp.Symbol)     { d.symbols = symbols }
+func (d *dummyApp) StepResult(int) bool                                { return false }
+func (d *dummyApp) FocusResults() bool                                 { return false }
+
+func (d *dummyApp) Complete(trigger string) { d.trigger = &trigger }
+
+func (d *dummyApp) ApplyWorkspaceEdit(edit *lsp.WorkspaceEdit) error {
+	d.edits = append(d.edits, edit)
+	return nil
+}
+
+func (d *dummyApp) ShowText(title, text string) { d.text = [2]string{title, text} }
+
+// Background does the work at once, as there is no event loop to finish it.
+func (d *dummyApp) Background(_ string, work func(ctx context.Context) func()) {
+	work(context.Background())()
+}
 
 type stubStatusBar struct{}
 
-func (stubStatusBar) SetScreen(tcell.Screen)      {}
-func (stubStatusBar) Draw(View)                   {}
-func (stubStatusBar) Message(string)              {}
-func (stubStatusBar) Messagef(string, ...any)     {}
-func (stubStatusBar) Error(string)                {}
-func (stubStatusBar) Errorf(string, ...any)       {}
-func (stubStatusBar) Input(string) (string, bool) { return "test.txt", true }
+func (stubStatusBar) SetScreen(tcell.Screen)        {}
+func (stubStatusBar) Draw(View)                     {}
+func (stubStatusBar) Message(string)                {}
+func (stubStatusBar) Messagef(string, ...any)       {}
+func (stubStatusBar) Error(string)                  {}
+func (stubStatusBar) Errorf(string, ...any)         {}
+func (stubStatusBar) Input(string) (string, bool)   { return "test.txt", true }
+func (stubStatusBar) Progress(string, int64, int64) {}
+func (stubStatusBar) Notify(string, tcell.Style)    {}
+
+func (stubStatusBar) InputDefault(string, string) (string, bool) { return "test.txt", true }
 
 func TestCommandOpenExecute(t *testing.T) {
 	commands = make(map[string]Command)
@@ -70,6 +114,7 @@ func TestCommandMoveExecute(t *testing.T) {
 
 // TODO: Add a TestCommandSaveExecuteUnnamed (status bar input)
 func TestCommandSaveExecute(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
 	tmp, _ := os.CreateTemp("", "cmdsave*.txt")
 	tmp.Close()
 	defer os.Remove(tmp.Name())
@@ -168,3 +213,34 @@ func TestCommandMoveExecuteShiftReverse(t *testing.T) {
 		t.Fatalf("unexpected selection %#v", sels)
 	}
 }
+
+// messagefStatusBar is an inputStatusBar that records formatted messages too.
+type messagefStatusBar struct {
+	inputStatusBar
+}
+
+func (sb *messagefStatusBar) Messagef(format string, args ...any) {
+	sb.Message(fmt.Sprintf(format, args...))
+}
+
+func TestCommandRestartServers(t *testing.T) {
+	old := restartServers
+	t.Cleanup(func() { restartServers = old })
+	var restarted []string
+	restartServers = func(filename string) int {
+		restarted = append(restarted, filename)
+		return len(restarted) - 1
+	}
+	sb := &messagefStatusBar{}
+	d := &dummyApp{view: NewView("a.go", rope.NewRope("")), sb: sb}
+
+	cmd := &CommandRestartServers{}
+	cmd.Execute(d, nil)
+	cmd.Execute(d, nil)
+	if len(restarted) != 2 || restarted[0] != "a.go" {
+		t.Fatalf("expected the buffer's servers restarted got %v", restarted)
+	}
+	if len(sb.messages) != 2 || sb.messages[0] != "No language server" || sb.messages[1] != "Restarted 1 language servers" {
+		t.Fatalf("unexpected messages %v", sb.messages)
+	}
+}
@@ -0,0 +1,416 @@
+package app
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+	"go.lsp.dev/protocol"
+
+	"tked/internal/lsp"
+	"tked/internal/tklog"
+)
+
+// maxCompletionRows is the most completions shown at once in the menu.
+const maxCompletionRows = 10
+
+// completionKinds are the short names shown for the kinds of completion.
+var completionKinds = map[protocol.CompletionItemKind]string{
+	protocol.CompletionItemKindText:          "text",
+	protocol.CompletionItemKindMethod:        "meth",
+	protocol.CompletionItemKindFunction:      "func",
+	protocol.CompletionItemKindConstructor:   "ctor",
+	protocol.CompletionItemKindField:         "field",
+	protocol.CompletionItemKindVariable:      "var",
+	protocol.CompletionItemKindClass:         "class",
+	protocol.CompletionItemKindInterface:     "iface",
+	protocol.CompletionItemKindModule:        "mod",
+	protocol.CompletionItemKindProperty:      "prop",
+	protocol.CompletionItemKindUnit:          "unit",
+	protocol.CompletionItemKindValue:         "value",
+	protocol.CompletionItemKindEnum:          "enum",
+	protocol.CompletionItemKindKeyword:       "kw",
+	protocol.CompletionItemKindSnippet:       "snip",
+	protocol.CompletionItemKindColor:         "color",
+	protocol.CompletionItemKindFile:          "file",
+	protocol.CompletionItemKindReference:     "ref",
+	protocol.CompletionItemKindFolder:        "dir",
+	protocol.CompletionItemKindEnumMember:    "enum",
+	protocol.CompletionItemKindConstant:      "const",
+	protocol.CompletionItemKindStruct:        "struct",
+	protocol.CompletionItemKindEvent:         "event",
+	protocol.CompletionItemKindOperator:      "op",
+	protocol.CompletionItemKindTypeParameter: "type",
+}
+
+// completionMenu is the list of completions shown at the cursor. It is
+// filtered by the text typed since it was opened, and closes when the cursor
+// leaves the word being completed.
+type completionMenu struct {
+	view  View
+	items []lsp.CompletionItem
+	// matches are the indexes in items of those matching the typed text, in
+	// the order shown.
+	matches  []int
+	selected int
+	top      int
+	// start is the byte index of the start of the text being completed.
+	start int
+	// requestIdx and requestPos are where the cursor was when the
+	// completions were requested. The items' edits are relative to the
+	// contents then.
+	requestIdx int
+	requestPos lsp.Position
+}
+
+func (a *app) Complete(trigger string) {
+	a.completion = nil
+	view := a.GetCurrentView()
+	filename := view.Buffer().GetFilename()
+	client := getLSP(filename)
+	if client == nil {
+		if trigger == "" {
+			a.statusBar.Message("No language server")
+		}
+		return
+	}
+	pos := cursorLSPPosition(view)
+	buffer := view.Buffer()
+	idx := indexForLSPPosition(buffer, pos)
+	start := wordStart(buffer, idx)
+
+	request(a, completionRequest, func(ctx context.Context) ([]lsp.CompletionItem, error) {
+		return client.Completion(ctx, filename, pos, trigger)
+	}, func(items []lsp.CompletionItem, err error) error {
+		if err != nil && trigger != "" {
+			tklog.Warn("Completion after %q failed: %v", trigger, err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if a.GetCurrentView() != view {
+			return nil
+		}
+
+		m := &completionMenu{
+			view:       view,
+			items:      items,
+			start:      start,
+			requestIdx: idx,
+			requestPos: pos,
+		}
+		for _, item := range items {
+			// The server knows better where the text being completed starts
+			if item.Edit != nil {
+				if start := indexForLSPPosition(buffer, item.Edit.Start); start <= idx {
+					m.start = start
+				}
+				break
+			}
+		}
+		// The cursor may have left the word while waiting
+		if _, ok := m.typed(); !ok {
+			return nil
+		}
+		m.filter()
+		if len(m.matches) == 0 {
+			if trigger == "" {
+				a.statusBar.Message("No completions")
+			}
+			return nil
+		}
+		a.completion = m
+		return nil
+	})
+}
+
+// wordStart returns the index of the start of the word ending at idx.
+func wordStart(buffer Buffer, idx int) int {
+	contents := buffer.Contents()
+	lineStart, _ := contents.LineStart(contents.LineAt(idx))
+	text := contents.Slice(lineStart, idx)
+	for len(text) > 0 {
+		r, size := utf8.DecodeLastRuneInString(text)
+		if !isWordRune(r) {
+			break
+		}
+		text = text[:len(text)-size]
+	}
+	return lineStart + len(text)
+}
+
+// wordAt returns the word around idx, or "" if there isn't one.
+func wordAt(buffer Buffer, idx int) string {
+	contents := buffer.Contents()
+	end := contents.Len()
+	if next, ok := contents.LineStart(contents.LineAt(idx) + 1); ok {
+		end = next - 1
+	}
+	rest := contents.Slice(idx, end)
+	for i, r := range rest {
+		if !isWordRune(r) {
+			rest = rest[:i]
+			break
+		}
+	}
+	start := wordStart(buffer, idx)
+	return contents.Slice(start, idx) + rest
+}
+
+// typed returns the text typed since the start of the word being completed,
+// and false if the cursor has left the word.
+func (m *completionMenu) typed() (string, bool) {
+	idx := cursorIndex(m.view)
+	if idx < m.start {
+		return "", false
+	}
+	text := m.view.Buffer().Contents().Slice(m.start, idx)
+	return text, !strings.ContainsRune(text, '\n')
+}
+
+// filter finds the items matching the typed text. Items that start with it
+// come first, followed by those that contain its characters in order, each
+// in the order the server sent them.
+func (m *completionMenu) filter() {
+	typed, _ := m.typed()
+	typed = strings.ToLower(typed)
+	var prefixed, others []int
+	for i, item := range m.items {
+		text := strings.ToLower(item.FilterText)
+		switch {
+		case strings.HasPrefix(text, typed):
+			prefixed = append(prefixed, i)
+		case isSubsequence(typed, text):
+			others = append(others, i)
+		}
+	}
+	m.matches = append(prefixed, others...)
+	m.selected = 0
+	m.top = 0
+}
+
+// isSubsequence returns true if the runes of sub appear in s in order.
+func isSubsequence(sub, s string) bool {
+	for _, r := range sub {
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+utf8.RuneLen(r):]
+	}
+	return true
+}
+
+// completionKey handles a key pressed while the completion menu is open. It
+// returns false if the key should be handled as usual.
+func (a *app) completionKey(ev *tcell.EventKey) bool {
+	m := a.completion
+	if m == nil {
+		return false
+	}
+	switch ev.Key() {
+	case tcell.KeyUp:
+		m.selected = (m.selected - 1 + len(m.matches)) % len(m.matches)
+	case tcell.KeyDown:
+		m.selected = (m.selected + 1) % len(m.matches)
+	case tcell.KeyEnter, tcell.KeyTab:
+		a.acceptCompletion()
+	case tcell.KeyEscape:
+		a.completion = nil
+	default:
+		return false
+	}
+	return true
+}
+
+// updateCompletion follows a key handled as usual: it filters the open menu
+// by what has been typed, or closes it if the cursor has left the word, and
+// asks for completions when a trigger character is typed.
+func (a *app) updateCompletion(ev *tcell.EventKey) {
+	if m := a.completion; m != nil {
+		if _, ok := m.typed(); !ok || m.view != a.GetCurrentView() {
+			a.completion = nil
+		} else if m.filter(); len(m.matches) == 0 {
+			a.completion = nil
+		}
+	}
+
+	if ev.Key() != tcell.KeyRune {
+		return
+	}
+	client := getLSP(a.GetCurrentView().Buffer().GetFilename())
+	if client == nil {
+		return
+	}
+	trigger := string(ev.Rune())
+	if slices.Contains(client.CompletionTriggers(), trigger) {
+		a.Complete(trigger)
+	}
+}
+
+// acceptCompletion inserts the selected completion, replacing the text typed,
+// and makes its additional edits as one undo step.
+func (a *app) acceptCompletion() {
+	m := a.completion
+	a.completion = nil
+	item := m.items[m.matches[m.selected]]
+	buffer := m.view.Buffer()
+	cursor := cursorIndex(m.view)
+
+	start, end := m.start, cursor
+	if item.Edit != nil {
+		start = m.index(cursor, item.Edit.Start)
+		end = max(start, m.index(cursor, item.Edit.End))
+	}
+	text := item.InsertText
+	var stops []snippetStop
+	if item.Snippet {
+		text, stops = expandSnippet(text)
+	}
+
+	edits := []indexEdit{{start: start, end: end, text: text}}
+	for _, e := range item.AdditionalEdits {
+		edits = append(edits, indexEdit{start: m.index(cursor, e.Start), end: m.index(cursor, e.End), text: e.Text})
+	}
+	applyIndexEdits(buffer, edits)
+
+	// Find where the text ended up after the additional edits before it
+	for _, e := range edits[1:] {
+		if e.start < start {
+			start += len(e.text) - (e.end - e.start)
+		}
+	}
+	a.endSnippet()
+	if len(stops) > 1 {
+		a.snippet = newSnippetSession(m.view, start, stops)
+		return
+	}
+	end = start + len(text)
+	if len(stops) == 1 {
+		end = start + stops[0].start
+	}
+	m.view.SetCursor(positionForIndex(buffer, end))
+	m.view.ClearAnchor()
+	m.view.SetSelections(nil)
+}
+
+// index returns the byte index of a position in an item's edits. The text
+// typed since the request moves positions after the cursor then.
+func (m *completionMenu) index(cursor int, pos lsp.Position) int {
+	if pos.Line == m.requestPos.Line && pos.Offset >= m.requestPos.Offset {
+		pos.Offset += cursor - m.requestIdx
+	}
+	return indexForLSPPosition(m.view.Buffer(), pos)
+}
+
+// draw draws the menu in a box below the cursor, or above it if there is more
+// room, with the labels lined up with the text being completed.
+func (m *completionMenu) draw(screen tcell.Screen) {
+	width, height := screen.Size()
+	top, left := m.view.TopLeft()
+	row, col := positionForIndex(m.view.Buffer(), m.start)
+	cursorRow, _ := m.view.Cursor()
+	x := m.view.GutterWidth() + col - left
+	y := 1 + cursorRow - top
+	if row != cursorRow || y < 1 || y >= height-1 {
+		return
+	}
+
+	rows := min(len(m.matches), maxCompletionRows)
+	if m.selected < m.top {
+		m.top = m.selected
+	} else if m.selected >= m.top+rows {
+		m.top = m.selected - rows + 1
+	}
+
+	kindWidth, labelWidth, detailWidth := 0, 0, 0
+	for _, i := range m.matches[m.top : m.top+rows] {
+		item := m.items[i]
+		kindWidth = max(kindWidth, len(completionKinds[item.Kind]))
+		labelWidth = max(labelWidth, utf8.RuneCountInString(item.Label))
+		detailWidth = max(detailWidth, utf8.RuneCountInString(firstLine(item.Detail)))
+	}
+	innerWidth := kindWidth + 1 + labelWidth + 2
+	if detailWidth > 0 {
+		innerWidth += detailWidth + 1
+	}
+	boxWidth := min(innerWidth+2, maxPopupWidth, width)
+
+	// The tab bar is above the view and the status bar below it
+	below := height - 1 - (y + 1)
+	above := y - 1
+	boxHeight := rows + 2
+	boxY := y + 1
+	if boxHeight > below && above > below {
+		boxHeight = min(boxHeight, above)
+		boxY = y - boxHeight
+	} else {
+		boxHeight = min(boxHeight, below)
+	}
+	if boxHeight < 3 {
+		return
+	}
+	// Line the labels up with the text, leaving room for the kind
+	boxX := max(0, min(x-kindWidth-3, width-boxWidth))
+
+	style := tcell.StyleDefault
+	drawBox(screen, boxX, boxY, boxWidth, boxHeight, style)
+	for r := range boxHeight - 2 {
+		i := m.top + r
+		item := m.items[m.matches[i]]
+		rowStyle := style
+		if i == m.selected {
+			rowStyle = rowStyle.Reverse(true)
+		}
+		text := " " + padRight(completionKinds[item.Kind], kindWidth) + " " + padRight(item.Label, labelWidth) + " "
+		fillString(screen, boxX+1, boxY+1+r, boxWidth-2, rowStyle, text)
+		if detail := firstLine(item.Detail); detail != "" {
+			n := utf8.RuneCountInString(text)
+			drawString(screen, boxX+1+n, boxY+1+r, boxWidth-2-n, rowStyle.Dim(true), strings.TrimSpace(detail))
+		}
+	}
+}
+
+// padRight pads s with spaces to width runes.
+func padRight(s string, width int) string {
+	return s + strings.Repeat(" ", max(0, width-utf8.RuneCountInString(s)))
+}
+
+// cursorIndex returns the byte index in the buffer of the view's cursor.
+func cursorIndex(v View) int {
+	row, col := v.Cursor()
+	return indexForPosition(v.Buffer(), row, col)
+}
+
+// snippetKey handles Tab, Shift+Tab and Escape while moving between the tab
+// stops of an inserted snippet. It returns false if the key should be handled
+// as usual.
+func (a *app) snippetKey(ev *tcell.EventKey) bool {
+	s := a.snippet
+	if s == nil || s.view != a.GetCurrentView() {
+		return false
+	}
+	switch ev.Key() {
+	case tcell.KeyTab:
+		if !s.move(1) {
+			a.snippet = nil
+		}
+	case tcell.KeyBacktab:
+		s.move(-1)
+	case tcell.KeyEscape:
+		a.endSnippet()
+	default:
+		return false
+	}
+	return true
+}
+
+// endSnippet ends moving between the tab stops of a snippet.
+func (a *app) endSnippet() {
+	if a.snippet != nil {
+		a.snippet.end()
+		a.snippet = nil
+	}
+}
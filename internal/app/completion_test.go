@@ -0,0 +1,255 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+	"go.lsp.dev/protocol"
+
+	"tked/internal/lsp"
+)
+
+// newCompletionApp creates an app with a file of the given contents open and
+// the cursor at row, col, served by client.
+func newCompletionApp(t *testing.T, client *fakeLSPClient, contents string, row, col int) *app {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	withFakeLSP(t, client)
+	commands = make(map[string]Command)
+	registerCommands()
+	ResetApp()
+	aInt, err := NewApp()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a := aInt.(*app)
+	filename := filepath.Join(t.TempDir(), "main.go")
+	os.WriteFile(filename, []byte(contents), 0644)
+	if err := a.OpenFile(filename); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a.GetCurrentView().SetCursor(row, col)
+	return a
+}
+
+// menuLabels returns the labels of the items shown in the completion menu.
+func menuLabels(a *app) []string {
+	if a.completion == nil {
+		return nil
+	}
+	var labels []string
+	for _, i := range a.completion.matches {
+		labels = append(labels, a.completion.items[i].Label)
+	}
+	return labels
+}
+
+func typeRunes(a *app, text string) {
+	for _, r := range text {
+		a.handleKey(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+	}
+}
+
+func TestCompleteFiltersAsYouType(t *testing.T) {
+	client := &fakeLSPClient{completions: []lsp.CompletionItem{
+		{Label: "Errorf", FilterText: "Errorf", InsertText: "Errorf"},
+		{Label: "Printf", FilterText: "Printf", InsertText: "Printf"},
+		{Label: "Println", FilterText: "Println", InsertText: "Println"},
+		{Label: "Sprint", FilterText: "Sprint", InsertText: "Sprint"},
+	}}
+	a := newCompletionApp(t, client, "fmt.Pr", 0, 6)
+
+	a.Complete("")
+	if got := client.positions; len(got) != 1 || got[0] != (lsp.Position{Line: 0, Offset: 6}) {
+		t.Fatalf("unexpected request positions %v", got)
+	}
+	// Prefix matches come before other matches
+	if got := strings.Join(menuLabels(a), " "); got != "Printf Println Sprint" {
+		t.Fatalf("unexpected items %q", got)
+	}
+
+	typeRunes(a, "in")
+	if got := strings.Join(menuLabels(a), " "); got != "Printf Println Sprint" {
+		t.Fatalf("unexpected items after typing %q", got)
+	}
+	typeRunes(a, "l")
+	if got := strings.Join(menuLabels(a), " "); got != "Println" {
+		t.Fatalf("unexpected items after typing %q", got)
+	}
+
+	// Leaving the word closes the menu
+	for range 6 {
+		a.handleKey(tcell.NewEventKey(tcell.KeyLeft, 0, tcell.ModNone))
+	}
+	if a.completion != nil {
+		t.Fatalf("expected the menu closed")
+	}
+}
+
+func TestCompleteNoMatches(t *testing.T) {
+	client := &fakeLSPClient{completions: []lsp.CompletionItem{
+		{Label: "Println", FilterText: "Println", InsertText: "Println"},
+	}}
+	a := newCompletionApp(t, client, "fmt.Pr", 0, 6)
+	a.Complete("")
+
+	typeRunes(a, "x")
+	if a.completion != nil {
+		t.Fatalf("expected the menu closed when nothing matches")
+	}
+	if got := a.GetCurrentView().Buffer().Contents().String(); got != "fmt.Prx" {
+		t.Fatalf("expected the key to be typed, got %q", got)
+	}
+}
+
+func TestCompletionMenuKeys(t *testing.T) {
+	client := &fakeLSPClient{completions: []lsp.CompletionItem{
+		{Label: "one", FilterText: "one", InsertText: "one"},
+		{Label: "two", FilterText: "two", InsertText: "two"},
+	}}
+	a := newCompletionApp(t, client, "x ", 0, 2)
+	a.Complete("")
+
+	a.handleKey(tcell.NewEventKey(tcell.KeyUp, 0, tcell.ModNone))
+	if a.completion.selected != 1 {
+		t.Fatalf("expected Up to wrap to the last item got %d", a.completion.selected)
+	}
+	a.handleKey(tcell.NewEventKey(tcell.KeyDown, 0, tcell.ModNone))
+	a.handleKey(tcell.NewEventKey(tcell.KeyDown, 0, tcell.ModNone))
+	a.handleKey(tcell.NewEventKey(tcell.KeyTab, 0, tcell.ModNone))
+	view := a.GetCurrentView()
+	if got := view.Buffer().Contents().String(); got != "x two" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	if row, col := view.Cursor(); row != 0 || col != 5 {
+		t.Fatalf("expected the cursor after the completion got %d,%d", row, col)
+	}
+
+	a.Complete("")
+	a.handleKey(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone))
+	if a.completion != nil {
+		t.Fatalf("expected Escape to close the menu")
+	}
+	if got := view.Buffer().Contents().String(); got != "x two" {
+		t.Fatalf("expected Escape to change nothing, got %q", got)
+	}
+}
+
+func TestAcceptCompletion(t *testing.T) {
+	client := &fakeLSPClient{completions: []lsp.CompletionItem{{
+		Label:      "Println",
+		FilterText: "Println",
+		Edit: &lsp.TextEdit{
+			Start: lsp.Position{Line: 3, Offset: 5},
+			End:   lsp.Position{Line: 3, Offset: 7},
+			Text:  "Println(${1:a})$0",
+		},
+		InsertText: "Println(${1:a})$0",
+		Snippet:    true,
+		AdditionalEdits: []lsp.TextEdit{{
+			Start: lsp.Position{Line: 2, Offset: 0},
+			End:   lsp.Position{Line: 2, Offset: 0},
+			Text:  "import \"fmt\"\n\n",
+		}},
+	}}}
+	a := newCompletionApp(t, client, "package main\n\nfunc f() {\n\tfmt.Pr\n}\n", 3, 10)
+	view := a.GetCurrentView()
+	buffer := view.Buffer()
+	a.Complete("")
+
+	// Text typed after the request is replaced too
+	typeRunes(a, "i")
+	a.handleKey(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone))
+	want := "package main\n\nimport \"fmt\"\n\nfunc f() {\n\tfmt.Println(a)\n}\n"
+	if got := buffer.Contents().String(); got != want {
+		t.Fatalf("unexpected contents %q", got)
+	}
+
+	// The placeholder is selected
+	if row, col := view.Cursor(); row != 5 || col != 17 {
+		t.Fatalf("expected the cursor after the placeholder got %d,%d", row, col)
+	}
+	if sel := view.Selections(); len(sel) != 1 || sel[0] != (Selection{StartRow: 5, StartCol: 16, EndRow: 5, EndCol: 17}) {
+		t.Fatalf("expected the placeholder selected got %v", sel)
+	}
+
+	// Tab moves to the final stop and stops moving between them
+	a.handleKey(tcell.NewEventKey(tcell.KeyTab, 0, tcell.ModNone))
+	if row, col := view.Cursor(); row != 5 || col != 18 {
+		t.Fatalf("expected the cursor at the end got %d,%d", row, col)
+	}
+	if a.snippet != nil {
+		t.Fatalf("expected the snippet finished")
+	}
+
+	// The completion is undone in one step
+	buffer.Undo()
+	if got := buffer.Contents().String(); got != "package main\n\nfunc f() {\n\tfmt.Pri\n}\n" {
+		t.Fatalf("unexpected contents after undo %q", got)
+	}
+}
+
+func TestCompletionTriggerCharacter(t *testing.T) {
+	client := &fakeLSPClient{
+		completions: []lsp.CompletionItem{{Label: "Println", FilterText: "Println", InsertText: "Println"}},
+		triggers:    []string{"."},
+	}
+	a := newCompletionApp(t, client, "fmt", 0, 3)
+
+	typeRunes(a, ".")
+	if got := client.positions; len(got) != 1 || got[0] != (lsp.Position{Line: 0, Offset: 4}) {
+		t.Fatalf("expected a request after the trigger got %v", got)
+	}
+	if got := menuLabels(a); len(got) != 1 {
+		t.Fatalf("expected the menu open got %v", got)
+	}
+	if a.completion.start != 4 {
+		t.Fatalf("expected completion to start after the trigger got %d", a.completion.start)
+	}
+}
+
+func TestCompletionMenuDraw(t *testing.T) {
+	client := &fakeLSPClient{completions: []lsp.CompletionItem{
+		{Label: "Println", Kind: protocol.CompletionItemKindFunction, Detail: "func(a ...any)", FilterText: "Println", InsertText: "Println"},
+		{Label: "Stdout", Kind: protocol.CompletionItemKindVariable, FilterText: "Stdout", InsertText: "Stdout"},
+	}}
+	a := newCompletionApp(t, client, "    fmt.", 0, 8)
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(60, 10)
+	a.screen = screen
+	a.statusBar.SetScreen(screen)
+	a.tabBar.SetScreen(screen)
+	a.layoutViews()
+
+	a.Complete("")
+	finishBackground(a)
+	a.draw()
+	screen.Show()
+
+	// The labels line up with the text being completed
+	x := a.GetCurrentView().GutterWidth() + 8
+	row := screenRow(screen, 3)
+	if i := strings.Index(row, "Println"); utf8.RuneCountInString(row[:max(0, i)]) != x {
+		t.Fatalf("expected the label at column %d got %q", x, row)
+	}
+	if !strings.Contains(row, "func Println func(a ...any)") {
+		t.Fatalf("expected the kind and detail got %q", row)
+	}
+	if row := screenRow(screen, 4); !strings.Contains(row, "var  Stdout") {
+		t.Fatalf("unexpected second row %q", row)
+	}
+}
+
+func TestCommandComplete(t *testing.T) {
+	d := &dummyApp{}
+	if _, err := (&CommandComplete{}).Execute(d, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.trigger == nil || *d.trigger != "" {
+		t.Fatalf("expected completion requested by the user")
+	}
+}
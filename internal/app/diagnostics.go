@@ -0,0 +1,145 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"go.lsp.dev/protocol"
+
+	"tked/internal/lsp"
+)
+
+// diagnosticGutterWidth is the width of the gutter that shows which rows have
+// diagnostics: a marker and a space.
+const diagnosticGutterWidth = 2
+
+// diagnosticStyle returns the style diagnostics of a severity are drawn in.
+func diagnosticStyle(severity protocol.DiagnosticSeverity) tcell.Style {
+	style := tcell.StyleDefault
+	switch severity {
+	case protocol.DiagnosticSeverityError:
+		return style.Foreground(tcell.ColorRed)
+	case protocol.DiagnosticSeverityWarning:
+		return style.Foreground(tcell.ColorYellow)
+	case protocol.DiagnosticSeverityInformation:
+		return style.Foreground(tcell.ColorBlue)
+	}
+	return style.Foreground(tcell.ColorGray)
+}
+
+// diagnosticMarkers are the gutter markers for each severity.
+var diagnosticMarkers = map[protocol.DiagnosticSeverity]rune{
+	protocol.DiagnosticSeverityError:       'E',
+	protocol.DiagnosticSeverityWarning:     'W',
+	protocol.DiagnosticSeverityInformation: 'I',
+	protocol.DiagnosticSeverityHint:        'H',
+}
+
+// diagnosticSpans are the parts of a buffer covered by diagnostics, worked out
+// once each time a view is drawn.
+type diagnosticSpans struct {
+	spans []diagnosticSpan
+	// rows holds the most severe diagnostic starting on each row.
+	rows map[int]protocol.DiagnosticSeverity
+}
+
+// diagnosticSpan is the byte range of the buffer a diagnostic covers.
+type diagnosticSpan struct {
+	start, end int
+	severity   protocol.DiagnosticSeverity
+}
+
+func newDiagnosticSpans(buffer Buffer, diagnostics []lsp.Diagnostic) diagnosticSpans {
+	d := diagnosticSpans{rows: map[int]protocol.DiagnosticSeverity{}}
+	for _, diag := range diagnostics {
+		start := indexForLSPPosition(buffer, diag.Start)
+		// Diagnostics for an empty range mark the character they are at
+		end := max(start+1, indexForLSPPosition(buffer, diag.End))
+		d.spans = append(d.spans, diagnosticSpan{start: start, end: end, severity: diag.Severity})
+		if s, ok := d.rows[diag.Start.Line]; !ok || diag.Severity < s {
+			d.rows[diag.Start.Line] = diag.Severity
+		}
+	}
+	return d
+}
+
+// at returns the severity of the most severe diagnostic covering idx.
+func (d diagnosticSpans) at(idx int) (protocol.DiagnosticSeverity, bool) {
+	var severity protocol.DiagnosticSeverity
+	found := false
+	for _, s := range d.spans {
+		if idx >= s.start && idx < s.end && (!found || s.severity < severity) {
+			severity = s.severity
+			found = true
+		}
+	}
+	return severity, found
+}
+
+// marker returns the gutter marker for a row.
+func (d diagnosticSpans) marker(row int) (rune, tcell.Style) {
+	severity, ok := d.rows[row]
+	if !ok {
+		return ' ', tcell.StyleDefault
+	}
+	return diagnosticMarkers[severity], diagnosticStyle(severity).Bold(true)
+}
+
+// indexForLSPPosition returns the byte index in the buffer of a position
+// reported by a language server.
+func indexForLSPPosition(buffer Buffer, pos lsp.Position) int {
+	start, _ := buffer.IndexForRow(pos.Line)
+	return min(start+pos.Offset, buffer.Contents().Len())
+}
+
+// cursorLSPPosition returns the position of the view's cursor in the form
+// the language server client takes.
+func cursorLSPPosition(v View) lsp.Position {
+	row, col := v.Cursor()
+	return lspPosition(v.Buffer(), row, col)
+}
+
+// cursorDiagnostic returns the diagnostic to describe on the status bar for
+// the view's cursor: the one under the cursor, or else the first on its row.
+func cursorDiagnostic(v View) (lsp.Diagnostic, bool) {
+	row, col := v.Cursor()
+	idx := indexForPosition(v.Buffer(), row, col)
+	var found lsp.Diagnostic
+	ok := false
+	for _, d := range v.Diagnostics() {
+		if row < d.Start.Line || row > d.End.Line {
+			continue
+		}
+		start := indexForLSPPosition(v.Buffer(), d.Start)
+		end := indexForLSPPosition(v.Buffer(), d.End)
+		if idx >= start && idx <= end {
+			return d, true
+		}
+		if !ok {
+			found, ok = d, true
+		}
+	}
+	return found, ok
+}
+
+// diagnosticItems returns a line describing each diagnostic, for the
+// diagnostics list.
+func diagnosticItems(diagnostics []lsp.Diagnostic) []string {
+	items := make([]string, len(diagnostics))
+	for i, d := range diagnostics {
+		source := ""
+		if d.Source != "" {
+			source = " (" + d.Source + ")"
+		}
+		items[i] = fmt.Sprintf("%d:%d %s: %s%s", d.Start.Line+1, d.Start.Offset+1,
+			strings.ToLower(d.Severity.String()), firstLine(d.Message), source)
+	}
+	return items
+}
+
+// firstLine returns the first line of s.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -0,0 +1,289 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+	"go.lsp.dev/protocol"
+
+	"tked/internal/lsp"
+	"tked/internal/rope"
+)
+
+// fakeLSPClient is a language server client that records what it is sent and
+// returns canned results.
+type fakeLSPClient struct {
+	changes     []lsp.Change
+	closed      []string
+	diagnostics []lsp.Diagnostic
+	hover       string
+	signature   *lsp.Signature
+	locations   map[string][]lsp.Location
+	completions []lsp.CompletionItem
+	triggers    []string
+	target      *lsp.RenameTarget
+	targetErr   error
+	rename      *lsp.WorkspaceEdit
+	newNames    []string
+	formatting  []lsp.TextEdit
+	formatted   []string
+	actions     []lsp.CodeAction
+	commands    []string
+	commandErr  error
+	symbols     []lsp.Symbol
+	queries     []string
+	tokens      []lsp.SemanticToken
+	err         error
+	// positions are the positions requests were made for. mu guards them, as
+	// requests are made in the background.
+	mu        sync.Mutex
+	positions []lsp.Position
+	// tokenUpdates counts the requests for semantic tokens.
+	tokenUpdates int
+}
+
+// record records the positions a request was made for.
+func (f *fakeLSPClient) record(positions ...lsp.Position) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.positions = append(f.positions, positions...)
+}
+
+func (f *fakeLSPClient) DidChange(_ string, _ int32, change lsp.Change) {
+	f.changes = append(f.changes, change)
+}
+func (f *fakeLSPClient) Flush(string)                        {}
+func (f *fakeLSPClient) DidClose(filename string)            { f.closed = append(f.closed, filename) }
+func (f *fakeLSPClient) DidOpen(string, int32, rope.Rope)    {}
+func (f *fakeLSPClient) Diagnostics(string) []lsp.Diagnostic { return f.diagnostics }
+func (f *fakeLSPClient) Hover(_ context.Context, _ string, pos lsp.Position) (string, error) {
+	f.record(pos)
+	return f.hover, f.err
+}
+func (f *fakeLSPClient) SignatureHelp(_ context.Context, _ string, pos lsp.Position) (*lsp.Signature, error) {
+	f.record(pos)
+	return f.signature, f.err
+}
+func (f *fakeLSPClient) Definition(_ context.Context, _ string, pos lsp.Position) ([]lsp.Location, error) {
+	return f.lookup("definition", pos)
+}
+func (f *fakeLSPClient) Declaration(_ context.Context, _ string, pos lsp.Position) ([]lsp.Location, error) {
+	return f.lookup("declaration", pos)
+}
+func (f *fakeLSPClient) TypeDefinition(_ context.Context, _ string, pos lsp.Position) ([]lsp.Location, error) {
+	return f.lookup("typeDefinition", pos)
+}
+func (f *fakeLSPClient) Implementation(_ context.Context, _ string, pos lsp.Position) ([]lsp.Location, error) {
+	return f.lookup("implementation", pos)
+}
+func (f *fakeLSPClient) References(_ context.Context, _ string, pos lsp.Position, _ bool) ([]lsp.Location, error) {
+	return f.lookup("references", pos)
+}
+func (f *fakeLSPClient) lookup(kind string, pos lsp.Position) ([]lsp.Location, error) {
+	f.record(pos)
+	return f.locations[kind], f.err
+}
+func (f *fakeLSPClient) Completion(_ context.Context, _ string, pos lsp.Position, _ string) ([]lsp.CompletionItem, error) {
+	f.record(pos)
+	return f.completions, f.err
+}
+func (f *fakeLSPClient) CompletionTriggers() []string { return f.triggers }
+func (f *fakeLSPClient) PrepareRename(_ context.Context, _ string, pos lsp.Position) (*lsp.RenameTarget, error) {
+	f.record(pos)
+	return f.target, f.targetErr
+}
+func (f *fakeLSPClient) Rename(_ context.Context, _ string, pos lsp.Position, newName string) (*lsp.WorkspaceEdit, error) {
+	f.newNames = append(f.newNames, newName)
+	return f.rename, f.err
+}
+func (f *fakeLSPClient) Format(_ context.Context, filename string, _ lsp.FormatOptions) ([]lsp.TextEdit, error) {
+	f.formatted = append(f.formatted, filename)
+	return f.formatting, f.err
+}
+func (f *fakeLSPClient) FormatRange(_ context.Context, filename string, start, end lsp.Position, _ lsp.FormatOptions) ([]lsp.TextEdit, error) {
+	f.formatted = append(f.formatted, filename)
+	f.record(start, end)
+	return f.formatting, f.err
+}
+func (f *fakeLSPClient) CodeActions(_ context.Context, _ string, start, end lsp.Position) ([]lsp.CodeAction, error) {
+	f.record(start, end)
+	return f.actions, f.err
+}
+func (f *fakeLSPClient) ExecuteCommand(command *protocol.Command, done func(error)) {
+	f.commands = append(f.commands, command.Command)
+	done(f.commandErr)
+}
+func (f *fakeLSPClient) DocumentSymbols(context.Context, string) ([]lsp.Symbol, error) {
+	return f.symbols, f.err
+}
+func (f *fakeLSPClient) WorkspaceSymbols(_ context.Context, _ string, query string) ([]lsp.Symbol, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, query)
+	return f.symbols, f.err
+}
+func (f *fakeLSPClient) SemanticTokens(string) []lsp.SemanticToken { return f.tokens }
+func (f *fakeLSPClient) UpdateSemanticTokens(context.Context, string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokenUpdates++
+	return f.err
+}
+func (f *fakeLSPClient) semanticTokenUpdates() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tokenUpdates
+}
+func (f *fakeLSPClient) ServerTextDocumentSyncOptions() protocol.TextDocumentSyncOptions {
+	return protocol.TextDocumentSyncOptions{}
+}
+
+// withFakeLSP makes client the language server client for every named file
+// until the test ends.
+func withFakeLSP(t *testing.T, client *fakeLSPClient) {
+	old, oldDocument, oldHas := getLSP, documentLSP, hasServers
+	getLSP = func(filename string) lsp.LSPClient {
+		if filename == "" {
+			return nil
+		}
+		return client
+	}
+	documentLSP = getLSP
+	hasServers = func(filename string) bool { return filename != "" }
+	t.Cleanup(func() { getLSP, documentLSP, hasServers = old, oldDocument, oldHas })
+}
+
+func TestGutterWidth(t *testing.T) {
+	withFakeLSP(t, &fakeLSPClient{})
+	v := NewView("a.go", rope.NewRope("abc"))
+	if w := v.GutterWidth(); w != diagnosticGutterWidth {
+		t.Fatalf("expected a gutter got %d", w)
+	}
+
+	// The gutter is kept while the server isn't running, so the text
+	// doesn't move
+	getLSP = func(string) lsp.LSPClient { return nil }
+	if w := v.GutterWidth(); w != diagnosticGutterWidth {
+		t.Fatalf("expected the gutter kept got %d", w)
+	}
+
+	// Files without servers have none
+	hasServers = func(string) bool { return false }
+	if w := v.GutterWidth(); w != 0 {
+		t.Fatalf("expected no gutter got %d", w)
+	}
+}
+
+func TestViewDrawDiagnostics(t *testing.T) {
+	client := &fakeLSPClient{diagnostics: []lsp.Diagnostic{
+		{Start: lsp.Position{Line: 1, Offset: 1}, End: lsp.Position{Line: 1, Offset: 3}, Severity: protocol.DiagnosticSeverityError, Message: "bad"},
+	}}
+	withFakeLSP(t, client)
+
+	v := NewView("a.go", rope.NewRope("abc\ndef"))
+	v.Resize(3, 10)
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(10, 3)
+	v.Draw(screen, 0, 0)
+	screen.Show()
+
+	// The text is drawn after the gutter, which marks the row
+	if ch, _, _, _ := screen.GetContent(0, 0); ch != ' ' {
+		t.Fatalf("expected empty gutter on row 0 got %q", ch)
+	}
+	if ch, _, _, _ := screen.GetContent(0, 1); ch != 'E' {
+		t.Fatalf("expected error marker on row 1 got %q", ch)
+	}
+	if ch, _, _, _ := screen.GetContent(diagnosticGutterWidth, 0); ch != 'a' {
+		t.Fatalf("expected text after the gutter got %q", ch)
+	}
+
+	// Only the diagnostic's range is underlined
+	for col, want := range []bool{false, true, true} {
+		_, _, style, _ := screen.GetContent(diagnosticGutterWidth+col, 1)
+		if got := styleUnderlined(style); got != want {
+			t.Fatalf("col %d: expected underline %v", col, want)
+		}
+	}
+}
+
+func TestStatusBarShowsDiagnostic(t *testing.T) {
+	withFakeLSP(t, &fakeLSPClient{diagnostics: []lsp.Diagnostic{
+		{Start: lsp.Position{Line: 0, Offset: 0}, End: lsp.Position{Line: 0, Offset: 1}, Severity: protocol.DiagnosticSeverityWarning, Message: "careful\nmore"},
+	}})
+
+	v := NewView("a.go", rope.NewRope("abc\ndef"))
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(40, 2)
+	sb := NewStatusBar()
+	sb.SetScreen(screen)
+	sb.Draw(v)
+	screen.Show()
+
+	cells, width, _ := screen.GetContents()
+	line := ""
+	for _, c := range cells[width : 2*width] {
+		line += string(c.Runes)
+	}
+	if want := "a.go: 1 1  careful"; line[:len(want)] != want {
+		t.Fatalf("expected %q on the status bar got %q", want, line)
+	}
+}
+
+func TestCommandDiagnostic(t *testing.T) {
+	withFakeLSP(t, &fakeLSPClient{diagnostics: []lsp.Diagnostic{
+		{Start: lsp.Position{Line: 0, Offset: 2}, Severity: protocol.DiagnosticSeverityError},
+		{Start: lsp.Position{Line: 2, Offset: 1}, Severity: protocol.DiagnosticSeverityHint},
+	}})
+	v := NewView("a.go", rope.NewRope("abc\ndef\nghi"))
+	d := &dummyApp{view: v, sb: &inputStatusBar{}}
+
+	next := &CommandDiagnostic{delta: 1}
+	prev := &CommandDiagnostic{delta: -1}
+	steps := []struct {
+		cmd      Command
+		row, col int
+	}{
+		{next, 0, 2},
+		{next, 2, 1},
+		{next, 0, 2}, // wraps around
+		{prev, 2, 1}, // and back
+		{prev, 0, 2},
+	}
+	for i, s := range steps {
+		if _, err := s.cmd.Execute(d, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if row, col := v.Cursor(); row != s.row || col != s.col {
+			t.Fatalf("step %d: expected cursor %d,%d got %d,%d", i, s.row, s.col, row, col)
+		}
+	}
+}
+
+func TestCommandDiagnosticNone(t *testing.T) {
+	withFakeLSP(t, &fakeLSPClient{})
+	sb := &inputStatusBar{}
+	d := &dummyApp{view: NewView("a.go", rope.NewRope("abc")), sb: sb}
+	(&CommandDiagnosticList{}).Execute(d, nil)
+	if len(sb.messages) != 1 || sb.messages[0] != "No diagnostics" {
+		t.Fatalf("expected no diagnostics message got %v", sb.messages)
+	}
+}
+
+func TestDiagnosticItems(t *testing.T) {
+	items := diagnosticItems([]lsp.Diagnostic{
+		{Start: lsp.Position{Line: 4, Offset: 2}, Severity: protocol.DiagnosticSeverityWarning, Source: "vet", Message: "unused\ndetails"},
+	})
+	if len(items) != 1 || items[0] != "5:3 warning: unused (vet)" {
+		t.Fatalf("unexpected items %q", items)
+	}
+}
+
+func styleUnderlined(style tcell.Style) bool {
+	_, _, attrs := style.Decompose()
+	return attrs&tcell.AttrUnderline != 0
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"fmt"
+	"slices"
+
+	"tked/internal/lsp"
+)
+
+// indexEdit replaces the text between the byte indexes start and end in a
+// buffer with text.
+type indexEdit struct {
+	start, end int
+	text       string
+}
+
+// indexEdits converts edits from a language server to byte indexes in the
+// buffer.
+func indexEdits(buffer Buffer, edits []lsp.TextEdit) []indexEdit {
+	out := make([]indexEdit, len(edits))
+	for i, e := range edits {
+		out[i] = indexEdit{
+			start: indexForLSPPosition(buffer, e.Start),
+			end:   indexForLSPPosition(buffer, e.End),
+			text:  e.Text,
+		}
+	}
+	return out
+}
+
+// applyIndexEdits makes edits to a buffer as a single undo step. The edits'
+// indexes are all in the contents before any of them are made, and they must
+// not overlap. Insertions at the same index are made in the order given, before
+// the text of an edit replacing text there.
+func applyIndexEdits(buffer Buffer, edits []indexEdit) {
+	// Working from the end of the buffer keeps the earlier indexes valid.
+	// Of the edits at the same index, one replacing text is made before the
+	// insertions, which would otherwise be deleted with it, and insertions
+	// are made last first, so each is inserted before the text of the ones
+	// after it.
+	order := make([]int, len(edits))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		if edits[a].start != edits[b].start {
+			return edits[b].start - edits[a].start
+		}
+		if edits[a].end != edits[b].end {
+			return edits[b].end - edits[a].end
+		}
+		return b - a
+	})
+
+	buffer.BeginEdit()
+	defer buffer.EndEdit()
+	for _, i := range order {
+		e := edits[i]
+		if e.end > e.start {
+			buffer.Delete(e.start, e.end)
+		}
+		if e.text != "" {
+			buffer.Insert(e.start, e.text)
+		}
+	}
+}
+
+// applyViewEdits makes edits to a view's buffer as a single undo step, like
+// applyIndexEdits, moving the cursor, anchor and selections to follow the
+// text they were at.
+func applyViewEdits(view View, edits []indexEdit) {
+	buffer := view.Buffer()
+	row, col := view.Cursor()
+	marks := []int{indexForPosition(buffer, row, col)}
+	aRow, aCol, hasAnchor := view.Anchor()
+	if hasAnchor {
+		marks = append(marks, indexForPosition(buffer, aRow, aCol))
+	}
+	selections := view.Selections()
+	for _, s := range selections {
+		marks = append(marks, indexForPosition(buffer, s.StartRow, s.StartCol), indexForPosition(buffer, s.EndRow, s.EndCol))
+	}
+
+	change := buffer.OnChange(func(_ Buffer, ev ChangeEvent, _ any) {
+		for i := range marks {
+			marks[i] = shiftIndex(marks[i], ev, false)
+		}
+	}, nil)
+	applyIndexEdits(buffer, edits)
+	change.Remove()
+
+	view.SetCursor(positionForIndex(buffer, marks[0]))
+	marks = marks[1:]
+	if hasAnchor {
+		view.SetAnchor(positionForIndex(buffer, marks[0]))
+		marks = marks[1:]
+	}
+	for i := range selections {
+		startRow, startCol := positionForIndex(buffer, marks[2*i])
+		endRow, endCol := positionForIndex(buffer, marks[2*i+1])
+		selections[i] = Selection{StartRow: startRow, StartCol: startCol, EndRow: endRow, EndCol: endCol}
+	}
+	if selections != nil {
+		view.SetSelections(selections)
+	}
+}
+
+func (a *app) ApplyWorkspaceEdit(edit *lsp.WorkspaceEdit) error {
+	current := a.GetCurrentView()
+	defer func() {
+		if slices.Contains(a.views, current) {
+			a.SetCurrentView(current)
+		}
+	}()
+
+	// Open every file first, so nothing is changed if one can't be
+	views := make([]View, len(edit.Files))
+	for i, file := range edit.Files {
+		view := a.viewForFile(file.Filename)
+		if view == nil {
+			if err := a.OpenFile(file.Filename); err != nil {
+				return err
+			}
+			view = a.GetCurrentView()
+			a.layoutViews()
+		}
+		if file.Version != nil && *file.Version != view.Buffer().GetVersion() {
+			return fmt.Errorf("%s has changed since the edit was made", displayFilename(file.Filename))
+		}
+		views[i] = view
+	}
+
+	for i, file := range edit.Files {
+		applyViewEdits(views[i], indexEdits(views[i].Buffer(), file.Edits))
+	}
+	return nil
+}
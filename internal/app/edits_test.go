@@ -0,0 +1,157 @@
+package app
+
+import (
+	"testing"
+
+	"tked/internal/lsp"
+	"tked/internal/rope"
+)
+
+func TestApplyIndexEdits(t *testing.T) {
+	tests := []struct {
+		contents string
+		edits    []indexEdit
+		want     string
+	}{
+		{"one two three", []indexEdit{{0, 3, "1"}, {8, 13, "3"}, {4, 4, "a"}, {4, 4, "b"}}, "1 abtwo 3"},
+		// Text replaced at an index doesn't take the insertions there with it
+		{"abcdef", []indexEdit{{1, 3, ""}, {1, 1, "X"}}, "aXdef"},
+		{"abcdef", []indexEdit{{1, 1, "X"}, {1, 3, "Y"}, {1, 1, "Z"}}, "aXZYdef"},
+	}
+	for _, test := range tests {
+		b := NewBuffer("", rope.NewRope(test.contents))
+		applyIndexEdits(b, test.edits)
+		if got := b.Contents().String(); got != test.want {
+			t.Fatalf("edits %v on %q expected %q got %q", test.edits, test.contents, test.want, got)
+		}
+
+		// The edits are undone together
+		b.Undo()
+		if got := b.Contents().String(); got != test.contents {
+			t.Fatalf("expected one undo step got %q", got)
+		}
+	}
+}
+
+func TestIndexEdits(t *testing.T) {
+	b := NewBuffer("", rope.NewRope("ab\ncd\n"))
+	edits := indexEdits(b, []lsp.TextEdit{
+		{Start: lsp.Position{Line: 1, Offset: 1}, End: lsp.Position{Line: 1, Offset: 2}, Text: "x"},
+		{Start: lsp.Position{Line: 5, Offset: 0}, End: lsp.Position{Line: 5, Offset: 0}, Text: "y"},
+	})
+	if edits[0] != (indexEdit{start: 4, end: 5, text: "x"}) {
+		t.Fatalf("unexpected edit %+v", edits[0])
+	}
+	// Positions past the end are clamped
+	if edits[1] != (indexEdit{start: 6, end: 6, text: "y"}) {
+		t.Fatalf("unexpected edit %+v", edits[1])
+	}
+}
+
+func TestApplyViewEdits(t *testing.T) {
+	ResetApp()
+	NewApp()
+	v := NewView("", rope.NewRope("func f() {\nreturn x\n}"))
+	v.SetCursor(1, 7)
+	v.SetSelections([]Selection{{StartRow: 1, StartCol: 0, EndRow: 1, EndCol: 6}})
+	applyViewEdits(v, []indexEdit{{start: 11, end: 11, text: "\t"}, {start: 0, end: 0, text: "// f\n"}})
+
+	if got := v.Buffer().Contents().String(); got != "// f\nfunc f() {\n\treturn x\n}" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	if row, col := v.Cursor(); row != 2 || col != 7+4 {
+		t.Fatalf("expected the cursor to follow its text got %d,%d", row, col)
+	}
+	if sel := v.Selections(); len(sel) != 1 || sel[0] != (Selection{StartRow: 2, StartCol: 4, EndRow: 2, EndCol: 10}) {
+		t.Fatalf("expected the selection to follow its text got %v", sel)
+	}
+
+	// Undo puts the cursor back too
+	v.Buffer().Undo()
+	if row, col := v.Cursor(); row != 1 || col != 7 {
+		t.Fatalf("expected the cursor restored got %d,%d", row, col)
+	}
+}
+
+func TestApplyWorkspaceEdit(t *testing.T) {
+	a, fileA, fileB := newNavigationApp(t)
+	a.OpenFile(fileA)
+	viewA := a.GetCurrentView()
+
+	edit := &lsp.WorkspaceEdit{Files: []lsp.FileEdit{
+		{Filename: fileA, Edits: []lsp.TextEdit{
+			{Start: lsp.Position{Line: 0, Offset: 0}, End: lsp.Position{Line: 0, Offset: 3}, Text: "ONE"},
+			{Start: lsp.Position{Line: 2, Offset: 0}, End: lsp.Position{Line: 2, Offset: 1}, Text: "T"},
+		}},
+		{Filename: fileB, Edits: []lsp.TextEdit{
+			{Start: lsp.Position{Line: 1, Offset: 0}, End: lsp.Position{Line: 1, Offset: 4}, Text: "FIVE"},
+		}},
+	}}
+	if err := a.ApplyWorkspaceEdit(edit); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The file that wasn't open is opened, and the current view is kept
+	if len(a.Views()) != 2 || a.GetCurrentView() != viewA {
+		t.Fatalf("expected %s opened behind the current view", fileB)
+	}
+	if got := viewA.Buffer().Contents().String(); got != "ONE\ntwo\nThree" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	viewB := a.viewForFile(fileB)
+	if got := viewB.Buffer().Contents().String(); got != "\tfour\nFIVE" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+
+	// Each buffer's edits are undone in one step
+	viewA.Buffer().Undo()
+	if got := viewA.Buffer().Contents().String(); got != "one\ntwo\nthree" {
+		t.Fatalf("expected one undo step got %q", got)
+	}
+
+	// Edits for another version of a document aren't made
+	version := viewB.Buffer().GetVersion() - 1
+	edit = &lsp.WorkspaceEdit{Files: []lsp.FileEdit{{Filename: fileB, Version: &version, Edits: []lsp.TextEdit{{Text: "x"}}}}}
+	if err := a.ApplyWorkspaceEdit(edit); err == nil {
+		t.Fatalf("expected an error for an old version")
+	}
+	if got := viewB.Buffer().Contents().String(); got != "\tfour\nFIVE" {
+		t.Fatalf("expected nothing changed got %q", got)
+	}
+}
+
+func TestCommandRename(t *testing.T) {
+	client := &fakeLSPClient{targetErr: lsp.ErrNotSupported}
+	withFakeLSP(t, client)
+	v := NewView("a.go", rope.NewRope("x := count + 1"))
+	v.SetCursor(0, 7)
+	sb := &inputStatusBar{input: "total"}
+	d := &dummyApp{view: v, sb: sb}
+
+	// Without prepareRename the word at the cursor is suggested
+	client.rename = &lsp.WorkspaceEdit{Files: []lsp.FileEdit{{Filename: "a.go", Edits: []lsp.TextEdit{{}}}}}
+	if _, err := (&CommandRename{}).Execute(d, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sb.initial != "count" {
+		t.Fatalf("expected the word at the cursor suggested got %q", sb.initial)
+	}
+	if len(client.newNames) != 1 || client.newNames[0] != "total" || len(d.edits) != 1 || d.edits[0] != client.rename {
+		t.Fatalf("expected the rename applied got %v %v", client.newNames, d.edits)
+	}
+
+	// The server's placeholder is suggested
+	client.targetErr = nil
+	client.target = &lsp.RenameTarget{Placeholder: "cnt"}
+	(&CommandRename{}).Execute(d, nil)
+	if sb.initial != "cnt" {
+		t.Fatalf("expected the placeholder suggested got %q", sb.initial)
+	}
+
+	// Nothing to rename
+	client.target = nil
+	(&CommandRename{}).Execute(d, nil)
+	if len(client.newNames) != 2 || len(sb.messages) != 1 {
+		t.Fatalf("expected a message and no rename got %v %v", client.newNames, sb.messages)
+	}
+}
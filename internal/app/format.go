@@ -0,0 +1,68 @@
+package app
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"tked/internal/lsp"
+)
+
+// formatOnSaveTimeout is how long saving waits for the language server to
+// format a file before saving it as it is. Saving waits on the main
+// goroutine, so this is short, and servers that aren't ready aren't asked.
+const formatOnSaveTimeout = 500 * time.Millisecond
+
+// serverReady reports whether any of the language servers for a file is
+// ready to answer requests.
+func serverReady(filename string) bool {
+	return slices.ContainsFunc(serverStates(filename), func(s lsp.ServerStatus) bool {
+		return s.State == lsp.ServerReady
+	})
+}
+
+// lspPosition returns a row and column in the buffer in the form the language
+// server client takes.
+func lspPosition(buffer Buffer, row, col int) lsp.Position {
+	idxRowStart, row := buffer.IndexForRow(row)
+	return lsp.Position{Line: row, Offset: indexForPosition(buffer, row, col) - idxRowStart}
+}
+
+// formatRequest returns a request to client for the edits that format the
+// view's buffer, or only the selected text if there is a selection.
+func formatRequest(client lsp.LSPClient, view View, settings Settings) func(ctx context.Context) ([]lsp.TextEdit, error) {
+	buffer := view.Buffer()
+	filename := buffer.GetFilename()
+	options := lsp.FormatOptions{TabSize: settings.TabWidth()}
+
+	if sel := view.Selections(); len(sel) > 0 {
+		start := lspPosition(buffer, sel[0].StartRow, sel[0].StartCol)
+		end := lspPosition(buffer, sel[0].EndRow, sel[0].EndCol)
+		return func(ctx context.Context) ([]lsp.TextEdit, error) {
+			return client.FormatRange(ctx, filename, start, end, options)
+		}
+	}
+	return func(ctx context.Context) ([]lsp.TextEdit, error) {
+		return client.Format(ctx, filename, options)
+	}
+}
+
+// applyFormatting makes the edits that format a view's buffer. The changes
+// are undone as a single step, and the cursor and selections stay with the
+// text they were at.
+func applyFormatting(view View, edits []lsp.TextEdit) {
+	if len(edits) > 0 {
+		applyViewEdits(view, indexEdits(view.Buffer(), edits))
+	}
+}
+
+// formatView formats the view's buffer with client, or only the selected text
+// if there is a selection, waiting for the server's answer.
+func formatView(ctx context.Context, client lsp.LSPClient, view View, settings Settings) error {
+	edits, err := formatRequest(client, view, settings)(ctx)
+	if err != nil {
+		return err
+	}
+	applyFormatting(view, edits)
+	return nil
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"os"
+	"testing"
+
+	"tked/internal/lsp"
+	"tked/internal/rope"
+)
+
+func TestCommandFormat(t *testing.T) {
+	client := &fakeLSPClient{formatting: []lsp.TextEdit{
+		{Start: lsp.Position{Line: 0, Offset: 1}, End: lsp.Position{Line: 0, Offset: 3}, Text: " "},
+		{Start: lsp.Position{Line: 1, Offset: 0}, End: lsp.Position{Line: 1, Offset: 0}, Text: "\t"},
+	}}
+	a := newCompletionApp(t, client, "x  = 1\ny = 2\n", 1, 4)
+	view := a.GetCurrentView()
+	buffer := view.Buffer()
+
+	if _, err := (&CommandFormat{}).Execute(a, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := buffer.Contents().String(); got != "x = 1\n\ty = 2\n" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	if len(client.formatted) != 1 || len(client.positions) != 0 {
+		t.Fatalf("expected the whole buffer formatted got %v %v", client.formatted, client.positions)
+	}
+	// The cursor stays on the "2" after the inserted tab
+	if row, col := view.Cursor(); row != 1 || col != 8 {
+		t.Fatalf("expected the cursor to follow its text got %d,%d", row, col)
+	}
+
+	buffer.Undo()
+	if got := buffer.Contents().String(); got != "x  = 1\ny = 2\n" {
+		t.Fatalf("expected one undo step got %q", got)
+	}
+}
+
+func TestCommandFormatSelection(t *testing.T) {
+	client := &fakeLSPClient{formatting: []lsp.TextEdit{
+		{Start: lsp.Position{Line: 1, Offset: 1}, End: lsp.Position{Line: 1, Offset: 3}, Text: " "},
+	}}
+	a := newCompletionApp(t, client, "x  = 1\ny  = 2\n", 1, 6)
+	view := a.GetCurrentView()
+	view.SetAnchor(1, 0)
+	view.SetSelections([]Selection{{StartRow: 1, StartCol: 0, EndRow: 1, EndCol: 6}})
+
+	if _, err := (&CommandFormat{}).Execute(a, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []lsp.Position{{Line: 1, Offset: 0}, {Line: 1, Offset: 6}}
+	if got := client.positions; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected the selection formatted got %v", got)
+	}
+	if got := view.Buffer().Contents().String(); got != "x  = 1\ny = 2\n" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	if sel := view.Selections(); len(sel) != 1 || sel[0] != (Selection{StartRow: 1, StartCol: 0, EndRow: 1, EndCol: 5}) {
+		t.Fatalf("expected the selection to follow its text got %v", sel)
+	}
+}
+
+func TestCommandFormatNoServer(t *testing.T) {
+	sb := &inputStatusBar{}
+	d := &dummyApp{view: NewView("", rope.NewRope("x")), sb: sb}
+	if _, err := (&CommandFormat{}).Execute(d, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sb.messages) != 1 {
+		t.Fatalf("expected a message got %v", sb.messages)
+	}
+}
+
+func TestFormatOnSave(t *testing.T) {
+	client := &fakeLSPClient{formatting: []lsp.TextEdit{
+		{Start: lsp.Position{Line: 0, Offset: 1}, End: lsp.Position{Line: 0, Offset: 3}, Text: " "},
+	}}
+	a := newCompletionApp(t, client, "x  = 1\n", 0, 0)
+	view := a.GetCurrentView()
+	filename := view.Buffer().GetFilename()
+	old := serverStates
+	t.Cleanup(func() { serverStates = old })
+	state := lsp.ServerStarting
+	serverStates = func(string) []lsp.ServerStatus { return []lsp.ServerStatus{{Name: "gopls", State: state}} }
+
+	// Off unless set for the language
+	if err := view.Save(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.formatted) != 0 {
+		t.Fatalf("expected no formatting got %v", client.formatted)
+	}
+
+	// Or while the server isn't ready, so saving doesn't wait for it
+	a.settings.(*settings).languages = map[string]LanguageSettings{"go": {FormatOnSave: true}}
+	if err := view.Save(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.formatted) != 0 {
+		t.Fatalf("expected no formatting got %v", client.formatted)
+	}
+
+	state = lsp.ServerReady
+	if err := view.Save(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "x = 1\n" {
+		t.Fatalf("expected the formatted text saved got %q", data)
+	}
+
+	// A file is saved even if it can't be formatted
+	client.err = lsp.ErrNotSupported
+	view.Buffer().Insert(0, "y\n")
+	if err := view.Save(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "y\nx = 1\n" {
+		t.Fatalf("expected the file saved got %q", data)
+	}
+}
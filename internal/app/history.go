@@ -0,0 +1,468 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tked/internal/rope"
+)
+
+// Undo history is kept between sessions in a JSON file per file edited, in the
+// user's state directory. Only the edits that lead from one state to the next
+// are stored, along with a hash of the file contents they start from, so the
+// history is only restored if the file hasn't changed since.
+
+// historyVersion is the version of the history file format.
+const historyVersion = 1
+
+// historyFile is the stored form of a buffer's undo tree.
+type historyFile struct {
+	Version int    `json:"version"`
+	Path    string `json:"path"`
+	// Hash is the hash of the contents of the anchor state, which is the
+	// state that matches the file on disk.
+	Hash   string         `json:"hash"`
+	Anchor int            `json:"anchor"`
+	States []historyState `json:"states"`
+}
+
+// historyState is the stored form of a bufferContents.
+type historyState struct {
+	// Parent and Redo are indexes into the states, or -1 for none.
+	Parent int       `json:"parent"`
+	Redo   int       `json:"redo"`
+	Time   time.Time `json:"time"`
+	// Edits turn the parent's contents into this state's.
+	Edits      []historyEdit              `json:"edits,omitempty"`
+	Properties map[string]json.RawMessage `json:"properties,omitempty"`
+}
+
+// historyEdit is the stored form of an edit. Text is kept as bytes so that
+// files that aren't valid UTF-8 survive the round trip.
+type historyEdit struct {
+	Start    int    `json:"start"`
+	Removed  []byte `json:"removed,omitempty"`
+	Inserted []byte `json:"inserted,omitempty"`
+}
+
+// PropCodec converts the values of a buffer property to and from JSON, so that
+// they can be kept with the undo history between sessions.
+type PropCodec struct {
+	Encode func(value any) (json.RawMessage, error)
+	Decode func(data json.RawMessage) (any, error)
+}
+
+// persistentProp is a property registered with RegisterPersistentBufferProperty.
+type persistentProp struct {
+	key   propKey
+	name  string
+	codec PropCodec
+}
+
+var persistentProps []persistentProp
+
+// RegisterPersistentBufferProperty registers a property like
+// RegisterBufferProperty, whose values are also kept with the undo history
+// between sessions under the given name.
+func RegisterPersistentBufferProperty(name string, codec PropCodec) PropKey {
+	key := RegisterBufferProperty().(propKey)
+	persistentProps = append(persistentProps, persistentProp{key: key, name: name, codec: codec})
+	return key
+}
+
+// undoHistorySettings returns the current undo history settings.
+func undoHistorySettings() UndoHistorySettings {
+	if theApp == nil {
+		return DefaultUndoHistorySettings
+	}
+	return GetApp().Settings().UndoHistory()
+}
+
+// historyDir returns the directory undo history is kept in, following the XDG
+// base directory specification.
+func historyDir() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "tked", "history"), nil
+}
+
+// historyPath returns the absolute path of filename and the path of the file
+// its undo history is kept in.
+func historyPath(filename string) (string, string, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", "", err
+	}
+	dir, err := historyDir()
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return abs, filepath.Join(dir, hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// hashRope returns the hash of the contents of a rope.
+func hashRope(r rope.Rope) string {
+	h := sha256.New()
+	r.Write(h)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ropeHash is the hash of a rope's contents, kept so that it isn't worked out
+// again while the contents are the same.
+type ropeHash struct {
+	rope rope.Rope
+	hash string
+}
+
+// of returns the hash of the contents of r, reusing the one kept if it is
+// for r.
+func (h *ropeHash) of(r rope.Rope) string {
+	if h.rope != r || h.hash == "" {
+		h.rope, h.hash = r, hashRope(r)
+	}
+	return h.hash
+}
+
+// pruneStates returns the states to keep so that there are at most maxStates,
+// in the order they were created. The oldest states are dropped first, but
+// only from the ends of the tree so that it stays connected, and the anchor is
+// always kept.
+func pruneStates(states []*bufferContents, anchor *bufferContents, maxStates int) []*bufferContents {
+	keep := make(map[*bufferContents]bool, len(states))
+	children := make(map[*bufferContents]int, len(states))
+	for _, s := range states {
+		keep[s] = true
+		if s.parent != nil {
+			children[s.parent]++
+		}
+	}
+
+	root := states[0]
+	for n := len(states); n > maxStates; n-- {
+		// States are in the order they were created, so the first one that can
+		// be removed is the oldest.
+		var oldest *bufferContents
+		for _, s := range states {
+			if keep[s] && s != anchor && (children[s] == 0 || (s == root && children[s] == 1)) {
+				oldest = s
+				break
+			}
+		}
+		if oldest == nil {
+			break
+		}
+
+		keep[oldest] = false
+		if oldest != root {
+			children[oldest.parent]--
+			continue
+		}
+		for _, s := range states {
+			if keep[s] && s.parent == root {
+				root = s
+				break
+			}
+		}
+	}
+
+	kept := make([]*bufferContents, 0, min(len(states), maxStates))
+	for _, s := range states {
+		if keep[s] {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// encodeHistory returns the stored form of the states. anchor must be one of
+// them, and any parent that isn't is treated as the root. hash is the hash of
+// the anchor's contents.
+func encodeHistory(path string, states []*bufferContents, anchor *bufferContents, hash string) (*historyFile, error) {
+	index := make(map[*bufferContents]int, len(states))
+	for i, s := range states {
+		index[s] = i
+	}
+	indexOf := func(s *bufferContents) int {
+		if i, ok := index[s]; ok {
+			return i
+		}
+		return -1
+	}
+
+	h := &historyFile{
+		Version: historyVersion,
+		Path:    path,
+		Hash:    hash,
+		Anchor:  index[anchor],
+		States:  make([]historyState, len(states)),
+	}
+	for i, s := range states {
+		hs := historyState{Parent: indexOf(s.parent), Redo: indexOf(s.redo), Time: s.time}
+		if hs.Parent != -1 {
+			for _, e := range s.edits {
+				hs.Edits = append(hs.Edits, historyEdit{Start: e.start, Removed: []byte(e.removed), Inserted: []byte(e.inserted)})
+			}
+		}
+		for _, pp := range persistentProps {
+			for _, pv := range s.properties {
+				if pv.key != pp.key || pv.value == nil {
+					continue
+				}
+				data, err := pp.codec.Encode(pv.value)
+				if err != nil {
+					return nil, err
+				}
+				if hs.Properties == nil {
+					hs.Properties = make(map[string]json.RawMessage)
+				}
+				hs.Properties[pp.name] = data
+			}
+		}
+		h.States[i] = hs
+	}
+	return h, nil
+}
+
+var errBadHistory = errors.New("undo history does not match the file")
+
+// decodeHistory rebuilds the states of an undo tree from its stored form,
+// starting from contents, which are the contents of the anchor state. It
+// returns the states in the order they were created.
+func decodeHistory(h *historyFile, contents rope.Rope) ([]*bufferContents, error) {
+	if h.Anchor < 0 || h.Anchor >= len(h.States) {
+		return nil, errBadHistory
+	}
+
+	states := make([]*bufferContents, len(h.States))
+	for i, hs := range h.States {
+		states[i] = &bufferContents{seq: i, time: hs.Time, dirty: i != h.Anchor, properties: []propValue{}}
+	}
+	for i, hs := range h.States {
+		s := states[i]
+		// Parents are always created before their children, and only the
+		// first state has no parent.
+		if (i == 0) != (hs.Parent == -1) || hs.Parent < -1 || hs.Parent >= i || hs.Redo < -1 || hs.Redo >= len(states) {
+			return nil, errBadHistory
+		}
+		if hs.Parent != -1 {
+			s.parent = states[hs.Parent]
+			s.parent.children = append(s.parent.children, s)
+		}
+		if hs.Redo != -1 {
+			s.redo = states[hs.Redo]
+		}
+		for _, e := range hs.Edits {
+			s.edits = append(s.edits, edit{start: e.Start, removed: string(e.Removed), inserted: string(e.Inserted)})
+		}
+		for _, pp := range persistentProps {
+			data, ok := hs.Properties[pp.name]
+			if !ok {
+				continue
+			}
+			value, err := pp.codec.Decode(data)
+			if err != nil {
+				return nil, err
+			}
+			s.properties = append(s.properties, propValue{key: pp.key, value: value})
+		}
+	}
+	for _, s := range states {
+		if s.redo != nil && s.redo.parent != s {
+			return nil, errBadHistory
+		}
+	}
+
+	// Work out the contents of every state by walking the tree out from the
+	// anchor, applying the edits forwards to move to a child and backwards to
+	// move to a parent.
+	states[h.Anchor].rope = contents
+	pending := []*bufferContents{states[h.Anchor]}
+	for len(pending) > 0 {
+		s := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if p := s.parent; p != nil && p.rope == nil {
+			r, ok := revertEdits(s.rope, s.edits)
+			if !ok {
+				return nil, errBadHistory
+			}
+			p.rope = r
+			pending = append(pending, p)
+		}
+		for _, c := range s.children {
+			if c.rope == nil {
+				r, ok := applyEdits(s.rope, c.edits)
+				if !ok {
+					return nil, errBadHistory
+				}
+				c.rope = r
+				pending = append(pending, c)
+			}
+		}
+	}
+	return states, nil
+}
+
+// applyEdits applies the edits to r. It returns false if the edits don't
+// match the contents of r.
+func applyEdits(r rope.Rope, edits []edit) (rope.Rope, bool) {
+	for _, e := range edits {
+		end := e.start + len(e.removed)
+		if e.start < 0 || end > r.Len() || r.Slice(e.start, end) != e.removed {
+			return nil, false
+		}
+		r = replace(r, e.start, end, e.inserted)
+	}
+	return r, true
+}
+
+// revertEdits undoes the edits applied to r. It returns false if the edits
+// don't match the contents of r.
+func revertEdits(r rope.Rope, edits []edit) (rope.Rope, bool) {
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		end := e.start + len(e.inserted)
+		if e.start < 0 || end > r.Len() || r.Slice(e.start, end) != e.inserted {
+			return nil, false
+		}
+		r = replace(r, e.start, end, e.removed)
+	}
+	return r, true
+}
+
+// saveHistory writes the undo tree of a buffer to the history store, keeping
+// it within the size limits in the settings. hash is the hash of the anchor's
+// contents. A tree of a single state has no history worth keeping, and isn't
+// written.
+func saveHistory(filename string, states []*bufferContents, anchor *bufferContents, hash string, settings UndoHistorySettings) error {
+	if len(states) <= 1 {
+		return nil
+	}
+	path, historyFilename, err := historyPath(filename)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(historyFilename), 0700); err != nil {
+		return err
+	}
+	expireHistory(filepath.Dir(historyFilename), settings.ExpiryDays)
+
+	// Drop older states until the history is small enough.
+	maxStates := settings.MaxStates
+	for {
+		kept := pruneStates(states, anchor, maxStates)
+		h, err := encodeHistory(path, kept, anchor, hash)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		if len(data) <= settings.MaxBytes {
+			return writeFileAtomic(historyFilename, data)
+		}
+		if len(kept) == 1 {
+			// Even the anchor alone is too big, so don't keep anything.
+			err := os.Remove(historyFilename)
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+			return err
+		}
+		maxStates = len(kept) / 2
+	}
+}
+
+// loadHistory reads the undo history for filename and rebuilds its states, if
+// the history was saved for the given contents. It returns nil if there is no
+// usable history.
+func loadHistory(filename string, contents rope.Rope, hash string, settings UndoHistorySettings) ([]*bufferContents, int, error) {
+	path, historyFilename, err := historyPath(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	if historyExpired(historyFilename, settings.ExpiryDays) {
+		return nil, 0, nil
+	}
+	data, err := os.ReadFile(historyFilename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	var h historyFile
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, 0, err
+	}
+	if h.Version != historyVersion || h.Path != path || h.Hash != hash {
+		// The file has changed since the history was saved
+		return nil, 0, nil
+	}
+	states, err := decodeHistory(&h, contents)
+	if err != nil {
+		return nil, 0, err
+	}
+	return states, h.Anchor, nil
+}
+
+// historyExpired returns true if the history file hasn't been written in the
+// given number of days. Zero days never expires.
+func historyExpired(filename string, days int) bool {
+	if days <= 0 {
+		return false
+	}
+	info, err := os.Stat(filename)
+	return err == nil && now().Sub(info.ModTime()) > time.Duration(days)*24*time.Hour
+}
+
+// expireHistory removes history files in dir that have expired.
+func expireHistory(dir string, days int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		filename := filepath.Join(dir, entry.Name())
+		if strings.HasSuffix(entry.Name(), ".json") && historyExpired(filename, days) {
+			os.Remove(filename)
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over
+// filename, so a crash never leaves a partly written file.
+func writeFileAtomic(filename string, data []byte) error {
+	dir, name := filepath.Split(filename)
+	tmp, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
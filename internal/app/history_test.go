@@ -0,0 +1,217 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tked/internal/rope"
+)
+
+// openView opens filename in a new view, as the app does.
+func openView(t *testing.T, filename string) View {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	v, err := NewViewFromReader(filename, f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return v
+}
+
+func TestHistoryRestoredOnOpen(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	filename := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(filename, []byte("one\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	v := openView(t, filename)
+	v.SetCursor(1, 0)
+	for _, r := range "two" {
+		v.InsertRune(r)
+	}
+	if err := v.Save(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v.Buffer().Insert(0, "unsaved ")
+	v.Buffer().Close()
+
+	// The file opens as it was saved, with the cursor where it was
+	v = openView(t, filename)
+	if got := v.Buffer().Contents().String(); got != "one\ntwo" {
+		t.Fatalf("expected saved contents got %q", got)
+	}
+	if row, col := v.Cursor(); row != 1 || col != 3 {
+		t.Fatalf("expected cursor 1,3 got %d,%d", row, col)
+	}
+	if v.Buffer().IsDirty() {
+		t.Fatalf("expected restored buffer to be clean")
+	}
+
+	// Undo goes back through the previous session
+	if !v.Buffer().Undo() || v.Buffer().Contents().String() != "one\n" {
+		t.Fatalf("expected undo to restore original contents got %q", v.Buffer().Contents().String())
+	}
+	if !v.Buffer().IsDirty() {
+		t.Fatalf("expected undone buffer to be dirty")
+	}
+	v.Buffer().Redo()
+	if !v.Buffer().Redo() || v.Buffer().Contents().String() != "unsaved one\ntwo" {
+		t.Fatalf("expected unsaved edit to be kept got %q", v.Buffer().Contents().String())
+	}
+}
+
+func TestHistoryIgnoredWhenFileChanged(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	filename := filepath.Join(t.TempDir(), "file.txt")
+	os.WriteFile(filename, []byte("abc"), 0644)
+
+	v := openView(t, filename)
+	v.Buffer().Insert(3, "def")
+	if err := v.Save(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	os.WriteFile(filename, []byte("changed"), 0644)
+	v = openView(t, filename)
+	if v.Buffer().Undo() {
+		t.Fatalf("expected no history for a changed file")
+	}
+	if n := len(v.Buffer().UndoStates()); n != 1 {
+		t.Fatalf("expected 1 state got %d", n)
+	}
+}
+
+func TestHistoryNotSavedWithoutEdits(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	filename := filepath.Join(t.TempDir(), "file.txt")
+	os.WriteFile(filename, []byte("abc"), 0644)
+	_, historyFilename, _ := historyPath(filename)
+
+	// A file that isn't edited has no history to write
+	v := openView(t, filename)
+	v.Buffer().Close()
+	if _, err := os.Stat(historyFilename); !os.IsNotExist(err) {
+		t.Fatalf("expected no history written got %v", err)
+	}
+
+	// The contents are hashed as they are loaded and written, not again
+	// for the history
+	v = openView(t, filename)
+	b := v.Buffer().(*buffer)
+	if b.savedHash.rope != b.saved.rope || b.savedHash.hash != hashRope(b.saved.rope) {
+		t.Fatalf("expected the hash kept from loading")
+	}
+	b.Insert(3, "def")
+	if err := v.Save(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.savedHash.rope != b.saved.rope || b.savedHash.hash != hashRope(rope.NewRope("abcdef")) {
+		t.Fatalf("expected the hash kept from writing")
+	}
+	if _, err := os.Stat(historyFilename); err != nil {
+		t.Fatalf("expected history written: %v", err)
+	}
+}
+
+func TestHistoryBinaryContents(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	filename := filepath.Join(t.TempDir(), "file.bin")
+	os.WriteFile(filename, []byte("a\xffb"), 0644)
+
+	v := openView(t, filename)
+	v.Buffer().Delete(1, 2)
+	v.Save("")
+
+	v = openView(t, filename)
+	if !v.Buffer().Undo() || v.Buffer().Contents().String() != "a\xffb" {
+		t.Fatalf("expected invalid UTF-8 restored got %q", v.Buffer().Contents().String())
+	}
+}
+
+func TestPruneStates(t *testing.T) {
+	b := NewBuffer("", rope.NewRope("")).(*buffer)
+	b.Insert(0, "ab") // 1
+	b.Insert(2, "cd") // 2
+	b.Undo()          // back to 1
+	b.Insert(2, "ef") // 3, a branch from 1
+	b.Insert(4, "gh") // 4
+	anchor := b.contents
+
+	seqs := func(states []*bufferContents) []int {
+		var out []int
+		for _, s := range states {
+			out = append(out, s.seq)
+		}
+		return out
+	}
+
+	// The root goes first, then the oldest leaf, never the anchor
+	if got := seqs(pruneStates(b.states, anchor, 4)); len(got) != 4 || got[0] != 1 {
+		t.Fatalf("expected root dropped got %v", got)
+	}
+	if got := seqs(pruneStates(b.states, anchor, 3)); len(got) != 3 || got[0] != 1 || got[1] != 3 {
+		t.Fatalf("expected old branch dropped got %v", got)
+	}
+	if got := seqs(pruneStates(b.states, anchor, 1)); len(got) != 1 || got[0] != 4 {
+		t.Fatalf("expected only the anchor got %v", got)
+	}
+
+	// A pruned history still rebuilds from the anchor
+	h, err := encodeHistory("/file", pruneStates(b.states, anchor, 3), anchor, hashRope(anchor.rope))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	states, err := decodeHistory(h, anchor.rope)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(states) != 3 || states[0].rope.String() != "ab" || states[0].parent != nil {
+		t.Fatalf("unexpected states after decode")
+	}
+}
+
+func TestHistoryLimits(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", dir)
+	filename := filepath.Join(t.TempDir(), "file.txt")
+	os.WriteFile(filename, nil, 0644)
+
+	v := openView(t, filename)
+	for i := 0; i < 20; i++ {
+		v.Buffer().Insert(0, strings.Repeat("x", 10))
+	}
+	settings := DefaultUndoHistorySettings
+	settings.MaxBytes = 1000
+	b := v.Buffer().(*buffer)
+	if err := saveHistory(filename, b.states, b.states[0], hashRope(b.states[0].rope), settings); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, historyFilename, _ := historyPath(filename)
+	info, err := os.Stat(historyFilename)
+	if err != nil || info.Size() > 1000 {
+		t.Fatalf("expected history within size limit: %v", err)
+	}
+
+	// Expired history is ignored, and removed when other history is saved
+	oldNow := now
+	defer func() { now = oldNow }()
+	now = func() time.Time { return time.Now().Add(31 * 24 * time.Hour) }
+	if states, _, _ := loadHistory(filename, rope.NewRope(""), hashRope(rope.NewRope("")), settings); states != nil {
+		t.Fatalf("expected expired history to be ignored")
+	}
+	other := filepath.Join(t.TempDir(), "other.txt")
+	if err := saveHistory(other, b.states[:2], b.states[0], hashRope(b.states[0].rope), settings); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(historyFilename); !os.IsNotExist(err) {
+		t.Fatalf("expected expired history removed")
+	}
+}
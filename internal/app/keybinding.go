@@ -36,6 +36,12 @@ func DefaultKeyBindings() KeyBindings {
 		{tcell.KeyCtrlD, tcell.ModCtrl, GetCommand("exit")},
 		{tcell.KeyCtrlZ, tcell.ModCtrl, GetCommand("undo")},
 		{tcell.KeyCtrlR, tcell.ModCtrl, GetCommand("redo")},
+		{tcell.KeyCtrlU, tcell.ModCtrl, GetCommand("undoTree")},
+		{tcell.KeyCtrlZ, tcell.ModCtrl | tcell.ModAlt, GetCommand("undoEarlier")},
+		{tcell.KeyCtrlR, tcell.ModCtrl | tcell.ModAlt, GetCommand("undoLater")},
+		{tcell.KeyPgUp, tcell.ModAlt, GetCommand("undoBranchPrev")},
+		{tcell.KeyPgDn, tcell.ModAlt, GetCommand("undoBranchNext")},
+		{tcell.KeyCtrlU, tcell.ModCtrl | tcell.ModAlt, GetCommand("undoTime")},
 		{tcell.KeyCtrlN, tcell.ModCtrl, GetCommand("new")},
 		{tcell.KeyCtrlW, tcell.ModCtrl, GetCommand("saveAs")},
 		{tcell.KeyCtrlS, tcell.ModCtrl, GetCommand("save")},
@@ -56,5 +62,28 @@ func DefaultKeyBindings() KeyBindings {
 		{tcell.KeyPgDn, tcell.ModNone, GetCommand("pagedown")},
 		{tcell.KeyRight, tcell.ModAlt, GetCommand("nextView")},
 		{tcell.KeyLeft, tcell.ModAlt, GetCommand("prevView")},
+		{tcell.KeyF8, tcell.ModNone, GetCommand("nextDiagnostic")},
+		{tcell.KeyF8, tcell.ModShift, GetCommand("prevDiagnostic")},
+		{tcell.KeyF8, tcell.ModCtrl, GetCommand("diagnostics")},
+		{tcell.KeyCtrlK, tcell.ModCtrl, GetCommand("hover")},
+		{tcell.KeyCtrlP, tcell.ModCtrl, GetCommand("signatureHelp")},
+		{tcell.KeyF12, tcell.ModNone, GetCommand("definition")},
+		{tcell.KeyF12, tcell.ModCtrl | tcell.ModAlt, GetCommand("declaration")},
+		{tcell.KeyF12, tcell.ModAlt, GetCommand("typeDefinition")},
+		{tcell.KeyF12, tcell.ModCtrl, GetCommand("implementation")},
+		{tcell.KeyLeft, tcell.ModCtrl | tcell.ModAlt, GetCommand("jumpBack")},
+		{tcell.KeyRight, tcell.ModCtrl | tcell.ModAlt, GetCommand("jumpForward")},
+		{tcell.KeyF12, tcell.ModShift, GetCommand("references")},
+		{tcell.KeyF4, tcell.ModNone, GetCommand("nextResult")},
+		{tcell.KeyF4, tcell.ModShift, GetCommand("prevResult")},
+		{tcell.KeyF4, tcell.ModCtrl, GetCommand("results")},
+		{tcell.KeyCtrlSpace, tcell.ModCtrl, GetCommand("complete")},
+		{tcell.KeyF2, tcell.ModNone, GetCommand("rename")},
+		{tcell.KeyCtrlL, tcell.ModCtrl, GetCommand("format")},
+		{tcell.KeyCtrlA, tcell.ModCtrl, GetCommand("codeActions")},
+		{tcell.KeyCtrlL, tcell.ModCtrl | tcell.ModAlt, GetCommand("restartServers")},
+		{tcell.KeyCtrlO, tcell.ModCtrl | tcell.ModAlt, GetCommand("serverLog")},
+		{tcell.KeyCtrlT, tcell.ModCtrl | tcell.ModAlt, GetCommand("outline")},
+		{tcell.KeyCtrlT, tcell.ModCtrl, GetCommand("workspaceSymbols")},
 	})
 }
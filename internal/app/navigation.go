@@ -0,0 +1,169 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"tked/internal/lsp"
+	"tked/internal/tklog"
+)
+
+// jumpLocation is a place in the jump stack.
+type jumpLocation struct {
+	// view is the view the jump was in. If it has been closed, filename is
+	// opened again instead.
+	view     View
+	filename string
+	pos      lsp.Position
+}
+
+func (a *app) JumpTo(filename string, pos lsp.Position) error {
+	from := a.currentLocation()
+	if err := a.openLocation(jumpLocation{filename: filename, pos: pos}); err != nil {
+		return err
+	}
+
+	// Jumping from somewhere reached with JumpBack drops the jumps after it
+	a.jumps = append(a.jumps[:a.jumpIndex], from)
+	a.jumpIndex = len(a.jumps)
+	return nil
+}
+
+func (a *app) JumpBack() bool {
+	if a.jumpIndex == 0 {
+		return false
+	}
+	if a.jumpIndex == len(a.jumps) {
+		// Remember where we are so JumpForward can come back
+		a.jumps = append(a.jumps, a.currentLocation())
+	}
+	a.jumpIndex--
+	a.gotoJump()
+	return true
+}
+
+func (a *app) JumpForward() bool {
+	if a.jumpIndex >= len(a.jumps)-1 {
+		return false
+	}
+	a.jumpIndex++
+	a.gotoJump()
+	return true
+}
+
+// gotoJump moves to the location at jumpIndex in the jump stack.
+func (a *app) gotoJump() {
+	if err := a.openLocation(a.jumps[a.jumpIndex]); err != nil {
+		a.statusBar.Errorf("Error jumping: %v", err)
+	}
+}
+
+// currentLocation returns the location of the cursor in the current view.
+func (a *app) currentLocation() jumpLocation {
+	view := a.GetCurrentView()
+	return jumpLocation{view: view, filename: view.Buffer().GetFilename(), pos: cursorLSPPosition(view)}
+}
+
+// openLocation makes the view for a location current, opening its file if it
+// isn't open, and moves the cursor there.
+func (a *app) openLocation(loc jumpLocation) error {
+	view := loc.view
+	if !slices.Contains(a.views, view) {
+		view = a.viewForFile(loc.filename)
+	}
+	if view == nil {
+		if loc.filename == "" {
+			return fmt.Errorf("the buffer has been closed")
+		}
+		if err := a.OpenFile(loc.filename); err != nil {
+			return err
+		}
+		view = a.GetCurrentView()
+	}
+
+	a.SetCurrentView(view)
+	buffer := view.Buffer()
+	view.SetCursor(positionForIndex(buffer, indexForLSPPosition(buffer, loc.pos)))
+	view.ClearAnchor()
+	view.SetSelections(nil)
+	return nil
+}
+
+// viewForFile returns the view of a file, or nil if it isn't open.
+func (a *app) viewForFile(filename string) View {
+	if filename == "" {
+		return nil
+	}
+	want, err := filepath.Abs(filename)
+	if err != nil {
+		return nil
+	}
+	for _, view := range a.views {
+		name := view.Buffer().GetFilename()
+		if name == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(name); err == nil && abs == want {
+			return view
+		}
+	}
+	return nil
+}
+
+// locationItems returns a line describing each location for a picker: the
+// file, line and column, and the text of the line.
+func locationItems(app App, locations []lsp.Location) []string {
+	items := make([]string, len(locations))
+	for i, loc := range locations {
+		items[i] = fmt.Sprintf("%s:%d:%d: %s", displayFilename(loc.Filename), loc.Start.Line+1,
+			loc.Start.Offset+1, strings.TrimSpace(locationLine(app, loc)))
+	}
+	return items
+}
+
+// locationLine returns the text of the line a location starts on, from the
+// buffer if the file is open and otherwise from disk.
+func locationLine(app App, loc lsp.Location) string {
+	for _, view := range app.Views() {
+		if view.Buffer().GetFilename() == loc.Filename {
+			contents := view.Buffer().Contents()
+			start, ok := contents.LineStart(loc.Start.Line)
+			if !ok {
+				return ""
+			}
+			end := contents.Len()
+			if next, ok := contents.LineStart(loc.Start.Line + 1); ok {
+				end = next - 1
+			}
+			return contents.Slice(start, end)
+		}
+	}
+
+	data, err := os.ReadFile(loc.Filename)
+	if err != nil {
+		tklog.Warn("Can't read %s for a preview: %v", loc.Filename, err)
+		return ""
+	}
+	lines := strings.Split(string(data), "\n")
+	if loc.Start.Line >= len(lines) {
+		return ""
+	}
+	return lines[loc.Start.Line]
+}
+
+// displayFilename returns a filename relative to the working directory if it
+// is inside it.
+func displayFilename(filename string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return filename
+	}
+	rel, err := filepath.Rel(wd, filename)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filename
+	}
+	return rel
+}
@@ -0,0 +1,175 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tked/internal/lsp"
+	"tked/internal/rope"
+)
+
+// newNavigationApp creates an app and two files to jump between.
+func newNavigationApp(t *testing.T) (*app, string, string) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	commands = make(map[string]Command)
+	registerCommands()
+	ResetApp()
+	aInt, err := NewApp()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	os.WriteFile(a, []byte("one\ntwo\nthree"), 0644)
+	os.WriteFile(b, []byte("\tfour\nfive"), 0644)
+	return aInt.(*app), a, b
+}
+
+// expectAt fails the test unless the current view is of filename with the
+// cursor at row, col.
+func expectAt(t *testing.T, a *app, filename string, row, col int) {
+	t.Helper()
+	view := a.GetCurrentView()
+	if got := view.Buffer().GetFilename(); got != filename {
+		t.Fatalf("expected to be in %s got %s", filename, got)
+	}
+	if r, c := view.Cursor(); r != row || c != col {
+		t.Fatalf("expected cursor %d,%d got %d,%d", row, col, r, c)
+	}
+}
+
+func TestJumpTo(t *testing.T) {
+	a, fileA, fileB := newNavigationApp(t)
+	if err := a.OpenFile(fileA); err != nil {
+		t.Fatalf("open error: %v", err)
+	}
+
+	// Opens the file, converting the byte offset to a column
+	if err := a.JumpTo(fileB, lsp.Position{Line: 0, Offset: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectAt(t, a, fileB, 0, 4)
+	if len(a.views) != 2 {
+		t.Fatalf("expected the file opened in a new view")
+	}
+
+	// Switches to the file's view if it is open
+	if err := a.JumpTo(fileA, lsp.Position{Line: 2, Offset: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectAt(t, a, fileA, 2, 2)
+	if len(a.views) != 2 {
+		t.Fatalf("expected the open view to be reused")
+	}
+
+	if err := a.JumpTo(filepath.Join(filepath.Dir(fileA), "missing.txt"), lsp.Position{}); err == nil {
+		t.Fatalf("expected error for a missing file")
+	}
+	expectAt(t, a, fileA, 2, 2)
+}
+
+func TestJumpBackAndForward(t *testing.T) {
+	a, fileA, fileB := newNavigationApp(t)
+	a.OpenFile(fileA)
+	a.GetCurrentView().SetCursor(1, 1)
+
+	if a.JumpBack() || a.JumpForward() {
+		t.Fatalf("expected nowhere to jump before any jumps")
+	}
+	a.JumpTo(fileB, lsp.Position{Line: 1, Offset: 2})
+	a.JumpTo(fileA, lsp.Position{Line: 2, Offset: 0})
+
+	if !a.JumpBack() {
+		t.Fatalf("expected to jump back")
+	}
+	expectAt(t, a, fileB, 1, 2)
+	a.JumpBack()
+	expectAt(t, a, fileA, 1, 1)
+	if a.JumpBack() {
+		t.Fatalf("expected no earlier jumps")
+	}
+
+	a.JumpForward()
+	expectAt(t, a, fileB, 1, 2)
+	a.JumpForward()
+	expectAt(t, a, fileA, 2, 0)
+	if a.JumpForward() {
+		t.Fatalf("expected no later jumps")
+	}
+
+	// A new jump after going back drops the later jumps
+	a.JumpBack()
+	a.JumpBack()
+	a.JumpTo(fileB, lsp.Position{Line: 0, Offset: 0})
+	if a.JumpForward() {
+		t.Fatalf("expected later jumps dropped")
+	}
+	a.JumpBack()
+	expectAt(t, a, fileA, 1, 1)
+}
+
+func TestJumpBackToClosedFile(t *testing.T) {
+	a, fileA, fileB := newNavigationApp(t)
+	a.OpenFile(fileA)
+	a.GetCurrentView().SetCursor(1, 0)
+	a.JumpTo(fileB, lsp.Position{})
+	a.CloseView(a.viewForFile(fileA))
+
+	a.JumpBack()
+	expectAt(t, a, fileA, 1, 0)
+}
+
+func TestLocationItems(t *testing.T) {
+	a, fileA, fileB := newNavigationApp(t)
+	a.OpenFile(fileA)
+	a.GetCurrentView().Buffer().Insert(0, "edited ")
+
+	items := locationItems(a, []lsp.Location{
+		{Filename: fileA, Start: lsp.Position{Line: 0, Offset: 2}},
+		{Filename: fileB, Start: lsp.Position{Line: 0, Offset: 1}},
+	})
+	want := []string{
+		fileA + ":1:3: edited one", // the open buffer, not the file
+		fileB + ":1:2: four",
+	}
+	for i := range want {
+		if items[i] != want[i] {
+			t.Fatalf("expected %q got %q", want[i], items[i])
+		}
+	}
+}
+
+func TestCommandGotoLocation(t *testing.T) {
+	client := &fakeLSPClient{locations: map[string][]lsp.Location{
+		"definition":     {{Filename: "b.go", Start: lsp.Position{Line: 3, Offset: 1}}},
+		"implementation": {{Filename: "b.go"}, {Filename: "c.go"}},
+	}}
+	withFakeLSP(t, client)
+	v := NewView("a.go", rope.NewRope("abc\ndef"))
+	v.SetCursor(1, 2)
+	sb := &inputStatusBar{}
+	d := &dummyApp{view: v, sb: sb}
+
+	if _, err := (&CommandGotoLocation{kind: "definition"}).Execute(d, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.positions[0] != (lsp.Position{Line: 1, Offset: 2}) {
+		t.Fatalf("expected lookup at the cursor got %v", client.positions[0])
+	}
+	if len(d.jumps) != 1 || d.jumps[0] != client.locations["definition"][0] {
+		t.Fatalf("expected jump to the definition got %v", d.jumps)
+	}
+
+	// Several results are picked from, and cancelling doesn't jump
+	(&CommandGotoLocation{kind: "implementation"}).Execute(d, nil)
+	if len(d.jumps) != 1 {
+		t.Fatalf("expected no jump when the pick is cancelled")
+	}
+
+	(&CommandGotoLocation{kind: "typeDefinition"}).Execute(d, nil)
+	if len(sb.messages) != 1 || sb.messages[0] != "No type definitions found" {
+		t.Fatalf("expected not found message got %v", sb.messages)
+	}
+}
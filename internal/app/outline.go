@@ -0,0 +1,164 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"go.lsp.dev/protocol"
+
+	"tked/internal/lsp"
+)
+
+// symbolKinds are the short names shown for the kinds of symbol.
+var symbolKinds = map[protocol.SymbolKind]string{
+	protocol.SymbolKindFile:          "file",
+	protocol.SymbolKindModule:        "mod",
+	protocol.SymbolKindNamespace:     "ns",
+	protocol.SymbolKindPackage:       "pkg",
+	protocol.SymbolKindClass:         "class",
+	protocol.SymbolKindMethod:        "meth",
+	protocol.SymbolKindProperty:      "prop",
+	protocol.SymbolKindField:         "field",
+	protocol.SymbolKindConstructor:   "ctor",
+	protocol.SymbolKindEnum:          "enum",
+	protocol.SymbolKindInterface:     "iface",
+	protocol.SymbolKindFunction:      "func",
+	protocol.SymbolKindVariable:      "var",
+	protocol.SymbolKindConstant:      "const",
+	protocol.SymbolKindString:        "str",
+	protocol.SymbolKindNumber:        "num",
+	protocol.SymbolKindBoolean:       "bool",
+	protocol.SymbolKindArray:         "array",
+	protocol.SymbolKindObject:        "obj",
+	protocol.SymbolKindKey:           "key",
+	protocol.SymbolKindNull:          "null",
+	protocol.SymbolKindEnumMember:    "enum",
+	protocol.SymbolKindStruct:        "struct",
+	protocol.SymbolKindEvent:         "event",
+	protocol.SymbolKindOperator:      "op",
+	protocol.SymbolKindTypeParameter: "type",
+}
+
+func (a *app) ShowOutline(title string, symbols []lsp.Symbol) {
+	var locations []lsp.Location
+	var items []string
+	var add func(symbols []lsp.Symbol, depth int)
+	add = func(symbols []lsp.Symbol, depth int) {
+		for _, s := range symbols {
+			item := strings.Repeat("  ", depth) + symbolKinds[s.Kind] + " " + s.Name
+			if s.Detail != "" {
+				item += "  " + s.Detail
+			}
+			locations = append(locations, s.Location)
+			items = append(items, item)
+			add(s.Children, depth+1)
+		}
+	}
+	add(symbols, 0)
+	if len(locations) == 0 {
+		a.ShowResults("", nil)
+		return
+	}
+
+	// Select the last symbol that starts before the cursor, which is the
+	// innermost one it is in if it is in any
+	selected := 0
+	view := a.GetCurrentView()
+	cursor := cursorLSPPosition(view)
+	for i, loc := range locations {
+		start := loc.Start
+		if loc.Filename == view.Buffer().GetFilename() &&
+			(start.Line < cursor.Line || start.Line == cursor.Line && start.Offset <= cursor.Offset) {
+			selected = i
+		}
+	}
+	a.results = &resultsPane{
+		title:     title,
+		locations: locations,
+		items:     items,
+		selected:  selected,
+	}
+	a.layoutViews()
+}
+
+// CommandOutline lists the symbols in the current buffer as a tree in the
+// results pane, and moves the keyboard focus there to choose one.
+type CommandOutline struct{}
+
+func (c *CommandOutline) Name() string { return "outline" }
+
+func (c *CommandOutline) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	view := app.GetCurrentView()
+	filename := view.Buffer().GetFilename()
+	client := getLSP(filename)
+	if client == nil {
+		app.GetStatusBar().Message("No language server")
+		return false, nil
+	}
+	viewRequest(app, "outline", func(ctx context.Context) ([]lsp.Symbol, error) {
+		return client.DocumentSymbols(ctx, filename)
+	}, func(symbols []lsp.Symbol, err error) error {
+		if errors.Is(err, lsp.ErrNotSupported) {
+			app.GetStatusBar().Message("The language server has no outline")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(symbols) == 0 {
+			app.GetStatusBar().Message("No symbols found")
+			return nil
+		}
+		app.ShowOutline("Outline", symbols)
+		app.FocusResults()
+		return nil
+	})
+	return false, nil
+}
+
+// CommandWorkspaceSymbols finds symbols anywhere in the current buffer's
+// project by name, asking the language server as the user types, and jumps
+// to the one chosen.
+type CommandWorkspaceSymbols struct{}
+
+func (c *CommandWorkspaceSymbols) Name() string { return "workspaceSymbols" }
+
+func (c *CommandWorkspaceSymbols) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	filename := app.GetCurrentView().Buffer().GetFilename()
+	client := getLSP(filename)
+	if client == nil {
+		app.GetStatusBar().Message("No language server")
+		return false, nil
+	}
+
+	var symbols []lsp.Symbol
+	idx, ok := app.Search("Symbols", func(ctx context.Context, query string) func() []string {
+		found, err := client.WorkspaceSymbols(ctx, filename, query)
+		return func() []string {
+			if errors.Is(err, lsp.ErrNotSupported) {
+				app.GetStatusBar().Message("The language server can't find symbols")
+			} else if err != nil {
+				app.GetStatusBar().Errorf("Error executing command: %v", err)
+			}
+			symbols = found
+			return symbolItems(found)
+		}
+	})
+	if !ok {
+		return false, nil
+	}
+	loc := symbols[idx].Location
+	return false, app.JumpTo(loc.Filename, loc.Start)
+}
+
+// symbolItems describes symbols found in a project, with where they are.
+func symbolItems(symbols []lsp.Symbol) []string {
+	items := make([]string, len(symbols))
+	for i, s := range symbols {
+		items[i] = fmt.Sprintf("%s  %s  %s:%d", s.Name, symbolKinds[s.Kind],
+			displayFilename(s.Location.Filename), s.Location.Start.Line+1)
+	}
+	return items
+}
@@ -0,0 +1,93 @@
+package app
+
+import (
+	"slices"
+	"testing"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/lsp"
+)
+
+func TestShowOutline(t *testing.T) {
+	a := newCompletionApp(t, &fakeLSPClient{}, "type T struct {\n\tx int\n}\n\nfunc main() {}\n", 1, 6)
+	filename := a.GetCurrentView().Buffer().GetFilename()
+	at := func(line, offset int) lsp.Location {
+		return lsp.Location{Filename: filename, Start: lsp.Position{Line: line, Offset: offset}}
+	}
+	a.ShowOutline("Outline", []lsp.Symbol{
+		{Name: "T", Kind: protocol.SymbolKindStruct, Detail: "struct{...}", Location: at(0, 5), Children: []lsp.Symbol{
+			{Name: "x", Kind: protocol.SymbolKindField, Detail: "int", Location: at(1, 1)},
+		}},
+		{Name: "main", Kind: protocol.SymbolKindFunction, Location: at(4, 5)},
+	})
+
+	// The symbols are listed as a tree, with the one at the cursor selected
+	want := []string{"struct T  struct{...}", "  field x  int", "func main"}
+	if a.results == nil || !slices.Equal(a.results.items, want) {
+		t.Fatalf("expected %q got %+v", want, a.results)
+	}
+	if a.results.selected != 1 || a.results.locations[2] != at(4, 5) {
+		t.Fatalf("expected the field selected got %d", a.results.selected)
+	}
+
+	// Choosing one jumps to it
+	a.StepResult(1)
+	if row, col := a.GetCurrentView().Cursor(); row != 4 || col != 5 {
+		t.Fatalf("expected the cursor on main got %d:%d", row, col)
+	}
+
+	a.ShowOutline("Outline", nil)
+	if a.results != nil {
+		t.Fatalf("expected no symbols to close the pane")
+	}
+}
+
+func TestCommandOutline(t *testing.T) {
+	client := &fakeLSPClient{err: lsp.ErrNotSupported}
+	withFakeLSP(t, client)
+	sb := &inputStatusBar{}
+	app := &dummyApp{sb: sb, view: NewView("a.go", nil)}
+
+	(&CommandOutline{}).Execute(app, nil)
+	client.err = nil
+	(&CommandOutline{}).Execute(app, nil)
+	if !slices.Equal(sb.messages, []string{"The language server has no outline", "No symbols found"}) {
+		t.Fatalf("unexpected messages %q", sb.messages)
+	}
+
+	client.symbols = []lsp.Symbol{{Name: "main", Kind: protocol.SymbolKindFunction}}
+	(&CommandOutline{}).Execute(app, nil)
+	if len(app.symbols) != 1 || app.symbols[0].Name != "main" {
+		t.Fatalf("expected the outline shown got %+v", app.symbols)
+	}
+}
+
+func TestCommandWorkspaceSymbols(t *testing.T) {
+	client := &fakeLSPClient{symbols: []lsp.Symbol{
+		{Name: "Open", Kind: protocol.SymbolKindFunction, Location: lsp.Location{Filename: "/src/a.go", Start: lsp.Position{Line: 9, Offset: 5}}},
+		{Name: "OpenFile", Kind: protocol.SymbolKindMethod, Location: lsp.Location{Filename: "/src/b.go", Start: lsp.Position{Line: 2, Offset: 14}}},
+	}}
+	withFakeLSP(t, client)
+	app := &pickApp{dummyApp: dummyApp{sb: &inputStatusBar{}, view: NewView("a.go", nil)}, choice: 1, query: "open"}
+
+	// The server is asked for what is typed, and the symbol chosen opened
+	(&CommandWorkspaceSymbols{}).Execute(app, nil)
+	if !slices.Equal(client.queries, []string{"open"}) {
+		t.Fatalf("expected the query sent got %q", client.queries)
+	}
+	if len(app.items) != 2 || app.items[0] != "Open  func  /src/a.go:10" {
+		t.Fatalf("unexpected items %q", app.items)
+	}
+	want := lsp.Location{Filename: "/src/b.go", Start: lsp.Position{Line: 2, Offset: 14}}
+	if len(app.jumps) != 1 || app.jumps[0] != want {
+		t.Fatalf("expected a jump to %+v got %+v", want, app.jumps)
+	}
+
+	// Nothing happens if the user cancels
+	app.choice = -1
+	(&CommandWorkspaceSymbols{}).Execute(app, nil)
+	if len(app.jumps) != 1 {
+		t.Fatalf("expected no jump got %+v", app.jumps)
+	}
+}
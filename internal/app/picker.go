@@ -0,0 +1,238 @@
+package app
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// picker is a list of items drawn in a box over the current view, from which
+// the user chooses one. Typing filters the list.
+type picker struct {
+	title  string
+	items  []string
+	filter []rune
+	// fuzzy is set to also match items containing the filter's runes in
+	// order, after those containing the filter.
+	fuzzy    bool
+	matches  []int // indexes of the items matching the filter
+	selected int   // index into matches
+	top      int   // first visible index into matches
+}
+
+// newPicker creates a picker for the items with the item at initial selected.
+func newPicker(title string, items []string, initial int) *picker {
+	p := &picker{title: title, items: items}
+	p.update()
+	for i, m := range p.matches {
+		if m == initial {
+			p.selected = i
+		}
+	}
+	return p
+}
+
+// update recalculates the items matching the filter.
+func (p *picker) update() {
+	filter := strings.ToLower(string(p.filter))
+	p.matches = p.matches[:0]
+	var others []int
+	for i, item := range p.items {
+		item = strings.ToLower(item)
+		switch {
+		case strings.Contains(item, filter):
+			p.matches = append(p.matches, i)
+		case p.fuzzy && isSubsequence(filter, item):
+			others = append(others, i)
+		}
+	}
+	p.matches = append(p.matches, others...)
+	p.selected = max(0, min(p.selected, len(p.matches)-1))
+}
+
+// setItems replaces the items, selecting the first that matches.
+func (p *picker) setItems(items []string) {
+	p.items = items
+	p.selected = 0
+	p.update()
+}
+
+// current returns the index of the selected item, or -1 if no items match.
+func (p *picker) current() int {
+	if len(p.matches) == 0 {
+		return -1
+	}
+	return p.matches[p.selected]
+}
+
+// handleKey updates the picker for a key press. It returns done=true when the
+// user has finished, with ok=false if they cancelled.
+func (p *picker) handleKey(ev *tcell.EventKey, page int) (done bool, ok bool) {
+	switch ev.Key() {
+	case tcell.KeyEnter:
+		return true, p.current() != -1
+	case tcell.KeyEscape:
+		return true, false
+	case tcell.KeyUp:
+		p.selected = max(0, p.selected-1)
+	case tcell.KeyDown:
+		p.selected = max(0, min(len(p.matches)-1, p.selected+1))
+	case tcell.KeyPgUp:
+		p.selected = max(0, p.selected-page)
+	case tcell.KeyPgDn:
+		p.selected = max(0, min(len(p.matches)-1, p.selected+page))
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if len(p.filter) > 0 {
+			p.filter = p.filter[:len(p.filter)-1]
+			p.update()
+		}
+	case tcell.KeyRune:
+		p.filter = append(p.filter, ev.Rune())
+		p.update()
+	}
+	return false, false
+}
+
+// size returns the number of list rows and the width of the box for a screen
+// of the given size.
+func (p *picker) size(width, height int) (int, int) {
+	rows := max(1, min(len(p.items), height-6))
+	boxWidth := len(p.title) + len(p.filter) + 6
+	for _, item := range p.items {
+		boxWidth = max(boxWidth, len([]rune(item))+4)
+	}
+	return rows, min(boxWidth, width-4)
+}
+
+// draw renders the picker centred on the screen.
+func (p *picker) draw(screen tcell.Screen) {
+	width, height := screen.Size()
+	rows, boxWidth := p.size(width, height)
+	x := (width - boxWidth) / 2
+	y := max(1, (height-rows-2)/2)
+
+	// Keep the selected item visible
+	if p.selected < p.top {
+		p.top = p.selected
+	} else if p.selected >= p.top+rows {
+		p.top = p.selected - rows + 1
+	}
+
+	style := tcell.StyleDefault
+	drawBox(screen, x, y, boxWidth, rows+2, style)
+	drawString(screen, x+2, y, boxWidth-4, style.Bold(true), " "+p.title+": "+string(p.filter)+" ")
+	for row := 0; row < rows; row++ {
+		i := p.top + row
+		rowStyle := style
+		text := ""
+		if i < len(p.matches) {
+			text = p.items[p.matches[i]]
+			if i == p.selected {
+				rowStyle = rowStyle.Reverse(true)
+			}
+		}
+		fillString(screen, x+1, y+1+row, boxWidth-2, rowStyle, " "+text)
+	}
+}
+
+// Pick shows the items in a picker and returns the index of the one the user
+// chose. onHighlight, if not nil, is called with the index of each item as it
+// is highlighted, so that it can be previewed.
+func (a *app) Pick(title string, items []string, initial int, onHighlight func(int)) (int, bool) {
+	if a.screen == nil || len(items) == 0 {
+		return -1, false
+	}
+	return a.runPicker(newPicker(title, items, initial), onHighlight, nil)
+}
+
+// searchRequest is the key for the searches made as the user types in a
+// picker.
+const searchRequest = "search"
+
+func (a *app) Search(title string, search func(ctx context.Context, query string) func() []string) (int, bool) {
+	if a.screen == nil {
+		return -1, false
+	}
+	p := newPicker(title, nil, 0)
+	p.fuzzy = true
+	find := func(query string) {
+		a.Background(searchRequest, func(ctx context.Context) func() {
+			found := search(ctx, query)
+			return func() { p.setItems(found()) }
+		})
+	}
+	find("")
+	defer a.cancelBackground(searchRequest)
+	return a.runPicker(p, nil, find)
+}
+
+// runPicker shows a picker until the user chooses an item or cancels.
+// onFilter, if not nil, is called with the filter each time it changes.
+func (a *app) runPicker(p *picker, onHighlight func(int), onFilter func(string)) (int, bool) {
+	highlighted := -1
+	for {
+		if onHighlight != nil && p.current() != -1 && p.current() != highlighted {
+			highlighted = p.current()
+			onHighlight(highlighted)
+		}
+
+		a.draw()
+		p.draw(a.screen)
+		a.screen.Show()
+
+		switch ev := a.screen.PollEvent().(type) {
+		case *tcell.EventKey:
+			_, height := a.screen.Size()
+			filter := string(p.filter)
+			if done, ok := p.handleKey(ev, height/2); done {
+				return p.current(), ok
+			}
+			if onFilter != nil && string(p.filter) != filter {
+				onFilter(string(p.filter))
+			}
+		case *tcell.EventResize:
+			a.handleResize(a.screen)
+		case *tcell.EventInterrupt:
+			runDispatched(ev)
+		}
+	}
+}
+
+// drawBox draws a box outline with its top left corner at x, y.
+func drawBox(screen tcell.Screen, x, y, width, height int, style tcell.Style) {
+	for col := x; col < x+width; col++ {
+		screen.SetContent(col, y, tcell.RuneHLine, nil, style)
+		screen.SetContent(col, y+height-1, tcell.RuneHLine, nil, style)
+	}
+	for row := y; row < y+height; row++ {
+		screen.SetContent(x, row, tcell.RuneVLine, nil, style)
+		screen.SetContent(x+width-1, row, tcell.RuneVLine, nil, style)
+	}
+	screen.SetContent(x, y, tcell.RuneULCorner, nil, style)
+	screen.SetContent(x+width-1, y, tcell.RuneURCorner, nil, style)
+	screen.SetContent(x, y+height-1, tcell.RuneLLCorner, nil, style)
+	screen.SetContent(x+width-1, y+height-1, tcell.RuneLRCorner, nil, style)
+}
+
+// drawString draws text starting at x, y, clipped to width columns. It
+// returns the number of columns drawn.
+func drawString(screen tcell.Screen, x, y, width int, style tcell.Style, text string) int {
+	col := 0
+	for _, r := range text {
+		if col >= width {
+			break
+		}
+		screen.SetContent(x+col, y, r, nil, style)
+		col++
+	}
+	return col
+}
+
+// fillString draws text like drawString, and pads the rest of width with
+// spaces.
+func fillString(screen tcell.Screen, x, y, width int, style tcell.Style, text string) {
+	for col := drawString(screen, x, y, width, style, text); col < width; col++ {
+		screen.SetContent(x+col, y, ' ', nil, style)
+	}
+}
@@ -0,0 +1,132 @@
+package app
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func TestPickerFilter(t *testing.T) {
+	p := newPicker("Pick", []string{"alpha", "beta", "gamma", "Alphabet"}, 1)
+	if p.current() != 1 {
+		t.Fatalf("expected initial item 1 got %d", p.current())
+	}
+	for _, r := range "alp" {
+		p.handleKey(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone), 5)
+	}
+	if len(p.matches) != 2 || p.matches[0] != 0 || p.matches[1] != 3 {
+		t.Fatalf("unexpected matches %v", p.matches)
+	}
+	p.handleKey(tcell.NewEventKey(tcell.KeyDown, 0, tcell.ModNone), 5)
+	if p.current() != 3 {
+		t.Fatalf("expected item 3 got %d", p.current())
+	}
+	if done, ok := p.handleKey(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone), 5); !done || !ok {
+		t.Fatalf("expected enter to accept")
+	}
+
+	p.handleKey(tcell.NewEventKey(tcell.KeyRune, 'z', tcell.ModNone), 5)
+	if p.current() != -1 {
+		t.Fatalf("expected no match")
+	}
+	if done, ok := p.handleKey(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone), 5); !done || ok {
+		t.Fatalf("expected enter with no match to cancel")
+	}
+}
+
+func TestAppPick(t *testing.T) {
+	commands = make(map[string]Command)
+	registerCommands()
+	ResetApp()
+	aInt, err := NewApp()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a := aInt.(*app)
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(40, 10)
+	a.screen = screen
+	a.statusBar.SetScreen(screen)
+	a.tabBar.SetScreen(screen)
+
+	var highlighted []int
+	done := make(chan struct{})
+	var idx int
+	var ok bool
+	go func() {
+		idx, ok = a.Pick("Pick", []string{"one", "two", "three"}, 0, func(i int) {
+			highlighted = append(highlighted, i)
+		})
+		close(done)
+	}()
+	screen.InjectKey(tcell.KeyDown, 0, tcell.ModNone)
+	screen.InjectKey(tcell.KeyDown, 0, tcell.ModNone)
+	screen.InjectKey(tcell.KeyEnter, 0, tcell.ModNone)
+	<-done
+	if !ok || idx != 2 {
+		t.Fatalf("expected item 2 got %d %v", idx, ok)
+	}
+	if len(highlighted) != 3 || highlighted[2] != 2 {
+		t.Fatalf("unexpected highlights %v", highlighted)
+	}
+}
+
+func TestPickerFuzzy(t *testing.T) {
+	p := newPicker("Pick", []string{"make_new", "alpha", "xmnx"}, 0)
+	p.fuzzy = true
+	for _, r := range "mn" {
+		p.handleKey(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone), 5)
+	}
+	// Items containing the filter come first
+	if !slices.Equal(p.matches, []int{2, 0}) {
+		t.Fatalf("unexpected matches %v", p.matches)
+	}
+
+	p.setItems([]string{"beta", "main"})
+	if !slices.Equal(p.matches, []int{1}) || p.current() != 1 {
+		t.Fatalf("expected the new items filtered got %v", p.matches)
+	}
+}
+
+func TestAppSearch(t *testing.T) {
+	a, _ := newBackgroundApp(t, &fakeLSPClient{})
+	a.tabBar.SetScreen(a.screen)
+	screen := a.screen.(tcell.SimulationScreen)
+
+	// Items are searched for as the user types
+	found := make(chan string, 10)
+	done := make(chan struct{})
+	var idx int
+	var ok bool
+	go func() {
+		idx, ok = a.Search("Symbols", func(ctx context.Context, query string) func() []string {
+			return func() []string {
+				found <- query
+				if query == "" {
+					return nil
+				}
+				return []string{"alpha", "m" + query, query + "x"}
+			}
+		})
+		close(done)
+	}()
+	if query := <-found; query != "" {
+		t.Fatalf("expected an empty query first got %q", query)
+	}
+	screen.InjectKey(tcell.KeyRune, 'b', tcell.ModNone)
+	if query := <-found; query != "b" {
+		t.Fatalf("expected the text typed searched for got %q", query)
+	}
+	screen.InjectKey(tcell.KeyDown, 0, tcell.ModNone)
+	screen.InjectKey(tcell.KeyEnter, 0, tcell.ModNone)
+	<-done
+	if !ok || idx != 2 {
+		t.Fatalf("expected item 2 got %d %v", idx, ok)
+	}
+	if len(a.background) != 0 {
+		t.Fatalf("expected no searches left running")
+	}
+}
@@ -0,0 +1,344 @@
+package app
+
+import (
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/uniseg"
+
+	"tked/internal/lsp"
+)
+
+// Popup is text drawn in a box next to the cursor, such as documentation from
+// a language server. It is closed by the next key press or when the cursor
+// moves.
+type Popup struct {
+	lines []popupLine
+	// row and col are where the cursor was when the popup was shown.
+	row, col int
+}
+
+// popupLine is a line of a popup made of spans of styled text.
+type popupLine []popupSpan
+
+type popupSpan struct {
+	text  string
+	style tcell.Style
+}
+
+// popupCell is one character of a popup laid out on the screen.
+type popupCell struct {
+	text  string
+	width int
+	style tcell.Style
+}
+
+const (
+	maxPopupWidth  = 80
+	maxPopupHeight = 12
+)
+
+var popupCodeStyle = tcell.StyleDefault.Foreground(tcell.ColorTeal)
+
+// NewMarkdownPopup creates a popup showing markdown.
+func NewMarkdownPopup(markdown string) *Popup {
+	return &Popup{lines: renderMarkdown(markdown)}
+}
+
+// newSignaturePopup creates a popup showing a function signature with the
+// current parameter highlighted, followed by its documentation.
+func newSignaturePopup(sig *lsp.Signature) *Popup {
+	label := popupLine{
+		{sig.Label[:sig.ParamStart], popupCodeStyle},
+		{sig.Label[sig.ParamStart:sig.ParamEnd], popupCodeStyle.Bold(true).Underline(true)},
+		{sig.Label[sig.ParamEnd:], popupCodeStyle},
+	}
+	p := &Popup{lines: []popupLine{label}}
+	for _, doc := range []string{sig.ParamDocumentation, sig.Documentation} {
+		if lines := renderMarkdown(doc); len(lines) > 0 {
+			p.lines = append(p.lines, nil)
+			p.lines = append(p.lines, lines...)
+		}
+	}
+	return p
+}
+
+// renderMarkdown converts markdown to styled lines. It handles the subset
+// language servers use: paragraphs, headings, lists, rules, fenced code
+// blocks and inline code, emphasis and links.
+func renderMarkdown(markdown string) []popupLine {
+	var lines []popupLine
+	var paragraph []string
+	blank := func() {
+		if len(lines) > 0 && len(lines[len(lines)-1]) > 0 {
+			lines = append(lines, nil)
+		}
+	}
+	flush := func() {
+		if len(paragraph) > 0 {
+			lines = append(lines, renderInline(strings.Join(paragraph, " "), tcell.StyleDefault))
+			paragraph = nil
+		}
+	}
+
+	tab := strings.Repeat(" ", GetApp().Settings().TabWidth())
+	fence := ""
+	for _, line := range strings.Split(markdown, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+				blank()
+				continue
+			}
+			line = strings.ReplaceAll(line, "\t", tab)
+			lines = append(lines, popupLine{{line, popupCodeStyle}})
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			flush()
+			blank()
+			fence = trimmed[:3]
+		case trimmed == "":
+			flush()
+			blank()
+		case isRule(trimmed):
+			flush()
+			blank()
+		case strings.HasPrefix(trimmed, "#"):
+			flush()
+			heading := strings.TrimLeft(trimmed, "#")
+			lines = append(lines, renderInline(strings.TrimSpace(heading), tcell.StyleDefault.Bold(true)))
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") || strings.HasPrefix(trimmed, "+ "):
+			flush()
+			indent := line[:len(line)-len(strings.TrimLeft(line, " "))]
+			item := append(popupLine{{indent + "• ", tcell.StyleDefault}}, renderInline(trimmed[2:], tcell.StyleDefault)...)
+			lines = append(lines, item)
+		default:
+			if hard := strings.HasSuffix(line, "  ") || strings.HasSuffix(line, "\\"); hard {
+				paragraph = append(paragraph, strings.TrimSuffix(trimmed, "\\"))
+				flush()
+			} else {
+				paragraph = append(paragraph, trimmed)
+			}
+		}
+	}
+	flush()
+
+	// Drop the blank line left after the last block
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// isRule reports whether a line is a horizontal rule, like "---".
+func isRule(line string) bool {
+	if len(line) < 3 || !strings.ContainsRune("-*_", rune(line[0])) {
+		return false
+	}
+	return strings.Trim(line, string(line[0])+" ") == ""
+}
+
+// renderInline converts the inline markdown in text to styled spans.
+func renderInline(text string, style tcell.Style) popupLine {
+	var line popupLine
+	var b strings.Builder
+	emit := func(s tcell.Style) {
+		if b.Len() > 0 {
+			line = append(line, popupSpan{b.String(), s})
+			b.Reset()
+		}
+	}
+
+	bold, italic := false, false
+	current := func() tcell.Style {
+		s := style
+		if bold {
+			s = s.Bold(true)
+		}
+		if italic {
+			s = s.Italic(true)
+		}
+		return s
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && strings.IndexByte(markdownPunctuation, text[i+1]) >= 0:
+			i++
+			b.WriteByte(text[i])
+		case c == '`':
+			end := strings.IndexByte(text[i+1:], '`')
+			if end < 0 {
+				b.WriteByte(c)
+				continue
+			}
+			emit(current())
+			b.WriteString(text[i+1 : i+1+end])
+			emit(popupCodeStyle)
+			i += end + 1
+		case (c == '*' || c == '_') && i+1 < len(text) && text[i+1] == c:
+			emit(current())
+			bold = !bold
+			i++
+		case (c == '*' || c == '_') && isEmphasis(text, i, italic):
+			emit(current())
+			italic = !italic
+		case c == '[':
+			// Links show their text
+			close := strings.Index(text[i:], "](")
+			end := -1
+			if close >= 0 {
+				end = strings.IndexByte(text[i+close:], ')')
+			}
+			if close < 0 || end < 0 {
+				b.WriteByte(c)
+				continue
+			}
+			emit(current())
+			line = append(line, renderInline(text[i+1:i+close], current().Underline(true))...)
+			i += close + end
+		default:
+			b.WriteByte(c)
+		}
+	}
+	emit(current())
+	return line
+}
+
+// markdownPunctuation are the characters that can be escaped with a
+// backslash.
+const markdownPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// isEmphasis reports whether the '*' or '_' at text[i] starts or ends
+// emphasis, rather than being part of a word like snake_case or an operator
+// like "a * b".
+func isEmphasis(text string, i int, open bool) bool {
+	isSpace := func(j int) bool {
+		return j < 0 || j >= len(text) || text[j] == ' '
+	}
+	isWord := func(j int) bool {
+		return j >= 0 && j < len(text) && (isWordRune(rune(text[j])) || text[j] >= utf8.RuneSelf)
+	}
+	if text[i] == '_' && isWord(i-1) && isWord(i+1) {
+		return false
+	}
+	if open {
+		return !isSpace(i - 1)
+	}
+	return !isSpace(i + 1)
+}
+
+// layout wraps the popup's lines to width columns, breaking at spaces where
+// possible.
+func (p *Popup) layout(width int) [][]popupCell {
+	var rows [][]popupCell
+	for _, line := range p.lines {
+		var row []popupCell
+		rowWidth := 0
+		for _, span := range line {
+			state := -1
+			text := span.text
+			for len(text) > 0 {
+				var cluster string
+				var w int
+				cluster, text, w, state = uniseg.FirstGraphemeClusterInString(text, state)
+				if w == 0 {
+					continue
+				}
+				if rowWidth+w > width && len(row) > 0 {
+					// Move the last word to the next row, dropping the space
+					// before it
+					var rest []popupCell
+					if space := lastSpace(row); space >= 0 {
+						row, rest = row[:space], row[space+1:]
+					}
+					rows = append(rows, row)
+					row, rowWidth = slices.Clone(rest), 0
+					for _, c := range row {
+						rowWidth += c.width
+					}
+					if cluster == " " && len(row) == 0 {
+						continue
+					}
+				}
+				row = append(row, popupCell{text: cluster, width: w, style: span.style})
+				rowWidth += w
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// lastSpace returns the index of the last space in a row that isn't part of
+// its indentation, or -1 if there is none.
+func lastSpace(row []popupCell) int {
+	indent := 0
+	for indent < len(row) && row[indent].text == " " {
+		indent++
+	}
+	for i := len(row) - 1; i > indent; i-- {
+		if row[i].text == " " {
+			return i
+		}
+	}
+	return -1
+}
+
+// draw draws the popup next to the cursor at x, y, within the area of the
+// screen starting at left, top with the given size.
+func (p *Popup) draw(screen tcell.Screen, x, y, left, top, width, height int) {
+	innerWidth := 0
+	for _, row := range p.layout(min(maxPopupWidth, width-4)) {
+		rowWidth := 0
+		for _, c := range row {
+			rowWidth += c.width
+		}
+		innerWidth = max(innerWidth, rowWidth)
+	}
+	rows := p.layout(max(1, innerWidth))
+	if innerWidth == 0 || len(rows) == 0 {
+		return
+	}
+
+	// Show the popup below the cursor, or above it if there is more room
+	below := top + height - (y + 1)
+	above := y - top
+	boxHeight := min(len(rows), maxPopupHeight) + 2
+	boxY := y + 1
+	if boxHeight > below && above > below {
+		boxHeight = min(boxHeight, above)
+		boxY = y - boxHeight
+	} else {
+		boxHeight = min(boxHeight, below)
+	}
+	if boxHeight < 3 {
+		return
+	}
+	boxWidth := innerWidth + 4
+	boxX := max(left, min(x, left+width-boxWidth))
+
+	style := tcell.StyleDefault
+	drawBox(screen, boxX, boxY, boxWidth, boxHeight, style)
+	for i := 0; i < boxHeight-2; i++ {
+		col := 0
+		fillString(screen, boxX+1, boxY+1+i, boxWidth-2, style, "")
+		for _, c := range rows[i] {
+			runes := []rune(c.text)
+			screen.SetContent(boxX+2+col, boxY+1+i, runes[0], runes[1:], c.style)
+			col += c.width
+		}
+	}
+	if len(rows) > boxHeight-2 {
+		// Show that there is more than fits
+		screen.SetContent(boxX+boxWidth-2, boxY+boxHeight-1, '…', nil, style)
+	}
+}
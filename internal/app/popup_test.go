@@ -0,0 +1,230 @@
+package app
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+
+	"tked/internal/lsp"
+	"tked/internal/rope"
+)
+
+// lineText returns the text of a popup line without its styles.
+func lineText(line popupLine) string {
+	text := ""
+	for _, span := range line {
+		text += span.text
+	}
+	return text
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	md := "```go\nfunc Max(x, y int) int\n```\n\n# Max\nMax returns\nthe **larger** of `x` and `y`.\n\n---\n\n- see [docs](https://example.com)\n- snake_case\\_name"
+	lines := renderMarkdown(md)
+	want := []string{
+		"func Max(x, y int) int",
+		"",
+		"Max",
+		"Max returns the larger of x and y.",
+		"",
+		"• see docs",
+		"• snake_case_name",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d lines got %d: %v", len(want), len(lines), lines)
+	}
+	for i, w := range want {
+		if got := lineText(lines[i]); got != w {
+			t.Fatalf("line %d: expected %q got %q", i, w, got)
+		}
+	}
+
+	if lines[0][0].style != popupCodeStyle {
+		t.Fatalf("expected code block in code style")
+	}
+	if _, _, attrs := lines[2][0].style.Decompose(); attrs&tcell.AttrBold == 0 {
+		t.Fatalf("expected bold heading")
+	}
+	styles := map[string]tcell.Style{}
+	for _, span := range lines[3] {
+		styles[span.text] = span.style
+	}
+	if _, _, attrs := styles["larger"].Decompose(); attrs&tcell.AttrBold == 0 {
+		t.Fatalf("expected bold span got %v", lines[3])
+	}
+	if styles["x"] != popupCodeStyle {
+		t.Fatalf("expected inline code span got %v", lines[3])
+	}
+}
+
+func TestRenderMarkdownEmphasis(t *testing.T) {
+	line := renderInline("a * b is *not* my_var", tcell.StyleDefault)
+	if got := lineText(line); got != "a * b is not my_var" {
+		t.Fatalf("unexpected text %q", got)
+	}
+	for _, span := range line {
+		_, _, attrs := span.style.Decompose()
+		if italic := attrs&tcell.AttrItalic != 0; italic != (span.text == "not") {
+			t.Fatalf("unexpected italics for %q", span.text)
+		}
+	}
+}
+
+func TestPopupLayoutWraps(t *testing.T) {
+	p := NewMarkdownPopup("one two three four\n\n```\n  indented code\n```")
+	rows := p.layout(10)
+	var got []string
+	for _, row := range rows {
+		text := ""
+		for _, c := range row {
+			text += c.text
+		}
+		got = append(got, text)
+	}
+	want := []string{"one two", "three four", "", "  indented", "code"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected %q got %q", want, got)
+	}
+}
+
+func TestSignaturePopup(t *testing.T) {
+	p := newSignaturePopup(&lsp.Signature{
+		Label:              "func Max(x, y int) int",
+		ParamStart:         12,
+		ParamEnd:           17,
+		Documentation:      "Max returns the larger.",
+		ParamDocumentation: "y is compared",
+	})
+	if len(p.lines) != 5 {
+		t.Fatalf("expected label, parameter and function docs got %d lines", len(p.lines))
+	}
+	param := p.lines[0][1]
+	if _, _, attrs := param.style.Decompose(); param.text != "y int" || attrs&tcell.AttrUnderline == 0 {
+		t.Fatalf("expected highlighted parameter got %+v", param)
+	}
+	if lineText(p.lines[2]) != "y is compared" || lineText(p.lines[4]) != "Max returns the larger." {
+		t.Fatalf("unexpected docs %v", p.lines)
+	}
+}
+
+func TestViewPopupClosesWhenCursorMoves(t *testing.T) {
+	v := NewView("", rope.NewRope("abc\ndef"))
+	v.SetCursor(0, 1)
+	v.ShowPopup(NewMarkdownPopup("docs"))
+	if v.Popup() == nil {
+		t.Fatalf("expected popup open")
+	}
+	v.SetCursor(0, 1)
+	if v.Popup() == nil {
+		t.Fatalf("expected popup to stay open while the cursor is still")
+	}
+	v.SetCursor(1, 1)
+	if v.Popup() != nil {
+		t.Fatalf("expected popup closed when the cursor moved")
+	}
+	v.SetCursor(0, 1)
+	if v.Popup() != nil {
+		t.Fatalf("expected popup to stay closed")
+	}
+}
+
+func TestViewDrawPopup(t *testing.T) {
+	v := NewView("", rope.NewRope("abc\ndef"))
+	v.Resize(6, 20)
+	v.SetCursor(0, 1)
+	v.ShowPopup(NewMarkdownPopup("hi"))
+
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(20, 6)
+	v.Draw(screen, 0, 0)
+	screen.Show()
+
+	// The box starts below the cursor and hides the text under it
+	if ch, _, _, _ := screen.GetContent(1, 1); ch != tcell.RuneULCorner {
+		t.Fatalf("expected popup corner below the cursor got %q", ch)
+	}
+	if ch, _, _, _ := screen.GetContent(3, 2); ch != 'h' {
+		t.Fatalf("expected popup text got %q", ch)
+	}
+	if ch, _, _, _ := screen.GetContent(0, 1); ch != 'd' {
+		t.Fatalf("expected text left of the popup got %q", ch)
+	}
+}
+
+func TestHandleKeyClosesPopup(t *testing.T) {
+	commands = make(map[string]Command)
+	registerCommands()
+	ResetApp()
+	aInt, err := NewApp()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a := aInt.(*app)
+	v := a.GetCurrentView()
+	v.ShowPopup(NewMarkdownPopup("docs"))
+
+	a.handleKey(tcell.NewEventKey(tcell.KeyRune, 'x', tcell.ModNone))
+	if v.Popup() != nil {
+		t.Fatalf("expected popup closed by a key press")
+	}
+	if got := v.Buffer().Contents().String(); got != "x" {
+		t.Fatalf("expected the key to be handled too, got %q", got)
+	}
+}
+
+func TestCommandHover(t *testing.T) {
+	client := &fakeLSPClient{hover: "**docs**"}
+	withFakeLSP(t, client)
+	v := NewView("a.go", rope.NewRope("ab\nxé🌟z"))
+	v.SetCursor(1, 3)
+	sb := &inputStatusBar{}
+	d := &dummyApp{view: v, sb: sb}
+
+	if _, err := (&CommandHover{}).Execute(d, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.positions) != 1 || client.positions[0] != (lsp.Position{Line: 1, Offset: 3}) {
+		t.Fatalf("expected request at the cursor's byte offset got %v", client.positions)
+	}
+	if p := v.Popup(); p == nil || lineText(p.lines[0]) != "docs" {
+		t.Fatalf("expected hover popup")
+	}
+
+	client.hover = ""
+	v.ClosePopup()
+	(&CommandHover{}).Execute(d, nil)
+	if v.Popup() != nil || len(sb.messages) != 1 {
+		t.Fatalf("expected a message when there is nothing to show")
+	}
+
+	// Errors from the server are shown once the answer arrives
+	client.err = errors.New("boom")
+	if _, err := (&CommandHover{}).Execute(d, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sb.errors) != 1 || !strings.Contains(sb.errors[0], "boom") {
+		t.Fatalf("expected the error from the server shown got %v", sb.errors)
+	}
+}
+
+func TestCommandSignatureHelp(t *testing.T) {
+	client := &fakeLSPClient{}
+	withFakeLSP(t, client)
+	v := NewView("a.go", rope.NewRope("f(x)"))
+	sb := &inputStatusBar{}
+	d := &dummyApp{view: v, sb: sb}
+
+	(&CommandSignatureHelp{}).Execute(d, nil)
+	if v.Popup() != nil || len(sb.messages) != 1 {
+		t.Fatalf("expected a message when there is no signature")
+	}
+
+	client.signature = &lsp.Signature{Label: "func f(x int)"}
+	(&CommandSignatureHelp{}).Execute(d, nil)
+	if p := v.Popup(); p == nil || lineText(p.lines[0]) != "func f(x int)" {
+		t.Fatalf("expected signature popup")
+	}
+}
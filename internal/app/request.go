@@ -0,0 +1,115 @@
+package app
+
+import (
+	"context"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Keys for the work done in the background. Starting work cancels any still
+// running with the same key, as its result is no longer wanted.
+const (
+	// popupRequest is for requests whose answers are shown in a popup, which
+	// any key cancels as it would close the popup.
+	popupRequest          = "popup"
+	completionRequest     = "completion"
+	lightBulbRequest      = "lightBulb"
+	semanticTokensRequest = "semanticTokens"
+)
+
+// passiveRequests are the keys for work the editor starts by itself as the
+// user types, which Escape leaves running as the user didn't ask for it.
+var passiveRequests = map[string]bool{lightBulbRequest: true, semanticTokensRequest: true}
+
+// backgroundTask is work started with Background that hasn't finished.
+type backgroundTask struct {
+	cancel context.CancelFunc
+}
+
+func (a *app) Background(key string, work func(ctx context.Context) func()) {
+	a.cancelBackground(key)
+	ctx, cancel := context.WithCancel(context.Background())
+	if a.screen == nil {
+		// Without an event loop, as in tests, the work is done at once
+		work(ctx)()
+		cancel()
+		return
+	}
+
+	task := &backgroundTask{cancel: cancel}
+	if a.background == nil {
+		a.background = map[string]*backgroundTask{}
+	}
+	a.background[key] = task
+	screen := a.screen
+	go func() {
+		done := work(ctx)
+		screen.PostEvent(tcell.NewEventInterrupt(func() {
+			if a.background[key] == task {
+				delete(a.background, key)
+			}
+			// Work cancelled on the main goroutine is dropped, even if it
+			// finished first
+			if ctx.Err() == nil {
+				done()
+			}
+			cancel()
+		}))
+	}()
+}
+
+// cancelBackground cancels the work running with a key, if there is any.
+func (a *app) cancelBackground(key string) {
+	if task := a.background[key]; task != nil {
+		task.cancel()
+		delete(a.background, key)
+	}
+}
+
+// cancelAllBackground cancels all the work running in the background.
+func (a *app) cancelAllBackground() {
+	for key := range a.background {
+		a.cancelBackground(key)
+	}
+}
+
+// cancelRequested cancels the work running in the background that the user
+// asked for, and returns how much there was.
+func (a *app) cancelRequested() int {
+	n := 0
+	for key := range a.background {
+		if !passiveRequests[key] {
+			a.cancelBackground(key)
+			n++
+		}
+	}
+	return n
+}
+
+// request makes a language server request with app.Background, and calls
+// done with the answer on the main goroutine. An error done returns is shown
+// on the status bar, as it would be for a command.
+func request[T any](app App, key string, req func(ctx context.Context) (T, error), done func(result T, err error) error) {
+	app.Background(key, func(ctx context.Context) func() {
+		result, err := req(ctx)
+		return func() {
+			if err := done(result, err); err != nil {
+				app.GetStatusBar().Errorf("Error executing command: %v", err)
+			}
+		}
+	})
+}
+
+// viewRequest is request for a request about the current view's text. The
+// answer is dropped if another view is made current or the text changes
+// before it arrives, as it would no longer fit.
+func viewRequest[T any](app App, key string, req func(ctx context.Context) (T, error), done func(result T, err error) error) {
+	view := app.GetCurrentView()
+	version := view.Buffer().GetVersion()
+	request(app, key, req, func(result T, err error) error {
+		if app.GetCurrentView() != view || view.Buffer().GetVersion() != version {
+			return nil
+		}
+		return done(result, err)
+	})
+}
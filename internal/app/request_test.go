@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// finishBackground runs the event loop until the work started in the
+// background has finished.
+func finishBackground(a *app) {
+	for len(a.background) > 0 {
+		if ev, ok := a.screen.PollEvent().(*tcell.EventInterrupt); ok {
+			runDispatched(ev)
+		}
+	}
+}
+
+// newBackgroundApp creates an app with a file open, drawing on a simulation
+// screen so that work is done in the background.
+func newBackgroundApp(t *testing.T, client *fakeLSPClient) (*app, *inputStatusBar) {
+	a := newCompletionApp(t, client, "package main\n", 0, 0)
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(40, 10)
+	a.screen = screen
+	sb := &inputStatusBar{}
+	a.statusBar = sb
+	return a, sb
+}
+
+func TestBackground(t *testing.T) {
+	a, _ := newBackgroundApp(t, &fakeLSPClient{})
+
+	release := make(chan struct{})
+	finished := false
+	a.Background("test", func(ctx context.Context) func() {
+		<-release
+		return func() { finished = true }
+	})
+	if finished {
+		t.Fatalf("expected the work to finish later")
+	}
+
+	// The result is delivered through the event loop
+	close(release)
+	finishBackground(a)
+	if !finished {
+		t.Fatalf("expected the result delivered")
+	}
+}
+
+func TestBackgroundCancel(t *testing.T) {
+	a, _ := newBackgroundApp(t, &fakeLSPClient{})
+
+	var results []string
+	work := func(name string) func(ctx context.Context) func() {
+		return func(ctx context.Context) func() {
+			<-ctx.Done()
+			return func() { results = append(results, name) }
+		}
+	}
+
+	// Starting work with the same key cancels the earlier work
+	a.Background("test", work("first"))
+	first := a.background["test"]
+	a.Background("test", work("second"))
+	if len(a.background) != 1 || a.background["test"] == first {
+		t.Fatalf("expected only the second work running got %v", a.background)
+	}
+
+	// Escape cancels what the user asked for, and the results are dropped,
+	// but leaves the work the editor started by itself
+	sb := &notifyStatusBar{}
+	a.statusBar = sb
+	a.Background(semanticTokensRequest, work("tokens"))
+	a.handleKey(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone))
+	if len(a.background) != 1 || a.background[semanticTokensRequest] == nil {
+		t.Fatalf("expected the requested work cancelled got %v", a.background)
+	}
+	if len(sb.notified) != 1 || sb.notified[0] != "Cancelled" || len(sb.messages) != 0 {
+		t.Fatalf("expected a notification got %v %v", sb.notified, sb.messages)
+	}
+
+	// With nothing the user asked for running, Escape doesn't say so
+	a.handleKey(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone))
+	if len(sb.notified) != 1 {
+		t.Fatalf("expected no more notifications got %v", sb.notified)
+	}
+	a.cancelAllBackground()
+	a.Background("test", func(ctx context.Context) func() { return func() {} })
+	finishBackground(a)
+	if len(results) != 0 {
+		t.Fatalf("expected cancelled results dropped got %v", results)
+	}
+}
+
+func TestViewRequestDropped(t *testing.T) {
+	client := &fakeLSPClient{hover: "docs"}
+	a, _ := newBackgroundApp(t, client)
+	view := a.GetCurrentView()
+
+	// An answer is dropped if the text changes before it arrives
+	(&CommandHover{}).Execute(a, nil)
+	view.InsertRune('x')
+	finishBackground(a)
+	if view.Popup() != nil {
+		t.Fatalf("expected the answer dropped after an edit")
+	}
+
+	// Any key cancels requests for a popup
+	(&CommandHover{}).Execute(a, nil)
+	a.handleKey(tcell.NewEventKey(tcell.KeyRight, 0, tcell.ModNone))
+	finishBackground(a)
+	if view.Popup() != nil {
+		t.Fatalf("expected the request cancelled by a key")
+	}
+
+	(&CommandHover{}).Execute(a, nil)
+	finishBackground(a)
+	if view.Popup() == nil {
+		t.Fatalf("expected the popup shown")
+	}
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/gdamore/tcell/v2"
+
+	"tked/internal/lsp"
+)
+
+// maxResultRows is the most results shown at once in the results pane.
+const maxResultRows = 8
+
+// resultsPane lists locations, such as the references to a symbol, below the
+// current view. It stays open while the user steps through the locations.
+type resultsPane struct {
+	title     string
+	locations []lsp.Location
+	items     []string
+	selected  int // -1 until a result has been chosen
+	top       int // first visible result
+
+	// y is the screen row the pane was last drawn at, for mouse clicks.
+	y int
+}
+
+// rows returns the number of screen rows the pane takes, including its title.
+func (p *resultsPane) rows() int {
+	return min(len(p.items), maxResultRows) + 1
+}
+
+// draw renders the pane with its title on screen row y. The selected result
+// is highlighted more strongly when the pane has the focus.
+func (p *resultsPane) draw(screen tcell.Screen, y int, focused bool) {
+	p.y = y
+	width, _ := screen.Size()
+	rows := p.rows() - 1
+
+	// Keep the selected result visible
+	if p.selected >= 0 && p.selected < p.top {
+		p.top = p.selected
+	} else if p.selected >= p.top+rows {
+		p.top = p.selected - rows + 1
+	}
+
+	title := fmt.Sprintf(" %s (%d)", p.title, len(p.items))
+	if p.selected >= 0 {
+		title = fmt.Sprintf(" %s (%d/%d)", p.title, p.selected+1, len(p.items))
+	}
+	fillString(screen, 0, y, width, tcell.StyleDefault.Reverse(true), title)
+	for row := 0; row < rows; row++ {
+		i := p.top + row
+		style := tcell.StyleDefault
+		marker := "  "
+		if i == p.selected {
+			marker = "> "
+			style = style.Bold(true)
+			if focused {
+				style = style.Reverse(true)
+			}
+		}
+		fillString(screen, 0, y+1+row, width, style, marker+p.items[i])
+	}
+}
+
+// indexAt returns the result drawn at screen row y.
+func (p *resultsPane) indexAt(y int) (int, bool) {
+	i := p.top + y - p.y - 1
+	if y <= p.y || y >= p.y+p.rows() || i >= len(p.items) {
+		return -1, false
+	}
+	return i, true
+}
+
+func (a *app) ShowResults(title string, locations []lsp.Location) {
+	if len(locations) == 0 {
+		a.results = nil
+	} else {
+		a.results = &resultsPane{
+			title:     title,
+			locations: locations,
+			items:     locationItems(a, locations),
+			selected:  -1,
+		}
+	}
+	a.layoutViews()
+}
+
+func (a *app) StepResult(delta int) bool {
+	p := a.results
+	if p == nil {
+		return false
+	}
+	switch {
+	case p.selected == -1 && delta < 0:
+		p.selected = len(p.locations) - 1
+	case p.selected == -1:
+		p.selected = 0
+	default:
+		p.selected = (p.selected + delta + len(p.locations)) % len(p.locations)
+	}
+	a.gotoResult()
+	return true
+}
+
+func (a *app) FocusResults() bool {
+	p := a.results
+	if p == nil || a.screen == nil {
+		return false
+	}
+	p.selected = max(0, p.selected)
+
+	for {
+		a.draw()
+		p.draw(a.screen, p.y, true)
+		a.screen.Show()
+
+		switch ev := a.screen.PollEvent().(type) {
+		case *tcell.EventKey:
+			switch ev.Key() {
+			case tcell.KeyEscape:
+				return true
+			case tcell.KeyEnter:
+				a.gotoResult()
+				return true
+			case tcell.KeyDelete:
+				a.ShowResults("", nil)
+				return true
+			case tcell.KeyUp:
+				p.selected = max(0, p.selected-1)
+			case tcell.KeyDown:
+				p.selected = min(len(p.items)-1, p.selected+1)
+			case tcell.KeyPgUp:
+				p.selected = max(0, p.selected-maxResultRows)
+			case tcell.KeyPgDn:
+				p.selected = min(len(p.items)-1, p.selected+maxResultRows)
+			}
+		case *tcell.EventResize:
+			a.handleResize(a.screen)
+		case *tcell.EventInterrupt:
+			runDispatched(ev)
+		}
+	}
+}
+
+// gotoResult jumps to the selected result.
+func (a *app) gotoResult() {
+	loc := a.results.locations[a.results.selected]
+	if err := a.JumpTo(loc.Filename, loc.Start); err != nil {
+		a.statusBar.Errorf("Error opening %s: %v", loc.Filename, err)
+	}
+}
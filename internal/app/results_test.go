@@ -0,0 +1,151 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+
+	"tked/internal/lsp"
+)
+
+// newResultsApp creates an app drawing on a simulation screen with results
+// listed for two files.
+func newResultsApp(t *testing.T) (*app, tcell.SimulationScreen, string, string) {
+	a, fileA, fileB := newNavigationApp(t)
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(100, 12)
+	a.screen = screen
+	a.statusBar.SetScreen(screen)
+	a.tabBar.SetScreen(screen)
+	a.OpenFile(fileA)
+	a.ShowResults("References", []lsp.Location{
+		{Filename: fileA, Start: lsp.Position{Line: 1, Offset: 1}},
+		{Filename: fileB, Start: lsp.Position{Line: 1, Offset: 0}},
+		{Filename: fileA, Start: lsp.Position{Line: 2, Offset: 3}},
+	})
+	return a, screen, fileA, fileB
+}
+
+// screenRow returns the text on a row of the screen.
+func screenRow(screen tcell.SimulationScreen, y int) string {
+	cells, width, _ := screen.GetContents()
+	var b strings.Builder
+	for _, c := range cells[y*width : (y+1)*width] {
+		b.WriteString(string(c.Runes))
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+func TestShowResults(t *testing.T) {
+	a, screen, fileA, _ := newResultsApp(t)
+
+	// The views make room for the pane's title and three results
+	if rows, _ := a.GetCurrentView().Size(); rows != 12-1-4 {
+		t.Fatalf("expected views to shrink for the pane got %d rows", rows)
+	}
+	a.draw()
+	screen.Show()
+	if got := screenRow(screen, 7); got != " References (3)" {
+		t.Fatalf("unexpected title %q", got)
+	}
+	if got := screenRow(screen, 8); got != "  "+fileA+":2:2: two" {
+		t.Fatalf("unexpected result %q", got)
+	}
+
+	a.ShowResults("", nil)
+	if a.results != nil {
+		t.Fatalf("expected the pane closed")
+	}
+	if rows, _ := a.GetCurrentView().Size(); rows != 12-1 {
+		t.Fatalf("expected views to fill the screen again got %d rows", rows)
+	}
+}
+
+func TestStepResult(t *testing.T) {
+	a, _, fileA, fileB := newResultsApp(t)
+
+	steps := []struct {
+		delta    int
+		filename string
+		row, col int
+	}{
+		{1, fileA, 1, 1},
+		{1, fileB, 1, 0},
+		{1, fileA, 2, 3},
+		{1, fileA, 1, 1}, // wraps around
+		{-1, fileA, 2, 3},
+	}
+	for _, s := range steps {
+		if !a.StepResult(s.delta) {
+			t.Fatalf("expected a result")
+		}
+		expectAt(t, a, s.filename, s.row, s.col)
+	}
+	if a.results == nil {
+		t.Fatalf("expected the pane to stay open")
+	}
+
+	a.ShowResults("", nil)
+	if a.StepResult(1) {
+		t.Fatalf("expected no results")
+	}
+}
+
+func TestStepResultBackwardsFirst(t *testing.T) {
+	a, _, fileA, _ := newResultsApp(t)
+	a.StepResult(-1)
+	expectAt(t, a, fileA, 2, 3)
+}
+
+func TestFocusResults(t *testing.T) {
+	a, screen, _, fileB := newResultsApp(t)
+	done := make(chan bool)
+	go func() { done <- a.FocusResults() }()
+	screen.InjectKey(tcell.KeyDown, 0, tcell.ModNone)
+	screen.InjectKey(tcell.KeyEnter, 0, tcell.ModNone)
+	if !<-done {
+		t.Fatalf("expected the pane to take the focus")
+	}
+	expectAt(t, a, fileB, 1, 0)
+
+	go func() { done <- a.FocusResults() }()
+	screen.InjectKey(tcell.KeyDelete, 0, tcell.ModNone)
+	<-done
+	if a.results != nil {
+		t.Fatalf("expected Delete to close the pane")
+	}
+}
+
+func TestHandleMouseResults(t *testing.T) {
+	a, _, fileA, _ := newResultsApp(t)
+	a.draw()
+	a.handleMouse(tcell.NewEventMouse(3, 10, tcell.Button1, tcell.ModNone))
+	expectAt(t, a, fileA, 2, 3)
+	if a.results.selected != 2 {
+		t.Fatalf("expected the clicked result selected")
+	}
+}
+
+func TestCommandReferences(t *testing.T) {
+	client := &fakeLSPClient{locations: map[string][]lsp.Location{
+		"references": {{Filename: "a.go"}, {Filename: "b.go"}},
+	}}
+	withFakeLSP(t, client)
+	sb := &inputStatusBar{}
+	d := &dummyApp{view: NewView("a.go", nil), sb: sb}
+
+	if _, err := (&CommandReferences{}).Execute(d, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(d.results) != 2 {
+		t.Fatalf("expected references shown got %v", d.results)
+	}
+
+	client.locations = nil
+	(&CommandReferences{}).Execute(d, nil)
+	if len(sb.messages) != 1 || sb.messages[0] != "No references found" {
+		t.Fatalf("expected no references message got %v", sb.messages)
+	}
+}
@@ -0,0 +1,129 @@
+package app
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+
+	"tked/internal/lsp"
+	"tked/internal/tklog"
+)
+
+// semanticStyles are the styles words are drawn in by the type the language
+// server gives them. Words of other types, such as variables, are drawn
+// plainly.
+var semanticStyles = map[string]tcell.Style{
+	"namespace":     tcell.StyleDefault.Foreground(tcell.ColorTeal),
+	"type":          tcell.StyleDefault.Foreground(tcell.ColorGreen),
+	"class":         tcell.StyleDefault.Foreground(tcell.ColorGreen),
+	"enum":          tcell.StyleDefault.Foreground(tcell.ColorGreen),
+	"interface":     tcell.StyleDefault.Foreground(tcell.ColorGreen),
+	"struct":        tcell.StyleDefault.Foreground(tcell.ColorGreen),
+	"typeParameter": tcell.StyleDefault.Foreground(tcell.ColorGreen),
+	"function":      tcell.StyleDefault.Foreground(tcell.ColorYellow),
+	"method":        tcell.StyleDefault.Foreground(tcell.ColorYellow),
+	"macro":         tcell.StyleDefault.Foreground(tcell.ColorYellow),
+	"keyword":       tcell.StyleDefault.Foreground(tcell.ColorFuchsia),
+	"modifier":      tcell.StyleDefault.Foreground(tcell.ColorFuchsia),
+	"enumMember":    tcell.StyleDefault.Foreground(tcell.ColorAqua),
+	"number":        tcell.StyleDefault.Foreground(tcell.ColorAqua),
+	"string":        tcell.StyleDefault.Foreground(tcell.ColorOlive),
+	"regexp":        tcell.StyleDefault.Foreground(tcell.ColorOlive),
+	"comment":       tcell.StyleDefault.Foreground(tcell.ColorGray),
+}
+
+// semanticStyle returns the style a token is drawn in, and false if it is
+// drawn plainly.
+func semanticStyle(token lsp.SemanticToken) (tcell.Style, bool) {
+	style, ok := semanticStyles[token.Type]
+	if slices.Contains(token.Modifiers, "deprecated") {
+		return style.StrikeThrough(true), true
+	}
+	return style, ok
+}
+
+// tokenSpans are the parts of the rows being drawn that the language server
+// has classified, worked out once each time a view is drawn, in order.
+type tokenSpans []tokenSpan
+
+// tokenSpan is the byte range of the buffer a token covers.
+type tokenSpan struct {
+	start, end int
+	style      tcell.Style
+}
+
+// newTokenSpans finds the tokens that start on rows top to bottom, not
+// including bottom. Tokens are sorted, and don't overlap or span rows.
+func newTokenSpans(buffer Buffer, tokens []lsp.SemanticToken, top, bottom int) tokenSpans {
+	var spans tokenSpans
+	i, _ := slices.BinarySearchFunc(tokens, top, func(token lsp.SemanticToken, row int) int {
+		return cmp.Compare(token.Start.Line, row)
+	})
+	for _, token := range tokens[i:] {
+		if token.Start.Line >= bottom {
+			break
+		}
+		if style, ok := semanticStyle(token); ok {
+			start := indexForLSPPosition(buffer, token.Start)
+			end := indexForLSPPosition(buffer, token.End)
+			spans = append(spans, tokenSpan{start: start, end: end, style: style})
+		}
+	}
+	return spans
+}
+
+// at returns the style of the token covering idx.
+func (s tokenSpans) at(idx int) (tcell.Style, bool) {
+	i := sort.Search(len(s), func(i int) bool { return s[i].start > idx }) - 1
+	if i >= 0 && idx < s[i].end {
+		return s[i].style, true
+	}
+	return tcell.StyleDefault, false
+}
+
+// semanticTokensPlace is a version of a view's text, as its language servers
+// see it. servers holds the servers' states, as a restarted server has to be
+// asked again.
+type semanticTokensPlace struct {
+	view    View
+	version int32
+	servers string
+}
+
+// updateSemanticTokens asks the language server for the current view's
+// semantic tokens when the view or its text changes, or its servers start
+// or stop. Until they come, the view is drawn with the last tokens, moved to
+// follow the edits. Requests that are cancelled are made again, and those
+// that fail once the servers' states change.
+func (a *app) updateSemanticTokens() {
+	view := a.GetCurrentView()
+	filename := view.Buffer().GetFilename()
+	var servers strings.Builder
+	for _, s := range serverStates(filename) {
+		fmt.Fprintf(&servers, "%s %v\x00", s.Name, s.State)
+	}
+	at := semanticTokensPlace{view: view, version: view.Buffer().GetVersion(), servers: servers.String()}
+	if at == a.semanticTokens || at == a.semanticTokensAsked && a.background[semanticTokensRequest] != nil {
+		return
+	}
+	client := getLSP(filename)
+	if client == nil || a.screen == nil {
+		return
+	}
+	a.semanticTokensAsked = at
+	request(a, semanticTokensRequest, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, client.UpdateSemanticTokens(ctx, filename)
+	}, func(_ struct{}, err error) error {
+		a.semanticTokens = at
+		if err != nil && !errors.Is(err, lsp.ErrNotSupported) {
+			tklog.Warn("Error getting semantic tokens for %s: %v", filename, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"go.lsp.dev/protocol"
+
+	"tked/internal/lsp"
+	"tked/internal/rope"
+)
+
+func TestViewDrawSemanticTokens(t *testing.T) {
+	client := &fakeLSPClient{
+		tokens: []lsp.SemanticToken{
+			{Start: lsp.Position{Line: 0, Offset: 0}, End: lsp.Position{Line: 0, Offset: 4}, Type: "keyword"},
+			{Start: lsp.Position{Line: 0, Offset: 5}, End: lsp.Position{Line: 0, Offset: 6}, Type: "function"},
+			{Start: lsp.Position{Line: 1, Offset: 0}, End: lsp.Position{Line: 1, Offset: 1}, Type: "variable"},
+			{Start: lsp.Position{Line: 1, Offset: 2}, End: lsp.Position{Line: 1, Offset: 3}, Type: "variable", Modifiers: []string{"deprecated"}},
+		},
+		diagnostics: []lsp.Diagnostic{
+			{Start: lsp.Position{Line: 0, Offset: 5}, End: lsp.Position{Line: 0, Offset: 6}, Severity: protocol.DiagnosticSeverityError},
+		},
+	}
+	withFakeLSP(t, client)
+
+	v := NewView("a.go", rope.NewRope("func f()\nx y"))
+	v.Resize(3, 12)
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(12, 3)
+	v.Draw(screen, 0, 0)
+	screen.Show()
+
+	// Words are coloured by type, and diagnostics are drawn over them
+	for _, tc := range []struct {
+		row, col int
+		fg       tcell.Color
+		attrs    tcell.AttrMask
+	}{
+		{0, 0, tcell.ColorFuchsia, 0},
+		{0, 3, tcell.ColorFuchsia, 0},
+		{0, 4, tcell.ColorDefault, 0},
+		{0, 5, tcell.ColorRed, tcell.AttrUnderline},
+		{1, 0, tcell.ColorDefault, 0},
+		{1, 2, tcell.ColorDefault, tcell.AttrStrikeThrough},
+	} {
+		_, _, style, _ := screen.GetContent(diagnosticGutterWidth+tc.col, tc.row)
+		if fg, _, attrs := style.Decompose(); fg != tc.fg || attrs != tc.attrs {
+			t.Fatalf("%d:%d: expected %v %v got %v %v", tc.row, tc.col, tc.fg, tc.attrs, fg, attrs)
+		}
+	}
+}
+
+func TestTokenSpans(t *testing.T) {
+	buffer := NewView("a.go", rope.NewRope("a\nbc d\ne")).Buffer()
+	tokens := []lsp.SemanticToken{
+		{Start: lsp.Position{Line: 0, Offset: 0}, End: lsp.Position{Line: 0, Offset: 1}, Type: "type"},
+		{Start: lsp.Position{Line: 1, Offset: 0}, End: lsp.Position{Line: 1, Offset: 2}, Type: "type"},
+		{Start: lsp.Position{Line: 1, Offset: 3}, End: lsp.Position{Line: 1, Offset: 4}, Type: "number"},
+		{Start: lsp.Position{Line: 2, Offset: 0}, End: lsp.Position{Line: 2, Offset: 1}, Type: "type"},
+	}
+
+	// Only tokens on the rows drawn are kept
+	spans := newTokenSpans(buffer, tokens, 1, 2)
+	if len(spans) != 2 {
+		t.Fatalf("expected the tokens on row 1 got %+v", spans)
+	}
+	for idx, want := range []string{"", "", "type", "type", "", "number", ""} {
+		style, ok := spans.at(idx)
+		if ok != (want != "") || ok && style != semanticStyles[want] {
+			t.Fatalf("%d: expected %q got %v", idx, want, style)
+		}
+	}
+}
+
+func TestUpdateSemanticTokens(t *testing.T) {
+	client := &fakeLSPClient{}
+	a, _ := newBackgroundApp(t, client)
+
+	a.updateSemanticTokens()
+	finishBackground(a)
+	if client.semanticTokenUpdates() != 1 {
+		t.Fatalf("expected the tokens asked for got %d requests", client.semanticTokenUpdates())
+	}
+
+	// They are only asked for again when the text changes
+	a.updateSemanticTokens()
+	finishBackground(a)
+	if client.semanticTokenUpdates() != 1 {
+		t.Fatalf("expected no new request got %d requests", client.semanticTokenUpdates())
+	}
+	a.GetCurrentView().InsertRune('x')
+	a.updateSemanticTokens()
+	finishBackground(a)
+	if client.semanticTokenUpdates() != 2 {
+		t.Fatalf("expected the tokens asked for again got %d requests", client.semanticTokenUpdates())
+	}
+
+	// Or when a request is cancelled before it is answered
+	a.GetCurrentView().InsertRune('y')
+	a.updateSemanticTokens()
+	a.cancelAllBackground()
+	a.updateSemanticTokens()
+	finishBackground(a)
+	// The cancelled request is still made, but its answer is dropped
+	for deadline := time.Now().Add(5 * time.Second); client.semanticTokenUpdates() < 4 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if client.semanticTokenUpdates() != 4 {
+		t.Fatalf("expected the cancelled request made again got %d requests", client.semanticTokenUpdates())
+	}
+
+	// Or when the server restarts, which a failed request is left for
+	client.mu.Lock()
+	client.err = errors.New("crashed")
+	client.mu.Unlock()
+	a.GetCurrentView().InsertRune('z')
+	a.updateSemanticTokens()
+	finishBackground(a)
+	a.updateSemanticTokens()
+	finishBackground(a)
+	if client.semanticTokenUpdates() != 5 {
+		t.Fatalf("expected a failed request left got %d requests", client.semanticTokenUpdates())
+	}
+	client.mu.Lock()
+	client.err = nil
+	client.mu.Unlock()
+	old := serverStates
+	t.Cleanup(func() { serverStates = old })
+	serverStates = func(string) []lsp.ServerStatus { return []lsp.ServerStatus{{Name: "gopls", State: lsp.ServerReady}} }
+	a.updateSemanticTokens()
+	finishBackground(a)
+	if client.semanticTokenUpdates() != 6 {
+		t.Fatalf("expected the tokens asked for after a restart got %d requests", client.semanticTokenUpdates())
+	}
+}
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"go.lsp.dev/protocol"
+
+	"tked/internal/lsp"
+	"tked/internal/rope"
+)
+
+// showServerMessage shows a message from a language server on the status
+// bar, or if the server offers actions, lets the user choose one. It returns
+// the index of the action chosen, or -1.
+func (a *app) showServerMessage(msg lsp.Message) int {
+	text := msg.Server + ": " + firstLine(msg.Text)
+	if len(msg.Actions) == 0 {
+		a.statusBar.Notify(text, messageStyle(msg.Type))
+		return -1
+	}
+	idx, ok := a.Pick(text, msg.Actions, 0, nil)
+	if !ok {
+		return -1
+	}
+	return idx
+}
+
+// messageStyle is the style a message from a language server is shown in.
+func messageStyle(typ protocol.MessageType) tcell.Style {
+	switch typ {
+	case protocol.MessageTypeError:
+		return tcell.StyleDefault.Foreground(tcell.ColorRed)
+	case protocol.MessageTypeWarning:
+		return tcell.StyleDefault.Foreground(tcell.ColorYellow)
+	}
+	return tcell.StyleDefault.Foreground(tcell.ColorWhite)
+}
+
+func (a *app) ShowText(title, text string) {
+	view := NewView("", rope.NewRope(text))
+	view.Buffer().SetTitle(title)
+	width, height := a.GetCurrentView().Size()
+	view.Resize(height, width)
+	view.SetCursor(view.Buffer().Contents().LineCount()-1, 0)
+
+	// Replace the text already shown with the title, unless it was edited
+	for i, v := range a.views {
+		if v.Buffer().GetFilename() == "" && v.Buffer().GetTitle() == title && !v.Buffer().IsDirty() {
+			a.views[i] = view
+			a.currentView = i
+			return
+		}
+	}
+	a.views = append(a.views, view)
+	a.currentView = len(a.views) - 1
+}
+
+// CommandServerLog shows what a language server for the current buffer has
+// logged, choosing which if there are several.
+type CommandServerLog struct{}
+
+func (c *CommandServerLog) Name() string { return "serverLog" }
+
+// serverLogs returns the logs of the language servers for a file. Tests
+// replace it.
+var serverLogs = lsp.ServerLogs
+
+func (c *CommandServerLog) Execute(app App, ev *tcell.EventKey) (bool, error) {
+	logs := serverLogs(app.GetCurrentView().Buffer().GetFilename())
+	if len(logs) == 0 {
+		app.GetStatusBar().Message("No language server")
+		return false, nil
+	}
+	log := logs[0]
+	if len(logs) > 1 {
+		names := make([]string, len(logs))
+		for i, l := range logs {
+			names[i] = l.Name
+		}
+		idx, ok := app.Pick("Language server log", names, 0, nil)
+		if !ok {
+			return false, nil
+		}
+		log = logs[idx]
+	}
+	app.ShowText(log.Name+" log", strings.Join(log.Lines, "\n"))
+	return false, nil
+}
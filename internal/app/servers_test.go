@@ -0,0 +1,111 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+	"go.lsp.dev/protocol"
+
+	"tked/internal/lsp"
+	"tked/internal/rope"
+)
+
+// notifyStatusBar records the notifications shown.
+type notifyStatusBar struct {
+	inputStatusBar
+	notified []string
+	styles   []tcell.Style
+}
+
+func (sb *notifyStatusBar) Notify(msg string, style tcell.Style) {
+	sb.notified = append(sb.notified, msg)
+	sb.styles = append(sb.styles, style)
+}
+
+func TestShowServerMessage(t *testing.T) {
+	a, _ := newBackgroundApp(t, &fakeLSPClient{})
+	a.tabBar.SetScreen(a.screen)
+	sb := &notifyStatusBar{}
+	a.statusBar = sb
+
+	// A message without actions is shown on the status bar
+	idx := a.showServerMessage(lsp.Message{Server: "gopls", Type: protocol.MessageTypeError, Text: "no go.mod\nsee the docs"})
+	if idx != -1 || len(sb.notified) != 1 || sb.notified[0] != "gopls: no go.mod" {
+		t.Fatalf("expected the first line notified got %d %v", idx, sb.notified)
+	}
+	if sb.styles[0] != messageStyle(protocol.MessageTypeError) {
+		t.Fatalf("expected an error shown in red")
+	}
+
+	// The user chooses one of the actions offered
+	screen := a.screen.(tcell.SimulationScreen)
+	screen.InjectKey(tcell.KeyDown, 0, tcell.ModNone)
+	screen.InjectKey(tcell.KeyEnter, 0, tcell.ModNone)
+	msg := lsp.Message{Server: "gopls", Text: "Create go.mod?", Actions: []string{"Ignore", "Create"}}
+	if idx := a.showServerMessage(msg); idx != 1 {
+		t.Fatalf("expected the second action chosen got %d", idx)
+	}
+	screen.InjectKey(tcell.KeyEscape, 0, tcell.ModNone)
+	if idx := a.showServerMessage(msg); idx != -1 {
+		t.Fatalf("expected no action chosen got %d", idx)
+	}
+}
+
+func TestShowText(t *testing.T) {
+	a := newCompletionApp(t, &fakeLSPClient{}, "package main\n", 0, 0)
+
+	a.ShowText("gopls log", "one\ntwo")
+	if len(a.views) != 2 || a.currentView != 1 {
+		t.Fatalf("expected the text shown in a new view got %d views", len(a.views))
+	}
+	view := a.GetCurrentView()
+	if view.Buffer().GetTitle() != "gopls log" || view.Buffer().Contents().String() != "one\ntwo" {
+		t.Fatalf("unexpected view %q %q", view.Buffer().GetTitle(), view.Buffer().Contents().String())
+	}
+	if row, _ := view.Cursor(); row != 1 {
+		t.Fatalf("expected the cursor on the last line got %d", row)
+	}
+
+	// Showing text with the same title again replaces it
+	a.SetCurrentView(a.views[0])
+	a.ShowText("gopls log", "three")
+	if len(a.views) != 2 || a.currentView != 1 || a.GetCurrentView().Buffer().Contents().String() != "three" {
+		t.Fatalf("expected the view replaced got %d views", len(a.views))
+	}
+
+	// Unless it was edited
+	a.GetCurrentView().InsertRune('x')
+	a.ShowText("gopls log", "four")
+	if len(a.views) != 3 || a.currentView != 2 {
+		t.Fatalf("expected the edited view kept got %d views", len(a.views))
+	}
+}
+
+func TestCommandServerLog(t *testing.T) {
+	old := serverLogs
+	t.Cleanup(func() { serverLogs = old })
+	var logs []lsp.ServerLog
+	serverLogs = func(filename string) []lsp.ServerLog { return logs }
+
+	sb := &inputStatusBar{}
+	app := &pickApp{dummyApp: dummyApp{sb: sb, view: NewView("a.go", rope.NewRope(""))}}
+	(&CommandServerLog{}).Execute(app, nil)
+	if len(sb.messages) != 1 || sb.messages[0] != "No language server" {
+		t.Fatalf("expected a message got %v", sb.messages)
+	}
+
+	// The log of the only server is shown
+	logs = []lsp.ServerLog{{Name: "gopls", Lines: []string{"started", "loaded"}}}
+	(&CommandServerLog{}).Execute(app, nil)
+	if app.text != [2]string{"gopls log", "started\nloaded"} {
+		t.Fatalf("unexpected text shown %q", app.text)
+	}
+
+	// Or the server chosen
+	logs = append(logs, lsp.ServerLog{Name: "lint", Lines: []string{"linting"}})
+	app.choice = 1
+	(&CommandServerLog{}).Execute(app, nil)
+	if len(app.items) != 2 || app.items[1] != "lint" || app.text != [2]string{"lint log", "linting"} {
+		t.Fatalf("expected the lint log shown got %q from %v", app.text, app.items)
+	}
+}
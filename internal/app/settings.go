@@ -3,9 +3,14 @@ package app
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/pelletier/go-toml/v2"
+
+	"tked/internal/lsp"
 )
 
 // Settings defines configurable editor options.
@@ -16,19 +21,132 @@ type Settings interface {
 	SetTabWidth(width int)
 	// KeyBindings returns the current key bindings.
 	KeyBindings() KeyBindings
+	// UndoHistory returns the settings for keeping undo history between
+	// sessions.
+	UndoHistory() UndoHistorySettings
+	// Language returns the settings for the language of the named file,
+	// named by its language identifier or else by its extension.
+	Language(filename string) LanguageSettings
+	// LanguageServers returns the language servers that can be started, in
+	// order of preference.
+	LanguageServers() []lsp.ServerConfig
 	// Save writes the current settings to the provided TOML file.
 	Save(filename string) error
 }
 
+// UndoHistorySettings controls how undo history is kept between sessions.
+type UndoHistorySettings struct {
+	// Enabled turns saving and restoring undo history on or off.
+	Enabled bool
+	// MaxStates is the most states kept for a file. The oldest are dropped
+	// first.
+	MaxStates int
+	// MaxBytes is the largest size of the history kept for a file.
+	MaxBytes int
+	// ExpiryDays is how many days the history for a file is kept after it
+	// was last saved. Zero keeps it forever.
+	ExpiryDays int
+}
+
+// LanguageSettings are options set per language, keyed by the language
+// identifier of a file such as "go".
+type LanguageSettings struct {
+	// FormatOnSave formats a file with its language server before it is
+	// saved.
+	FormatOnSave bool
+}
+
 // Default settings
 const (
 	DefaultTabWidth = 4
 )
 
+// DefaultUndoHistorySettings are the undo history settings used when none are
+// configured.
+var DefaultUndoHistorySettings = UndoHistorySettings{
+	Enabled:    true,
+	MaxStates:  1000,
+	MaxBytes:   1 << 20,
+	ExpiryDays: 30,
+}
+
+// undoHistoryConfig is the TOML form of UndoHistorySettings. Fields that are
+// missing keep their defaults.
+type undoHistoryConfig struct {
+	Enabled    *bool `toml:"enabled"`
+	MaxStates  *int  `toml:"max_states"`
+	MaxBytes   *int  `toml:"max_bytes"`
+	ExpiryDays *int  `toml:"expiry_days"`
+}
+
+// languageConfig is the TOML form of LanguageSettings.
+type languageConfig struct {
+	FormatOnSave *bool `toml:"format_on_save"`
+}
+
+// languageServerConfig is the TOML form of lsp.ServerConfig.
+type languageServerConfig struct {
+	Name                  string            `toml:"name"`
+	Command               string            `toml:"command"`
+	Args                  []string          `toml:"args,omitempty"`
+	Env                   map[string]string `toml:"env,omitempty"`
+	RootMarkers           []string          `toml:"root_markers,omitempty"`
+	Extensions            []string          `toml:"extensions,omitempty"`
+	Globs                 []string          `toml:"globs,omitempty"`
+	LanguageID            string            `toml:"language_id,omitempty"`
+	InitializationOptions map[string]any    `toml:"initialization_options,omitempty"`
+}
+
+// languageServers returns the default language servers with the configured
+// ones added. A configured server replaces a default one with the same name.
+func languageServers(configs []languageServerConfig) ([]lsp.ServerConfig, error) {
+	servers := slices.Clone(lsp.DefaultServers)
+	seen := make(map[string]struct{}, len(configs))
+	for _, c := range configs {
+		if c.Command == "" {
+			return nil, fmt.Errorf("language server %q has no command", c.Name)
+		}
+		if c.Name == "" {
+			c.Name = c.Command
+		}
+		if _, ok := seen[c.Name]; ok {
+			return nil, fmt.Errorf("duplicate language server %q", c.Name)
+		}
+		seen[c.Name] = struct{}{}
+
+		server := lsp.ServerConfig{
+			Name:        c.Name,
+			Command:     c.Command,
+			Args:        c.Args,
+			Env:         c.Env,
+			RootMarkers: c.RootMarkers,
+			Globs:       c.Globs,
+			LanguageID:  c.LanguageID,
+		}
+		for _, ext := range c.Extensions {
+			server.Extensions = append(server.Extensions, strings.TrimPrefix(ext, "."))
+		}
+		if c.InitializationOptions != nil {
+			server.InitializationOptions = c.InitializationOptions
+		}
+
+		i := slices.IndexFunc(servers, func(s lsp.ServerConfig) bool { return s.Name == c.Name })
+		if i >= 0 {
+			servers[i] = server
+		} else {
+			servers = append(servers, server)
+		}
+	}
+	return servers, nil
+}
+
 // settings is the default implementation of Settings.
 type settings struct {
 	tabWidth    int
 	keyBindings KeyBindings
+	undoHistory UndoHistorySettings
+	languages   map[string]LanguageSettings
+	servers     []lsp.ServerConfig
 }
 
 func (s *settings) TabWidth() int { return s.tabWidth }
@@ -42,6 +160,17 @@ func (s *settings) SetTabWidth(width int) {
 
 func (s *settings) KeyBindings() KeyBindings { return s.keyBindings }
 
+func (s *settings) UndoHistory() UndoHistorySettings { return s.undoHistory }
+
+func (s *settings) Language(filename string) LanguageSettings {
+	if language, ok := s.languages[lsp.LanguageID(filename)]; ok {
+		return language
+	}
+	return s.languages[strings.TrimPrefix(filepath.Ext(filename), ".")]
+}
+
+func (s *settings) LanguageServers() []lsp.ServerConfig { return s.servers }
+
 func (s *settings) Save(filename string) error {
 	var cfg struct {
 		TabWidth int `toml:"tab_width"`
@@ -50,9 +179,38 @@ func (s *settings) Save(filename string) error {
 			Mod     uint32 `toml:"mod"`
 			Command string `toml:"command"`
 		} `toml:"key_bindings"`
+		UndoHistory undoHistoryConfig         `toml:"undo_history"`
+		Languages   map[string]languageConfig `toml:"languages"`
+		Servers     []languageServerConfig    `toml:"language_servers"`
 	}
 
 	cfg.TabWidth = s.tabWidth
+	cfg.UndoHistory = undoHistoryConfig{
+		Enabled:    &s.undoHistory.Enabled,
+		MaxStates:  &s.undoHistory.MaxStates,
+		MaxBytes:   &s.undoHistory.MaxBytes,
+		ExpiryDays: &s.undoHistory.ExpiryDays,
+	}
+	if len(s.languages) > 0 {
+		cfg.Languages = make(map[string]languageConfig, len(s.languages))
+		for id, language := range s.languages {
+			cfg.Languages[id] = languageConfig{FormatOnSave: &language.FormatOnSave}
+		}
+	}
+	for _, server := range s.servers {
+		options, _ := server.InitializationOptions.(map[string]any)
+		cfg.Servers = append(cfg.Servers, languageServerConfig{
+			Name:                  server.Name,
+			Command:               server.Command,
+			Args:                  server.Args,
+			Env:                   server.Env,
+			RootMarkers:           server.RootMarkers,
+			Extensions:            server.Extensions,
+			Globs:                 server.Globs,
+			LanguageID:            server.LanguageID,
+			InitializationOptions: options,
+		})
+	}
 	cfg.Bindings = make([]struct {
 		Key     int    `toml:"key"`
 		Mod     uint32 `toml:"mod"`
@@ -80,6 +238,8 @@ func NewSettings() Settings {
 	return &settings{
 		tabWidth:    DefaultTabWidth,
 		keyBindings: DefaultKeyBindings(),
+		undoHistory: DefaultUndoHistorySettings,
+		servers:     lsp.DefaultServers,
 	}
 }
 
@@ -99,6 +259,9 @@ func NewSettingsFromFile(filename string) (Settings, error) {
 			Mod     uint32 `toml:"mod"`
 			Command string `toml:"command"`
 		} `toml:"key_bindings"`
+		UndoHistory undoHistoryConfig         `toml:"undo_history"`
+		Languages   map[string]languageConfig `toml:"languages"`
+		Servers     []languageServerConfig    `toml:"language_servers"`
 	}
 	if err := toml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
@@ -130,8 +293,42 @@ func NewSettingsFromFile(filename string) (Settings, error) {
 		keyBindings = NewKeyBindings(bindings)
 	}
 
+	// Set the undo history limits, ignoring values that make no sense
+	undoHistory := DefaultUndoHistorySettings
+	if cfg.UndoHistory.Enabled != nil {
+		undoHistory.Enabled = *cfg.UndoHistory.Enabled
+	}
+	if cfg.UndoHistory.MaxStates != nil && *cfg.UndoHistory.MaxStates > 0 {
+		undoHistory.MaxStates = *cfg.UndoHistory.MaxStates
+	}
+	if cfg.UndoHistory.MaxBytes != nil && *cfg.UndoHistory.MaxBytes > 0 {
+		undoHistory.MaxBytes = *cfg.UndoHistory.MaxBytes
+	}
+	if cfg.UndoHistory.ExpiryDays != nil && *cfg.UndoHistory.ExpiryDays >= 0 {
+		undoHistory.ExpiryDays = *cfg.UndoHistory.ExpiryDays
+	}
+
+	// Set the options for each language
+	languages := make(map[string]LanguageSettings, len(cfg.Languages))
+	for id, c := range cfg.Languages {
+		var language LanguageSettings
+		if c.FormatOnSave != nil {
+			language.FormatOnSave = *c.FormatOnSave
+		}
+		languages[id] = language
+	}
+
+	// Add the language servers to the defaults
+	servers, err := languageServers(cfg.Servers)
+	if err != nil {
+		return nil, err
+	}
+
 	return &settings{
 		tabWidth:    tabWidth,
 		keyBindings: keyBindings,
+		undoHistory: undoHistory,
+		languages:   languages,
+		servers:     servers,
 	}, nil
 }
@@ -95,3 +95,179 @@ func TestSettingsSave(t *testing.T) {
 		t.Fatalf("expected key bindings saved")
 	}
 }
+
+func TestSettingsUndoHistory(t *testing.T) {
+	commands = make(map[string]Command)
+	registerCommands()
+	if got := NewSettings().UndoHistory(); got != DefaultUndoHistorySettings {
+		t.Fatalf("expected default undo history settings got %+v", got)
+	}
+
+	filename := t.TempDir() + "/settings.toml"
+	content := "" +
+		"[undo_history]\n" +
+		"enabled = false\n" +
+		"max_states = 50\n" +
+		"max_bytes = -1\n"
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s, err := NewSettingsFromFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := DefaultUndoHistorySettings
+	want.Enabled = false
+	want.MaxStates = 50
+	if got := s.UndoHistory(); got != want {
+		t.Fatalf("expected %+v got %+v", want, got)
+	}
+
+	// The settings are saved
+	if err := s.Save(filename); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var cfg struct {
+		UndoHistory struct {
+			Enabled   bool `toml:"enabled"`
+			MaxStates int  `toml:"max_states"`
+		} `toml:"undo_history"`
+	}
+	if err := toml.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.UndoHistory.Enabled || cfg.UndoHistory.MaxStates != 50 {
+		t.Fatalf("unexpected saved undo history settings %+v", cfg.UndoHistory)
+	}
+}
+
+func TestSettingsLanguages(t *testing.T) {
+	commands = make(map[string]Command)
+	registerCommands()
+	if NewSettings().Language("main.go").FormatOnSave {
+		t.Fatalf("expected format on save off by default")
+	}
+
+	filename := t.TempDir() + "/settings.toml"
+	content := "" +
+		"[languages.go]\n" +
+		"format_on_save = true\n" +
+		"\n" +
+		"[languages.py]\n" +
+		"\n" +
+		"[languages.tsx]\n" +
+		"format_on_save = true\n"
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s, err := NewSettingsFromFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !s.Language("/src/main.go").FormatOnSave || s.Language("main.py").FormatOnSave || s.Language("README").FormatOnSave {
+		t.Fatalf("unexpected language settings")
+	}
+	// Languages can be named by extension, as tsx files are typescriptreact
+	if !s.Language("App.tsx").FormatOnSave || s.Language("App.ts").FormatOnSave {
+		t.Fatalf("expected language settings found by extension")
+	}
+
+	// The settings are saved
+	if err := s.Save(filename); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var cfg struct {
+		Languages map[string]struct {
+			FormatOnSave bool `toml:"format_on_save"`
+		} `toml:"languages"`
+	}
+	if err := toml.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.Languages["go"].FormatOnSave || cfg.Languages["py"].FormatOnSave {
+		t.Fatalf("unexpected saved language settings %+v", cfg.Languages)
+	}
+}
+
+func TestSettingsLanguageServers(t *testing.T) {
+	commands = make(map[string]Command)
+	registerCommands()
+	if got := NewSettings().LanguageServers(); len(got) != 1 || got[0].Name != "gopls" {
+		t.Fatalf("expected the default servers got %+v", got)
+	}
+
+	filename := t.TempDir() + "/settings.toml"
+	content := "" +
+		"[[language_servers]]\n" +
+		"name = \"gopls\"\n" +
+		"command = \"/opt/bin/gopls\"\n" +
+		"args = [\"serve\"]\n" +
+		"extensions = [\".go\"]\n" +
+		"root_markers = [\"go.mod\"]\n" +
+		"initialization_options = { usePlaceholders = true }\n" +
+		"\n" +
+		"[[language_servers]]\n" +
+		"command = \"lint-ls\"\n" +
+		"env = { LINT_LEVEL = \"strict\" }\n" +
+		"extensions = [\"go\"]\n" +
+		"globs = [\"Makefile\"]\n" +
+		"language_id = \"golang\"\n"
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s, err := NewSettingsFromFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	servers := s.LanguageServers()
+	if len(servers) != 2 {
+		t.Fatalf("expected the default replaced and a server added got %+v", servers)
+	}
+	gopls, lint := servers[0], servers[1]
+	if gopls.Command != "/opt/bin/gopls" || len(gopls.Args) != 1 || len(gopls.Extensions) != 1 || gopls.Extensions[0] != "go" {
+		t.Fatalf("unexpected gopls settings %+v", gopls)
+	}
+	if options, ok := gopls.InitializationOptions.(map[string]any); !ok || options["usePlaceholders"] != true {
+		t.Fatalf("unexpected initialization options %#v", gopls.InitializationOptions)
+	}
+	if lint.Name != "lint-ls" || lint.Env["LINT_LEVEL"] != "strict" || lint.Globs[0] != "Makefile" || lint.LanguageID != "golang" || lint.InitializationOptions != nil {
+		t.Fatalf("unexpected lint settings %+v", lint)
+	}
+
+	// The servers are saved
+	if err := s.Save(filename); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var cfg struct {
+		Servers []languageServerConfig `toml:"language_servers"`
+	}
+	if err := toml.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Servers) != 2 || cfg.Servers[1].Command != "lint-ls" || cfg.Servers[0].InitializationOptions["usePlaceholders"] != true {
+		t.Fatalf("unexpected saved servers %+v", cfg.Servers)
+	}
+
+	// A server needs a command, and names must be different
+	for _, content := range []string{
+		"[[language_servers]]\nname = \"x\"\n",
+		"[[language_servers]]\ncommand = \"x\"\n[[language_servers]]\ncommand = \"x\"\n",
+	} {
+		os.WriteFile(filename, []byte(content), 0644)
+		if _, err := NewSettingsFromFile(filename); err == nil {
+			t.Fatalf("expected an error for %q", content)
+		}
+	}
+}
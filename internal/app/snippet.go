@@ -0,0 +1,238 @@
+package app
+
+import (
+	"slices"
+	"strings"
+)
+
+// snippetStop is a tab stop in an expanded snippet: the byte range of its
+// placeholder text, which is empty for a plain $1.
+type snippetStop struct {
+	number     int
+	start, end int
+}
+
+// expandSnippet expands a snippet in the LSP snippet syntax, returning the
+// text to insert and its tab stops in the order they are visited. The final
+// stop, $0, is last and is added at the end of the text if the snippet
+// doesn't have one. Variables such as $TM_FILENAME expand to their default
+// text, as the editor doesn't provide any.
+func expandSnippet(snippet string) (string, []snippetStop) {
+	p := &snippetParser{s: snippet}
+	p.parse(0)
+	text := p.out.String()
+
+	// Visit the stops in number order with $0 last. Where a number is used
+	// more than once, the first is visited.
+	var stops []snippetStop
+	seen := map[int]bool{}
+	for _, stop := range p.stops {
+		if !seen[stop.number] {
+			seen[stop.number] = true
+			stops = append(stops, stop)
+		}
+	}
+	if !seen[0] {
+		stops = append(stops, snippetStop{number: 0, start: len(text), end: len(text)})
+	}
+	slices.SortStableFunc(stops, func(a, b snippetStop) int {
+		if a.number == 0 || b.number == 0 {
+			return b.number - a.number // 0 sorts last
+		}
+		return a.number - b.number
+	})
+	return text, stops
+}
+
+type snippetParser struct {
+	s     string
+	i     int
+	out   strings.Builder
+	stops []snippetStop
+}
+
+// parse expands the snippet up to an unescaped closing character, which is
+// left for the caller, or to the end if close is 0.
+func (p *snippetParser) parse(close byte) {
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		switch {
+		case c == close:
+			return
+		case c == '\\' && p.i+1 < len(p.s) && strings.IndexByte(`$}\,|`, p.s[p.i+1]) >= 0:
+			p.out.WriteByte(p.s[p.i+1])
+			p.i += 2
+		case c == '$':
+			p.i++
+			if !p.dollar() {
+				p.out.WriteByte('$')
+			}
+		default:
+			p.out.WriteByte(c)
+			p.i++
+		}
+	}
+}
+
+// dollar expands the tab stop or variable after a '$'. It returns false,
+// consuming nothing, if there isn't one.
+func (p *snippetParser) dollar() bool {
+	start := p.i
+	if n, ok := p.number(); ok {
+		p.stops = append(p.stops, snippetStop{number: n, start: p.out.Len(), end: p.out.Len()})
+		return true
+	}
+	if p.name() != "" {
+		return true // a variable with no value
+	}
+	if p.i >= len(p.s) || p.s[p.i] != '{' {
+		return false
+	}
+	p.i++
+
+	n, isStop := p.number()
+	if !isStop && p.name() == "" {
+		p.i = start
+		return false
+	}
+	stop := snippetStop{number: n, start: p.out.Len()}
+	switch {
+	case p.i < len(p.s) && p.s[p.i] == '}':
+	case p.i < len(p.s) && p.s[p.i] == ':':
+		// A placeholder, or a variable's default text
+		p.i++
+		p.parse('}')
+	case isStop && p.i < len(p.s) && p.s[p.i] == '|':
+		// A choice, which inserts the first option
+		p.i++
+		var choice strings.Builder
+		for p.i < len(p.s) && p.s[p.i] != ',' && p.s[p.i] != '|' {
+			if p.s[p.i] == '\\' && p.i+1 < len(p.s) {
+				p.i++
+			}
+			choice.WriteByte(p.s[p.i])
+			p.i++
+		}
+		p.out.WriteString(choice.String())
+		for p.i < len(p.s) && p.s[p.i] != '}' {
+			p.i++
+		}
+	default:
+		p.i = start
+		return false
+	}
+	if p.i >= len(p.s) {
+		// Unterminated, so treat what was read as text
+		return true
+	}
+	p.i++ // the closing '}'
+	if isStop {
+		stop.end = p.out.Len()
+		p.stops = append(p.stops, stop)
+	}
+	return true
+}
+
+// number reads a tab stop number.
+func (p *snippetParser) number() (int, bool) {
+	n, digits := 0, 0
+	for p.i < len(p.s) && p.s[p.i] >= '0' && p.s[p.i] <= '9' {
+		n = n*10 + int(p.s[p.i]-'0')
+		p.i++
+		digits++
+	}
+	return n, digits > 0
+}
+
+// name reads a variable name.
+func (p *snippetParser) name() string {
+	start := p.i
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || p.i > start && c >= '0' && c <= '9' {
+			p.i++
+			continue
+		}
+		break
+	}
+	return p.s[start:p.i]
+}
+
+// snippetSession tracks the tab stops of a snippet inserted into a buffer, so
+// that Tab and Shift+Tab can move between them.
+type snippetSession struct {
+	view    View
+	stops   []snippetStop // byte indexes in the buffer
+	current int
+	change  ChangeRegistration
+}
+
+// newSnippetSession starts a session for the stops of a snippet inserted at
+// offset in the view's buffer, selecting the first stop.
+func newSnippetSession(view View, offset int, stops []snippetStop) *snippetSession {
+	s := &snippetSession{view: view}
+	for _, stop := range stops {
+		stop.start += offset
+		stop.end += offset
+		s.stops = append(s.stops, stop)
+	}
+	s.change = view.Buffer().OnChange(s.onBufferChange, nil)
+	s.selectStop()
+	return s
+}
+
+// onBufferChange moves the stops to follow edits. The current stop grows
+// as text is typed into it.
+func (s *snippetSession) onBufferChange(buffer Buffer, ev ChangeEvent, context any) {
+	for i := range s.stops {
+		stop := &s.stops[i]
+		stop.start = shiftIndex(stop.start, ev, i == s.current)
+		stop.end = shiftIndex(stop.end, ev, false)
+	}
+}
+
+// shiftIndex returns where a byte index is after a change. An index at the
+// start of an insertion stays before the inserted text if stick is set, and
+// otherwise moves after it.
+func shiftIndex(idx int, ev ChangeEvent, stick bool) int {
+	switch {
+	case idx < ev.Start || idx == ev.Start && stick:
+		return idx
+	case idx < ev.OldEnd:
+		return ev.Start
+	}
+	return idx + ev.NewEnd - ev.OldEnd
+}
+
+// move moves to the next stop, or the previous one if delta is negative. It
+// returns false when the session is over, having reached the final stop.
+func (s *snippetSession) move(delta int) bool {
+	s.current = max(0, s.current+delta)
+	s.selectStop()
+	if s.current >= len(s.stops)-1 {
+		s.end()
+		return false
+	}
+	return true
+}
+
+// selectStop puts the cursor at the end of the current stop with its
+// placeholder selected.
+func (s *snippetSession) selectStop() {
+	stop := s.stops[min(s.current, len(s.stops)-1)]
+	buffer := s.view.Buffer()
+	startRow, startCol := positionForIndex(buffer, stop.start)
+	endRow, endCol := positionForIndex(buffer, stop.end)
+	s.view.SetCursor(endRow, endCol)
+	s.view.ClearAnchor()
+	if stop.end > stop.start {
+		s.view.SetSelections([]Selection{orderedSelection(startRow, startCol, endRow, endCol)})
+	} else {
+		s.view.SetSelections(nil)
+	}
+}
+
+// end stops tracking the buffer.
+func (s *snippetSession) end() {
+	s.change.Remove()
+}
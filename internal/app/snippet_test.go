@@ -0,0 +1,75 @@
+package app
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExpandSnippet(t *testing.T) {
+	tests := []struct {
+		snippet string
+		text    string
+		stops   []snippetStop
+	}{
+		{"plain", "plain", []snippetStop{{0, 5, 5}}},
+		{"f($1, $2)$0;", "f(, );", []snippetStop{{1, 2, 2}, {2, 4, 4}, {0, 5, 5}}},
+		{"${2:b} ${1:a}", "b a", []snippetStop{{1, 2, 3}, {2, 0, 1}, {0, 3, 3}}},
+		{"${1:outer ${2:inner}}", "outer inner", []snippetStop{{1, 0, 11}, {2, 6, 11}, {0, 11, 11}}},
+		{"${1|one,two|}", "one", []snippetStop{{1, 0, 3}, {0, 3, 3}}},
+		{"$TM_FILENAME${NAME:default}", "default", []snippetStop{{0, 7, 7}}},
+		{`\$1 \} \\ $`, `$1 } \ $`, []snippetStop{{0, 8, 8}}},
+		{"${1:unterminated", "unterminated", []snippetStop{{0, 12, 12}}},
+		{"$1 $1", " ", []snippetStop{{1, 0, 0}, {0, 1, 1}}},
+	}
+	for _, tt := range tests {
+		text, stops := expandSnippet(tt.snippet)
+		if text != tt.text || !slices.Equal(stops, tt.stops) {
+			t.Fatalf("%q: expected %q %v got %q %v", tt.snippet, tt.text, tt.stops, text, stops)
+		}
+	}
+}
+
+func TestSnippetSessionFollowsEdits(t *testing.T) {
+	ResetApp()
+	NewApp()
+	v := NewView("", nil)
+	b := v.Buffer()
+	text, stops := expandSnippet("f(${1:x}, $2)")
+	b.Insert(0, "// "+text)
+
+	s := newSnippetSession(v, 3, stops)
+	if sel := v.Selections(); len(sel) != 1 || sel[0] != (Selection{StartRow: 0, StartCol: 5, EndRow: 0, EndCol: 6}) {
+		t.Fatalf("expected the placeholder selected got %v", sel)
+	}
+
+	// Typing over the placeholder grows the stop and moves the ones after
+	b.Delete(5, 6)
+	b.Insert(5, "abc")
+	if s.stops[0].start != 5 || s.stops[0].end != 8 || s.stops[1].start != 10 {
+		t.Fatalf("unexpected stops %+v", s.stops)
+	}
+
+	if !s.move(1) {
+		t.Fatalf("expected more stops")
+	}
+	if row, col := v.Cursor(); row != 0 || col != 10 {
+		t.Fatalf("expected the cursor at the second stop got %d,%d", row, col)
+	}
+	s.move(-1)
+	if row, col := v.Cursor(); row != 0 || col != 8 {
+		t.Fatalf("expected the cursor back at the first stop got %d,%d", row, col)
+	}
+
+	// Reaching the final stop ends the session
+	s.move(1)
+	if s.move(1) {
+		t.Fatalf("expected the session to end")
+	}
+	if row, col := v.Cursor(); row != 0 || col != 11 {
+		t.Fatalf("expected the cursor at the end got %d,%d", row, col)
+	}
+	b.Insert(0, "x")
+	if s.stops[2].start != 11 {
+		t.Fatalf("expected the session to stop following edits")
+	}
+}
@@ -2,8 +2,12 @@ package app
 
 import (
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/gdamore/tcell/v2"
+
+	"tked/internal/lsp"
 )
 
 // StatusBar describes the behaviour of a status bar component.
@@ -23,12 +27,39 @@ type StatusBar interface {
 	// Input displays a prompt on the status bar and returns the entered value.
 	// The boolean return is false if the prompt was cancelled with Esc.
 	Input(prompt string) (string, bool)
+	// InputDefault is like Input with initial already entered.
+	InputDefault(prompt, initial string) (string, bool)
+	// Progress immediately shows the progress of a long running operation on
+	// the status bar. total may be zero if the amount of work is unknown.
+	Progress(msg string, done, total int64)
+	// Notify shows a message on the status bar for a few seconds without
+	// waiting for a key, such as one from a language server.
+	Notify(msg string, style tcell.Style)
 }
 
 type statusBar struct {
 	screen tcell.Screen
+
+	// notification is shown in place of the diagnostic at the cursor until
+	// notificationEnd.
+	notification      string
+	notificationStyle tcell.Style
+	notificationEnd   time.Time
+	// spinning is set while a redraw is waiting to turn a spinner.
+	spinning bool
 }
 
+// notifyDuration is how long a notification is shown, and spinInterval how
+// often a spinner turns.
+const (
+	notifyDuration = 5 * time.Second
+	spinInterval   = 100 * time.Millisecond
+)
+
+// spinnerFrames are the frames of the spinner shown for work whose progress
+// is unknown.
+const spinnerFrames = `-\|/`
+
 // SetScreen sets the screen that the status bar will draw on.
 func (sb *statusBar) SetScreen(s tcell.Screen) {
 	if s == nil {
@@ -59,6 +90,82 @@ func (sb *statusBar) Draw(v View) {
 	width, height := sb.screen.Size()
 	sb.drawText(0, height-1, width-1, tcell.StyleDefault.Foreground(tcell.ColorWhite), filename+dirty)
 	sb.drawText(len(filename)+len(dirty), height-1, width-1, tcell.StyleDefault.Foreground(tcell.ColorWhite), cursor)
+
+	// Show the states of the file's language servers on the right, and a
+	// notification or the diagnostic at the cursor in the space left
+	left := len(filename) + len(dirty) + len(cursor) + 2
+	end := width - 1
+	if v != nil {
+		for _, s := range slices.Backward(serverStates(v.Buffer().GetFilename())) {
+			text := s.Name + " " + s.State.String()
+			if s.State == lsp.ServerReady && len(s.Progress) > 0 {
+				text = s.Name + " " + sb.progressText(s.Progress[0])
+			}
+			x := end - len(text)
+			if x < left {
+				break
+			}
+			sb.drawText(x, height-1, end, serverStateStyle(s.State), text)
+			end = x - 2
+		}
+	}
+	if now().Before(sb.notificationEnd) {
+		sb.drawText(left, height-1, end, sb.notificationStyle, firstLine(sb.notification))
+	} else if v != nil {
+		if d, ok := cursorDiagnostic(v); ok {
+			sb.drawText(left, height-1, end, diagnosticStyle(d.Severity), firstLine(d.Message))
+		}
+	}
+}
+
+// maxProgressWidth is the most of the status bar a server's progress takes.
+const maxProgressWidth = 40
+
+// progressText describes work a language server is doing, with its
+// percentage if the server says, or else a spinner that turns while it is
+// shown.
+func (sb *statusBar) progressText(p lsp.Progress) string {
+	text := p.Title
+	if p.Message != "" {
+		text += ": " + p.Message
+	}
+	if len(text) > maxProgressWidth {
+		text = text[:maxProgressWidth-3] + "..."
+	}
+	if p.Percentage >= 0 {
+		return fmt.Sprintf("%s %d%%", text, p.Percentage)
+	}
+
+	if !sb.spinning {
+		sb.spinning = true
+		sb.redrawAfter(spinInterval, func() { sb.spinning = false })
+	}
+	frame := now().UnixMilli() / spinInterval.Milliseconds() % int64(len(spinnerFrames))
+	return spinnerFrames[frame:frame+1] + " " + text
+}
+
+// redrawAfter runs fn on the main goroutine after a delay, which redraws the
+// screen.
+func (sb *statusBar) redrawAfter(delay time.Duration, fn func()) {
+	screen := sb.screen
+	time.AfterFunc(delay, func() {
+		screen.PostEvent(tcell.NewEventInterrupt(fn))
+	})
+}
+
+// serverStates returns the states of the language servers for a file. Tests
+// replace it.
+var serverStates = lsp.ServerStates
+
+// serverStateStyle is the style a language server's state is shown in.
+func serverStateStyle(state lsp.ServerState) tcell.Style {
+	switch state {
+	case lsp.ServerReady:
+		return tcell.StyleDefault.Foreground(tcell.ColorGreen)
+	case lsp.ServerCrashed, lsp.ServerFailed:
+		return tcell.StyleDefault.Foreground(tcell.ColorRed)
+	}
+	return tcell.StyleDefault.Foreground(tcell.ColorYellow)
 }
 
 // Message displays a message on the status bar.
@@ -85,7 +192,13 @@ func (sb *statusBar) Errorf(format string, args ...any) {
 // second return value will be false if the user pressed Esc to cancel the
 // prompt.
 func (sb *statusBar) Input(prompt string) (string, bool) {
-	input := []rune{}
+	return sb.InputDefault(prompt, "")
+}
+
+// InputDefault is like Input with initial already entered, for the user to
+// edit or replace.
+func (sb *statusBar) InputDefault(prompt, initial string) (string, bool) {
+	input := []rune(initial)
 	for {
 		width, height := sb.screen.Size()
 		// Clear the status line
@@ -112,10 +225,43 @@ func (sb *statusBar) Input(prompt string) (string, bool) {
 			}
 		case *tcell.EventResize:
 			sb.screen.Sync()
+		case *tcell.EventInterrupt:
+			runDispatched(ev)
 		}
 	}
 }
 
+// Notify shows a message on the status bar for a few seconds, without waiting
+// for a key.
+func (sb *statusBar) Notify(msg string, style tcell.Style) {
+	sb.notification = msg
+	sb.notificationStyle = style
+	sb.notificationEnd = now().Add(notifyDuration)
+	if sb.screen != nil {
+		sb.redrawAfter(notifyDuration, func() {})
+	}
+}
+
+// Progress immediately shows the progress of a long running operation. It does
+// nothing if the status bar has no screen yet.
+func (sb *statusBar) Progress(msg string, done, total int64) {
+	if sb.screen == nil {
+		return
+	}
+
+	text := fmt.Sprintf("%s %d KB", msg, done/1024)
+	if total > 0 {
+		text = fmt.Sprintf("%s %d%%", msg, min(100, done*100/total))
+	}
+
+	width, height := sb.screen.Size()
+	for x := range width {
+		sb.screen.SetContent(x, height-1, ' ', nil, tcell.StyleDefault)
+	}
+	sb.drawText(0, height-1, width-1, tcell.StyleDefault.Foreground(tcell.ColorWhite), text)
+	sb.screen.Show()
+}
+
 func (sb *statusBar) drawPrompt(msg string, style tcell.Style) {
 	for {
 		width, height := sb.screen.Size()
@@ -125,11 +271,13 @@ func (sb *statusBar) drawPrompt(msg string, style tcell.Style) {
 		// TODO: this is a hack to get the message to display for a short time
 		// and then disappear. It should be replaced with a more robust solution.
 		ev := sb.screen.PollEvent()
-		switch ev.(type) {
+		switch ev := ev.(type) {
 		case *tcell.EventKey, *tcell.EventMouse:
 			return
 		case *tcell.EventResize:
 			sb.screen.Sync()
+		case *tcell.EventInterrupt:
+			runDispatched(ev)
 		}
 	}
 }
@@ -1,9 +1,14 @@
 package app
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gdamore/tcell/v2"
+
+	"tked/internal/lsp"
+	"tked/internal/rope"
 )
 
 func TestStatusBarInputEnter(t *testing.T) {
@@ -48,3 +53,124 @@ func TestStatusBarInputEsc(t *testing.T) {
 		t.Fatalf("expected cancel got %q %v", val, ok)
 	}
 }
+
+func TestStatusBarProgress(t *testing.T) {
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(20, 5)
+	sb := NewStatusBar()
+	sb.Progress("ignored", 1, 2) // no screen yet, must not panic
+	sb.SetScreen(screen)
+	sb.Progress("Load", 50, 200)
+
+	want := "Load 25%"
+	for col, r := range want {
+		ch, _, _, _ := screen.GetContent(col, 4)
+		if ch != r {
+			t.Fatalf("expected %q on status line, mismatch at col %d", want, col)
+		}
+	}
+}
+
+func TestStatusBarServerStates(t *testing.T) {
+	old := serverStates
+	t.Cleanup(func() { serverStates = old })
+	serverStates = func(filename string) []lsp.ServerStatus {
+		return []lsp.ServerStatus{{Name: "gopls", State: lsp.ServerReady}, {Name: "lint", State: lsp.ServerCrashed}}
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(40, 2)
+	sb := NewStatusBar()
+	sb.SetScreen(screen)
+	sb.Draw(NewView("a.go", rope.NewRope("")))
+	screen.Show()
+
+	line := statusLine(screen)
+	if want := "gopls ready  lint crashed "; line[len(line)-len(want):] != want {
+		t.Fatalf("expected %q at the end of the status bar got %q", want, line)
+	}
+	if _, _, style, _ := screen.GetContent(len(line)-3, 1); style != serverStateStyle(lsp.ServerCrashed) {
+		t.Fatalf("expected a crashed server shown in red")
+	}
+}
+
+// statusLine returns the text on the last line of a screen.
+func statusLine(screen tcell.SimulationScreen) string {
+	cells, width, height := screen.GetContents()
+	line := ""
+	for _, c := range cells[width*(height-1):] {
+		line += string(c.Runes)
+	}
+	return line
+}
+
+func TestStatusBarServerProgress(t *testing.T) {
+	old := serverStates
+	t.Cleanup(func() { serverStates = old })
+	progress := lsp.Progress{Title: "Loading", Message: "3/4 packages", Percentage: 75}
+	serverStates = func(filename string) []lsp.ServerStatus {
+		return []lsp.ServerStatus{{Name: "gopls", State: lsp.ServerReady, Progress: []lsp.Progress{progress}}}
+	}
+
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(60, 2)
+	sb := NewStatusBar().(*statusBar)
+	sb.SetScreen(screen)
+	sb.Draw(NewView("a.go", rope.NewRope("")))
+	screen.Show()
+	if want := "gopls Loading: 3/4 packages 75% "; !strings.HasSuffix(statusLine(screen), want) {
+		t.Fatalf("expected %q at the end of the status bar got %q", want, statusLine(screen))
+	}
+
+	// Without a percentage a spinner turns, redrawing until it is hidden
+	progress = lsp.Progress{Title: "Indexing", Percentage: -1}
+	screen.Clear()
+	sb.Draw(NewView("a.go", rope.NewRope("")))
+	screen.Show()
+	if line := statusLine(screen); !strings.HasSuffix(line[:len(line)-len("Indexing ")], " ") || !strings.HasSuffix(line, "Indexing ") {
+		t.Fatalf("expected the spinner shown got %q", line)
+	}
+	if !sb.spinning {
+		t.Fatalf("expected a redraw scheduled")
+	}
+	if ev, ok := screen.PollEvent().(*tcell.EventInterrupt); !ok {
+		t.Fatalf("expected a redraw got %v", ev)
+	} else {
+		runDispatched(ev)
+	}
+	if sb.spinning {
+		t.Fatalf("expected the spinner ready to turn again")
+	}
+}
+
+func TestStatusBarNotify(t *testing.T) {
+	oldNow, oldStates := now, serverStates
+	t.Cleanup(func() { now, serverStates = oldNow, oldStates })
+	serverStates = func(filename string) []lsp.ServerStatus { return nil }
+	start := time.Now()
+	now = func() time.Time { return start }
+
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(40, 2)
+	sb := NewStatusBar()
+	sb.SetScreen(screen)
+	sb.Notify("gopls: go.mod is missing", tcell.StyleDefault.Foreground(tcell.ColorYellow))
+	sb.Draw(NewView("a.go", rope.NewRope("")))
+	screen.Show()
+	if line := statusLine(screen); !strings.Contains(line, "gopls: go.mod is missing") {
+		t.Fatalf("expected the notification shown got %q", line)
+	}
+
+	// The notification is hidden after a while
+	now = func() time.Time { return start.Add(notifyDuration) }
+	screen.Clear()
+	sb.Draw(NewView("a.go", rope.NewRope("")))
+	screen.Show()
+	if line := statusLine(screen); strings.Contains(line, "go.mod") {
+		t.Fatalf("expected the notification hidden got %q", line)
+	}
+}
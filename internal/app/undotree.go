@@ -0,0 +1,87 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// undoTreeItems returns one line describing each of the states, for showing
+// the undo tree in a picker. States are listed in the order they were created
+// and indented by how many branches deep they are.
+func undoTreeItems(states []UndoState, at time.Time) []string {
+	// A state stays at its parent's depth if it is the parent's first child,
+	// otherwise it starts a new branch one level deeper.
+	depth := make([]int, len(states))
+	hasChild := make([]bool, len(states))
+	items := make([]string, len(states))
+	for i, s := range states {
+		marker := "o"
+		if s.Current {
+			marker = "@"
+		}
+		from := ""
+		if s.Parent >= 0 {
+			depth[i] = depth[s.Parent]
+			if hasChild[s.Parent] {
+				depth[i]++
+			}
+			hasChild[s.Parent] = true
+			from = fmt.Sprintf(" (from #%d)", s.Parent)
+		}
+		items[i] = fmt.Sprintf("%s%s #%d%s  %s", strings.Repeat("  ", depth[i]), marker, s.Seq, from, formatAge(at.Sub(s.Time)))
+	}
+	return items
+}
+
+// formatAge returns a short description of how long ago something happened.
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return "just now"
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
+
+// currentUndoState returns the current state from the list of states.
+func currentUndoState(states []UndoState) UndoState {
+	for _, s := range states {
+		if s.Current {
+			return s
+		}
+	}
+	return states[0]
+}
+
+// undoStateAt returns the sequence number of the most recently created state
+// that existed at time t, or the initial state if t is before all of them.
+func undoStateAt(states []UndoState, t time.Time) int {
+	seq := 0
+	for _, s := range states {
+		if !s.Time.After(t) {
+			seq = s.Seq
+		}
+	}
+	return seq
+}
+
+// parseUndoTime parses a time offset such as "5m" (back five minutes) or "+1h"
+// (forward one hour).
+func parseUndoTime(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	forward := strings.HasPrefix(s, "+")
+	d, err := time.ParseDuration(strings.TrimLeft(s, "+-"))
+	if err != nil {
+		return 0, err
+	}
+	if !forward {
+		d = -d
+	}
+	return d, nil
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"tked/internal/rope"
+)
+
+func TestUndoTreeItems(t *testing.T) {
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	states := []UndoState{
+		{Seq: 0, Parent: -1, Time: at.Add(-time.Hour)},
+		{Seq: 1, Parent: 0, Time: at.Add(-10 * time.Minute)},
+		{Seq: 2, Parent: 1, Time: at.Add(-5 * time.Minute)},
+		{Seq: 3, Parent: 1, Time: at.Add(-30 * time.Second), Current: true},
+	}
+	items := undoTreeItems(states, at)
+	want := []string{
+		"o #0  1h ago",
+		"o #1 (from #0)  10m ago",
+		"o #2 (from #1)  5m ago",
+		"  @ #3 (from #1)  30s ago",
+	}
+	if strings.Join(items, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected items:\n%s", strings.Join(items, "\n"))
+	}
+}
+
+func TestParseUndoTime(t *testing.T) {
+	if d, err := parseUndoTime("5m"); err != nil || d != -5*time.Minute {
+		t.Fatalf("expected -5m got %v %v", d, err)
+	}
+	if d, err := parseUndoTime(" +1h "); err != nil || d != time.Hour {
+		t.Fatalf("expected 1h got %v %v", d, err)
+	}
+	if _, err := parseUndoTime("soon"); err == nil {
+		t.Fatalf("expected error for invalid offset")
+	}
+}
+
+type inputStatusBar struct {
+	stubStatusBar
+	input    string
+	initial  string
+	messages []string
+	errors   []string
+}
+
+func (sb *inputStatusBar) Input(string) (string, bool) { return sb.input, true }
+func (sb *inputStatusBar) Message(msg string)          { sb.messages = append(sb.messages, msg) }
+func (sb *inputStatusBar) Errorf(format string, args ...any) {
+	sb.errors = append(sb.errors, fmt.Sprintf(format, args...))
+}
+
+func (sb *inputStatusBar) InputDefault(_, initial string) (string, bool) {
+	sb.initial = initial
+	return sb.input, true
+}
+
+func TestCommandUndoBranch(t *testing.T) {
+	v := NewView("", rope.NewRope(""))
+	b := v.Buffer()
+	b.Insert(0, "a")
+	b.Undo()
+	b.Insert(0, "b")
+	d := &dummyApp{view: v, sb: &inputStatusBar{}}
+
+	c := &CommandUndoBranch{delta: 1}
+	if _, err := c.Execute(d, nil); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got := b.Contents().String(); got != "a" {
+		t.Fatalf("expected other branch 'a' got %q", got)
+	}
+	if _, err := c.Execute(d, nil); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got := b.Contents().String(); got != "b" {
+		t.Fatalf("expected branch to wrap to 'b' got %q", got)
+	}
+}
+
+func TestCommandUndoChronological(t *testing.T) {
+	v := NewView("", rope.NewRope(""))
+	b := v.Buffer()
+	b.Insert(0, "a")
+	b.Undo()
+	b.Insert(0, "b")
+	d := &dummyApp{view: v}
+
+	// Earlier goes to state 1 ("a") even though it is on another branch
+	earlier := &CommandUndoChronological{delta: -1}
+	earlier.Execute(d, nil)
+	if got := b.Contents().String(); got != "a" {
+		t.Fatalf("expected 'a' got %q", got)
+	}
+	later := &CommandUndoChronological{delta: 1}
+	later.Execute(d, nil)
+	if got := b.Contents().String(); got != "b" {
+		t.Fatalf("expected 'b' got %q", got)
+	}
+}
+
+func TestCommandUndoTime(t *testing.T) {
+	oldNow := now
+	defer func() { now = oldNow }()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+
+	v := NewView("", rope.NewRope(""))
+	b := v.Buffer()
+	now = func() time.Time { return start.Add(time.Minute) }
+	b.Insert(0, "a")
+	now = func() time.Time { return start.Add(20 * time.Minute) }
+	b.Insert(1, "b")
+
+	sb := &inputStatusBar{input: "10m"}
+	d := &dummyApp{view: v, sb: sb}
+	c := &CommandUndoTime{}
+	if _, err := c.Execute(d, nil); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got := b.Contents().String(); got != "a" {
+		t.Fatalf("expected state as of 10 minutes earlier got %q", got)
+	}
+
+	sb.input = "+1h"
+	if _, err := c.Execute(d, nil); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got := b.Contents().String(); got != "ab" {
+		t.Fatalf("expected latest state got %q", got)
+	}
+}
@@ -1,12 +1,18 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
 	"io"
 	"os"
 	"path/filepath"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/uniseg"
 
+	"tked/internal/lsp"
 	"tked/internal/rope"
 	"tked/internal/tklog"
 )
@@ -55,6 +61,23 @@ type View interface {
 	// Draw renders the view's contents on the provided screen.
 	// topOffset and leftOffset specify where to start drawing on the screen.
 	Draw(screen tcell.Screen, topOffset, leftOffset int)
+	// GutterWidth returns the number of columns drawn to the left of the
+	// text, for markers such as diagnostics.
+	GutterWidth() int
+
+	// Diagnostics returns the language server's diagnostics for the buffer.
+	Diagnostics() []lsp.Diagnostic
+	// SemanticTokens returns the language server's highlighting for the
+	// buffer.
+	SemanticTokens() []lsp.SemanticToken
+
+	// ShowPopup shows a popup next to the cursor until the cursor moves or
+	// ClosePopup is called.
+	ShowPopup(popup *Popup)
+	// ClosePopup closes the popup, if one is open.
+	ClosePopup()
+	// Popup returns the open popup, or nil if there isn't one.
+	Popup() *Popup
 
 	// Save writes the buffer contents to disk using the filename. If fileanme
 	// is empty, save uses the existing filename if set, otherwise it returns an error.
@@ -71,6 +94,8 @@ type view struct {
 	// anchor holds the position where a selection started. When nil, there
 	// is no active selection anchor.
 	anchor *cursor
+
+	popup *Popup
 }
 
 type cursor struct {
@@ -119,7 +144,11 @@ func (v *view) SetTopLeft(top, left int) {
 }
 
 func (v *view) Cursor() (int, int) {
-	c := v.buffer.GetProperty(cursorProp).(*cursor)
+	c, ok := v.buffer.GetProperty(cursorProp).(*cursor)
+	if !ok {
+		// States restored from history may not have a cursor
+		return 0, 0
+	}
 	return c.row, c.col
 }
 
@@ -130,10 +159,12 @@ func (v *view) SetCursor(row, col int) {
 
 	idxRowStart, row := v.buffer.IndexForRow(row)
 	colInfos := parseRow(v.buffer, row, idxRowStart)
-	if len(colInfos) == 0 {
-		col = 0
-	} else {
-		col = min(col, len(colInfos))
+	col = min(col, len(colInfos))
+
+	// Never leave the cursor in the middle of a character that spans several
+	// columns, such as a tab or a wide character.
+	for col > 0 && col < len(colInfos) && !colInfos[col].newChar {
+		col--
 	}
 
 	v.buffer.SetProperty(cursorProp, &cursor{
@@ -188,6 +219,10 @@ func (v *view) ClearAnchor() {
 func (v *view) InsertRune(r rune) {
 	sels := v.Selections()
 	if len(sels) > 0 {
+		// Replacing a selection is undone as a single step
+		v.buffer.BeginEdit()
+		defer v.buffer.EndEdit()
+
 		startIdx := indexForPosition(v.buffer, sels[0].StartRow, sels[0].StartCol)
 		endIdx := indexForPosition(v.buffer, sels[0].EndRow, sels[0].EndCol)
 		v.buffer.Delete(startIdx, endIdx)
@@ -196,38 +231,13 @@ func (v *view) InsertRune(r rune) {
 	}
 
 	cursorRow, cursorCol := v.Cursor()
-	idxForRow, cursorRow := v.buffer.IndexForRow(cursorRow)
-	idx := idxForRow
-	colInfos := parseRow(v.buffer, cursorRow, idx)
-	if len(colInfos) != 0 {
-		colInfoIdx := cursorCol
-		if cursorCol >= len(colInfos) {
-			colInfoIdx = len(colInfos) - 1
-			idx = colInfos[colInfoIdx].idx + 1
-		} else {
-			idx = colInfos[colInfoIdx].idx
-		}
-	}
+	idx := v.indexForRowCol(cursorRow, cursorCol)
 	v.buffer.Insert(idx, string(r))
 
-	if r == '\n' {
-		cursorRow++
-		cursorCol = 0
-	} else {
-		cursorCol++
-
-		// parse the row to find the next character, in case we inserted a tab
-		colInfos = parseRow(v.buffer, cursorRow, idxForRow)
-		if cursorCol < len(colInfos) {
-			for ; !colInfos[cursorCol].newChar; cursorCol++ {
-				if cursorCol >= len(colInfos) {
-					break
-				}
-			}
-		}
-	}
-
-	v.SetCursor(cursorRow, cursorCol)
+	// Place the cursor after the inserted rune. Looking the position up from
+	// the buffer index accounts for tabs, wide characters and runes that
+	// combine with the previous character.
+	v.SetCursor(v.positionForIndex(idx + utf8.RuneLen(r)))
 }
 
 func (v *view) DeleteRune(forward bool) {
@@ -236,7 +246,10 @@ func (v *view) DeleteRune(forward bool) {
 	if len(selections) > 0 {
 		startIdx := v.indexForRowCol(selections[0].StartRow, selections[0].StartCol)
 		endIdx := v.indexForRowCol(selections[0].EndRow, selections[0].EndCol)
+		// Deleting a selection is never coalesced with other deletes
+		v.buffer.BeginEdit()
 		v.buffer.Delete(startIdx, endIdx)
+		v.buffer.EndEdit()
 		v.SetCursor(selections[0].StartRow, selections[0].StartCol)
 		v.SetSelections([]Selection{})
 		return
@@ -246,54 +259,49 @@ func (v *view) DeleteRune(forward bool) {
 
 	idxForRow, cursorRow := v.buffer.IndexForRow(cursorRow)
 	colInfos := parseRow(v.buffer, cursorRow, idxForRow)
+	cursorCol = min(cursorCol, len(colInfos))
 
-	// if cursor is inside a multi-character rune, delete the entire rune
+	// if cursor is inside a character spanning several columns, delete the
+	// entire character
 	if cursorCol < len(colInfos) && !colInfos[cursorCol].newChar {
-		idx := colInfos[cursorCol].idx
-		v.buffer.Delete(idx, idx+1)
+		ci := colInfos[cursorCol]
+		v.buffer.Delete(ci.idx, ci.idx+ci.size)
 
-		// move the cursor to where the multi-character rune started
-		for ; !colInfos[cursorCol].newChar; cursorCol-- {
+		// move the cursor to where the character started
+		for !colInfos[cursorCol].newChar {
+			cursorCol--
 			if cursorCol < 0 {
 				tklog.Panic("cursorCol < 0") // bug, not error
 			}
 		}
 		v.SetCursor(cursorRow, cursorCol)
-	} else {
-		var idx int
-		if cursorCol >= len(colInfos) {
-			idx = colInfos[len(colInfos)-1].idx + 1
-		} else {
-			idx = colInfos[cursorCol].idx
-		}
+		return
+	}
 
-		if forward {
-			v.buffer.Delete(idx, idx+1)
-			// Cursor doesn't move in this case
+	idx := cellIndex(colInfos, cursorCol, idxForRow)
+	if forward {
+		if cursorCol < len(colInfos) {
+			v.buffer.Delete(idx, idx+colInfos[cursorCol].size)
 		} else {
-			// Cursor moves back one character, handling the case where it was at the start of a line
-			cursorCol--
-			if cursorCol < 0 {
-				cursorRow--
-				if cursorRow < 0 {
-					cursorRow = 0
-				} else {
-					// Set cursorCol to the end of the previous line
-
-					// Start at the beginning of the previous line
-					idxForRow, cursorRow = v.buffer.IndexForRow(cursorRow)
-
-					// Scan to the end of the line
-					colInfos = parseRow(v.buffer, cursorRow, idxForRow)
-					cursorCol = len(colInfos)
-				}
-			}
-
-			// Actaully delete the character now- we don't do it before
-			// because we need to know the length of the previous line
-			v.buffer.Delete(idx-1, idx)
-			v.SetCursor(cursorRow, cursorCol)
+			v.buffer.Delete(idx, idx+1) // join with the next line
 		}
+		// Cursor doesn't move in this case
+		v.SetCursor(cursorRow, cursorCol)
+	} else if cursorCol > 0 {
+		// Delete the whole character before the cursor
+		prevCol := cursorCol - 1
+		for !colInfos[prevCol].newChar {
+			prevCol--
+		}
+		v.buffer.Delete(colInfos[prevCol].idx, idx)
+		v.SetCursor(cursorRow, prevCol)
+	} else if cursorRow > 0 {
+		// Join with the previous line, moving the cursor to its end. We find
+		// the end before deleting the newline.
+		prevIdx, prevRow := v.buffer.IndexForRow(cursorRow - 1)
+		prevCol := len(parseRow(v.buffer, prevRow, prevIdx))
+		v.buffer.Delete(idx-1, idx)
+		v.SetCursor(prevRow, prevCol)
 	}
 }
 
@@ -302,28 +310,57 @@ func (v *view) Draw(screen tcell.Screen, topOffset, leftOffset int) {
 	viewTop, viewLeft := v.TopLeft()
 	selections := v.Selections()
 
-	idxRowStart, _ := v.buffer.IndexForRow(viewTop)
+	// The text is drawn to the right of the gutter
+	gutterWidth := v.GutterWidth()
+	diagnostics := newDiagnosticSpans(v.buffer, v.Diagnostics())
+	tokens := newTokenSpans(v.buffer, v.SemanticTokens(), viewTop, viewTop+viewHeight)
+	leftOffset += gutterWidth
+	viewWidth -= gutterWidth
+
 	for row := viewTop; row < viewTop+viewHeight; row++ {
+		idxRowStart, actualRow := v.buffer.IndexForRow(row)
+		if actualRow != row {
+			break // past the end of the buffer
+		}
+		if gutterWidth > 0 {
+			marker, style := diagnostics.marker(row)
+			screen.SetContent(leftOffset-gutterWidth, topOffset+row-viewTop, marker, nil, style)
+		}
 		colInfos := parseRow(v.buffer, row, idxRowStart)
-		if len(colInfos) == 0 {
-			idxRowStart++
-		} else {
-			for col, colInfo := range colInfos {
-				if col >= viewLeft && col < viewLeft+viewWidth {
-					style := tcell.StyleDefault
-					if isSelected(selections, row, col) {
-						style = style.Reverse(true)
+		for col, colInfo := range colInfos {
+			if col >= viewLeft && col < viewLeft+viewWidth {
+				style, _ := tokens.at(colInfo.idx)
+				if severity, ok := diagnostics.at(colInfo.idx); ok {
+					style = diagnosticStyle(severity).Underline(true)
+				}
+				if isSelected(selections, row, col) {
+					style = style.Reverse(true)
+				}
+				r, comb := colInfo.r, colInfo.comb
+				if r == 0 {
+					// The second column of a wide character is drawn by the
+					// terminal along with the first, unless the first is
+					// scrolled out of view.
+					if col > viewLeft {
+						continue
 					}
-					screen.SetContent(leftOffset+col-viewLeft, topOffset+row-viewTop, colInfo.r, nil, style)
+					r = ' '
+				} else if colInfo.width > 1 && col+colInfo.width > viewLeft+viewWidth {
+					// Don't draw wide characters past the edge of the view
+					r, comb = ' ', nil
 				}
-				idxRowStart = colInfo.idx + 2
+				screen.SetContent(leftOffset+col-viewLeft, topOffset+row-viewTop, r, comb, style)
 			}
 		}
 	}
 
 	cursorRow, cursorCol := v.Cursor()
 	if cursorRow >= viewTop && cursorCol >= viewLeft && cursorRow < viewTop+viewHeight-1 && cursorCol < viewLeft+viewWidth {
-		screen.ShowCursor(leftOffset+cursorCol-viewLeft, topOffset+cursorRow-viewTop)
+		x, y := leftOffset+cursorCol-viewLeft, topOffset+cursorRow-viewTop
+		screen.ShowCursor(x, y)
+		if popup := v.Popup(); popup != nil {
+			popup.draw(screen, x, y, leftOffset-gutterWidth, topOffset, viewWidth+gutterWidth, viewHeight)
+		}
 	} else {
 		screen.HideCursor()
 	}
@@ -338,6 +375,17 @@ func (v *view) Save(filename string) error {
 		return os.ErrInvalid
 	}
 
+	if client := getLSP(v.buffer.GetFilename()); client != nil && GetApp().Settings().Language(filename).FormatOnSave &&
+		serverReady(v.buffer.GetFilename()) {
+		// Save anyway if the server can't format the file in time
+		ctx, cancel := context.WithTimeout(context.Background(), formatOnSaveTimeout)
+		err := formatView(ctx, client, v, GetApp().Settings())
+		cancel()
+		if err != nil {
+			tklog.Warn("Error formatting %s before saving: %v", filename, err)
+		}
+	}
+
 	dir, name := filepath.Split(filename)
 
 	// Create a temporary file in the same directory so that os.Rename works
@@ -365,11 +413,62 @@ func (v *view) Save(filename string) error {
 		return err
 	}
 
+	if filename == v.buffer.GetFilename() {
+		if err := v.buffer.SaveHistory(); err != nil {
+			tklog.Error("Error saving undo history for %s: %v", filename, err)
+		}
+	}
+
 	return nil
 }
 
+func (v *view) GutterWidth() int {
+	// The gutter is kept while the servers start, stop and restart, so the
+	// text doesn't move sideways
+	if !hasServers(v.buffer.GetFilename()) {
+		return 0
+	}
+	return diagnosticGutterWidth
+}
+
+func (v *view) Diagnostics() []lsp.Diagnostic {
+	client := getLSP(v.buffer.GetFilename())
+	if client == nil {
+		return nil
+	}
+	return client.Diagnostics(v.buffer.GetFilename())
+}
+
+func (v *view) SemanticTokens() []lsp.SemanticToken {
+	client := getLSP(v.buffer.GetFilename())
+	if client == nil {
+		return nil
+	}
+	return client.SemanticTokens(v.buffer.GetFilename())
+}
+
+func (v *view) ShowPopup(popup *Popup) {
+	popup.row, popup.col = v.Cursor()
+	v.popup = popup
+}
+
+func (v *view) ClosePopup() {
+	v.popup = nil
+}
+
+func (v *view) Popup() *Popup {
+	if v.popup == nil {
+		return nil
+	}
+	if row, col := v.Cursor(); row != v.popup.row || col != v.popup.col {
+		v.popup = nil // the cursor moved
+	}
+	return v.popup
+}
+
 func (v *view) ensureCursorVisible() {
 	cursorRow, cursorCol := v.Cursor()
+	width := v.width - v.GutterWidth()
 	if cursorRow < v.top {
 		v.top = cursorRow
 	} else if cursorRow >= v.top+v.height-1 {
@@ -378,12 +477,12 @@ func (v *view) ensureCursorVisible() {
 
 	if cursorCol < v.left {
 		v.left = cursorCol
-	} else if cursorCol >= v.left+v.width-1 {
-		v.left = cursorCol - v.width + 1
+	} else if cursorCol >= v.left+width-1 {
+		v.left = cursorCol - width + 1
 	}
 }
 
-func (v *view) onBufferChange(buffer Buffer, start, end int, context any) {
+func (v *view) onBufferChange(buffer Buffer, ev ChangeEvent, context any) {
 	v.ensureCursorVisible()
 }
 
@@ -396,72 +495,136 @@ func NewView(filename string, contents rope.Rope) View {
 		contents = rope.NewRope("")
 	}
 
+	return newView(NewBuffer(filename, contents))
+}
+
+// Create a new view with the given filename and contents read from the reader.
+// The buffer's undo history, including the cursor, is restored if it was
+// saved for these contents.
+func NewViewFromReader(filename string, r io.Reader) (View, error) {
+	registerViewProperties()
+
+	buffer, err := NewBufferFromReader(filename, r)
+	if err != nil {
+		return nil, err
+	}
+	return newView(buffer), nil
+}
+
+// newView creates a view of the buffer.
+func newView(buffer Buffer) View {
 	v := &view{
-		buffer: NewBuffer(filename, contents),
+		buffer: buffer,
 		width:  80,
 		height: 24,
 		top:    0,
 		left:   0,
 		anchor: nil,
 	}
-	v.SetCursor(0, 0)
-	v.SetSelections([]Selection{})
+	if buffer.GetProperty(cursorProp) == nil {
+		v.SetCursor(0, 0)
+		v.SetSelections([]Selection{})
+	}
 	v.buffer.OnChange(v.onBufferChange, v)
 	return v
 }
 
-// Create a new view with the given filename and contents read from the reader.
-func NewViewFromReader(filename string, r io.Reader) (View, error) {
-	contents, err := rope.NewFromReader(r)
-	if err != nil {
-		return nil, err
-	}
-	return NewView(filename, contents), nil
-}
-
 var cursorProp PropKey
 var selectionsProp PropKey
 
 func registerViewProperties() {
 	if cursorProp == nil {
-		cursorProp = RegisterBufferProperty()
+		cursorProp = RegisterPersistentBufferProperty("cursor", PropCodec{
+			Encode: func(value any) (json.RawMessage, error) {
+				c := value.(*cursor)
+				return json.Marshal([2]int{c.row, c.col})
+			},
+			Decode: func(data json.RawMessage) (any, error) {
+				var pos [2]int
+				if err := json.Unmarshal(data, &pos); err != nil {
+					return nil, err
+				}
+				return &cursor{row: pos[0], col: pos[1]}, nil
+			},
+		})
 	}
 	if selectionsProp == nil {
-		selectionsProp = RegisterBufferProperty()
+		selectionsProp = RegisterPersistentBufferProperty("selections", PropCodec{
+			Encode: func(value any) (json.RawMessage, error) {
+				return json.Marshal(value.([]Selection))
+			},
+			Decode: func(data json.RawMessage) (any, error) {
+				var selections []Selection
+				if err := json.Unmarshal(data, &selections); err != nil {
+					return nil, err
+				}
+				return selections, nil
+			},
+		})
 	}
 }
 
+// colInfo describes one screen column of a row. A character that spans several
+// columns, like a tab or a wide character, has one colInfo per column and
+// only the first has newChar set.
 type colInfo struct {
 	newChar bool
-	r       rune
-	idx     int
+	// r and comb are the runes to draw in the column. r is zero for the
+	// second column of a wide character, which the terminal draws along
+	// with the first.
+	r    rune
+	comb []rune
+	// idx and size are the byte index and length of the character in the
+	// buffer. width is the number of columns the character spans.
+	idx   int
+	size  int
+	width int
 }
 
 func (v *view) indexForRowCol(row, col int) int {
-	idxRowStart, actualRow := v.buffer.IndexForRow(row)
-	row = actualRow
-	colInfos := parseRow(v.buffer, row, idxRowStart)
-	if len(colInfos) == 0 {
-		return idxRowStart
-	}
-	if col >= len(colInfos) {
-		return colInfos[len(colInfos)-1].idx + 1
+	return indexForPosition(v.buffer, row, col)
+}
+
+func (v *view) positionForIndex(idx int) (int, int) {
+	return positionForIndex(v.buffer, idx)
+}
+
+// positionForIndex returns the row and column of the character at the byte
+// index idx in the buffer.
+func positionForIndex(buffer Buffer, idx int) (int, int) {
+	row := buffer.Contents().LineAt(idx)
+	idxRowStart, row := buffer.IndexForRow(row)
+	colInfos := parseRow(buffer, row, idxRowStart)
+	for col, ci := range colInfos {
+		if ci.newChar && ci.idx+ci.size > idx {
+			return row, col
+		}
 	}
-	return colInfos[col].idx
+	return row, len(colInfos)
 }
 
+// parseRow splits the row starting at idxStart into screen columns. The row
+// is decoded as UTF-8 and split into grapheme clusters, so characters made of
+// several runes occupy a single column, or two for wide characters.
 func parseRow(buffer Buffer, row int, idxStart int) []colInfo {
 	tabWidth := GetApp().Settings().TabWidth()
 	colInfos := []colInfo{}
 
+	contents := buffer.Contents()
+	idxEnd := contents.Len()
+	if next, ok := contents.LineStart(contents.LineAt(idxStart) + 1); ok {
+		idxEnd = next - 1 // exclude the newline
+	}
+	text := contents.Slice(idxStart, idxEnd)
+
 	idx := idxStart
 	col := 0
-	for {
-		r, ok := buffer.Contents().Index(idx)
-		if !ok || r == '\n' {
-			// End of buffer or end of line
-			break
-		} else if r == '\t' {
+	state := -1
+	for len(text) > 0 {
+		var cluster string
+		var width int
+		cluster, text, width, state = uniseg.FirstGraphemeClusterInString(text, state)
+		if cluster == "\t" {
 			width := tabWidth
 			if col%tabWidth != 0 {
 				width = tabWidth - col%tabWidth
@@ -471,36 +634,71 @@ func parseRow(buffer Buffer, row int, idxStart int) []colInfo {
 					newChar: i == 0,
 					r:       ' ',
 					idx:     idx,
+					size:    1,
+					width:   width,
 				})
 			}
 			col += width
 			idx++
-		} else {
-			colInfos = append(colInfos, colInfo{
-				newChar: true,
-				r:       rune(r),
-				idx:     idx,
-			})
-			col++
-			idx++
+			continue
+		}
+
+		runes := []rune(cluster)
+		r, comb := runes[0], runes[1:]
+		if len(comb) == 0 {
+			comb = nil
 		}
+		if unicode.IsControl(r) {
+			// Show control characters, such as a carriage return, as
+			// a single replacement character
+			r, comb, width = utf8.RuneError, nil, 1
+		}
+		width = max(1, width)
+		for i := range width {
+			ci := colInfo{newChar: i == 0, idx: idx, size: len(cluster), width: width}
+			if i == 0 {
+				ci.r, ci.comb = r, comb
+			}
+			colInfos = append(colInfos, ci)
+		}
+		col += width
+		idx += len(cluster)
 	}
 
 	return colInfos
 }
 
-func indexForPosition(buffer Buffer, row, col int) int {
-	idxRowStart, actualRow := buffer.IndexForRow(row)
-	colInfos := parseRow(buffer, actualRow, idxRowStart)
+// cellIndex returns the byte index of the character in column col of a row
+// starting at idxRowStart. Columns past the end of the row map to the end of
+// the row.
+func cellIndex(colInfos []colInfo, col int, idxRowStart int) int {
 	if len(colInfos) == 0 {
 		return idxRowStart
 	}
 	if col >= len(colInfos) {
-		return colInfos[len(colInfos)-1].idx + 1
+		last := colInfos[len(colInfos)-1]
+		return last.idx + last.size
 	}
 	return colInfos[col].idx
 }
 
+func indexForPosition(buffer Buffer, row, col int) int {
+	idxRowStart, actualRow := buffer.IndexForRow(row)
+	colInfos := parseRow(buffer, actualRow, idxRowStart)
+	return cellIndex(colInfos, col, idxRowStart)
+}
+
+// columnAfter returns the column following the character at row and col.
+func columnAfter(buffer Buffer, row, col int) int {
+	idxRowStart, row := buffer.IndexForRow(row)
+	colInfos := parseRow(buffer, row, idxRowStart)
+	col++
+	for col < len(colInfos) && !colInfos[col].newChar {
+		col++
+	}
+	return col
+}
+
 func isSelected(selections []Selection, row, col int) bool {
 	for _, s := range selections {
 		if row < s.StartRow || row > s.EndRow {
@@ -16,9 +16,10 @@ func TestViewInsertUndoRedo(t *testing.T) {
 	if got := v.Buffer().Contents().String(); got != "ab" {
 		t.Fatalf("expected ab got %q", got)
 	}
+	// Typing a word is undone in one step
 	v.Buffer().Undo()
-	if got := v.Buffer().Contents().String(); got != "a" {
-		t.Fatalf("after undo expected a got %q", got)
+	if got := v.Buffer().Contents().String(); got != "" {
+		t.Fatalf("after undo expected empty buffer got %q", got)
 	}
 	v.Buffer().Redo()
 	if got := v.Buffer().Contents().String(); got != "ab" {
@@ -26,6 +27,19 @@ func TestViewInsertUndoRedo(t *testing.T) {
 	}
 }
 
+func TestViewInsertRuneReplacesSelectionInOneStep(t *testing.T) {
+	v := NewView("", rope.NewRope("hello world"))
+	v.SetSelections([]Selection{{StartRow: 0, StartCol: 6, EndRow: 0, EndCol: 11}})
+	v.InsertRune('x')
+	if got := v.Buffer().Contents().String(); got != "hello x" {
+		t.Fatalf("expected hello x got %q", got)
+	}
+	v.Buffer().Undo()
+	if got := v.Buffer().Contents().String(); got != "hello world" {
+		t.Fatalf("expected a single undo to restore the selection, got %q", got)
+	}
+}
+
 func TestViewDeleteRune(t *testing.T) {
 	r := rope.NewRope("")
 	v := NewView("", r)
@@ -320,9 +334,10 @@ func TestViewInsertRune_UnicodeCharacters(t *testing.T) {
 	if got := v.Buffer().Contents().String(); got != "he🌟llo" {
 		t.Fatalf("expected 'he🌟llo' got %q", got)
 	}
+	// The emoji is a wide character, so it takes two columns
 	row, col := v.Cursor()
-	if row != 0 || col != 3 {
-		t.Fatalf("expected cursor (0,3) got (%d,%d)", row, col)
+	if row != 0 || col != 4 {
+		t.Fatalf("expected cursor (0,4) got (%d,%d)", row, col)
 	}
 }
 
@@ -452,3 +467,132 @@ func TestViewDrawSelectedTextMultiLine(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRowUTF8(t *testing.T) {
+	v := NewView("", rope.NewRope("héllo\nx"))
+	colInfos := parseRow(v.Buffer(), 0, 0)
+	if len(colInfos) != 5 {
+		t.Fatalf("expected 5 columns got %d", len(colInfos))
+	}
+	if colInfos[1].r != 'é' || colInfos[1].idx != 1 || colInfos[1].size != 2 {
+		t.Fatalf("unexpected column %+v", colInfos[1])
+	}
+	if colInfos[2].r != 'l' || colInfos[2].idx != 3 {
+		t.Fatalf("unexpected column %+v", colInfos[2])
+	}
+}
+
+func TestParseRowGraphemeClusters(t *testing.T) {
+	// "e" followed by a combining acute accent, then a wide CJK character
+	v := NewView("", rope.NewRope("e\u0301中a"))
+	colInfos := parseRow(v.Buffer(), 0, 0)
+	if len(colInfos) != 4 {
+		t.Fatalf("expected 4 columns got %d", len(colInfos))
+	}
+	if colInfos[0].r != 'e' || len(colInfos[0].comb) != 1 || colInfos[0].size != 3 {
+		t.Fatalf("unexpected combined column %+v", colInfos[0])
+	}
+	if colInfos[1].r != '中' || !colInfos[1].newChar || colInfos[1].width != 2 {
+		t.Fatalf("unexpected wide column %+v", colInfos[1])
+	}
+	if colInfos[2].newChar || colInfos[2].r != 0 || colInfos[2].idx != colInfos[1].idx {
+		t.Fatalf("unexpected wide continuation column %+v", colInfos[2])
+	}
+	if colInfos[3].r != 'a' {
+		t.Fatalf("unexpected column %+v", colInfos[3])
+	}
+}
+
+func TestViewCursorNotInsideWideCharacter(t *testing.T) {
+	v := NewView("", rope.NewRope("中文"))
+	v.SetCursor(0, 1)
+	if _, col := v.Cursor(); col != 0 {
+		t.Fatalf("expected cursor snapped to column 0 got %d", col)
+	}
+	v.SetCursor(0, 3)
+	if _, col := v.Cursor(); col != 2 {
+		t.Fatalf("expected cursor snapped to column 2 got %d", col)
+	}
+}
+
+func TestViewInsertRuneMultiByte(t *testing.T) {
+	v := NewView("", rope.NewRope("añb"))
+	v.SetCursor(0, 2)
+	v.InsertRune('ü')
+	if got := v.Buffer().Contents().String(); got != "añüb" {
+		t.Fatalf("expected 'añüb' got %q", got)
+	}
+	if _, col := v.Cursor(); col != 3 {
+		t.Fatalf("expected cursor col 3 got %d", col)
+	}
+
+	// A combining mark joins the previous character
+	v.InsertRune('\u0308')
+	if got := v.Buffer().Contents().String(); got != "añü\u0308b" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	if _, col := v.Cursor(); col != 3 {
+		t.Fatalf("expected cursor col 3 got %d", col)
+	}
+}
+
+func TestViewDeleteRuneGraphemeCluster(t *testing.T) {
+	v := NewView("", rope.NewRope("ae\u0301中b"))
+	v.SetCursor(0, 4) // after the wide character
+	v.DeleteRune(false)
+	if got := v.Buffer().Contents().String(); got != "ae\u0301b" {
+		t.Fatalf("expected wide character deleted got %q", got)
+	}
+	v.DeleteRune(false)
+	if got := v.Buffer().Contents().String(); got != "ab" {
+		t.Fatalf("expected combined character deleted got %q", got)
+	}
+	if _, col := v.Cursor(); col != 1 {
+		t.Fatalf("expected cursor col 1 got %d", col)
+	}
+
+	v2 := NewView("", rope.NewRope("🌟x"))
+	v2.SetCursor(0, 0)
+	v2.DeleteRune(true)
+	if got := v2.Buffer().Contents().String(); got != "x" {
+		t.Fatalf("expected emoji deleted got %q", got)
+	}
+}
+
+func TestCommandMoveRightOverWideCharacter(t *testing.T) {
+	v := NewView("", rope.NewRope("中a"))
+	d := &dummyApp{view: v}
+	v.SetCursor(0, 0)
+	c := &CommandMove{dCol: 1}
+	if _, err := c.Execute(d, nil); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if _, col := v.Cursor(); col != 2 {
+		t.Fatalf("expected cursor col 2 got %d", col)
+	}
+	c = &CommandMove{dCol: -1}
+	if _, err := c.Execute(d, nil); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if _, col := v.Cursor(); col != 0 {
+		t.Fatalf("expected cursor col 0 got %d", col)
+	}
+}
+
+func TestViewDrawWideCharacters(t *testing.T) {
+	v := NewView("", rope.NewRope("中é"))
+	v.Resize(1, 5)
+
+	screen := tcell.NewSimulationScreen("")
+	screen.Init()
+	screen.SetSize(5, 1)
+	v.Draw(screen, 0, 0)
+	screen.Show()
+
+	if ch, _, _, width := screen.GetContent(0, 0); ch != '中' || width != 2 {
+		t.Fatalf("expected wide character at col 0 got %q width %d", ch, width)
+	}
+	if ch, _, _, _ := screen.GetContent(2, 0); ch != 'é' {
+		t.Fatalf("expected é at col 2 got %q", ch)
+	}
+}
@@ -0,0 +1,134 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/tklog"
+)
+
+// CodeAction is a change a server offers to make, such as a quick fix for a
+// diagnostic or organizing imports. Choosing it applies its edit, if it has
+// one, and then runs its command.
+type CodeAction struct {
+	Title     string
+	Kind      protocol.CodeActionKind
+	Preferred bool
+	// Disabled is why the action can't be applied now, if it can't.
+	Disabled string
+	Edit     *WorkspaceEdit
+	Command  *protocol.Command
+}
+
+func (c *lspClient) CodeActions(ctx context.Context, filename string, start, end Position) ([]CodeAction, error) {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !supported(caps.CodeActionProvider) {
+		return nil, ErrNotSupported
+	}
+	from, err := c.textDocumentPosition(filename, start)
+	if err != nil {
+		return nil, err
+	}
+	to, err := c.textDocumentPosition(filename, end)
+	if err != nil {
+		return nil, err
+	}
+	params := &protocol.CodeActionParams{
+		TextDocument: from.TextDocument,
+		Range:        protocol.Range{Start: from.Position, End: to.Position},
+		Context:      protocol.CodeActionContext{Diagnostics: c.diagnosticsBetween(filename, start, end)},
+	}
+	var result []json.RawMessage
+	if err := c.call(ctx, filename, protocol.MethodTextDocumentCodeAction, params, &result); err != nil {
+		return nil, err
+	}
+
+	// The result mixes code actions with bare commands
+	var actions []CodeAction
+	for _, raw := range result {
+		var item struct {
+			protocol.CodeAction
+			Command json.RawMessage `json:"command"`
+		}
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil, err
+		}
+		if len(item.Command) > 0 && item.Command[0] == '"' {
+			var command protocol.Command
+			if err := json.Unmarshal(raw, &command); err != nil {
+				return nil, err
+			}
+			actions = append(actions, CodeAction{Title: command.Title, Command: &command})
+			continue
+		}
+
+		action := CodeAction{Title: item.Title, Kind: item.Kind, Preferred: item.IsPreferred}
+		if item.Disabled != nil {
+			action.Disabled = item.Disabled.Reason
+		}
+		if len(item.Command) > 0 && string(item.Command) != "null" {
+			action.Command = &protocol.Command{}
+			if err := json.Unmarshal(item.Command, action.Command); err != nil {
+				return nil, err
+			}
+		}
+		if item.Edit != nil {
+			if action.Edit, err = c.convertWorkspaceEdit(item.Edit); err != nil {
+				// Leave out actions the editor can't apply
+				tklog.Warn("LSP code action %q: %v", item.Title, err)
+				continue
+			}
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// diagnosticsBetween returns the diagnostics the server sent for a document
+// that touch the text between start and end, with their ranges moved to
+// follow the edits made since.
+func (c *lspClient) diagnosticsBetween(filename string, start, end Position) []protocol.Diagnostic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	doc := c.docs[absPath(filename)]
+	if doc == nil {
+		return nil
+	}
+	out := []protocol.Diagnostic{}
+	for i, d := range doc.diagnostics {
+		if comparePositions(d.End, start) < 0 || comparePositions(d.Start, end) > 0 || i >= len(doc.published) {
+			continue
+		}
+		diagnostic := doc.published[i]
+		diagnostic.Range = protocol.Range{Start: utf16Position(doc.contents, d.Start), End: utf16Position(doc.contents, d.End)}
+		out = append(out, diagnostic)
+	}
+	return out
+}
+
+// ExecuteCommand runs a command on the server. Servers usually make the
+// command's changes by sending edits to apply while it runs, so it is sent
+// in the background and done is called on the editor's main goroutine with
+// the result.
+func (c *lspClient) ExecuteCommand(command *protocol.Command, done func(error)) {
+	params := &protocol.ExecuteCommandParams{Command: command.Command, Arguments: command.Arguments}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		conn, _, err := c.connection(ctx)
+		if err == nil {
+			_, err = conn.Call(ctx, protocol.MethodWorkspaceExecuteCommand, params, nil)
+		}
+		if err != nil {
+			tklog.Error("LSP error on %s %s: %v", protocol.MethodWorkspaceExecuteCommand, command.Command, err)
+			err = fmt.Errorf("%s: %w", command.Title, err)
+		}
+		dispatch(func() { done(err) })
+	}()
+}
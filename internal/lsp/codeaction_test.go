@@ -0,0 +1,85 @@
+package lsp
+
+import (
+	"context"
+	"testing"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+func TestCodeActions(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.DidOpen("a.go", 1, rope.NewRope("é := 1\nx := 2\n"))
+	if _, err := c.CodeActions(context.Background(), "a.go", Position{}, Position{}); err != ErrNotSupported {
+		t.Fatalf("expected not supported got %v", err)
+	}
+
+	c.serverCapabilities.CodeActionProvider = true
+	c.PublishDiagnostics(context.Background(), &protocol.PublishDiagnosticsParams{
+		URI: "a.go",
+		Diagnostics: []protocol.Diagnostic{
+			{Range: protocol.Range{Start: protocol.Position{Line: 1, Character: 0}, End: protocol.Position{Line: 1, Character: 1}}, Code: "unused", Message: "x unused"},
+			{Range: protocol.Range{Start: protocol.Position{Line: 0, Character: 0}, End: protocol.Position{Line: 0, Character: 1}}, Message: "é unused"},
+		},
+	})
+	// An edit before the diagnostic moves it
+	c.DidChange("a.go", 2, Change{Start: Position{1, 0}, End: Position{1, 0}, Text: "  ", Before: rope.NewRope("é := 1\nx := 2\n"), After: rope.NewRope("é := 1\n  x := 2\n")})
+
+	conn.results = map[string]string{
+		protocol.MethodTextDocumentCodeAction: `[
+			{"title": "Organize imports", "command": "organize", "arguments": ["a.go"]},
+			{"title": "Remove x", "kind": "quickfix", "isPreferred": true,
+				"edit": {"changes": {"a.go": [{"range": {"start": {"line": 1, "character": 2}, "end": {"line": 2, "character": 0}}, "newText": ""}]}}},
+			{"title": "Extract", "kind": "refactor.extract", "disabled": {"reason": "nothing selected"},
+				"command": {"title": "Extract", "command": "extract"}}
+		]`,
+	}
+	actions, err := c.CodeActions(context.Background(), "a.go", Position{1, 2}, Position{1, 3})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	params := conn.params[len(conn.params)-1].(*protocol.CodeActionParams)
+	if got := params.Context.Diagnostics; len(got) != 1 || got[0].Code != "unused" || got[0].Range.Start != (protocol.Position{Line: 1, Character: 2}) {
+		t.Fatalf("expected the diagnostic at the range sent got %+v", got)
+	}
+
+	if len(actions) != 3 {
+		t.Fatalf("expected 3 actions got %+v", actions)
+	}
+	if a := actions[0]; a.Title != "Organize imports" || a.Command == nil || a.Command.Command != "organize" || a.Edit != nil {
+		t.Fatalf("unexpected command %+v", a)
+	}
+	if a := actions[1]; !a.Preferred || a.Kind != protocol.QuickFix || a.Command != nil || a.Edit == nil || len(a.Edit.Files) != 1 {
+		t.Fatalf("unexpected quick fix %+v", a)
+	}
+	if want := (TextEdit{Start: Position{1, 2}, End: Position{2, 0}}); actions[1].Edit.Files[0].Edits[0] != want {
+		t.Fatalf("expected %+v got %+v", want, actions[1].Edit.Files[0].Edits[0])
+	}
+	if a := actions[2]; a.Disabled != "nothing selected" || a.Command == nil || a.Command.Command != "extract" {
+		t.Fatalf("unexpected disabled action %+v", a)
+	}
+}
+
+func TestExecuteCommand(t *testing.T) {
+	SetDispatcher(func(fn func()) { fn() })
+	defer SetDispatcher(nil)
+
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	done := make(chan error, 1)
+	c.ExecuteCommand(&protocol.Command{Title: "Fill struct", Command: "fill", Arguments: []any{"a.go"}}, func(err error) {
+		done <- err
+	})
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	params, ok := conn.params[0].(*protocol.ExecuteCommandParams)
+	if conn.methods[0] != protocol.MethodWorkspaceExecuteCommand || !ok || params.Command != "fill" || len(params.Arguments) != 1 {
+		t.Fatalf("unexpected request %v %+v", conn.methods, conn.params)
+	}
+}
@@ -0,0 +1,145 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// CompletionItem is a suggestion for text to insert at a position.
+type CompletionItem struct {
+	Label  string
+	Kind   protocol.CompletionItemKind
+	Detail string
+	// FilterText and SortText are used to filter and sort the items. They
+	// default to the label.
+	FilterText string
+	SortText   string
+	// Edit is the edit that inserts the item. Its range covers the text
+	// already typed that the item replaces. If Edit is nil, InsertText
+	// replaces the word before the position.
+	Edit       *TextEdit
+	InsertText string
+	// Snippet is set when the text to insert is a snippet, with tab stops
+	// like $1 and ${2:placeholder}.
+	Snippet bool
+	// AdditionalEdits are made elsewhere in the document when the item is
+	// inserted, such as adding an import.
+	AdditionalEdits []TextEdit
+}
+
+// completionItemResult is protocol.CompletionItem with a textEdit that can be
+// an InsertReplaceEdit.
+type completionItemResult struct {
+	Label               string                      `json:"label"`
+	Kind                protocol.CompletionItemKind `json:"kind"`
+	Detail              string                      `json:"detail"`
+	FilterText          string                      `json:"filterText"`
+	SortText            string                      `json:"sortText"`
+	InsertText          string                      `json:"insertText"`
+	InsertTextFormat    protocol.InsertTextFormat   `json:"insertTextFormat"`
+	AdditionalTextEdits []protocol.TextEdit         `json:"additionalTextEdits"`
+	TextEdit            *struct {
+		Range   *protocol.Range `json:"range"`
+		Insert  *protocol.Range `json:"insert"`
+		NewText string          `json:"newText"`
+	} `json:"textEdit"`
+}
+
+func (c *lspClient) CompletionTriggers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != ServerReady || c.serverCapabilities.CompletionProvider == nil {
+		return nil
+	}
+	return c.serverCapabilities.CompletionProvider.TriggerCharacters
+}
+
+func (c *lspClient) Completion(ctx context.Context, filename string, pos Position, trigger string) ([]CompletionItem, error) {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caps.CompletionProvider == nil {
+		return nil, ErrNotSupported
+	}
+	position, err := c.textDocumentPosition(filename, pos)
+	if err != nil {
+		return nil, err
+	}
+	completionContext := &protocol.CompletionContext{TriggerKind: protocol.CompletionTriggerKindInvoked}
+	if trigger != "" {
+		completionContext = &protocol.CompletionContext{
+			TriggerKind:      protocol.CompletionTriggerKindTriggerCharacter,
+			TriggerCharacter: trigger,
+		}
+	}
+
+	var raw json.RawMessage
+	params := &protocol.CompletionParams{TextDocumentPositionParams: position, Context: completionContext}
+	if err := c.call(ctx, filename, protocol.MethodTextDocumentCompletion, params, &raw); err != nil {
+		return nil, err
+	}
+
+	// The result can be null, a list of items or a CompletionList
+	var results []completionItemResult
+	if len(raw) > 0 && raw[0] == '{' {
+		var list struct {
+			Items []completionItemResult `json:"items"`
+		}
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+		results = list.Items
+	} else if err := json.Unmarshal(raw, &results); err != nil {
+		return nil, err
+	}
+
+	contents := c.contents(filename)
+	if contents == nil {
+		return nil, nil // closed while waiting
+	}
+	items := make([]CompletionItem, len(results))
+	for i, r := range results {
+		item := CompletionItem{
+			Label:           r.Label,
+			Kind:            r.Kind,
+			Detail:          r.Detail,
+			FilterText:      r.FilterText,
+			SortText:        r.SortText,
+			InsertText:      r.InsertText,
+			Snippet:         r.InsertTextFormat == protocol.InsertTextFormatSnippet,
+			AdditionalEdits: convertTextEdits(contents, r.AdditionalTextEdits),
+		}
+		if item.FilterText == "" {
+			item.FilterText = item.Label
+		}
+		if item.SortText == "" {
+			item.SortText = item.Label
+		}
+		if item.InsertText == "" {
+			item.InsertText = item.Label
+		}
+		if e := r.TextEdit; e != nil {
+			// Of an InsertReplaceEdit's ranges, use the one that inserts
+			// rather than replacing the rest of the word
+			r := e.Range
+			if r == nil {
+				r = e.Insert
+			}
+			if r != nil {
+				edit := convertTextEdit(contents, *r, e.NewText)
+				item.Edit = &edit
+				item.InsertText = e.NewText
+			}
+		}
+		items[i] = item
+	}
+	slices.SortStableFunc(items, func(a, b CompletionItem) int {
+		return strings.Compare(a.SortText, b.SortText)
+	})
+	return items, nil
+}
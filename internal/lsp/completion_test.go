@@ -0,0 +1,77 @@
+package lsp
+
+import (
+	"context"
+	"testing"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+func TestCompletion(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	if _, err := c.Completion(context.Background(), "a.go", Position{}, ""); err != ErrNotSupported {
+		t.Fatalf("expected not supported got %v", err)
+	}
+
+	c.serverCapabilities.CompletionProvider = &protocol.CompletionOptions{TriggerCharacters: []string{"."}}
+	if got := c.CompletionTriggers(); len(got) != 1 || got[0] != "." {
+		t.Fatalf("unexpected triggers %v", got)
+	}
+	c.DidOpen("a.go", 1, rope.NewRope("é.Pr\n"))
+	conn.results = map[string]string{
+		protocol.MethodTextDocumentCompletion: `{"isIncomplete": false, "items": [
+			{"label": "Println", "sortText": "b", "insertTextFormat": 2,
+				"textEdit": {"newText": "Println($1)", "insert": {"start": {"line": 0, "character": 2}, "end": {"line": 0, "character": 4}},
+					"replace": {"start": {"line": 0, "character": 2}, "end": {"line": 0, "character": 5}}},
+				"additionalTextEdits": [{"range": {"start": {"line": 0, "character": 0}, "end": {"line": 0, "character": 0}}, "newText": "x"}]},
+			{"label": "Printf", "sortText": "a", "kind": 3, "detail": "func()"}
+		]}`,
+	}
+
+	items, err := c.Completion(context.Background(), "a.go", Position{Line: 0, Offset: 5}, ".")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items got %+v", items)
+	}
+
+	// Items are sorted and missing text defaults to the label
+	item := items[0]
+	if item.Label != "Printf" || item.FilterText != "Printf" || item.InsertText != "Printf" || item.Edit != nil {
+		t.Fatalf("unexpected first item %+v", item)
+	}
+	if item.Kind != protocol.CompletionItemKindFunction || item.Detail != "func()" || item.Snippet {
+		t.Fatalf("unexpected first item %+v", item)
+	}
+
+	// The insert range is used and converted to byte offsets
+	item = items[1]
+	want := TextEdit{Start: Position{0, 3}, End: Position{0, 5}, Text: "Println($1)"}
+	if item.Edit == nil || *item.Edit != want || item.InsertText != "Println($1)" || !item.Snippet {
+		t.Fatalf("unexpected second item %+v", item)
+	}
+	if len(item.AdditionalEdits) != 1 || item.AdditionalEdits[0].Text != "x" {
+		t.Fatalf("unexpected additional edits %+v", item.AdditionalEdits)
+	}
+
+	params := conn.params[len(conn.params)-1].(*protocol.CompletionParams)
+	if params.Context.TriggerKind != protocol.CompletionTriggerKindTriggerCharacter || params.Context.TriggerCharacter != "." {
+		t.Fatalf("unexpected context %+v", params.Context)
+	}
+	if params.Position != (protocol.Position{Line: 0, Character: 4}) {
+		t.Fatalf("unexpected position %+v", params.Position)
+	}
+
+	// A plain list of items
+	conn.results[protocol.MethodTextDocumentCompletion] = `[{"label": "x"}]`
+	if items, err := c.Completion(context.Background(), "a.go", Position{}, ""); err != nil || len(items) != 1 {
+		t.Fatalf("expected one item got %v, %v", items, err)
+	}
+	conn.results[protocol.MethodTextDocumentCompletion] = `null`
+	if items, err := c.Completion(context.Background(), "a.go", Position{}, ""); err != nil || len(items) != 0 {
+		t.Fatalf("expected no items got %v, %v", items, err)
+	}
+}
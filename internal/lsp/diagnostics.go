@@ -0,0 +1,163 @@
+package lsp
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+// Diagnostic is a problem in a document reported by a language server, such
+// as a compile error or a warning.
+type Diagnostic struct {
+	Start    Position
+	End      Position
+	Severity protocol.DiagnosticSeverity
+	Source   string
+	Message  string
+}
+
+// document is the client's copy of an open document.
+type document struct {
+	version     int32
+	contents    rope.Rope
+	diagnostics []Diagnostic
+	// published holds the diagnostics as the server sent them, in the same
+	// order, to send back with code action requests.
+	published []protocol.Diagnostic
+	// semanticTokens are the document's highlighting, and
+	// semanticTokensResult the answer they came from.
+	semanticTokens       []SemanticToken
+	semanticTokensResult *semanticTokensResult
+}
+
+// dispatcher runs functions on the editor's main goroutine.
+var dispatcher func(fn func())
+
+// SetDispatcher sets the function used to run code on the editor's main
+// goroutine when a server sends something the editor should show, like new
+// diagnostics. dispatch must be safe to call from any goroutine.
+func SetDispatcher(dispatch func(fn func())) {
+	dispatcher = dispatch
+}
+
+// dispatch runs fn on the editor's main goroutine, if there is one.
+func dispatch(fn func()) {
+	if dispatcher != nil {
+		dispatcher(fn)
+	}
+}
+
+func (c *lspClient) Diagnostics(filename string) []Diagnostic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if doc := c.docs[absPath(filename)]; doc != nil {
+		return slices.Clone(doc.diagnostics)
+	}
+	return nil
+}
+
+func (c *lspClient) PublishDiagnostics(_ context.Context, params *protocol.PublishDiagnosticsParams) error {
+	filename := uriFilename(params.URI)
+
+	c.mu.Lock()
+	doc := c.docs[filename]
+	// Diagnostics for text older than the editor's would be put in the wrong
+	// places, so the last ones are kept, moved to follow the edits, until
+	// the server catches up. Without a version, they are older if there are
+	// changes the server hasn't been sent.
+	stale := c.pending[filename] != nil
+	if doc != nil && params.Version != 0 {
+		stale = int32(params.Version) < doc.version
+	}
+	if doc != nil && !stale {
+		// Sorting first keeps the two lists in the same order
+		doc.published = slices.Clone(params.Diagnostics)
+		slices.SortStableFunc(doc.published, func(a, b protocol.Diagnostic) int {
+			if a.Range.Start.Line != b.Range.Start.Line {
+				return cmp.Compare(a.Range.Start.Line, b.Range.Start.Line)
+			}
+			return cmp.Compare(a.Range.Start.Character, b.Range.Start.Character)
+		})
+		doc.diagnostics = convertDiagnostics(doc.contents, doc.published)
+	}
+	c.mu.Unlock()
+
+	// Redraw to show them
+	dispatch(func() {})
+	return nil
+}
+
+// convertDiagnostics converts diagnostics from the LSP form, sorted by where
+// they start.
+func convertDiagnostics(r rope.Rope, diagnostics []protocol.Diagnostic) []Diagnostic {
+	out := make([]Diagnostic, 0, len(diagnostics))
+	for _, d := range diagnostics {
+		severity := d.Severity
+		if severity == 0 {
+			severity = protocol.DiagnosticSeverityError
+		}
+		out = append(out, Diagnostic{
+			Start:    bytePosition(r, d.Range.Start),
+			End:      bytePosition(r, d.Range.End),
+			Severity: severity,
+			Source:   d.Source,
+			Message:  d.Message,
+		})
+	}
+	slices.SortStableFunc(out, func(a, b Diagnostic) int {
+		return comparePositions(a.Start, b.Start)
+	})
+	return out
+}
+
+// comparePositions returns -1, 0 or 1 as a is before, at or after b.
+func comparePositions(a, b Position) int {
+	if a.Line != b.Line {
+		return a.Line - b.Line
+	}
+	return a.Offset - b.Offset
+}
+
+// shiftDiagnostics moves the diagnostics to follow the text they are about
+// after a change. Diagnostics for text that was replaced shrink to the edges
+// of the change.
+func shiftDiagnostics(diagnostics []Diagnostic, change Change) {
+	shift := shiftFunc(change)
+	for i := range diagnostics {
+		diagnostics[i].Start = shift(diagnostics[i].Start)
+		diagnostics[i].End = shift(diagnostics[i].End)
+	}
+}
+
+// shiftFunc returns a function that moves positions to follow the text they
+// are in after a change. Positions in text that was replaced move to its
+// start.
+func shiftFunc(change Change) func(Position) Position {
+	newEnd := changeEnd(change)
+	return func(pos Position) Position {
+		switch {
+		case comparePositions(pos, change.Start) < 0:
+			return pos
+		case comparePositions(pos, change.End) < 0:
+			return change.Start
+		case pos.Line == change.End.Line:
+			return Position{Line: newEnd.Line, Offset: newEnd.Offset + pos.Offset - change.End.Offset}
+		default:
+			return Position{Line: pos.Line + newEnd.Line - change.End.Line, Offset: pos.Offset}
+		}
+	}
+}
+
+// changeEnd returns the position of the end of the text inserted by a change.
+func changeEnd(change Change) Position {
+	lines := strings.Count(change.Text, "\n")
+	if lines == 0 {
+		return Position{Line: change.Start.Line, Offset: change.Start.Offset + len(change.Text)}
+	}
+	return Position{Line: change.Start.Line + lines, Offset: len(change.Text) - strings.LastIndex(change.Text, "\n") - 1}
+}
@@ -0,0 +1,118 @@
+package lsp
+
+import (
+	"context"
+	"testing"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+func TestPublishDiagnostics(t *testing.T) {
+	dispatched := 0
+	SetDispatcher(func(fn func()) {
+		dispatched++
+		fn()
+	})
+	defer SetDispatcher(nil)
+
+	c, _ := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.DidOpen("a.go", 1, rope.NewRope("a🌟b\nxyz"))
+	err := c.PublishDiagnostics(context.Background(), &protocol.PublishDiagnosticsParams{
+		URI: "a.go",
+		Diagnostics: []protocol.Diagnostic{
+			{Range: protocol.Range{Start: protocol.Position{Line: 1, Character: 1}, End: protocol.Position{Line: 1, Character: 2}}, Message: "second"},
+			{Range: protocol.Range{Start: protocol.Position{Line: 0, Character: 3}, End: protocol.Position{Line: 0, Character: 4}},
+				Severity: protocol.DiagnosticSeverityWarning, Source: "vet", Message: "first"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dispatched != 1 {
+		t.Fatalf("expected the editor to be told about new diagnostics")
+	}
+
+	diags := c.Diagnostics("a.go")
+	want := []Diagnostic{
+		{Start: Position{0, 5}, End: Position{0, 6}, Severity: protocol.DiagnosticSeverityWarning, Source: "vet", Message: "first"},
+		{Start: Position{1, 1}, End: Position{1, 2}, Severity: protocol.DiagnosticSeverityError, Message: "second"},
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("expected %d diagnostics got %v", len(want), diags)
+	}
+	for i := range want {
+		if diags[i] != want[i] {
+			t.Fatalf("diagnostic %d: expected %+v got %+v", i, want[i], diags[i])
+		}
+	}
+
+	// Diagnostics for files that aren't open are dropped
+	c.PublishDiagnostics(context.Background(), &protocol.PublishDiagnosticsParams{URI: "b.go", Diagnostics: []protocol.Diagnostic{{}}})
+	if len(c.Diagnostics("b.go")) != 0 {
+		t.Fatalf("expected no diagnostics for a closed file")
+	}
+	c.DidClose("a.go")
+	if len(c.Diagnostics("a.go")) != 0 {
+		t.Fatalf("expected diagnostics dropped on close")
+	}
+}
+
+func TestPublishDiagnosticsStale(t *testing.T) {
+	c, _ := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	before := rope.NewRope("ab\ncd")
+	c.DidOpen("a.go", 1, before)
+	publish := func(version uint32, line uint32) {
+		c.PublishDiagnostics(context.Background(), &protocol.PublishDiagnosticsParams{
+			URI:     documentURI("a.go"),
+			Version: version,
+			Diagnostics: []protocol.Diagnostic{
+				{Range: protocol.Range{Start: protocol.Position{Line: line, Character: 1}, End: protocol.Position{Line: line, Character: 2}}},
+			},
+		})
+	}
+	publish(1, 0)
+
+	// Diagnostics for the text before an edit are dropped, and the last ones
+	// follow the edit instead
+	c.DidChange("a.go", 2, Change{Start: Position{0, 0}, End: Position{0, 0}, Text: "\n",
+		Before: before, After: rope.NewRope("\n" + before.String())})
+	publish(1, 1)
+	if diags := c.Diagnostics("a.go"); len(diags) != 1 || diags[0].Start != (Position{1, 1}) {
+		t.Fatalf("expected the first diagnostics moved got %+v", diags)
+	}
+	// As are those without a version while the edit hasn't been sent
+	publish(0, 2)
+	if diags := c.Diagnostics("a.go"); len(diags) != 1 || diags[0].Start != (Position{1, 1}) {
+		t.Fatalf("expected the first diagnostics moved got %+v", diags)
+	}
+
+	c.Flush("a.go")
+	publish(2, 2)
+	if diags := c.Diagnostics("a.go"); len(diags) != 1 || diags[0].Start != (Position{2, 1}) {
+		t.Fatalf("expected the new diagnostics got %+v", diags)
+	}
+}
+
+func TestShiftDiagnostics(t *testing.T) {
+	diags := []Diagnostic{
+		{Start: Position{0, 1}, End: Position{0, 2}}, // before the change
+		{Start: Position{1, 2}, End: Position{1, 4}}, // overlapping it
+		{Start: Position{1, 5}, End: Position{1, 6}}, // after it on the same line
+		{Start: Position{3, 0}, End: Position{3, 1}}, // on a later line
+	}
+	// Replace 1:1-1:3 with "x\ny"
+	shiftDiagnostics(diags, Change{Start: Position{1, 1}, End: Position{1, 3}, Text: "x\ny"})
+	want := []Diagnostic{
+		{Start: Position{0, 1}, End: Position{0, 2}},
+		{Start: Position{1, 1}, End: Position{2, 2}},
+		{Start: Position{2, 3}, End: Position{2, 4}},
+		{Start: Position{4, 0}, End: Position{4, 1}},
+	}
+	for i := range want {
+		if diags[i] != want[i] {
+			t.Fatalf("diagnostic %d: expected %+v got %+v", i, want[i], diags[i])
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package lsp
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+// TextEdit replaces the text between Start and End in a document with Text.
+type TextEdit struct {
+	Start Position
+	End   Position
+	Text  string
+}
+
+// convertTextEdits converts edits to a document from the LSP form.
+func convertTextEdits(contents rope.Rope, edits []protocol.TextEdit) []TextEdit {
+	out := make([]TextEdit, len(edits))
+	for i, e := range edits {
+		out[i] = convertTextEdit(contents, e.Range, e.NewText)
+	}
+	return out
+}
+
+func convertTextEdit(contents rope.Rope, r protocol.Range, text string) TextEdit {
+	return TextEdit{
+		Start: bytePosition(contents, r.Start),
+		End:   bytePosition(contents, r.End),
+		Text:  text,
+	}
+}
+
+// WorkspaceEdit is a set of edits to documents, such as those renaming a
+// symbol everywhere it is used.
+type WorkspaceEdit struct {
+	Files []FileEdit
+}
+
+// FileEdit holds the edits to one document. Their ranges are all in the
+// document before any of them are made, and they don't overlap.
+type FileEdit struct {
+	Filename string
+	// Version is the version of the document the edits are for, or nil if
+	// they are for its current contents.
+	Version *int32
+	Edits   []TextEdit
+}
+
+// convertWorkspaceEdit converts a workspace edit from the LSP form. Documents
+// that aren't open are read from disk to convert their positions.
+func (c *lspClient) convertWorkspaceEdit(edit *protocol.WorkspaceEdit) (*WorkspaceEdit, error) {
+	out := &WorkspaceEdit{}
+	if edit == nil {
+		return out, nil
+	}
+	add := func(uri protocol.DocumentURI, version *int32, edits []protocol.TextEdit) error {
+		filename := uriFilename(uri)
+		contents := c.contents(filename)
+		if contents == nil {
+			return fmt.Errorf("can't read %s to edit it", filename)
+		}
+		out.Files = append(out.Files, FileEdit{
+			Filename: filename,
+			Version:  version,
+			Edits:    convertTextEdits(contents, edits),
+		})
+		return nil
+	}
+
+	// Document changes are preferred when a server sends both
+	if len(edit.DocumentChanges) > 0 {
+		for _, change := range edit.DocumentChanges {
+			if change.TextDocument.URI == "" {
+				return nil, fmt.Errorf("file operations are not supported")
+			}
+			if err := add(change.TextDocument.URI, change.TextDocument.Version, change.Edits); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	uris := slices.Sorted(maps.Keys(edit.Changes))
+	for _, uri := range uris {
+		if err := add(uri, nil, edit.Changes[uri]); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
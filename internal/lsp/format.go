@@ -0,0 +1,72 @@
+package lsp
+
+import (
+	"context"
+
+	"go.lsp.dev/protocol"
+)
+
+// FormatOptions are the preferences a server follows when formatting.
+type FormatOptions struct {
+	TabSize      int
+	InsertSpaces bool
+}
+
+func (c *lspClient) Format(ctx context.Context, filename string, options FormatOptions) ([]TextEdit, error) {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !supported(caps.DocumentFormattingProvider) {
+		return nil, ErrNotSupported
+	}
+	params := &protocol.DocumentFormattingParams{
+		TextDocument: protocol.TextDocumentIdentifier{URI: documentURI(filename)},
+		Options:      formattingOptions(options),
+	}
+	return c.format(ctx, filename, protocol.MethodTextDocumentFormatting, params)
+}
+
+func (c *lspClient) FormatRange(ctx context.Context, filename string, start, end Position, options FormatOptions) ([]TextEdit, error) {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !supported(caps.DocumentRangeFormattingProvider) {
+		return nil, ErrNotSupported
+	}
+	from, err := c.textDocumentPosition(filename, start)
+	if err != nil {
+		return nil, err
+	}
+	to, err := c.textDocumentPosition(filename, end)
+	if err != nil {
+		return nil, err
+	}
+	params := &protocol.DocumentRangeFormattingParams{
+		TextDocument: from.TextDocument,
+		Range:        protocol.Range{Start: from.Position, End: to.Position},
+		Options:      formattingOptions(options),
+	}
+	return c.format(ctx, filename, protocol.MethodTextDocumentRangeFormatting, params)
+}
+
+// format sends a formatting request and converts the edits in the answer.
+func (c *lspClient) format(ctx context.Context, filename, method string, params any) ([]TextEdit, error) {
+	var result []protocol.TextEdit
+	if err := c.call(ctx, filename, method, params, &result); err != nil {
+		return nil, err
+	}
+	contents := c.contents(filename)
+	if contents == nil {
+		return nil, nil // closed while waiting
+	}
+	return convertTextEdits(contents, result), nil
+}
+
+func formattingOptions(options FormatOptions) protocol.FormattingOptions {
+	return protocol.FormattingOptions{
+		TabSize:      uint32(options.TabSize),
+		InsertSpaces: options.InsertSpaces,
+	}
+}
@@ -0,0 +1,53 @@
+package lsp
+
+import (
+	"context"
+	"testing"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+func TestFormat(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.DidOpen("a.go", 1, rope.NewRope("é  :=  1\n"))
+	if _, err := c.Format(context.Background(), "a.go", FormatOptions{TabSize: 4}); err != ErrNotSupported {
+		t.Fatalf("expected not supported got %v", err)
+	}
+
+	c.serverCapabilities.DocumentFormattingProvider = true
+	conn.results = map[string]string{
+		protocol.MethodTextDocumentFormatting: `[{"range": {"start": {"line": 0, "character": 1}, "end": {"line": 0, "character": 3}}, "newText": " "}]`,
+	}
+	edits, err := c.Format(context.Background(), "a.go", FormatOptions{TabSize: 8})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := TextEdit{Start: Position{0, 2}, End: Position{0, 4}, Text: " "}
+	if len(edits) != 1 || edits[0] != want {
+		t.Fatalf("expected %+v got %+v", want, edits)
+	}
+	params := conn.params[len(conn.params)-1].(*protocol.DocumentFormattingParams)
+	if params.Options.TabSize != 8 || params.Options.InsertSpaces {
+		t.Fatalf("unexpected options %+v", params.Options)
+	}
+}
+
+func TestFormatRange(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.DidOpen("a.go", 1, rope.NewRope("é\nx  =  1\n"))
+	if _, err := c.FormatRange(context.Background(), "a.go", Position{}, Position{}, FormatOptions{}); err != ErrNotSupported {
+		t.Fatalf("expected not supported got %v", err)
+	}
+
+	c.serverCapabilities.DocumentRangeFormattingProvider = true
+	if _, err := c.FormatRange(context.Background(), "a.go", Position{0, 2}, Position{1, 3}, FormatOptions{TabSize: 4}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	params := conn.params[len(conn.params)-1].(*protocol.DocumentRangeFormattingParams)
+	want := protocol.Range{Start: protocol.Position{Line: 0, Character: 1}, End: protocol.Position{Line: 1, Character: 3}}
+	if params.Range != want {
+		t.Fatalf("expected range %+v got %+v", want, params.Range)
+	}
+}
@@ -0,0 +1,219 @@
+package lsp
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+// clientGroup is the client for files served by more than one language
+// server, such as a linter next to the language's main server. Documents are
+// synced with all of them. Diagnostics, completions and code actions are
+// gathered from all of them, and other requests go to the first server that
+// supports them.
+type clientGroup struct {
+	clients []*lspClient
+}
+
+func (g *clientGroup) DidChange(filename string, version int32, change Change) {
+	for _, c := range g.clients {
+		c.DidChange(filename, version, change)
+	}
+}
+
+func (g *clientGroup) Flush(filename string) {
+	for _, c := range g.clients {
+		c.Flush(filename)
+	}
+}
+
+func (g *clientGroup) DidClose(filename string) {
+	for _, c := range g.clients {
+		c.DidClose(filename)
+	}
+}
+
+func (g *clientGroup) DidOpen(filename string, version int32, contents rope.Rope) {
+	for _, c := range g.clients {
+		c.DidOpen(filename, version, contents)
+	}
+}
+
+func (g *clientGroup) Diagnostics(filename string) []Diagnostic {
+	var out []Diagnostic
+	for _, c := range g.clients {
+		out = append(out, c.Diagnostics(filename)...)
+	}
+	slices.SortStableFunc(out, func(a, b Diagnostic) int {
+		return comparePositions(a.Start, b.Start)
+	})
+	return out
+}
+
+// skipped reports whether a request failed because a server can't make it,
+// so the next server should be asked instead.
+func skipped(err error) bool {
+	return errors.Is(err, ErrNotSupported) || errors.Is(err, errNotStarted) || errors.Is(err, errStopped)
+}
+
+// first makes a request of each server in turn until one supports it.
+func first[T any](g *clientGroup, request func(c *lspClient) (T, error)) (T, error) {
+	for _, c := range g.clients {
+		result, err := request(c)
+		if !skipped(err) {
+			return result, err
+		}
+	}
+	var zero T
+	return zero, ErrNotSupported
+}
+
+// all makes a request of every server that supports it, and gathers the
+// results in the order of the servers.
+func all[T any](g *clientGroup, request func(c *lspClient) ([]T, error)) ([]T, error) {
+	var out []T
+	supported := false
+	for _, c := range g.clients {
+		results, err := request(c)
+		if skipped(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		supported = true
+		out = append(out, results...)
+	}
+	if !supported {
+		return nil, ErrNotSupported
+	}
+	return out, nil
+}
+
+func (g *clientGroup) Hover(ctx context.Context, filename string, pos Position) (string, error) {
+	return first(g, func(c *lspClient) (string, error) { return c.Hover(ctx, filename, pos) })
+}
+
+func (g *clientGroup) SignatureHelp(ctx context.Context, filename string, pos Position) (*Signature, error) {
+	return first(g, func(c *lspClient) (*Signature, error) { return c.SignatureHelp(ctx, filename, pos) })
+}
+
+func (g *clientGroup) Definition(ctx context.Context, filename string, pos Position) ([]Location, error) {
+	return first(g, func(c *lspClient) ([]Location, error) { return c.Definition(ctx, filename, pos) })
+}
+
+func (g *clientGroup) Declaration(ctx context.Context, filename string, pos Position) ([]Location, error) {
+	return first(g, func(c *lspClient) ([]Location, error) { return c.Declaration(ctx, filename, pos) })
+}
+
+func (g *clientGroup) TypeDefinition(ctx context.Context, filename string, pos Position) ([]Location, error) {
+	return first(g, func(c *lspClient) ([]Location, error) { return c.TypeDefinition(ctx, filename, pos) })
+}
+
+func (g *clientGroup) Implementation(ctx context.Context, filename string, pos Position) ([]Location, error) {
+	return first(g, func(c *lspClient) ([]Location, error) { return c.Implementation(ctx, filename, pos) })
+}
+
+func (g *clientGroup) References(ctx context.Context, filename string, pos Position, includeDeclaration bool) ([]Location, error) {
+	return first(g, func(c *lspClient) ([]Location, error) { return c.References(ctx, filename, pos, includeDeclaration) })
+}
+
+func (g *clientGroup) Completion(ctx context.Context, filename string, pos Position, trigger string) ([]CompletionItem, error) {
+	return all(g, func(c *lspClient) ([]CompletionItem, error) {
+		if trigger != "" && !slices.Contains(c.CompletionTriggers(), trigger) {
+			return nil, nil
+		}
+		return c.Completion(ctx, filename, pos, trigger)
+	})
+}
+
+func (g *clientGroup) CompletionTriggers() []string {
+	var out []string
+	for _, c := range g.clients {
+		for _, trigger := range c.CompletionTriggers() {
+			if !slices.Contains(out, trigger) {
+				out = append(out, trigger)
+			}
+		}
+	}
+	return out
+}
+
+func (g *clientGroup) PrepareRename(ctx context.Context, filename string, pos Position) (*RenameTarget, error) {
+	// Ask the server that will do the rename
+	for _, c := range g.clients {
+		if caps, err := c.capabilities(ctx); skipped(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if supported(caps.RenameProvider) {
+			return c.PrepareRename(ctx, filename, pos)
+		}
+	}
+	return nil, ErrNotSupported
+}
+
+func (g *clientGroup) Rename(ctx context.Context, filename string, pos Position, newName string) (*WorkspaceEdit, error) {
+	return first(g, func(c *lspClient) (*WorkspaceEdit, error) { return c.Rename(ctx, filename, pos, newName) })
+}
+
+func (g *clientGroup) Format(ctx context.Context, filename string, options FormatOptions) ([]TextEdit, error) {
+	return first(g, func(c *lspClient) ([]TextEdit, error) { return c.Format(ctx, filename, options) })
+}
+
+func (g *clientGroup) FormatRange(ctx context.Context, filename string, start, end Position, options FormatOptions) ([]TextEdit, error) {
+	return first(g, func(c *lspClient) ([]TextEdit, error) { return c.FormatRange(ctx, filename, start, end, options) })
+}
+
+func (g *clientGroup) CodeActions(ctx context.Context, filename string, start, end Position) ([]CodeAction, error) {
+	return all(g, func(c *lspClient) ([]CodeAction, error) { return c.CodeActions(ctx, filename, start, end) })
+}
+
+func (g *clientGroup) DocumentSymbols(ctx context.Context, filename string) ([]Symbol, error) {
+	return first(g, func(c *lspClient) ([]Symbol, error) { return c.DocumentSymbols(ctx, filename) })
+}
+
+func (g *clientGroup) WorkspaceSymbols(ctx context.Context, filename, query string) ([]Symbol, error) {
+	return first(g, func(c *lspClient) ([]Symbol, error) { return c.WorkspaceSymbols(ctx, filename, query) })
+}
+
+// SemanticTokens returns the tokens of the first server that has sent any,
+// which is the one UpdateSemanticTokens asks.
+func (g *clientGroup) SemanticTokens(filename string) []SemanticToken {
+	for _, c := range g.clients {
+		if tokens := c.SemanticTokens(filename); tokens != nil {
+			return tokens
+		}
+	}
+	return nil
+}
+
+func (g *clientGroup) UpdateSemanticTokens(ctx context.Context, filename string) error {
+	_, err := first(g, func(c *lspClient) (struct{}, error) { return struct{}{}, c.UpdateSemanticTokens(ctx, filename) })
+	return err
+}
+
+// ExecuteCommand runs a command on the server that offers it, or the first
+// server if none say they do.
+func (g *clientGroup) ExecuteCommand(command *protocol.Command, done func(error)) {
+	for _, c := range g.clients {
+		c.mu.Lock()
+		provider := c.serverCapabilities.ExecuteCommandProvider
+		if c.state != ServerReady {
+			provider = nil
+		}
+		c.mu.Unlock()
+		if provider != nil && slices.Contains(provider.Commands, command.Command) {
+			c.ExecuteCommand(command, done)
+			return
+		}
+	}
+	g.clients[0].ExecuteCommand(command, done)
+}
+
+func (g *clientGroup) ServerTextDocumentSyncOptions() protocol.TextDocumentSyncOptions {
+	return g.clients[0].ServerTextDocumentSyncOptions()
+}
@@ -0,0 +1,87 @@
+package lsp
+
+import (
+	"context"
+	"testing"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+// newGroup returns a group of two clients that have a document open, and
+// their connections.
+func newGroup(contents string) (*clientGroup, *fakeConn, *fakeConn) {
+	main, mainConn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	lint, lintConn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	g := &clientGroup{clients: []*lspClient{main, lint}}
+	g.DidOpen("a.go", 1, rope.NewRope(contents))
+	return g, mainConn, lintConn
+}
+
+func TestClientGroupRequests(t *testing.T) {
+	g, mainConn, lintConn := newGroup("x := 1\n")
+	main, lint := g.clients[0], g.clients[1]
+	if _, err := g.Hover(context.Background(), "a.go", Position{}); err != ErrNotSupported {
+		t.Fatalf("expected not supported got %v", err)
+	}
+
+	// Requests go to the first server that supports them
+	lint.serverCapabilities.HoverProvider = true
+	lintConn.results = map[string]string{protocol.MethodTextDocumentHover: `{"contents": "from lint"}`}
+	if got, err := g.Hover(context.Background(), "a.go", Position{}); err != nil || got != "from lint" {
+		t.Fatalf("expected the linter's hover got %q, %v", got, err)
+	}
+	main.serverCapabilities.HoverProvider = true
+	mainConn.results = map[string]string{protocol.MethodTextDocumentHover: `{"contents": "from main"}`}
+	if got, _ := g.Hover(context.Background(), "a.go", Position{}); got != "from main" {
+		t.Fatalf("expected the main server's hover got %q", got)
+	}
+
+	// Code actions come from every server
+	main.serverCapabilities.CodeActionProvider = true
+	lint.serverCapabilities.CodeActionProvider = true
+	mainConn.results[protocol.MethodTextDocumentCodeAction] = `[{"title": "Organize imports"}]`
+	lintConn.results[protocol.MethodTextDocumentCodeAction] = `[{"title": "Fix lint"}]`
+	actions, err := g.CodeActions(context.Background(), "a.go", Position{}, Position{})
+	if err != nil || len(actions) != 2 || actions[0].Title != "Organize imports" || actions[1].Title != "Fix lint" {
+		t.Fatalf("expected actions from both servers got %+v, %v", actions, err)
+	}
+}
+
+func TestClientGroupDiagnostics(t *testing.T) {
+	g, _, _ := newGroup("one\ntwo\n")
+	g.clients[0].PublishDiagnostics(context.Background(), &protocol.PublishDiagnosticsParams{URI: "a.go", Diagnostics: []protocol.Diagnostic{
+		{Range: protocol.Range{Start: protocol.Position{Line: 1}}, Message: "main"},
+	}})
+	g.clients[1].PublishDiagnostics(context.Background(), &protocol.PublishDiagnosticsParams{URI: "a.go", Diagnostics: []protocol.Diagnostic{
+		{Range: protocol.Range{Start: protocol.Position{Line: 0}}, Message: "lint"},
+	}})
+	diags := g.Diagnostics("a.go")
+	if len(diags) != 2 || diags[0].Message != "lint" || diags[1].Message != "main" {
+		t.Fatalf("expected both servers' diagnostics in order got %+v", diags)
+	}
+
+	// Both servers hear about changes
+	g.DidClose("a.go")
+	if len(g.clients[0].Diagnostics("a.go")) != 0 || len(g.clients[1].Diagnostics("a.go")) != 0 {
+		t.Fatalf("expected the document closed on both servers")
+	}
+}
+
+func TestClientGroupExecuteCommand(t *testing.T) {
+	SetDispatcher(func(fn func()) { fn() })
+	defer SetDispatcher(nil)
+
+	g, mainConn, lintConn := newGroup("")
+	g.clients[1].serverCapabilities.ExecuteCommandProvider = &protocol.ExecuteCommandOptions{Commands: []string{"lint.fix"}}
+	done := make(chan error, 2)
+	g.ExecuteCommand(&protocol.Command{Command: "lint.fix"}, func(err error) { done <- err })
+	<-done
+	g.ExecuteCommand(&protocol.Command{Command: "other"}, func(err error) { done <- err })
+	<-done
+
+	if lintConn.count() != 1 || mainConn.count() != 1 {
+		t.Fatalf("expected a command on each server got %v and %v", mainConn.methods, lintConn.methods)
+	}
+}
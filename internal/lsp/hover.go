@@ -0,0 +1,200 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"unicode/utf16"
+
+	"go.lsp.dev/protocol"
+)
+
+// Signature describes the function being called at a position in a document.
+type Signature struct {
+	// Label is the function's signature, such as "func Max(x, y int) int".
+	Label string
+	// ParamStart and ParamEnd are the byte range in Label of the parameter
+	// the cursor is at. They are equal when there isn't one.
+	ParamStart int
+	ParamEnd   int
+	// Documentation and ParamDocumentation are markdown describing the
+	// function and the parameter.
+	Documentation      string
+	ParamDocumentation string
+}
+
+// hoverResult is protocol.Hover with contents in any of the forms servers
+// send.
+type hoverResult struct {
+	Contents json.RawMessage `json:"contents"`
+}
+
+// signatureHelpResult is protocol.SignatureHelp with documentation and
+// parameter labels in any of the forms servers send.
+type signatureHelpResult struct {
+	Signatures []struct {
+		Label         string          `json:"label"`
+		Documentation json.RawMessage `json:"documentation"`
+		Parameters    []struct {
+			Label         json.RawMessage `json:"label"`
+			Documentation json.RawMessage `json:"documentation"`
+		} `json:"parameters"`
+		ActiveParameter *uint32 `json:"activeParameter"`
+	} `json:"signatures"`
+	ActiveSignature uint32 `json:"activeSignature"`
+	ActiveParameter uint32 `json:"activeParameter"`
+}
+
+func (c *lspClient) Hover(ctx context.Context, filename string, pos Position) (string, error) {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !supported(caps.HoverProvider) {
+		return "", ErrNotSupported
+	}
+	params, err := c.textDocumentPosition(filename, pos)
+	if err != nil {
+		return "", err
+	}
+	var result *hoverResult
+	if err := c.call(ctx, filename, protocol.MethodTextDocumentHover, &protocol.HoverParams{TextDocumentPositionParams: params}, &result); err != nil {
+		return "", err
+	}
+	if result == nil {
+		return "", nil
+	}
+	return markdown(result.Contents), nil
+}
+
+func (c *lspClient) SignatureHelp(ctx context.Context, filename string, pos Position) (*Signature, error) {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caps.SignatureHelpProvider == nil {
+		return nil, ErrNotSupported
+	}
+	params, err := c.textDocumentPosition(filename, pos)
+	if err != nil {
+		return nil, err
+	}
+	var result *signatureHelpResult
+	if err := c.call(ctx, filename, protocol.MethodTextDocumentSignatureHelp, &protocol.SignatureHelpParams{TextDocumentPositionParams: params}, &result); err != nil {
+		return nil, err
+	}
+	if result == nil || len(result.Signatures) == 0 {
+		return nil, nil
+	}
+
+	active := result.Signatures[min(int(result.ActiveSignature), len(result.Signatures)-1)]
+	sig := &Signature{
+		Label:         active.Label,
+		Documentation: documentation(active.Documentation),
+	}
+	param := result.ActiveParameter
+	if active.ActiveParameter != nil {
+		param = *active.ActiveParameter
+	}
+	if int(param) < len(active.Parameters) {
+		p := active.Parameters[param]
+		sig.ParamStart, sig.ParamEnd = parameterRange(active.Label, p.Label)
+		sig.ParamDocumentation = documentation(p.Documentation)
+	}
+	return sig, nil
+}
+
+// parameterRange returns the byte range in a signature's label of a parameter
+// label, which is either a substring of the signature's label or a range of it
+// in UTF-16 code units.
+func parameterRange(signature string, label json.RawMessage) (int, int) {
+	var s string
+	if json.Unmarshal(label, &s) == nil {
+		if i := strings.Index(signature, s); i >= 0 && s != "" {
+			return i, i + len(s)
+		}
+		return 0, 0
+	}
+	var offsets [2]int
+	if json.Unmarshal(label, &offsets) == nil && offsets[0] <= offsets[1] {
+		return utf16Offset(signature, offsets[0]), utf16Offset(signature, offsets[1])
+	}
+	return 0, 0
+}
+
+// utf16Offset returns the byte offset in s of the given number of UTF-16 code
+// units, clamped to the length of s.
+func utf16Offset(s string, units int) int {
+	n := 0
+	for i, r := range s {
+		if n >= units {
+			return i
+		}
+		n += max(1, utf16.RuneLen(r))
+	}
+	return len(s)
+}
+
+// markdown converts content from a server to markdown. Content can be
+// MarkupContent, a MarkedString, which is a markdown string or a code block,
+// or a list of MarkedStrings.
+func markdown(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) == nil {
+		parts := []string{}
+		for _, item := range list {
+			if part := markdown(item); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		return strings.Join(parts, "\n\n")
+	}
+
+	var content struct {
+		Kind     protocol.MarkupKind `json:"kind"`
+		Value    string              `json:"value"`
+		Language string              `json:"language"`
+	}
+	if json.Unmarshal(raw, &content) != nil {
+		return ""
+	}
+	switch {
+	case content.Language != "":
+		return "```" + content.Language + "\n" + content.Value + "\n```"
+	case content.Kind == protocol.PlainText:
+		return escapeMarkdown(content.Value)
+	}
+	return content.Value
+}
+
+// documentation converts a documentation field from a server, which is plain
+// text or MarkupContent, to markdown.
+func documentation(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return escapeMarkdown(s)
+	}
+	return markdown(raw)
+}
+
+// escapeMarkdown escapes plain text so it is shown as it is when rendered as
+// markdown.
+func escapeMarkdown(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune("\\`*_[]#", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,113 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+func TestHover(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.serverCapabilities.HoverProvider = true
+	conn.results = map[string]string{
+		protocol.MethodTextDocumentHover: `{"contents":{"kind":"markdown","value":"**docs**"}}`,
+	}
+	c.DidOpen("a.go", 1, rope.NewRope("a🌟b"))
+	// A held back change is sent before the request
+	c.DidChange("a.go", 2, Change{Start: Position{0, 5}, End: Position{0, 5}, Text: "c", Before: rope.NewRope("a🌟b"), After: rope.NewRope("a🌟cb")})
+
+	text, err := c.Hover(context.Background(), "a.go", Position{Line: 0, Offset: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if text != "**docs**" {
+		t.Fatalf("unexpected hover %q", text)
+	}
+	if len(conn.methods) != 2 || conn.methods[0] != protocol.MethodTextDocumentDidChange {
+		t.Fatalf("expected didChange then hover got %v", conn.methods)
+	}
+	params := conn.params[1].(*protocol.HoverParams)
+	if params.Position != (protocol.Position{Line: 0, Character: 3}) {
+		t.Fatalf("expected UTF-16 position got %+v", params.Position)
+	}
+
+	// No result is not an error
+	conn.results[protocol.MethodTextDocumentHover] = `null`
+	if text, err := c.Hover(context.Background(), "a.go", Position{}); err != nil || text != "" {
+		t.Fatalf("expected no hover got %q, %v", text, err)
+	}
+
+	if _, err := c.Hover(context.Background(), "b.go", Position{}); err == nil {
+		t.Fatalf("expected error for a document that isn't open")
+	}
+	c.serverCapabilities.HoverProvider = false
+	if _, err := c.Hover(context.Background(), "a.go", Position{}); err != ErrNotSupported {
+		t.Fatalf("expected not supported got %v", err)
+	}
+}
+
+func TestSignatureHelp(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	if _, err := c.SignatureHelp(context.Background(), "a.go", Position{}); err != ErrNotSupported {
+		t.Fatalf("expected not supported got %v", err)
+	}
+
+	c.serverCapabilities.SignatureHelpProvider = &protocol.SignatureHelpOptions{}
+	conn.results = map[string]string{
+		protocol.MethodTextDocumentSignatureHelp: `{
+			"signatures": [
+				{"label": "other()"},
+				{"label": "f(🌟 int, y string)", "documentation": "plain *text*",
+				 "parameters": [{"label": [2, 8]}, {"label": "y string", "documentation": {"kind": "markdown", "value": "*why*"}}]}
+			],
+			"activeSignature": 1,
+			"activeParameter": 0
+		}`,
+	}
+	c.DidOpen("a.go", 1, rope.NewRope("f("))
+
+	sig, err := c.SignatureHelp(context.Background(), "a.go", Position{Line: 0, Offset: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sig.Label != "f(🌟 int, y string)" || sig.Label[sig.ParamStart:sig.ParamEnd] != "🌟 int" {
+		t.Fatalf("unexpected signature %+v", sig)
+	}
+	if sig.Documentation != `plain \*text\*` {
+		t.Fatalf("expected plain text escaped got %q", sig.Documentation)
+	}
+
+	conn.results[protocol.MethodTextDocumentSignatureHelp] = `{"signatures": [{"label": "f(x, y string)", "activeParameter": 1,
+		"parameters": [{"label": "x"}, {"label": "y string", "documentation": "why"}]}]}`
+	sig, _ = c.SignatureHelp(context.Background(), "a.go", Position{})
+	if sig.Label[sig.ParamStart:sig.ParamEnd] != "y string" || sig.ParamDocumentation != "why" {
+		t.Fatalf("expected the signature's active parameter got %+v", sig)
+	}
+
+	conn.results[protocol.MethodTextDocumentSignatureHelp] = `{"signatures": []}`
+	if sig, err := c.SignatureHelp(context.Background(), "a.go", Position{}); sig != nil || err != nil {
+		t.Fatalf("expected no signature got %+v, %v", sig, err)
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	tests := map[string]string{
+		`"# title"`: "# title",
+		`{"language": "go", "value": "func f()"}`:   "```go\nfunc f()\n```",
+		`["a", {"language": "go", "value": "b"}]`:   "a\n\n```go\nb\n```",
+		`{"kind": "plaintext", "value": "a_b"}`:     `a\_b`,
+		`{"kind": "markdown", "value": "**bold**"}`: "**bold**",
+	}
+	for raw, want := range tests {
+		if got := markdown(json.RawMessage(raw)); got != want {
+			t.Fatalf("markdown(%s) expected %q got %q", raw, want, got)
+		}
+	}
+	if got := markdown(nil); got != "" {
+		t.Fatalf("expected empty markdown got %q", got)
+	}
+}
@@ -0,0 +1,161 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+// Location is a range in a file, such as where a symbol is defined.
+type Location struct {
+	Filename string
+	Start    Position
+	End      Position
+}
+
+// locationResult holds a Location or a LocationLink, which servers send when
+// the client supports links.
+type locationResult struct {
+	URI                  protocol.DocumentURI `json:"uri"`
+	Range                protocol.Range       `json:"range"`
+	TargetURI            protocol.DocumentURI `json:"targetUri"`
+	TargetSelectionRange protocol.Range       `json:"targetSelectionRange"`
+}
+
+func (c *lspClient) Definition(ctx context.Context, filename string, pos Position) ([]Location, error) {
+	return c.locations(ctx, filename, pos, protocol.MethodTextDocumentDefinition, nil)
+}
+
+func (c *lspClient) Declaration(ctx context.Context, filename string, pos Position) ([]Location, error) {
+	return c.locations(ctx, filename, pos, protocol.MethodTextDocumentDeclaration, nil)
+}
+
+func (c *lspClient) TypeDefinition(ctx context.Context, filename string, pos Position) ([]Location, error) {
+	return c.locations(ctx, filename, pos, protocol.MethodTextDocumentTypeDefinition, nil)
+}
+
+func (c *lspClient) Implementation(ctx context.Context, filename string, pos Position) ([]Location, error) {
+	return c.locations(ctx, filename, pos, protocol.MethodTextDocumentImplementation, nil)
+}
+
+func (c *lspClient) References(ctx context.Context, filename string, pos Position, includeDeclaration bool) ([]Location, error) {
+	return c.locations(ctx, filename, pos, protocol.MethodTextDocumentReferences,
+		func(params protocol.TextDocumentPositionParams) any {
+			return &protocol.ReferenceParams{
+				TextDocumentPositionParams: params,
+				Context:                    protocol.ReferenceContext{IncludeDeclaration: includeDeclaration},
+			}
+		})
+}
+
+// locations sends one of the requests that take a position and answer with
+// locations. The params are TextDocumentPositionParams unless makeParams is
+// set to build them.
+func (c *lspClient) locations(ctx context.Context, filename string, pos Position, method string,
+	makeParams func(protocol.TextDocumentPositionParams) any) ([]Location, error) {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !supported(locationProvider(caps, method)) {
+		return nil, ErrNotSupported
+	}
+	position, err := c.textDocumentPosition(filename, pos)
+	if err != nil {
+		return nil, err
+	}
+	var params any = &position
+	if makeParams != nil {
+		params = makeParams(position)
+	}
+
+	var raw json.RawMessage
+	if err := c.call(ctx, filename, method, params, &raw); err != nil {
+		return nil, err
+	}
+
+	// The result can be null, a Location or a list of Locations or
+	// LocationLinks
+	var results []locationResult
+	if len(raw) > 0 && raw[0] == '{' {
+		var result locationResult
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	} else if err := json.Unmarshal(raw, &results); err != nil {
+		return nil, err
+	}
+	return c.convertLocations(results), nil
+}
+
+// locationProvider returns the capability the server has for a location
+// request.
+func locationProvider(caps *protocol.ServerCapabilities, method string) any {
+	switch method {
+	case protocol.MethodTextDocumentDefinition:
+		return caps.DefinitionProvider
+	case protocol.MethodTextDocumentDeclaration:
+		return caps.DeclarationProvider
+	case protocol.MethodTextDocumentTypeDefinition:
+		return caps.TypeDefinitionProvider
+	case protocol.MethodTextDocumentImplementation:
+		return caps.ImplementationProvider
+	case protocol.MethodTextDocumentReferences:
+		return caps.ReferencesProvider
+	}
+	return nil
+}
+
+// convertLocations converts locations from the LSP form.
+func (c *lspClient) convertLocations(results []locationResult) []Location {
+	locations := make([]Location, 0, len(results))
+	contents := map[string]rope.Rope{}
+	for _, result := range results {
+		uri, r := result.URI, result.Range
+		if result.TargetURI != "" {
+			uri, r = result.TargetURI, result.TargetSelectionRange
+		}
+		filename := uriFilename(uri)
+		if _, ok := contents[filename]; !ok {
+			contents[filename] = c.contents(filename)
+		}
+		locations = append(locations, Location{
+			Filename: filename,
+			Start:    c.position(contents[filename], r.Start),
+			End:      c.position(contents[filename], r.End),
+		})
+	}
+	return locations
+}
+
+// contents returns the contents of a document: the client's copy if it is
+// open, or else the file on disk. It returns nil if the file can't be read.
+func (c *lspClient) contents(filename string) rope.Rope {
+	c.mu.Lock()
+	doc := c.docs[absPath(filename)]
+	c.mu.Unlock()
+	if doc != nil {
+		return doc.contents
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	return rope.NewRope(string(data))
+}
+
+// position converts a position in the LSP form using the document's contents,
+// if they are known.
+func (c *lspClient) position(contents rope.Rope, pos protocol.Position) Position {
+	if contents == nil {
+		// Without the contents the best guess is that the line is ASCII
+		return Position{Line: int(pos.Line), Offset: int(pos.Character)}
+	}
+	return bytePosition(contents, pos)
+}
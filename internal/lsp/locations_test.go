@@ -0,0 +1,101 @@
+package lsp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+func TestDefinition(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	if _, err := c.Definition(context.Background(), "a.go", Position{}); err != ErrNotSupported {
+		t.Fatalf("expected not supported got %v", err)
+	}
+
+	c.serverCapabilities.DefinitionProvider = true
+	c.DidOpen("a.go", 1, rope.NewRope("🌟x := 1\n"))
+	other := filepath.Join(t.TempDir(), "b.go")
+	os.WriteFile(other, []byte("é = x\n"), 0644)
+
+	// A single location, converted using the open document
+	conn.results = map[string]string{
+		protocol.MethodTextDocumentDefinition: `{"uri": "` + string(documentURI("a.go")) + `", "range": {"start": {"line": 0, "character": 2}, "end": {"line": 0, "character": 3}}}`,
+	}
+	locations, err := c.Definition(context.Background(), "a.go", Position{Line: 0, Offset: 4})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Location{Filename: absPath("a.go"), Start: Position{0, 4}, End: Position{0, 5}}
+	if len(locations) != 1 || locations[0] != want {
+		t.Fatalf("expected %+v got %+v", want, locations)
+	}
+
+	// Links, converted using the file on disk
+	conn.results[protocol.MethodTextDocumentDefinition] = `[{"targetUri": "` + string(documentURI(other)) + `",
+		"targetRange": {"start": {"line": 0, "character": 0}, "end": {"line": 1, "character": 0}},
+		"targetSelectionRange": {"start": {"line": 0, "character": 4}, "end": {"line": 0, "character": 5}}}]`
+	locations, _ = c.Definition(context.Background(), "a.go", Position{})
+	want = Location{Filename: other, Start: Position{0, 5}, End: Position{0, 6}}
+	if len(locations) != 1 || locations[0] != want {
+		t.Fatalf("expected %+v got %+v", want, locations)
+	}
+
+	conn.results[protocol.MethodTextDocumentDefinition] = `null`
+	if locations, err := c.Definition(context.Background(), "a.go", Position{}); err != nil || len(locations) != 0 {
+		t.Fatalf("expected no locations got %v, %v", locations, err)
+	}
+}
+
+func TestLocationRequests(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.serverCapabilities.DeclarationProvider = true
+	c.serverCapabilities.TypeDefinitionProvider = map[string]any{}
+	c.serverCapabilities.ImplementationProvider = true
+	c.DidOpen("a.go", 1, rope.NewRope("x"))
+
+	c.Declaration(context.Background(), "a.go", Position{})
+	c.TypeDefinition(context.Background(), "a.go", Position{})
+	c.Implementation(context.Background(), "a.go", Position{})
+	want := []string{
+		protocol.MethodTextDocumentDeclaration,
+		protocol.MethodTextDocumentTypeDefinition,
+		protocol.MethodTextDocumentImplementation,
+	}
+	if len(conn.methods) != len(want) {
+		t.Fatalf("expected %v got %v", want, conn.methods)
+	}
+	for i := range want {
+		if conn.methods[i] != want[i] {
+			t.Fatalf("expected %v got %v", want, conn.methods)
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.serverCapabilities.ReferencesProvider = true
+	c.DidOpen("a.go", 1, rope.NewRope("x := x + 1"))
+	conn.results = map[string]string{
+		protocol.MethodTextDocumentReferences: `[
+			{"uri": "a.go", "range": {"start": {"line": 0, "character": 0}, "end": {"line": 0, "character": 1}}},
+			{"uri": "a.go", "range": {"start": {"line": 0, "character": 5}, "end": {"line": 0, "character": 6}}}
+		]`,
+	}
+
+	locations, err := c.References(context.Background(), "a.go", Position{Line: 0, Offset: 5}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(locations) != 2 || locations[1].Start != (Position{0, 5}) {
+		t.Fatalf("unexpected references %+v", locations)
+	}
+	params := conn.params[0].(*protocol.ReferenceParams)
+	if !params.Context.IncludeDeclaration || params.Position != (protocol.Position{Line: 0, Character: 5}) {
+		t.Fatalf("unexpected params %+v", params)
+	}
+}
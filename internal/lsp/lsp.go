@@ -2,187 +2,373 @@ package lsp
 
 import (
 	"context"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 
 	"go.lsp.dev/jsonrpc2"
 	"go.lsp.dev/protocol"
 	"go.uber.org/zap"
 
+	"tked/internal/rope"
 	"tked/internal/tklog"
 )
 
+// LSPClient is the client for the language servers that serve a file. The
+// servers start in the background, and the notifications about documents
+// return at once, so they can be used from the editor's main goroutine.
+// Requests wait for the servers to start and then for their answers, so they
+// should be made on another goroutine, with a context that is cancelled when
+// the answer is no longer wanted.
 type LSPClient interface {
-	DidChangeFull(filename string, version int32, contents string)
+	// DidChange tells the server about an edit to a document. Edits are sent
+	// as ranges if the server supports it, and are held back briefly so that
+	// bursts of edits are sent together.
+	DidChange(filename string, version int32, change Change)
+	// Flush sends any edits to a document that are being held back.
+	Flush(filename string)
 	DidClose(filename string)
-	DidOpen(filename string, version int32, contents string)
+	DidOpen(filename string, version int32, contents rope.Rope)
+
+	// Diagnostics returns the latest diagnostics the server reported for a
+	// document, sorted by where they start, and moved to follow any edits
+	// made since.
+	Diagnostics(filename string) []Diagnostic
+
+	// Hover returns markdown describing the symbol at a position, or "" if
+	// there is nothing to show.
+	Hover(ctx context.Context, filename string, pos Position) (string, error)
+	// SignatureHelp returns the signature of the function being called at a
+	// position, or nil if there isn't one.
+	SignatureHelp(ctx context.Context, filename string, pos Position) (*Signature, error)
+
+	// Definition, Declaration, TypeDefinition and Implementation return
+	// where the symbol at a position is defined, declared, where its type is
+	// defined, and where it is implemented.
+	Definition(ctx context.Context, filename string, pos Position) ([]Location, error)
+	Declaration(ctx context.Context, filename string, pos Position) ([]Location, error)
+	TypeDefinition(ctx context.Context, filename string, pos Position) ([]Location, error)
+	Implementation(ctx context.Context, filename string, pos Position) ([]Location, error)
+	// References returns where the symbol at a position is used, including
+	// where it is declared if includeDeclaration is set.
+	References(ctx context.Context, filename string, pos Position, includeDeclaration bool) ([]Location, error)
+
+	// Completion returns suggestions for text to insert at a position,
+	// sorted in the order the server wants them shown. trigger is the
+	// character typed that asked for them, or "" if the user asked.
+	Completion(ctx context.Context, filename string, pos Position, trigger string) ([]CompletionItem, error)
+	// CompletionTriggers returns the characters that should ask for
+	// completions when they are typed, which is none until the server has
+	// started.
+	CompletionTriggers() []string
+
+	// PrepareRename returns the symbol a rename at a position would change,
+	// or nil if there's nothing to rename there. It returns ErrNotSupported
+	// if the server leaves it to the client to decide.
+	PrepareRename(ctx context.Context, filename string, pos Position) (*RenameTarget, error)
+	// Rename returns the edits that rename the symbol at a position.
+	Rename(ctx context.Context, filename string, pos Position, newName string) (*WorkspaceEdit, error)
+
+	// Format returns the edits that format a document, and FormatRange
+	// those that format the text between start and end.
+	Format(ctx context.Context, filename string, options FormatOptions) ([]TextEdit, error)
+	FormatRange(ctx context.Context, filename string, start, end Position, options FormatOptions) ([]TextEdit, error)
+
+	// CodeActions returns the actions the server offers for the text between
+	// start and end and the diagnostics there.
+	CodeActions(ctx context.Context, filename string, start, end Position) ([]CodeAction, error)
+	// ExecuteCommand runs a command of the server's, such as a code action's,
+	// calling done on the editor's main goroutine when it has finished.
+	ExecuteCommand(command *protocol.Command, done func(error))
+
+	// DocumentSymbols returns the symbols declared in a document, as a tree
+	// in the order they appear.
+	DocumentSymbols(ctx context.Context, filename string) ([]Symbol, error)
+	// WorkspaceSymbols returns the symbols in a file's project that match a
+	// query, however the server matches them.
+	WorkspaceSymbols(ctx context.Context, filename, query string) ([]Symbol, error)
+
+	// SemanticTokens returns the words in a document the server has
+	// classified for highlighting, sorted by where they start, and moved to
+	// follow any edits made since.
+	SemanticTokens(filename string) []SemanticToken
+	// UpdateSemanticTokens asks the server for a document's semantic tokens
+	// if it has changed since they were last asked for.
+	UpdateSemanticTokens(ctx context.Context, filename string) error
 
 	// TODO: Cleanup server capabilities
 	ServerTextDocumentSyncOptions() protocol.TextDocumentSyncOptions
 }
 
 type lspClient struct {
-	name                          string
-	cancel                        context.CancelFunc
+	name   string
+	config ServerConfig
+	root   string
+
+	// mu guards the fields below, apart from those of the running server.
+	mu sync.Mutex
+	// state is the server's state. ready is closed while the server is
+	// running, or once it has failed with startErr or been stopped, and is
+	// replaced when it starts again. Until it is running documents are only
+	// tracked, and they are opened on the server when it is ready.
+	state    ServerState
+	ready    chan struct{}
+	startErr error
+	// cancel stops the server, which closes stopped once it has.
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	// pending holds the changes not yet sent for each document, and docs the
+	// open documents.
+	pending map[string]*pendingChanges
+	docs    map[string]*document
+	// log holds the latest lines the server logged, and progress the work
+	// it is reporting progress on.
+	log      []string
+	progress []*workProgress
+
+	// The running server's fields are set while it starts, and otherwise
+	// only used with mu held while the state is ServerReady. Notifications
+	// are sent through outbox, so that mu isn't held while writing to the
+	// server.
 	conn                          jsonrpc2.Conn
 	server                        protocol.Server
+	outbox                        *outbox
 	cmd                           *exec.Cmd
 	serverTextDocumentSyncOptions protocol.TextDocumentSyncOptions
-}
-
-func (c *lspClient) DidChangeFull(filename string, version int32, contents string) {
-	if c.serverTextDocumentSyncOptions.Change != protocol.TextDocumentSyncKindNone {
-		err := c.server.DidChange(context.TODO(), &protocol.DidChangeTextDocumentParams{
-			TextDocument: protocol.VersionedTextDocumentIdentifier{
-				TextDocumentIdentifier: protocol.TextDocumentIdentifier{
-					URI: protocol.DocumentURI(filename),
-				},
-				Version: version,
-			},
-			ContentChanges: []protocol.TextDocumentContentChangeEvent{
-				{
-					Text: contents,
-				},
-			},
-		})
-		if err != nil {
-			tklog.Error("LSP error on DidChange %s: %v", filename, err)
-		} else {
-			tklog.Info("LSP did change full: %s(%s)", c.name, filename)
-		}
-	} else {
-		tklog.Info("LSP did change full not supported", filename)
-	}
+	serverCapabilities            protocol.ServerCapabilities
 }
 
 func (c *lspClient) DidClose(filename string) {
-	if c.ServerTextDocumentSyncOptions().OpenClose {
-		err := c.server.DidClose(context.TODO(), &protocol.DidCloseTextDocumentParams{
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked(filename)
+	delete(c.docs, absPath(filename))
+
+	if c.state != ServerReady {
+		return
+	}
+	if c.serverTextDocumentSyncOptions.OpenClose {
+		c.outbox.notify(protocol.MethodTextDocumentDidClose, filename, &protocol.DidCloseTextDocumentParams{
 			TextDocument: protocol.TextDocumentIdentifier{
-				URI: protocol.DocumentURI(filename),
+				URI: documentURI(filename),
 			},
 		})
-		if err != nil {
-			tklog.Error("LSP error on DidClose %s: %v", filename, err)
-		} else {
-			tklog.Info("LSP did close: %s(%s)", c.name, filename)
-		}
 	} else {
 		tklog.Info("LSP did close not supported", filename)
 	}
 }
 
-func (c *lspClient) DidOpen(filename string, version int32, contents string) {
+func (c *lspClient) DidOpen(filename string, version int32, contents rope.Rope) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.docs == nil {
+		c.docs = map[string]*document{}
+	}
+	doc := &document{version: version, contents: contents}
+	c.docs[absPath(filename)] = doc
+	if c.state == ServerReady {
+		c.openLocked(absPath(filename), doc)
+	}
+}
+
+// openLocked opens a document on the server. c.mu must be held, so that the
+// document isn't changed before the server has it.
+func (c *lspClient) openLocked(filename string, doc *document) {
 	if c.serverTextDocumentSyncOptions.OpenClose {
-		err := c.server.DidOpen(context.TODO(), &protocol.DidOpenTextDocumentParams{
+		c.outbox.notify(protocol.MethodTextDocumentDidOpen, filename, &protocol.DidOpenTextDocumentParams{
 			TextDocument: protocol.TextDocumentItem{
-				URI:        protocol.DocumentURI(filename),
-				LanguageID: protocol.LanguageIdentifier(strings.TrimPrefix(filepath.Ext(filename), ".")),
-				Version:    version,
-				Text:       contents,
+				URI:        documentURI(filename),
+				LanguageID: protocol.LanguageIdentifier(c.languageID(filename)),
+				Version:    doc.version,
+				Text:       doc.contents.String(),
 			}})
-		if err != nil {
-			tklog.Error("LSP error on DidOpen %s: %v", filename, err)
-		} else {
-			tklog.Info("LSP did open: %s(%s)", c.name, filename)
-		}
 	} else {
 		tklog.Info("LSP did open not supported", filename)
 	}
 }
 
-func (c *lspClient) shutdown() {
-	// TODO: This block makes Shutdown hang
-	/*
-		if c.cancel != nil {
-			c.cancel()
-		}
-	*/
-
-	if c.server != nil {
-		c.server.Shutdown(context.TODO())
-		c.server.Exit(context.TODO())
+// LanguageID returns the identifier of a file's language, which servers use
+// to tell languages apart and settings use to configure them. Files that
+// aren't in the tables are known by their extension.
+func LanguageID(filename string) string {
+	base := filepath.Base(filename)
+	if id, ok := languageIDsByName[base]; ok {
+		return id
 	}
-	if c.conn != nil {
-		c.conn.Close()
+	ext := filepath.Ext(base)
+	if id, ok := languageIDs[ext]; ok {
+		return id
 	}
-
-	tklog.Info("LSP shutdown: %s", c.name)
+	if id, ok := languageIDs[strings.ToLower(ext)]; ok {
+		return id
+	}
+	return strings.TrimPrefix(ext, ".")
 }
 
-func (c *lspClient) ServerTextDocumentSyncOptions() protocol.TextDocumentSyncOptions {
-	return c.serverTextDocumentSyncOptions
+// languageIDsByName are the language identifiers of files known by their
+// whole name.
+var languageIDsByName = map[string]string{
+	"COMMIT_EDITMSG":  "git-commit",
+	"Dockerfile":      "dockerfile",
+	"GNUmakefile":     "makefile",
+	"Makefile":        "makefile",
+	"git-rebase-todo": "git-rebase",
+	"go.mod":          "go.mod",
+	"go.sum":          "go.sum",
+	"go.work":         "go.work",
+	"makefile":        "makefile",
 }
 
-func (lspClient) Progress(context.Context, *protocol.ProgressParams) error { return nil }
-func (lspClient) WorkDoneProgressCreate(context.Context, *protocol.WorkDoneProgressCreateParams) error {
-	return nil
+// languageIDs are the language identifiers for file extensions, as listed
+// in the LSP specification.
+var languageIDs = map[string]string{
+	".bash":       "shellscript",
+	".bat":        "bat",
+	".bib":        "bibtex",
+	".c":          "c",
+	".cc":         "cpp",
+	".cjs":        "javascript",
+	".clj":        "clojure",
+	".cljc":       "clojure",
+	".cljs":       "clojure",
+	".cmd":        "bat",
+	".coffee":     "coffeescript",
+	".cpp":        "cpp",
+	".cs":         "csharp",
+	".cshtml":     "razor",
+	".css":        "css",
+	".cts":        "typescript",
+	".cxx":        "cpp",
+	".dart":       "dart",
+	".diff":       "diff",
+	".edn":        "clojure",
+	".erl":        "erlang",
+	".ex":         "elixir",
+	".exs":        "elixir",
+	".fs":         "fsharp",
+	".fsi":        "fsharp",
+	".fsx":        "fsharp",
+	".go":         "go",
+	".gradle":     "groovy",
+	".groovy":     "groovy",
+	".h":          "c",
+	".handlebars": "handlebars",
+	".hbs":        "handlebars",
+	".hh":         "cpp",
+	".hpp":        "cpp",
+	".hrl":        "erlang",
+	".htm":        "html",
+	".html":       "html",
+	".hxx":        "cpp",
+	".ini":        "ini",
+	".jade":       "jade",
+	".java":       "java",
+	".js":         "javascript",
+	".json":       "json",
+	".jsx":        "javascriptreact",
+	".less":       "less",
+	".lua":        "lua",
+	".m":          "objective-c",
+	".markdown":   "markdown",
+	".md":         "markdown",
+	".mjs":        "javascript",
+	".mk":         "makefile",
+	".mm":         "objective-cpp",
+	".mts":        "typescript",
+	".patch":      "diff",
+	".php":        "php",
+	".pl":         "perl",
+	".pm":         "perl",
+	".ps1":        "powershell",
+	".psm1":       "powershell",
+	".pug":        "jade",
+	".py":         "python",
+	".r":          "r",
+	".raku":       "perl6",
+	".rb":         "ruby",
+	".rs":         "rust",
+	".sass":       "sass",
+	".scala":      "scala",
+	".scss":       "scss",
+	".sh":         "shellscript",
+	".shader":     "shaderlab",
+	".sql":        "sql",
+	".swift":      "swift",
+	".tex":        "latex",
+	".ts":         "typescript",
+	".tsx":        "typescriptreact",
+	".vb":         "vb",
+	".xml":        "xml",
+	".xsl":        "xsl",
+	".xslt":       "xsl",
+	".yaml":       "yaml",
+	".yml":        "yaml",
+	".zsh":        "shellscript",
 }
-func (lspClient) LogMessage(context.Context, *protocol.LogMessageParams) error { return nil }
-func (lspClient) PublishDiagnostics(context.Context, *protocol.PublishDiagnosticsParams) error {
-	return nil
+
+// languageID returns the identifier of a document's language sent to the
+// server: the one configured for it, or else the file's.
+func (c *lspClient) languageID(filename string) string {
+	if c.config.LanguageID != "" {
+		return c.config.LanguageID
+	}
+	return LanguageID(filename)
 }
-func (lspClient) ShowMessage(context.Context, *protocol.ShowMessageParams) error { return nil }
-func (lspClient) ShowMessageRequest(context.Context, *protocol.ShowMessageRequestParams) (*protocol.MessageActionItem, error) {
-	return nil, nil
+
+func (c *lspClient) ServerTextDocumentSyncOptions() protocol.TextDocumentSyncOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != ServerReady {
+		return protocol.TextDocumentSyncOptions{}
+	}
+	return c.serverTextDocumentSyncOptions
 }
-func (lspClient) Telemetry(context.Context, interface{}) error                           { return nil }
-func (lspClient) RegisterCapability(context.Context, *protocol.RegistrationParams) error { return nil }
-func (lspClient) UnregisterCapability(context.Context, *protocol.UnregistrationParams) error {
+
+func (*lspClient) Telemetry(context.Context, interface{}) error                           { return nil }
+func (*lspClient) RegisterCapability(context.Context, *protocol.RegistrationParams) error { return nil }
+func (*lspClient) UnregisterCapability(context.Context, *protocol.UnregistrationParams) error {
 	return nil
 }
-func (lspClient) ApplyEdit(context.Context, *protocol.ApplyWorkspaceEditParams) (bool, error) {
-	return false, nil
-}
-func (lspClient) Configuration(context.Context, *protocol.ConfigurationParams) ([]interface{}, error) {
+func (*lspClient) Configuration(context.Context, *protocol.ConfigurationParams) ([]interface{}, error) {
 	return nil, nil
 }
-func (lspClient) WorkspaceFolders(context.Context) ([]protocol.WorkspaceFolder, error) {
+func (*lspClient) WorkspaceFolders(context.Context) ([]protocol.WorkspaceFolder, error) {
 	return nil, nil
 }
 
 var startLSPClientFunc = startLSPClient
 
-func startLSPClient(command string) (*lspClient, error) {
-	workspaceFolder, err := os.Getwd()
-	if err != nil {
-		tklog.Error("startLSPClient %s: %v", command, err)
-		return nil, err
+// startLSPClient starts a client's language server, which runs until ctx is
+// cancelled.
+func startLSPClient(ctx context.Context, client *lspClient) error {
+	config := client.config
+	root := client.root
+	command := config.Name
+	cmd := exec.CommandContext(ctx, config.Command, config.Args...)
+	cmd.Dir = root
+	if len(config.Env) > 0 {
+		cmd.Env = os.Environ()
+		for _, name := range slices.Sorted(maps.Keys(config.Env)) {
+			cmd.Env = append(cmd.Env, name+"="+config.Env[name])
+		}
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	cmd := exec.CommandContext(ctx, command)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		cancel()
-		tklog.Error("startLSPClient %s: %v", command, err)
-		return nil, err
+		return err
 	}
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		cancel()
-		tklog.Error("startLSPClient %s: %v", command, err)
-		return nil, err
+		return err
 	}
+	cmd.Stderr = &logWriter{client: client}
 	if err := cmd.Start(); err != nil {
-		cancel()
-		tklog.Error("startLSPClient %s: %v", command, err)
-		return nil, err
-	}
-
-	client := &lspClient{
-		name:   command,
-		cancel: cancel,
-		conn:   nil,
-		server: nil,
-		cmd:    cmd,
-		serverTextDocumentSyncOptions: protocol.TextDocumentSyncOptions{
-			OpenClose: false,
-			Change:    protocol.TextDocumentSyncKindNone,
-		},
+		return err
 	}
+	client.cmd = cmd
 
 	rw := stdio{ReadCloser: stdout, WriteCloser: stdin}
 	stream := jsonrpc2.NewStream(rw)
@@ -190,69 +376,132 @@ func startLSPClient(command string) (*lspClient, error) {
 	client.conn = conn
 	client.server = server
 
-	initializeResponse, err := server.Initialize(ctx, &protocol.InitializeParams{
+	initCtx, cancel := context.WithTimeout(ctx, startTimeout)
+	defer cancel()
+	initializeResponse, err := server.Initialize(initCtx, &protocol.InitializeParams{
 		ProcessID: int32(os.Getpid()),
 		ClientInfo: &protocol.ClientInfo{
 			Name:    "tked",
 			Version: "0.1.0", // TODO: Get the version from the build info
 		},
+		InitializationOptions: config.InitializationOptions,
+		RootURI:               documentURI(root),
 		Capabilities: protocol.ClientCapabilities{
 			Workspace: &protocol.WorkspaceClientCapabilities{
 				WorkspaceFolders: true,
+				ApplyEdit:        true,
+				ExecuteCommand:   &protocol.ExecuteCommandClientCapabilities{},
+				WorkspaceEdit:    &protocol.WorkspaceClientCapabilitiesWorkspaceEdit{DocumentChanges: true},
+				Symbol:           &protocol.WorkspaceSymbolClientCapabilities{},
 			},
 			TextDocument: &protocol.TextDocumentClientCapabilities{
-				// TODO: Many capabilities here
+				// Not yet supported: saving (willSave and didSave), document
+				// highlights, code lenses, folding ranges and inlay hints
+				PublishDiagnostics: &protocol.PublishDiagnosticsClientCapabilities{VersionSupport: true},
+				Hover: &protocol.HoverTextDocumentClientCapabilities{
+					ContentFormat: []protocol.MarkupKind{protocol.Markdown, protocol.PlainText},
+				},
+				SignatureHelp: &protocol.SignatureHelpTextDocumentClientCapabilities{
+					SignatureInformation: &protocol.TextDocumentClientCapabilitiesSignatureInformation{
+						DocumentationFormat: []protocol.MarkupKind{protocol.Markdown, protocol.PlainText},
+						ParameterInformation: &protocol.TextDocumentClientCapabilitiesParameterInformation{
+							LabelOffsetSupport: true,
+						},
+						ActiveParameterSupport: true,
+					},
+				},
+				Definition:      &protocol.DefinitionTextDocumentClientCapabilities{LinkSupport: true},
+				Declaration:     &protocol.DeclarationTextDocumentClientCapabilities{LinkSupport: true},
+				TypeDefinition:  &protocol.TypeDefinitionTextDocumentClientCapabilities{LinkSupport: true},
+				Implementation:  &protocol.ImplementationTextDocumentClientCapabilities{LinkSupport: true},
+				References:      &protocol.ReferencesTextDocumentClientCapabilities{},
+				Rename:          &protocol.RenameClientCapabilities{PrepareSupport: true},
+				Formatting:      &protocol.DocumentFormattingClientCapabilities{},
+				RangeFormatting: &protocol.DocumentRangeFormattingClientCapabilities{},
+				DocumentSymbol: &protocol.DocumentSymbolClientCapabilities{
+					HierarchicalDocumentSymbolSupport: true,
+				},
+				SemanticTokens: semanticTokensClientCapabilities,
+				CodeAction: &protocol.CodeActionClientCapabilities{
+					CodeActionLiteralSupport: &protocol.CodeActionClientCapabilitiesLiteralSupport{
+						CodeActionKind: &protocol.CodeActionClientCapabilitiesKind{
+							ValueSet: []protocol.CodeActionKind{
+								protocol.QuickFix,
+								protocol.Refactor,
+								protocol.RefactorExtract,
+								protocol.RefactorInline,
+								protocol.RefactorRewrite,
+								protocol.Source,
+								protocol.SourceOrganizeImports,
+							},
+						},
+					},
+					IsPreferredSupport: true,
+					DisabledSupport:    true,
+				},
+				Completion: &protocol.CompletionTextDocumentClientCapabilities{
+					CompletionItem: &protocol.CompletionTextDocumentClientCapabilitiesItem{
+						SnippetSupport:      true,
+						DocumentationFormat: []protocol.MarkupKind{protocol.Markdown, protocol.PlainText},
+					},
+					ContextSupport: true,
+				},
 			},
 			Window: &protocol.WindowClientCapabilities{
-				// TODO: workDoneProgress, showMessage and showDocument
+				// TODO: showDocument
+				WorkDoneProgress: true,
+				ShowMessage: &protocol.ShowMessageRequestClientCapabilities{
+					MessageActionItem: &protocol.ShowMessageRequestClientCapabilitiesMessageActionItem{},
+				},
 			},
 			General: &protocol.GeneralClientCapabilities{},
 		},
 		WorkspaceFolders: []protocol.WorkspaceFolder{
 			{
-				URI:  workspaceFolder,
-				Name: filepath.Base(workspaceFolder),
+				URI:  string(documentURI(root)),
+				Name: filepath.Base(root),
 			},
 		},
 	})
 	if err != nil {
-		cancel()
-		cmd.Process.Kill()
-		tklog.Error("startLSPClient %s: %v", command, err)
-		return nil, err
+		return err
 	}
 
 	client.serverTextDocumentSyncOptions = parseTextDocumentSyncOptions(initializeResponse.Capabilities.TextDocumentSync)
+	client.serverCapabilities = initializeResponse.Capabilities
 
-	err = server.Initialized(ctx, &protocol.InitializedParams{})
-	if err != nil {
-		tklog.Error("startLSPClient %s: %v", command, err)
-		return nil, err
+	if err := server.Initialized(initCtx, &protocol.InitializedParams{}); err != nil {
+		return err
 	}
 
-	tklog.Info("LSP initialized: %s", command)
-	return client, nil
+	tklog.Info("LSP initialized: %s in %s", command, root)
+	return nil
 }
 
+// parseTextDocumentSyncOptions reads a server's textDocumentSync capability,
+// which is either the options or, from older servers, just the kind of
+// changes it wants, in which case it also wants documents opened and closed.
 func parseTextDocumentSyncOptions(textDocumentSync interface{}) protocol.TextDocumentSyncOptions {
-	textDocumentSyncMap := textDocumentSync.(map[string]interface{})
 	var textDocumentSyncOptions protocol.TextDocumentSyncOptions
 	textDocumentSyncOptions.OpenClose = false
 	textDocumentSyncOptions.Change = protocol.TextDocumentSyncKindNone
 
-	for key, value := range textDocumentSyncMap {
-		switch key {
-		case "openClose":
-			switch value {
-			case true:
-				textDocumentSyncOptions.OpenClose = true
-			}
-		case "change":
-			switch value {
-			case 1.0:
-				textDocumentSyncOptions.Change = protocol.TextDocumentSyncKindFull
-			case 2.0:
-				textDocumentSyncOptions.Change = protocol.TextDocumentSyncKindIncremental
+	switch textDocumentSync := textDocumentSync.(type) {
+	case float64:
+		textDocumentSyncOptions.OpenClose = true
+		textDocumentSyncOptions.Change = parseTextDocumentSyncKind(textDocumentSync)
+	case map[string]interface{}:
+		for key, value := range textDocumentSync {
+			switch key {
+			case "openClose":
+				switch value {
+				case true:
+					textDocumentSyncOptions.OpenClose = true
+				}
+			case "change":
+				if kind, ok := value.(float64); ok {
+					textDocumentSyncOptions.Change = parseTextDocumentSyncKind(kind)
+				}
 			}
 		}
 	}
@@ -260,57 +509,12 @@ func parseTextDocumentSyncOptions(textDocumentSync interface{}) protocol.TextDoc
 	return textDocumentSyncOptions
 }
 
-var activeLSPs map[string]LSPClient
-
-func GetLSP(filename string) LSPClient {
-	// TODO: Concurrency?
-	if activeLSPs == nil {
-		activeLSPs = map[string]LSPClient{}
-	}
-
-	if filename == "" {
-		return nil
-	}
-
-	// We use the file extension to determine the LSP client to use
-	ext := filepath.Ext(filename)
-	client, ok := activeLSPs[ext]
-	if !ok {
-		// cache the nil value so we don't keep trying to create an LSP for this filetype
-		activeLSPs[ext] = nil
-
-		// TODO: Add support for other languages, and LSP mapping in the editor settings
-		var lspServerCommand string
-		switch ext {
-		case ".go":
-			lspServerCommand = "gopls"
-		}
-
-		if lspServerCommand == "" {
-			tklog.Warn("no LSP server command found for %s", ext)
-			return nil
-		}
-
-		var err error
-		client, err = startLSPClientFunc(lspServerCommand)
-		if err != nil {
-			tklog.Error("failed to create LSP client for %s: %v", ext, err)
-		} else {
-			activeLSPs[ext] = client
-		}
-	}
-
-	return client
-}
-
-func ShutdownAll() {
-	if activeLSPs == nil {
-		return
-	}
-
-	for _, lsp := range activeLSPs {
-		if lsp != nil {
-			lsp.(*lspClient).shutdown()
-		}
+func parseTextDocumentSyncKind(kind float64) protocol.TextDocumentSyncKind {
+	switch kind {
+	case 1.0:
+		return protocol.TextDocumentSyncKindFull
+	case 2.0:
+		return protocol.TextDocumentSyncKindIncremental
 	}
+	return protocol.TextDocumentSyncKindNone
 }
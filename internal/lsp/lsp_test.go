@@ -1,75 +1,107 @@
 package lsp
 
 import (
-	"go.lsp.dev/protocol"
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"go.lsp.dev/jsonrpc2"
+	"go.lsp.dev/protocol"
+	"go.uber.org/zap"
+
+	"tked/internal/rope"
 )
 
 func TestParseTextDocumentSyncOptions(t *testing.T) {
-	input := map[string]interface{}{
-		"openClose": true,
-		"change":    1.0,
-	}
-	opts := parseTextDocumentSyncOptions(input)
-	if !opts.OpenClose {
-		t.Errorf("expected OpenClose true")
+	tests := []struct {
+		input     interface{}
+		openClose bool
+		change    protocol.TextDocumentSyncKind
+	}{
+		{map[string]interface{}{"openClose": true, "change": 1.0}, true, protocol.TextDocumentSyncKindFull},
+		{map[string]interface{}{"change": 2.0}, false, protocol.TextDocumentSyncKindIncremental},
+		{map[string]interface{}{"openClose": false, "change": "full"}, false, protocol.TextDocumentSyncKindNone},
+		// Older servers send just the kind of changes
+		{2.0, true, protocol.TextDocumentSyncKindIncremental},
+		{1.0, true, protocol.TextDocumentSyncKindFull},
+		{0.0, true, protocol.TextDocumentSyncKindNone},
+		{nil, false, protocol.TextDocumentSyncKindNone},
+		{"full", false, protocol.TextDocumentSyncKindNone},
 	}
-	if opts.Change != protocol.TextDocumentSyncKindFull {
-		t.Errorf("expected Change full got %v", opts.Change)
+	for _, test := range tests {
+		opts := parseTextDocumentSyncOptions(test.input)
+		if opts.OpenClose != test.openClose || opts.Change != test.change {
+			t.Errorf("%v: expected OpenClose %v and Change %v got %+v", test.input, test.openClose, test.change, opts)
+		}
 	}
+}
 
-	input2 := map[string]interface{}{
-		"change": 2.0,
-	}
-	opts2 := parseTextDocumentSyncOptions(input2)
-	if opts2.OpenClose {
-		t.Errorf("expected OpenClose false")
-	}
-	if opts2.Change != protocol.TextDocumentSyncKindIncremental {
-		t.Errorf("expected Change incremental got %v", opts2.Change)
+// withServers makes configs the registry, with start starting the servers,
+// until the test ends, when they are shut down. Servers are restarted and
+// killed without the usual delays.
+func withServers(t *testing.T, configs []ServerConfig, start func(ctx context.Context, c *lspClient) error) {
+	oldServers, oldActive, oldGroups, oldStart := servers, activeLSPs, groups, startLSPClientFunc
+	oldDelay, oldTimeout := restartDelay, shutdownTimeout
+	SetServers(configs)
+	activeLSPs = nil
+	startLSPClientFunc = start
+	restartDelay, shutdownTimeout = time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() {
+		waitForServers()
+		ShutdownAll()
+		servers, activeLSPs, groups, startLSPClientFunc = oldServers, oldActive, oldGroups, oldStart
+		restartDelay, shutdownTimeout = oldDelay, oldTimeout
+	})
+}
+
+// waitForServers waits for the servers in the registry to be running, or to
+// be given up on.
+func waitForServers() {
+	registryMu.Lock()
+	clients := slices.Collect(maps.Values(activeLSPs))
+	registryMu.Unlock()
+	for _, c := range clients {
+		if c.lockRunning(context.Background()) == nil {
+			c.mu.Unlock()
+		}
 	}
 }
 
 func TestGetLSPUnknownExtension(t *testing.T) {
-	oldActive := activeLSPs
-	oldStart := startLSPClientFunc
-	activeLSPs = nil
-	called := false
-	startLSPClientFunc = func(cmd string) (*lspClient, error) {
-		called = true
-		return &lspClient{name: cmd}, nil
-	}
-	defer func() {
-		activeLSPs = oldActive
-		startLSPClientFunc = oldStart
-	}()
+	var called atomic.Bool
+	withServers(t, DefaultServers, func(ctx context.Context, c *lspClient) error {
+		called.Store(true)
+		return nil
+	})
 
 	client := GetLSP("file.txt")
 	if client != nil {
 		t.Fatalf("expected nil client for txt got %#v", client)
 	}
-	if called {
-		t.Fatalf("startLSPClientFunc should not be called")
+	// Whether a file has servers is known without starting them
+	if HasServers("file.txt") || HasServers("") || !HasServers("a.go") {
+		t.Fatalf("expected servers for Go files only")
 	}
-	if v, ok := activeLSPs[".txt"]; !ok || v != nil {
-		t.Fatalf("expected cached nil for .txt")
+	waitForServers()
+	if called.Load() {
+		t.Fatalf("startLSPClientFunc should not be called")
 	}
 }
 
 func TestGetLSPGoCaching(t *testing.T) {
-	oldActive := activeLSPs
-	oldStart := startLSPClientFunc
-	activeLSPs = nil
-	count := 0
-	created := &lspClient{name: "stub"}
-	startLSPClientFunc = func(cmd string) (*lspClient, error) {
-		count++
-		return created, nil
-	}
-	defer func() {
-		activeLSPs = oldActive
-		startLSPClientFunc = oldStart
-	}()
+	var count atomic.Int32
+	withServers(t, DefaultServers, func(ctx context.Context, c *lspClient) error {
+		count.Add(1)
+		return nil
+	})
 
 	c1 := GetLSP("a.go")
 	if c1 == nil {
@@ -79,8 +111,229 @@ func TestGetLSPGoCaching(t *testing.T) {
 	if c1 != c2 {
 		t.Fatalf("expected same cached client")
 	}
-	if count != 1 {
-		t.Fatalf("expected startLSPClientFunc once got %d", count)
+	waitForServers()
+	if count.Load() != 1 {
+		t.Fatalf("expected startLSPClientFunc once got %d", count.Load())
+	}
+}
+
+func TestGetLSPRegistry(t *testing.T) {
+	var mu sync.Mutex
+	var started []string
+	withServers(t, []ServerConfig{
+		{Name: "gopls", Command: "gopls", Extensions: []string{"go"}},
+		{Name: "lint", Command: "golint-ls", Extensions: []string{"go"}, Globs: []string{"Makefile", "*/scripts/*.sh"}},
+		{Name: "broken", Command: "missing", Globs: []string{"*.go"}},
+	}, func(ctx context.Context, c *lspClient) error {
+		mu.Lock()
+		started = append(started, c.config.Name)
+		mu.Unlock()
+		if c.config.Name == "broken" {
+			return &exec.Error{Name: "missing", Err: exec.ErrNotFound}
+		}
+		return nil
+	})
+
+	// Servers are used while they start, and left out once they fail
+	if group, ok := GetLSP("/src/main.go").(*clientGroup); !ok || len(group.clients) != 3 {
+		t.Fatalf("expected all three servers while starting got %#v", GetLSP("/src/main.go"))
+	}
+	waitForServers()
+
+	// Several servers for a file are grouped in order
+	group, ok := GetLSP("/src/main.go").(*clientGroup)
+	if !ok || len(group.clients) != 2 || group.clients[0].name != "gopls" || group.clients[1].name != "lint" {
+		t.Fatalf("expected gopls and lint grouped got %#v", GetLSP("/src/main.go"))
+	}
+	if GetLSP("/src/other.go") != group {
+		t.Fatalf("expected the group reused")
+	}
+	// Servers that aren't installed aren't tried again
+	if len(started) != 3 {
+		t.Fatalf("expected each server started once got %v", started)
+	}
+
+	// Globs match names and paths
+	if c, ok := GetLSP("/src/Makefile").(*lspClient); !ok || c.name != "lint" {
+		t.Fatalf("expected lint for a Makefile got %#v", GetLSP("/src/Makefile"))
+	}
+	if c, ok := GetLSP("src/scripts/build.sh").(*lspClient); !ok || c.name != "lint" {
+		t.Fatalf("expected lint for a script got %#v", GetLSP("src/scripts/build.sh"))
+	}
+	if GetLSP("/src/build.sh") != nil || GetLSP("") != nil {
+		t.Fatalf("expected no client for unmatched files")
+	}
+}
+
+func TestGetLSPRoots(t *testing.T) {
+	withServers(t, DefaultServers, func(ctx context.Context, c *lspClient) error { return nil })
+	dir := t.TempDir()
+	for _, name := range []string{"a/go.mod", "a/pkg/x.go", "a/y.go", "b/.git/HEAD", "b/cmd/z.go"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		os.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+
+	// One server is started for each project
+	x := GetLSP(filepath.Join(dir, "a/pkg/x.go"))
+	if GetLSP(filepath.Join(dir, "a/y.go")) != x {
+		t.Fatalf("expected files in a project to share a server")
+	}
+	z := GetLSP(filepath.Join(dir, "b/cmd/z.go"))
+	if z == x {
+		t.Fatalf("expected a server for each project")
+	}
+	if root := x.(*lspClient).root; root != filepath.Join(dir, "a") {
+		t.Fatalf("unexpected root %q", root)
+	}
+	if root := z.(*lspClient).root; root != filepath.Join(dir, "b") {
+		t.Fatalf("unexpected root %q", root)
+	}
+
+	// Without a marker the file's directory is the root
+	if got := findRoot(filepath.Join(dir, "c/w.go"), []string{"go.mod"}); got != filepath.Join(dir, "c") {
+		t.Fatalf("unexpected root %q", got)
+	}
+}
+
+func TestStartInBackground(t *testing.T) {
+	conn := &fakeConn{}
+	release := make(chan struct{})
+	withServers(t, DefaultServers, func(ctx context.Context, c *lspClient) error {
+		<-release
+		c.conn = conn
+		c.server = protocol.ServerDispatcher(conn, zap.NewNop())
+		c.serverTextDocumentSyncOptions = protocol.TextDocumentSyncOptions{OpenClose: true, Change: protocol.TextDocumentSyncKindIncremental}
+		c.serverCapabilities.HoverProvider = true
+		return nil
+	})
+
+	// Documents are tracked while the server starts
+	client := GetLSP("a.go")
+	client.DidOpen("a.go", 1, rope.NewRope("x"))
+	client.DidChange("a.go", 2, Change{Start: Position{0, 1}, End: Position{0, 1}, Text: "y", Before: rope.NewRope("x"), After: rope.NewRope("xy")})
+	client.DidOpen("b.go", 1, rope.NewRope("b"))
+	client.DidClose("b.go")
+	if triggers := client.CompletionTriggers(); triggers != nil {
+		t.Fatalf("expected no triggers while starting got %v", triggers)
+	}
+
+	// Requests wait for the server, until they are cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Hover(ctx, "a.go", Position{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request cancelled got %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := client.Hover(context.Background(), "a.go", Position{})
+		done <- err
+	}()
+
+	// Once started, the server is sent the documents as they are then
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(conn.methods) != 2 || conn.methods[0] != protocol.MethodTextDocumentDidOpen || conn.methods[1] != protocol.MethodTextDocumentHover {
+		t.Fatalf("unexpected messages %v", conn.methods)
+	}
+	open := conn.params[0].(*protocol.DidOpenTextDocumentParams).TextDocument
+	if open.URI != documentURI("a.go") || open.Version != 2 || open.Text != "xy" {
+		t.Fatalf("unexpected document opened %+v", open)
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	var attempts atomic.Int32
+	withServers(t, DefaultServers, func(ctx context.Context, c *lspClient) error {
+		attempts.Add(1)
+		return errors.New("bad flag")
+	})
+
+	// A server that keeps failing is retried, and then given up on
+	client := GetLSP("a.go")
+	if _, err := client.Hover(context.Background(), "a.go", Position{}); !errors.Is(err, errNotStarted) {
+		t.Fatalf("expected a start error got %v", err)
+	}
+	if n := attempts.Load(); n != maxRestarts+1 {
+		t.Fatalf("expected %d attempts got %d", maxRestarts+1, n)
+	}
+	if GetLSP("a.go") != nil {
+		t.Fatalf("expected no client once the server failed")
+	}
+}
+
+// blockingConn is a fakeConn that never answers requests.
+type blockingConn struct {
+	fakeConn
+}
+
+func (b *blockingConn) Call(ctx context.Context, method string, params, result any) (jsonrpc2.ID, error) {
+	<-ctx.Done()
+	return jsonrpc2.NewNumberID(7), ctx.Err()
+}
+
+func TestCallCancelled(t *testing.T) {
+	c, _ := newSyncClient(protocol.TextDocumentSyncKindFull)
+	conn := &blockingConn{}
+	c.conn = conn
+	c.serverCapabilities.HoverProvider = true
+	c.DidOpen("a.go", 1, rope.NewRope(""))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := c.Hover(ctx, "a.go", Position{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request cancelled got %v", err)
+	}
+	// The server is told to stop working on it
+	if len(conn.methods) != 1 || conn.methods[0] != protocol.MethodCancelRequest {
+		t.Fatalf("expected the request cancelled on the server got %v", conn.methods)
+	}
+}
+
+func TestDocumentURI(t *testing.T) {
+	uri := documentURI("/src/my project/main.go")
+	if uri != "file:///src/my%20project/main.go" {
+		t.Fatalf("unexpected URI %q", uri)
+	}
+	if got := uriFilename(uri); got != "/src/my project/main.go" {
+		t.Fatalf("unexpected filename %q", got)
+	}
+	if got := documentURI("main.go"); got != protocol.DocumentURI("file://"+filepath.ToSlash(absPath("main.go"))) {
+		t.Fatalf("expected relative paths made absolute got %q", got)
+	}
+}
+
+func TestLanguageID(t *testing.T) {
+	for filename, want := range map[string]string{
+		"main.go":        "go",
+		"/src/go.mod":    "go.mod",
+		"app.TSX":        "typescriptreact",
+		"Makefile":       "makefile",
+		"script.unknown": "unknown",
+		"README":         "",
+	} {
+		if got := LanguageID(filename); got != want {
+			t.Errorf("%s: expected %q got %q", filename, want, got)
+		}
+	}
+}
+
+func TestLanguageIDFromConfig(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.serverTextDocumentSyncOptions.OpenClose = true
+	c.server = protocol.ServerDispatcher(conn, zap.NewNop())
+	c.DidOpen("a.tsx", 1, rope.NewRope(""))
+	c.config.LanguageID = "tsx"
+	c.DidOpen("b.tsx", 1, rope.NewRope(""))
+	written(c)
+
+	var ids []protocol.LanguageIdentifier
+	for _, p := range conn.params {
+		ids = append(ids, p.(*protocol.DidOpenTextDocumentParams).TextDocument.LanguageID)
+	}
+	if len(ids) != 2 || ids[0] != "typescriptreact" || ids[1] != "tsx" {
+		t.Fatalf("unexpected language IDs %v", ids)
 	}
 }
 
@@ -0,0 +1,116 @@
+package lsp
+
+import (
+	"context"
+	"sync"
+
+	"go.lsp.dev/jsonrpc2"
+
+	"tked/internal/tklog"
+)
+
+// outbox holds the notifications waiting to be written to a running server.
+// Writing to a server that has stopped reading its input blocks, so they are
+// written by the outbox's own goroutine, in the order they were queued,
+// rather than by whoever sent them, which is often the editor's main
+// goroutine holding c.mu.
+type outbox struct {
+	name string
+	conn jsonrpc2.Conn
+
+	// mu guards queue. wake has room for one wakeup, which is left when
+	// notifications are queued, and closed is closed once the server has
+	// stopped running.
+	mu     sync.Mutex
+	queue  []notification
+	wake   chan struct{}
+	closed chan struct{}
+}
+
+// notification is a notification waiting to be written, or, if written is
+// set, a marker that closes it once those before it have been.
+type notification struct {
+	method   string
+	filename string
+	params   any
+	written  chan struct{}
+}
+
+func newOutbox(name string, conn jsonrpc2.Conn) *outbox {
+	o := &outbox{name: name, conn: conn, wake: make(chan struct{}, 1), closed: make(chan struct{})}
+	go o.run()
+	return o
+}
+
+// notify queues a notification about a document.
+func (o *outbox) notify(method, filename string, params any) {
+	o.push(notification{method: method, filename: filename, params: params})
+}
+
+// wait waits for the notifications queued so far to be written, or for ctx
+// to be cancelled or the server to stop.
+func (o *outbox) wait(ctx context.Context) error {
+	written := make(chan struct{})
+	o.push(notification{written: written})
+	select {
+	case <-written:
+		return nil
+	case <-o.closed:
+		return errStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops writing once the server has stopped running, dropping what
+// hasn't been written.
+func (o *outbox) close() {
+	close(o.closed)
+}
+
+func (o *outbox) isClosed() bool {
+	select {
+	case <-o.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (o *outbox) push(n notification) {
+	o.mu.Lock()
+	o.queue = append(o.queue, n)
+	o.mu.Unlock()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) run() {
+	for {
+		select {
+		case <-o.wake:
+		case <-o.closed:
+			return
+		}
+		for {
+			o.mu.Lock()
+			if len(o.queue) == 0 || o.isClosed() {
+				o.mu.Unlock()
+				break
+			}
+			n := o.queue[0]
+			o.queue = o.queue[1:]
+			o.mu.Unlock()
+
+			if n.written != nil {
+				close(n.written)
+			} else if err := o.conn.Notify(context.Background(), n.method, n.params); err != nil {
+				tklog.Error("LSP error on %s %s: %v", n.method, n.filename, err)
+			} else {
+				tklog.Info("LSP %s: %s(%s)", n.method, o.name, n.filename)
+			}
+		}
+	}
+}
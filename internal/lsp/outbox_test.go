@@ -0,0 +1,75 @@
+package lsp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+// stuckConn is a server that has stopped reading its input, so writes to it
+// block until it is unstuck.
+type stuckConn struct {
+	fakeConn
+	unstuck chan struct{}
+}
+
+func (s *stuckConn) Notify(ctx context.Context, method string, params any) error {
+	<-s.unstuck
+	return s.fakeConn.Notify(ctx, method, params)
+}
+
+func TestOutboxDoesNotBlockClient(t *testing.T) {
+	c, _ := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	conn := &stuckConn{unstuck: make(chan struct{})}
+	c.conn, c.outbox = conn, newOutbox("fake", conn)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := int32(1); i <= 3; i++ {
+			c.DidChange("a.go", i, Change{Text: "x", Before: rope.NewRope(""), After: rope.NewRope("x")})
+			c.Flush("a.go")
+		}
+		c.Diagnostics("a.go")
+		c.State()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the client not to wait for a stuck server")
+	}
+
+	// Requests wait for the notifications before them
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.outbox.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out got %v", err)
+	}
+
+	close(conn.unstuck)
+	written(c)
+	if conn.count() != 3 {
+		t.Fatalf("expected the changes written in the end got %v", conn.methods)
+	}
+	for i, params := range conn.params {
+		if v := params.(*didChangeParams).TextDocument.Version; v != int32(i+1) {
+			t.Fatalf("expected the changes written in order got version %d at %d", v, i)
+		}
+	}
+}
+
+func TestOutboxClose(t *testing.T) {
+	conn := &stuckConn{unstuck: make(chan struct{})}
+	o := newOutbox("fake", conn)
+	o.notify(protocol.MethodTextDocumentDidClose, "a.go", nil)
+	o.close()
+	if err := o.wait(context.Background()); !errors.Is(err, errStopped) {
+		t.Fatalf("expected errStopped got %v", err)
+	}
+	close(conn.unstuck)
+}
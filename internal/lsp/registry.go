@@ -0,0 +1,271 @@
+package lsp
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ServerConfig describes a language server: how to start it and which files
+// it serves.
+type ServerConfig struct {
+	// Name identifies the server in logs and settings.
+	Name    string
+	Command string
+	Args    []string
+	// Env holds environment variables set for the server on top of the
+	// editor's own.
+	Env map[string]string
+	// RootMarkers are files or directories, such as go.mod, that mark the
+	// root of a project. A server is started for each project.
+	RootMarkers []string
+	// Extensions and Globs choose the files the server serves: by extension
+	// without the dot, or by a pattern matched against the file's name or
+	// its whole path.
+	Extensions []string
+	Globs      []string
+	// LanguageID is sent to the server to say what language a document is
+	// in. It defaults to the file's.
+	LanguageID string
+	// InitializationOptions are passed to the server when it starts.
+	InitializationOptions any
+}
+
+// DefaultServers are the language servers used when none are configured.
+var DefaultServers = []ServerConfig{
+	{
+		Name:        "gopls",
+		Command:     "gopls",
+		RootMarkers: []string{"go.work", "go.mod", ".git"},
+		Extensions:  []string{"go"},
+	},
+}
+
+// registryMu guards the registry: servers, activeLSPs, groups and roots.
+var registryMu sync.Mutex
+
+// servers are the language servers files are matched against, in order of
+// preference.
+var servers = DefaultServers
+
+// SetServers sets the language servers files are matched against, in order
+// of preference. Servers already running are left alone.
+func SetServers(configs []ServerConfig) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	servers = configs
+	groups = nil
+	roots = nil
+}
+
+// matches reports whether the server serves a file.
+func (s ServerConfig) matches(filename string) bool {
+	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
+	if ext != "" && slices.Contains(s.Extensions, ext) {
+		return true
+	}
+	for _, glob := range s.Globs {
+		if ok, _ := filepath.Match(glob, filepath.Base(filename)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, filename); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// activeLSPs holds the servers started, by name and project root. Servers
+// given up on are kept so they aren't tried again until they are restarted
+// by hand.
+var activeLSPs map[string]*lspClient
+
+// groups holds the clients for files served by more than one server, by the
+// keys of the servers in activeLSPs.
+var groups map[string]*clientGroup
+
+// roots holds the project root of each file for each server, so the
+// filesystem isn't searched each time a file's client is needed.
+var roots map[string]string
+
+// serverKey returns the key in activeLSPs of the server that serves a file.
+func serverKey(config ServerConfig, filename string) (string, string) {
+	if roots == nil {
+		roots = map[string]string{}
+	}
+	key := config.Name + "\x00" + filename
+	root, ok := roots[key]
+	if !ok {
+		root = findRoot(filename, config.RootMarkers)
+		roots[key] = root
+	}
+	return config.Name + "\x00" + root, root
+}
+
+// GetLSP returns the client for the language servers that serve a file,
+// starting them in the background if they aren't running, or nil if there
+// are none. Servers that have failed are left out. It is safe to call from
+// any goroutine.
+func GetLSP(filename string) LSPClient {
+	return clientFor(filename, false)
+}
+
+// DocumentLSP is like GetLSP, but includes servers that have failed. It is
+// for telling the servers about a file being opened, edited and closed,
+// which they keep track of whatever their state so that they have the file
+// as it is if they are restarted.
+func DocumentLSP(filename string) LSPClient {
+	return clientFor(filename, true)
+}
+
+// HasServers reports whether any language server is configured to serve a
+// file, whether or not one is running. Unlike GetLSP it doesn't start any.
+func HasServers(filename string) bool {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return filename != "" && slices.ContainsFunc(servers, func(config ServerConfig) bool {
+		return config.matches(filename)
+	})
+}
+
+// clientFor returns the client for the language servers that serve a file,
+// including those that have failed if failed is set.
+func clientFor(filename string, failed bool) LSPClient {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if activeLSPs == nil {
+		activeLSPs = map[string]*lspClient{}
+	}
+
+	if filename == "" {
+		return nil
+	}
+
+	var clients []*lspClient
+	var keys []string
+	for _, config := range servers {
+		if !config.matches(filename) {
+			continue
+		}
+		key, root := serverKey(config, filename)
+		client, ok := activeLSPs[key]
+		if !ok {
+			client = newLSPClient(config, root)
+			activeLSPs[key] = client
+		}
+		if failed || client.State() != ServerFailed {
+			clients = append(clients, client)
+			keys = append(keys, key)
+		}
+	}
+
+	switch len(clients) {
+	case 0:
+		return nil
+	case 1:
+		return clients[0]
+	}
+	key := strings.Join(keys, "\x00")
+	group, ok := groups[key]
+	if !ok {
+		if groups == nil {
+			groups = map[string]*clientGroup{}
+		}
+		group = &clientGroup{clients: clients}
+		groups[key] = group
+	}
+	return group
+}
+
+// ServerStatus describes a language server that serves a file.
+type ServerStatus struct {
+	Name  string
+	State ServerState
+	// Progress is the work the server is reporting progress on, oldest
+	// first.
+	Progress []Progress
+}
+
+// ServerStates returns the states of the language servers started for a
+// file, in order of preference. Unlike GetLSP it doesn't start any.
+func ServerStates(filename string) []ServerStatus {
+	var states []ServerStatus
+	for _, client := range startedClients(filename) {
+		client.mu.Lock()
+		states = append(states, ServerStatus{Name: client.name, State: client.state, Progress: client.progressLocked()})
+		client.mu.Unlock()
+	}
+	return states
+}
+
+// ServerLog is what a language server has logged.
+type ServerLog struct {
+	Name  string
+	Lines []string
+}
+
+// ServerLogs returns the logs of the language servers started for a file,
+// in order of preference.
+func ServerLogs(filename string) []ServerLog {
+	var logs []ServerLog
+	for _, client := range startedClients(filename) {
+		client.mu.Lock()
+		logs = append(logs, ServerLog{Name: client.name, Lines: slices.Clone(client.log)})
+		client.mu.Unlock()
+	}
+	return logs
+}
+
+// RestartServers restarts the language servers started for a file, even
+// those given up on, reopening its documents on them. It returns how many
+// were restarted once they are starting again.
+func RestartServers(filename string) int {
+	clients := startedClients(filename)
+	each(clients, (*lspClient).restart)
+	return len(clients)
+}
+
+// startedClients returns the clients started for a file, whatever their
+// state.
+func startedClients(filename string) []*lspClient {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if filename == "" {
+		return nil
+	}
+	var clients []*lspClient
+	for _, config := range servers {
+		if !config.matches(filename) {
+			continue
+		}
+		key, _ := serverKey(config, filename)
+		if client, ok := activeLSPs[key]; ok {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// ShutdownAll stops every language server.
+func ShutdownAll() {
+	registryMu.Lock()
+	clients := slices.Collect(maps.Values(activeLSPs))
+	registryMu.Unlock()
+	each(clients, (*lspClient).shutdown)
+}
+
+// each calls fn for every client at once, as each may wait for its server,
+// and returns when they have all finished.
+func each(clients []*lspClient, fn func(c *lspClient)) {
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(c)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,127 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/tklog"
+)
+
+// RenameTarget is the range of the symbol a rename would change, and the text
+// to suggest as the new name.
+type RenameTarget struct {
+	Start       Position
+	End         Position
+	Placeholder string
+}
+
+// editHandler applies workspace edits the server asks for.
+var editHandler func(edit *WorkspaceEdit) error
+
+// SetEditHandler sets the function that applies edits servers send with
+// workspace/applyEdit. It is called on the editor's main goroutine, and
+// returns an error if the edit wasn't applied.
+func SetEditHandler(handler func(edit *WorkspaceEdit) error) {
+	editHandler = handler
+}
+
+func (c *lspClient) PrepareRename(ctx context.Context, filename string, pos Position) (*RenameTarget, error) {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	options, ok := caps.RenameProvider.(map[string]any)
+	if !ok || options["prepareProvider"] != true {
+		return nil, ErrNotSupported
+	}
+	position, err := c.textDocumentPosition(filename, pos)
+	if err != nil {
+		return nil, err
+	}
+	var raw json.RawMessage
+	params := &protocol.PrepareRenameParams{TextDocumentPositionParams: position}
+	if err := c.call(ctx, filename, protocol.MethodTextDocumentPrepareRename, params, &raw); err != nil {
+		return nil, err
+	}
+
+	// The result is null if there's nothing to rename, a range, a range and
+	// placeholder, or asks the client to find the word at the position
+	var result struct {
+		protocol.Range
+		Placeholder     string          `json:"placeholder"`
+		InnerRange      *protocol.Range `json:"range"`
+		DefaultBehavior bool            `json:"defaultBehavior"`
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, err
+	}
+	if result.DefaultBehavior {
+		return nil, ErrNotSupported
+	}
+	r := result.Range
+	if result.InnerRange != nil {
+		r = *result.InnerRange
+	}
+	contents := c.contents(filename)
+	target := &RenameTarget{Start: bytePosition(contents, r.Start), End: bytePosition(contents, r.End), Placeholder: result.Placeholder}
+	if target.Placeholder == "" {
+		start, _ := contents.LineStart(target.Start.Line)
+		end, _ := contents.LineStart(target.End.Line)
+		target.Placeholder = contents.Slice(start+target.Start.Offset, end+target.End.Offset)
+	}
+	return target, nil
+}
+
+func (c *lspClient) Rename(ctx context.Context, filename string, pos Position, newName string) (*WorkspaceEdit, error) {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !supported(caps.RenameProvider) {
+		return nil, ErrNotSupported
+	}
+	position, err := c.textDocumentPosition(filename, pos)
+	if err != nil {
+		return nil, err
+	}
+	var result *protocol.WorkspaceEdit
+	params := &protocol.RenameParams{TextDocumentPositionParams: position, NewName: newName}
+	if err := c.call(ctx, filename, protocol.MethodTextDocumentRename, params, &result); err != nil {
+		return nil, err
+	}
+	return c.convertWorkspaceEdit(result)
+}
+
+// ApplyEdit applies an edit the server asks for on the editor's main
+// goroutine, waiting for it to be done.
+func (c *lspClient) ApplyEdit(ctx context.Context, params *protocol.ApplyWorkspaceEditParams) (bool, error) {
+	if editHandler == nil || dispatcher == nil {
+		return false, nil
+	}
+	done := make(chan error, 1)
+	dispatch(func() {
+		// Positions are converted here so they match the editor's buffers
+		edit, err := c.convertWorkspaceEdit(&params.Edit)
+		if err == nil {
+			err = editHandler(edit)
+		}
+		done <- err
+	})
+
+	select {
+	case err := <-done:
+		if err != nil {
+			tklog.Warn("LSP edit %q not applied: %v", params.Label, err)
+			return false, nil
+		}
+		return true, nil
+	case <-ctx.Done():
+		return false, fmt.Errorf("applying edit: %w", ctx.Err())
+	}
+}
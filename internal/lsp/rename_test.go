@@ -0,0 +1,123 @@
+package lsp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+func TestPrepareRename(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.serverCapabilities.RenameProvider = true
+	c.DidOpen("a.go", 1, rope.NewRope("é := count\n"))
+	if _, err := c.PrepareRename(context.Background(), "a.go", Position{}); err != ErrNotSupported {
+		t.Fatalf("expected not supported got %v", err)
+	}
+
+	c.serverCapabilities.RenameProvider = map[string]any{"prepareProvider": true}
+	conn.results = map[string]string{
+		protocol.MethodTextDocumentPrepareRename: `{"start": {"line": 0, "character": 5}, "end": {"line": 0, "character": 10}}`,
+	}
+	target, err := c.PrepareRename(context.Background(), "a.go", Position{Line: 0, Offset: 6})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := RenameTarget{Start: Position{0, 6}, End: Position{0, 11}, Placeholder: "count"}
+	if target == nil || *target != want {
+		t.Fatalf("expected %+v got %+v", want, target)
+	}
+
+	conn.results[protocol.MethodTextDocumentPrepareRename] = `{"range": {"start": {"line": 0, "character": 4}, "end": {"line": 0, "character": 9}}, "placeholder": "n"}`
+	if target, _ := c.PrepareRename(context.Background(), "a.go", Position{}); target == nil || target.Placeholder != "n" || target.Start != (Position{0, 5}) {
+		t.Fatalf("unexpected target %+v", target)
+	}
+	conn.results[protocol.MethodTextDocumentPrepareRename] = `{"defaultBehavior": true}`
+	if _, err := c.PrepareRename(context.Background(), "a.go", Position{}); err != ErrNotSupported {
+		t.Fatalf("expected the client to choose got %v", err)
+	}
+	conn.results[protocol.MethodTextDocumentPrepareRename] = `null`
+	if target, err := c.PrepareRename(context.Background(), "a.go", Position{}); target != nil || err != nil {
+		t.Fatalf("expected nothing to rename got %+v, %v", target, err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.serverCapabilities.RenameProvider = true
+	c.DidOpen("a.go", 1, rope.NewRope("é := n\n"))
+	other := filepath.Join(t.TempDir(), "b.go")
+	os.WriteFile(other, []byte("🌟 n\n"), 0644)
+
+	conn.results = map[string]string{
+		protocol.MethodTextDocumentRename: `{"documentChanges": [
+			{"textDocument": {"uri": "` + string(documentURI("a.go")) + `", "version": 1},
+				"edits": [{"range": {"start": {"line": 0, "character": 5}, "end": {"line": 0, "character": 6}}, "newText": "m"}]},
+			{"textDocument": {"uri": "` + string(documentURI(other)) + `", "version": null},
+				"edits": [{"range": {"start": {"line": 0, "character": 3}, "end": {"line": 0, "character": 4}}, "newText": "m"}]}
+		]}`,
+	}
+	edit, err := c.Rename(context.Background(), "a.go", Position{Line: 0, Offset: 6}, "m")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(edit.Files) != 2 {
+		t.Fatalf("expected edits to 2 files got %+v", edit)
+	}
+	a, b := edit.Files[0], edit.Files[1]
+	if a.Filename != absPath("a.go") || a.Version == nil || *a.Version != 1 || a.Edits[0] != (TextEdit{Start: Position{0, 6}, End: Position{0, 7}, Text: "m"}) {
+		t.Fatalf("unexpected edit %+v", a)
+	}
+	// Positions in files that aren't open are converted using the file
+	if b.Filename != other || b.Version != nil || b.Edits[0] != (TextEdit{Start: Position{0, 5}, End: Position{0, 6}, Text: "m"}) {
+		t.Fatalf("unexpected edit %+v", b)
+	}
+	params := conn.params[len(conn.params)-1].(*protocol.RenameParams)
+	if params.NewName != "m" || params.Position != (protocol.Position{Line: 0, Character: 5}) {
+		t.Fatalf("unexpected params %+v", params)
+	}
+
+	conn.results[protocol.MethodTextDocumentRename] = `{"changes": {"a.go": [{"range": {"start": {"line": 0, "character": 0}, "end": {"line": 0, "character": 1}}, "newText": "e"}]}}`
+	edit, _ = c.Rename(context.Background(), "a.go", Position{}, "e")
+	if len(edit.Files) != 1 || edit.Files[0].Edits[0].End != (Position{0, 2}) {
+		t.Fatalf("unexpected edit %+v", edit)
+	}
+}
+
+func TestApplyEdit(t *testing.T) {
+	c, _ := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.DidOpen("a.go", 1, rope.NewRope("x\n"))
+	params := &protocol.ApplyWorkspaceEditParams{Edit: protocol.WorkspaceEdit{
+		Changes: map[protocol.DocumentURI][]protocol.TextEdit{"a.go": {{NewText: "y"}}},
+	}}
+
+	// Without an editor to apply it the edit is refused
+	if ok, err := c.ApplyEdit(context.Background(), params); ok || err != nil {
+		t.Fatalf("expected the edit refused got %v, %v", ok, err)
+	}
+
+	var applied *WorkspaceEdit
+	var handlerErr error
+	t.Cleanup(func() { SetDispatcher(nil); SetEditHandler(nil) })
+	SetDispatcher(func(fn func()) { go fn() })
+	SetEditHandler(func(edit *WorkspaceEdit) error {
+		applied = edit
+		return handlerErr
+	})
+	if ok, err := c.ApplyEdit(context.Background(), params); !ok || err != nil {
+		t.Fatalf("expected the edit applied got %v, %v", ok, err)
+	}
+	if len(applied.Files) != 1 || applied.Files[0].Edits[0].Text != "y" {
+		t.Fatalf("unexpected edit %+v", applied)
+	}
+
+	handlerErr = errors.New("changed")
+	if ok, _ := c.ApplyEdit(context.Background(), params); ok {
+		t.Fatalf("expected the edit to fail")
+	}
+}
@@ -0,0 +1,127 @@
+package lsp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.lsp.dev/jsonrpc2"
+	"go.lsp.dev/protocol"
+
+	"tked/internal/tklog"
+)
+
+// requestTimeout is how long to wait for a server to answer a request before
+// giving up on it. It doesn't include waiting for the server to start.
+const requestTimeout = 5 * time.Second
+
+// ErrNotSupported is returned for requests the server doesn't support.
+var ErrNotSupported = errors.New("not supported by the language server")
+
+// supported reports whether a server capability that can be a bool or an
+// options struct is enabled.
+func supported(provider any) bool {
+	switch p := provider.(type) {
+	case nil:
+		return false
+	case bool:
+		return p
+	}
+	return true
+}
+
+// lockRunning waits for the server to be running and returns with c.mu
+// held, or returns the error it failed with.
+func (c *lspClient) lockRunning(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		switch c.state {
+		case ServerReady:
+			return nil
+		case ServerFailed:
+			err := c.startErr
+			c.mu.Unlock()
+			return err
+		case ServerStopped:
+			c.mu.Unlock()
+			return errStopped
+		}
+		ready := c.ready
+		c.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// capabilities waits for the server to be running and returns what it
+// supports.
+func (c *lspClient) capabilities(ctx context.Context) (*protocol.ServerCapabilities, error) {
+	if err := c.lockRunning(ctx); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+	caps := c.serverCapabilities
+	return &caps, nil
+}
+
+// connection waits for the server to be running and returns the connection
+// to it, and the outbox notifications to it are sent through.
+func (c *lspClient) connection(ctx context.Context) (jsonrpc2.Conn, *outbox, error) {
+	if err := c.lockRunning(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer c.mu.Unlock()
+	return c.conn, c.outbox, nil
+}
+
+// call sends a request and waits for the result, until ctx is cancelled or
+// the server takes too long, when the server is told to stop working on it.
+// Changes to the document that are being held back are sent first so the
+// server sees what the user sees.
+func (c *lspClient) call(ctx context.Context, filename, method string, params, result any) error {
+	c.Flush(filename)
+
+	conn, outbox, err := c.connection(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	// The server must have the changes before it is asked about them
+	if outbox != nil {
+		err = outbox.wait(ctx)
+	}
+	if err == nil {
+		err = protocol.Call(ctx, conn, method, params, result)
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			tklog.Info("LSP %s cancelled: %s(%s)", method, c.name, filename)
+		} else {
+			tklog.Error("LSP error on %s %s: %v", method, filename, err)
+		}
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	tklog.Info("LSP %s: %s(%s)", method, c.name, filename)
+	return nil
+}
+
+// textDocumentPosition converts a position in an open document to the LSP
+// form used by most requests.
+func (c *lspClient) textDocumentPosition(filename string, pos Position) (protocol.TextDocumentPositionParams, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	doc := c.docs[absPath(filename)]
+	if doc == nil {
+		return protocol.TextDocumentPositionParams{}, fmt.Errorf("%s is not open in the language server", filename)
+	}
+	return protocol.TextDocumentPositionParams{
+		TextDocument: protocol.TextDocumentIdentifier{URI: documentURI(filename)},
+		Position:     utf16Position(doc.contents, pos),
+	}, nil
+}
@@ -0,0 +1,232 @@
+package lsp
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+// SemanticToken is a word in a document that the server has classified for
+// highlighting, such as the name of a function or a parameter.
+type SemanticToken struct {
+	Start Position
+	End   Position
+	// Type is the kind of word, such as "function" or "parameter", and
+	// Modifiers say more about it, such as "readonly", in the names the
+	// server's legend gives them.
+	Type      string
+	Modifiers []string
+}
+
+// semanticTokensResult holds the tokens the server last sent for a document
+// as it sent them, which later answers can be the changes to.
+type semanticTokensResult struct {
+	resultID string
+	data     []uint32
+	// version is the version of the document they are for.
+	version int32
+}
+
+// semanticTokensAnswer holds a SemanticTokens, or a SemanticTokensDelta,
+// which servers can send for a delta request.
+type semanticTokensAnswer struct {
+	ResultID string                        `json:"resultId"`
+	Data     []uint32                      `json:"data"`
+	Edits    []protocol.SemanticTokensEdit `json:"edits"`
+}
+
+// semanticTokensProvider is the server's semantic tokens capability, which
+// the protocol package doesn't describe fully.
+type semanticTokensProvider struct {
+	Legend protocol.SemanticTokensLegend `json:"legend"`
+	// Full is true or {"delta": true} if the server sends the tokens for a
+	// whole document, and the latter if it can send the changes since the
+	// last tokens.
+	Full any `json:"full"`
+}
+
+// semanticTokensClientCapabilities says the client wants the tokens for whole
+// documents, and the changes to them, of the standard types.
+var semanticTokensClientCapabilities = &protocol.SemanticTokensClientCapabilities{
+	Requests: protocol.SemanticTokensWorkspaceClientCapabilitiesRequests{
+		Full: map[string]any{"delta": true},
+	},
+	TokenTypes: []string{
+		"namespace", "type", "class", "enum", "interface", "struct", "typeParameter", "parameter",
+		"variable", "property", "enumMember", "event", "function", "method", "macro", "keyword",
+		"modifier", "comment", "string", "number", "regexp", "operator",
+	},
+	TokenModifiers: []string{
+		"declaration", "definition", "readonly", "static", "deprecated", "abstract", "async",
+		"modification", "documentation", "defaultLibrary",
+	},
+	Formats: []protocol.TokenFormat{protocol.TokenFormatRelative},
+}
+
+func (c *lspClient) SemanticTokens(filename string) []SemanticToken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if doc := c.docs[absPath(filename)]; doc != nil {
+		return slices.Clone(doc.semanticTokens)
+	}
+	return nil
+}
+
+func (c *lspClient) UpdateSemanticTokens(ctx context.Context, filename string) error {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return err
+	}
+	provider, full, delta := semanticTokensSupport(caps)
+	if !full {
+		return ErrNotSupported
+	}
+
+	c.mu.Lock()
+	doc := c.docs[absPath(filename)]
+	if doc == nil {
+		c.mu.Unlock()
+		return fmt.Errorf("%s is not open in the language server", filename)
+	}
+	version, contents, previous := doc.version, doc.contents, doc.semanticTokensResult
+	c.mu.Unlock()
+	if previous != nil && previous.version == version {
+		return nil
+	}
+
+	// Ask for the changes since the last tokens if the server can send them,
+	// though it can send them all anyway
+	textDocument := protocol.TextDocumentIdentifier{URI: documentURI(filename)}
+	var answer semanticTokensAnswer
+	if delta && previous != nil && previous.resultID != "" {
+		params := &protocol.SemanticTokensDeltaParams{TextDocument: textDocument, PreviousResultID: previous.resultID}
+		err = c.call(ctx, filename, protocol.MethodSemanticTokensFullDelta, params, &answer)
+	} else {
+		params := &protocol.SemanticTokensParams{TextDocument: textDocument}
+		err = c.call(ctx, filename, protocol.MethodSemanticTokensFull, params, &answer)
+	}
+	if err != nil {
+		return err
+	}
+	data := answer.Data
+	if answer.Edits != nil || data == nil {
+		if previous == nil {
+			return fmt.Errorf("%s: changes to semantic tokens that weren't sent", filename)
+		}
+		if data, err = applySemanticTokensEdits(previous.data, answer.Edits); err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	tokens := decodeSemanticTokens(contents, data, provider.Legend)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if doc = c.docs[absPath(filename)]; doc == nil {
+		return nil // closed while waiting
+	}
+	doc.semanticTokensResult = &semanticTokensResult{resultID: answer.ResultID, data: data, version: version}
+	// Tokens for text that has since changed are only kept for the changes
+	// to them that the next answer holds
+	if doc.version == version {
+		doc.semanticTokens = tokens
+	}
+	return nil
+}
+
+// shiftSemanticTokens moves a document's tokens to follow the words they
+// are for after a change, dropping those for words that were changed.
+func shiftSemanticTokens(doc *document, change Change) {
+	shift := shiftFunc(change)
+	tokens := doc.semanticTokens[:0]
+	for _, token := range doc.semanticTokens {
+		token.Start, token.End = shift(token.Start), shift(token.End)
+		if token.Start != token.End {
+			tokens = append(tokens, token)
+		}
+	}
+	doc.semanticTokens = tokens
+}
+
+// semanticTokensSupport returns the server's semantic tokens capability, and
+// whether it sends the tokens for whole documents and the changes to them.
+func semanticTokensSupport(caps *protocol.ServerCapabilities) (provider semanticTokensProvider, full, delta bool) {
+	if caps.SemanticTokensProvider == nil {
+		return provider, false, false
+	}
+	data, err := json.Marshal(caps.SemanticTokensProvider)
+	if err != nil || json.Unmarshal(data, &provider) != nil {
+		return provider, false, false
+	}
+	switch f := provider.Full.(type) {
+	case bool:
+		return provider, f, false
+	case map[string]any:
+		delta, _ := f["delta"].(bool)
+		return provider, true, delta
+	}
+	return provider, false, false
+}
+
+// applySemanticTokensEdits makes the changes a server sent to the tokens it
+// sent before.
+func applySemanticTokensEdits(data []uint32, edits []protocol.SemanticTokensEdit) ([]uint32, error) {
+	// Each edit's start is in the tokens before any of the edits, so they are
+	// made from the end
+	edits = slices.Clone(edits)
+	slices.SortStableFunc(edits, func(a, b protocol.SemanticTokensEdit) int {
+		return cmp.Compare(b.Start, a.Start)
+	})
+	data = slices.Clone(data)
+	for _, edit := range edits {
+		start, end := int(edit.Start), int(edit.Start)+int(edit.DeleteCount)
+		if end > len(data) {
+			return nil, fmt.Errorf("semantic tokens edit %d-%d past the end of %d", start, end, len(data))
+		}
+		data = slices.Replace(data, start, end, edit.Data...)
+	}
+	return data, nil
+}
+
+// decodeSemanticTokens converts tokens from the LSP form, in which each token
+// is five numbers: its line and start relative to the token before, its
+// length, its type and a bit set of its modifiers. Lengths and starts are
+// counted in UTF-16 code units.
+func decodeSemanticTokens(r rope.Rope, data []uint32, legend protocol.SemanticTokensLegend) []SemanticToken {
+	tokens := make([]SemanticToken, 0, len(data)/5)
+	line, char := 0, 0
+	var text string
+	textLine := -1
+	for i := 0; i+5 <= len(data); i += 5 {
+		if data[i] > 0 {
+			line += int(data[i])
+			char = 0
+		}
+		char += int(data[i+1])
+		length, typ, modifiers := int(data[i+2]), int(data[i+3]), data[i+4]
+		if typ >= len(legend.TokenTypes) || line >= r.LineCount() {
+			continue
+		}
+		if line != textLine {
+			text, textLine = lineText(r, line), line
+		}
+
+		token := SemanticToken{
+			Start: Position{Line: line, Offset: utf16Offset(text, char)},
+			End:   Position{Line: line, Offset: utf16Offset(text, char+length)},
+			Type:  string(legend.TokenTypes[typ]),
+		}
+		for bit, modifier := range legend.TokenModifiers {
+			if modifiers&(1<<bit) != 0 {
+				token.Modifiers = append(token.Modifiers, string(modifier))
+			}
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
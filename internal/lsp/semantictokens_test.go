@@ -0,0 +1,79 @@
+package lsp
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+func TestSemanticTokens(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	before := rope.NewRope("func 🌟() {\n\tx := 1\n}\n")
+	c.DidOpen("a.go", 1, before)
+	if err := c.UpdateSemanticTokens(context.Background(), "a.go"); err != ErrNotSupported {
+		t.Fatalf("expected not supported got %v", err)
+	}
+
+	c.serverCapabilities.SemanticTokensProvider = map[string]any{
+		"legend": map[string]any{
+			"tokenTypes":     []string{"function", "keyword", "variable"},
+			"tokenModifiers": []string{"definition", "readonly"},
+		},
+		"full": map[string]any{"delta": true},
+	}
+	conn.results = map[string]string{
+		protocol.MethodSemanticTokensFull: `{"resultId": "1", "data": [0,0,4,1,0, 0,5,2,0,1, 1,1,1,2,1]}`,
+	}
+	if err := c.UpdateSemanticTokens(context.Background(), "a.go"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The emoji is four bytes and two UTF-16 units
+	want := []SemanticToken{
+		{Start: Position{0, 0}, End: Position{0, 4}, Type: "keyword"},
+		{Start: Position{0, 5}, End: Position{0, 9}, Type: "function", Modifiers: []string{"definition"}},
+		{Start: Position{1, 1}, End: Position{1, 2}, Type: "variable", Modifiers: []string{"definition"}},
+	}
+	if tokens := c.SemanticTokens("a.go"); !equalTokens(tokens, want) {
+		t.Fatalf("expected %+v got %+v", want, tokens)
+	}
+
+	// The document hasn't changed, so they aren't asked for again
+	count := conn.count()
+	c.UpdateSemanticTokens(context.Background(), "a.go")
+	if conn.count() != count {
+		t.Fatalf("expected no request got %v", conn.methods[count:])
+	}
+
+	// They follow edits until the changes to them are asked for
+	c.DidChange("a.go", 2, Change{Start: Position{0, 0}, End: Position{0, 0}, Text: "\n",
+		Before: before, After: rope.NewRope("\n" + before.String())})
+	for i := range want {
+		want[i].Start.Line++
+		want[i].End.Line++
+	}
+	if tokens := c.SemanticTokens("a.go"); !equalTokens(tokens, want) {
+		t.Fatalf("expected %+v got %+v", want, tokens)
+	}
+
+	conn.results[protocol.MethodSemanticTokensFullDelta] = `{"resultId": "2", "edits": [
+		{"start": 10, "deleteCount": 5}, {"start": 0, "deleteCount": 1, "data": [1]}]}`
+	if err := c.UpdateSemanticTokens(context.Background(), "a.go"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if params := conn.params[len(conn.params)-1].(*protocol.SemanticTokensDeltaParams); params.PreviousResultID != "1" {
+		t.Fatalf("expected the changes since the first tokens asked for got %+v", params)
+	}
+	if tokens := c.SemanticTokens("a.go"); !equalTokens(tokens, want[:2]) {
+		t.Fatalf("expected %+v got %+v", want[:2], tokens)
+	}
+}
+
+func equalTokens(a, b []SemanticToken) bool {
+	return slices.EqualFunc(a, b, func(x, y SemanticToken) bool {
+		return x.Start == y.Start && x.End == y.End && x.Type == y.Type && slices.Equal(x.Modifiers, y.Modifiers)
+	})
+}
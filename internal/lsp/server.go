@@ -0,0 +1,320 @@
+package lsp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os/exec"
+	"slices"
+	"time"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/tklog"
+)
+
+// ServerState is where a language server is in its life.
+type ServerState int
+
+const (
+	// ServerStarting is a server starting, or restarting after it exited.
+	ServerStarting ServerState = iota
+	// ServerReady is a server that is running and can be sent requests.
+	ServerReady
+	// ServerCrashed is a server that exited or failed to start, waiting to
+	// be restarted.
+	ServerCrashed
+	// ServerFailed is a server given up on after failing too often. It is
+	// only tried again when it is restarted by hand.
+	ServerFailed
+	// ServerStopped is a server that was shut down.
+	ServerStopped
+)
+
+func (s ServerState) String() string {
+	switch s {
+	case ServerStarting:
+		return "starting"
+	case ServerReady:
+		return "ready"
+	case ServerCrashed:
+		return "crashed"
+	case ServerFailed:
+		return "failed"
+	case ServerStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("ServerState(%d)", int(s))
+}
+
+// startTimeout is how long a server has to answer the initialize request
+// before it is given up on.
+const startTimeout = 30 * time.Second
+
+// shutdownTimeout is how long a server has to answer the shutdown request,
+// and then to exit, before it is killed.
+var shutdownTimeout = 2 * time.Second
+
+// restartDelay is how long to wait before restarting a server that exited.
+// It doubles each time the server fails again, and after maxRestarts
+// failures in a row the server is given up on. A server that ran for
+// stableTime before exiting starts the count again.
+var restartDelay = time.Second
+
+const maxRestarts = 5
+
+var stableTime = time.Minute
+
+// errNotStarted is returned for requests to a server that failed to start.
+var errNotStarted = errors.New("the language server didn't start")
+
+// errStopped is returned for requests to a server that was shut down.
+var errStopped = errors.New("the language server was stopped")
+
+// newLSPClient returns a client for a server for the project at root, which
+// is started in the background.
+func newLSPClient(config ServerConfig, root string) *lspClient {
+	client := &lspClient{
+		name:   config.Name,
+		config: config,
+		root:   root,
+		ready:  make(chan struct{}),
+	}
+	client.start()
+	return client
+}
+
+// State returns the server's state.
+func (c *lspClient) State() ServerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// setStateLocked changes the server's state, opening or closing ready to
+// match. c.mu must be held. Changes not yet sent and diagnostics are dropped
+// when the server stops running, as the documents are sent whole if it
+// starts again. Semantic tokens are kept until new ones replace them.
+func (c *lspClient) setStateLocked(state ServerState) {
+	if c.state == ServerReady && state != ServerReady {
+		for _, p := range c.pending {
+			p.timer.Stop()
+		}
+		c.pending = nil
+		for _, doc := range c.docs {
+			doc.published = nil
+			doc.diagnostics = nil
+			doc.semanticTokensResult = nil
+		}
+	}
+	if state != ServerReady && state != ServerStarting {
+		c.progress = nil
+	}
+	c.state = state
+
+	waiting := state == ServerStarting || state == ServerCrashed
+	select {
+	case <-c.ready:
+		if waiting {
+			c.ready = make(chan struct{})
+		}
+	default:
+		if !waiting {
+			close(c.ready)
+		}
+	}
+
+	// Redraw to show the new state
+	dispatch(func() {})
+}
+
+// start runs the server in the background, restarting it when it exits,
+// until it is shut down.
+func (c *lspClient) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	c.startErr = nil
+	c.cancel = cancel
+	c.stopped = make(chan struct{})
+	c.setStateLocked(ServerStarting)
+	stopped := c.stopped
+	c.mu.Unlock()
+
+	go func() {
+		defer close(stopped)
+		c.run(ctx)
+	}()
+}
+
+// run starts the server and restarts it each time it exits, after a delay,
+// until ctx is cancelled or it has failed too often.
+func (c *lspClient) run(ctx context.Context) {
+	failures := 0
+	for {
+		attempt, stop := context.WithCancel(ctx)
+		err := startLSPClientFunc(attempt, c)
+		var ran time.Duration
+		if err == nil && c.started() {
+			startedAt := time.Now()
+			c.waitExit(attempt)
+			ran = time.Since(startedAt)
+		}
+		restart := c.exited()
+		stop()
+		if exitErr := c.cleanup(); err == nil {
+			err = exitErr
+		}
+		if !restart || ctx.Err() != nil {
+			return
+		}
+
+		if ran >= stableTime {
+			failures = 0
+		}
+		failures++
+		if failures > maxRestarts || errors.Is(err, exec.ErrNotFound) {
+			tklog.Error("giving up on LSP server %s in %s: %v", c.name, c.root, err)
+			c.giveUp(fmt.Errorf("%w: %w", errNotStarted, err))
+			return
+		}
+		delay := restartDelay << (failures - 1)
+		tklog.Error("LSP server %s in %s exited, restarting in %v: %v", c.name, c.root, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+
+		c.mu.Lock()
+		if c.state == ServerCrashed {
+			c.setStateLocked(ServerStarting)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// started records that the server is running, and opens the documents
+// tracked while it was starting. It reports false if the server was shut
+// down meanwhile.
+func (c *lspClient) started() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == ServerStopped {
+		return false
+	}
+	c.outbox = newOutbox(c.name, c.conn)
+	c.setStateLocked(ServerReady)
+	for _, filename := range slices.Sorted(maps.Keys(c.docs)) {
+		c.openLocked(filename, c.docs[filename])
+	}
+	return true
+}
+
+// waitExit waits for the running server to exit, or ctx to be cancelled.
+func (c *lspClient) waitExit(ctx context.Context) {
+	var done <-chan struct{}
+	if c.conn != nil {
+		done = c.conn.Done()
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// exited records that the server has exited, or failed to start, and
+// reports whether it should be restarted, which it shouldn't if it was shut
+// down.
+func (c *lspClient) exited() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == ServerStopped {
+		return false
+	}
+	c.setStateLocked(ServerCrashed)
+	return true
+}
+
+// cleanup closes the connection to a server that is no longer running and
+// waits for its process to exit, returning why it did.
+func (c *lspClient) cleanup() error {
+	var err error
+	if c.conn != nil {
+		c.conn.Close()
+		err = c.conn.Err()
+	}
+	if c.cmd != nil {
+		if waitErr := c.cmd.Wait(); waitErr != nil {
+			err = waitErr
+		}
+	}
+	if c.outbox != nil {
+		c.outbox.close()
+	}
+	c.conn, c.server, c.cmd, c.outbox = nil, nil, nil, nil
+	if err == nil {
+		err = errors.New("the language server exited")
+	}
+	return err
+}
+
+// giveUp records that the server failed too often to be restarted.
+func (c *lspClient) giveUp(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == ServerStopped {
+		return
+	}
+	c.startErr = err
+	c.setStateLocked(ServerFailed)
+}
+
+// shutdown stops the server, asking it to shut down and exit if it is
+// running, and killing it if it doesn't in time. It returns once the server
+// has stopped.
+func (c *lspClient) shutdown() {
+	c.mu.Lock()
+	state := c.state
+	var server protocol.Server
+	if state == ServerReady {
+		server = c.server
+	}
+	cancel, stopped := c.cancel, c.stopped
+	if state != ServerStopped {
+		c.setStateLocked(ServerStopped)
+	}
+	c.mu.Unlock()
+	if state == ServerStopped {
+		<-stopped
+		return
+	}
+
+	if server != nil {
+		ctx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := server.Shutdown(ctx)
+		cancelShutdown()
+		if err == nil {
+			err = server.Exit(context.Background())
+		}
+		if err != nil {
+			tklog.Warn("LSP error on shutdown %s: %v", c.name, err)
+		}
+
+		select {
+		case <-stopped:
+		case <-time.After(shutdownTimeout):
+			tklog.Warn("LSP server %s in %s didn't exit, killing it", c.name, c.root)
+		}
+	}
+	cancel()
+	<-stopped
+	tklog.Info("LSP shutdown: %s", c.name)
+}
+
+// restart stops the server and starts it again, even if it was given up on.
+func (c *lspClient) restart() {
+	c.shutdown()
+	c.start()
+	tklog.Info("LSP restart: %s in %s", c.name, c.root)
+}
@@ -0,0 +1,242 @@
+package lsp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.lsp.dev/protocol"
+	"go.uber.org/zap"
+
+	"tked/internal/rope"
+)
+
+// exitingConn is a fakeConn for a server process that exits when it is
+// told to, or when exit is closed.
+type exitingConn struct {
+	fakeConn
+	exit     chan struct{}
+	exitOnce sync.Once
+}
+
+func newExitingConn() *exitingConn {
+	return &exitingConn{exit: make(chan struct{})}
+}
+
+func (e *exitingConn) Notify(ctx context.Context, method string, params any) error {
+	if method == protocol.MethodExit {
+		e.crash()
+	}
+	return e.fakeConn.Notify(ctx, method, params)
+}
+func (e *exitingConn) Done() <-chan struct{} { return e.exit }
+func (e *exitingConn) crash()                { e.exitOnce.Do(func() { close(e.exit) }) }
+
+// withExitingServers makes gopls start with a new exitingConn each time,
+// returning the conns so far.
+func withExitingServers(t *testing.T) func() []*exitingConn {
+	var mu sync.Mutex
+	var conns []*exitingConn
+	withServers(t, DefaultServers, func(ctx context.Context, c *lspClient) error {
+		conn := newExitingConn()
+		c.conn = conn
+		c.server = protocol.ServerDispatcher(conn, zap.NewNop())
+		c.serverTextDocumentSyncOptions = protocol.TextDocumentSyncOptions{OpenClose: true, Change: protocol.TextDocumentSyncKindFull}
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+		return nil
+	})
+	return func() []*exitingConn {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*exitingConn(nil), conns...)
+	}
+}
+
+// waitForState waits for a client to be in a state.
+func waitForState(t *testing.T, c *lspClient, state ServerState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v got %v", state, c.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRestartAfterCrash(t *testing.T) {
+	conns := withExitingServers(t)
+	client := GetLSP("a.go").(*lspClient)
+	client.DidOpen("a.go", 1, rope.NewRope("x"))
+	waitForState(t, client, ServerReady)
+	client.PublishDiagnostics(context.Background(), &protocol.PublishDiagnosticsParams{
+		URI:         documentURI("a.go"),
+		Diagnostics: []protocol.Diagnostic{{Message: "unused"}},
+	})
+
+	// A server that crashes is restarted, and sent the documents again
+	conns()[0].crash()
+	for deadline := time.Now().Add(5 * time.Second); len(conns()) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the server restarted")
+		}
+	}
+	waitForState(t, client, ServerReady)
+	client.DidChange("a.go", 2, Change{Start: Position{0, 1}, End: Position{0, 1}, Text: "y", Before: rope.NewRope("x"), After: rope.NewRope("xy")})
+	written(client)
+	restarted := conns()[1]
+	if restarted.count() != 1 || restarted.methods[0] != protocol.MethodTextDocumentDidOpen {
+		t.Fatalf("expected the document reopened got %v", restarted.methods)
+	}
+	if open := restarted.params[0].(*protocol.DidOpenTextDocumentParams).TextDocument; open.Version != 1 || open.Text != "x" {
+		t.Fatalf("unexpected document reopened %+v", open)
+	}
+	// Diagnostics from the server that crashed are dropped
+	if d := client.Diagnostics("a.go"); len(d) != 0 {
+		t.Fatalf("expected no diagnostics got %v", d)
+	}
+
+	// Changes are sent to the new server
+	client.Flush("a.go")
+	written(client)
+	if restarted.count() != 2 || restarted.methods[1] != protocol.MethodTextDocumentDidChange {
+		t.Fatalf("expected the change sent got %v", restarted.methods)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	conns := withExitingServers(t)
+	client := GetLSP("a.go").(*lspClient)
+	waitForState(t, client, ServerReady)
+
+	// A server is asked to shut down and exit, and isn't restarted
+	ShutdownAll()
+	conn := conns()[0]
+	if len(conn.methods) != 2 || conn.methods[0] != protocol.MethodShutdown || conn.methods[1] != protocol.MethodExit {
+		t.Fatalf("expected shutdown and exit got %v", conn.methods)
+	}
+	if client.State() != ServerStopped || len(conns()) != 1 {
+		t.Fatalf("expected the server stopped got %v", client.State())
+	}
+	if _, err := client.Hover(context.Background(), "a.go", Position{}); !errors.Is(err, errStopped) {
+		t.Fatalf("expected requests refused got %v", err)
+	}
+}
+
+func TestShutdownKills(t *testing.T) {
+	killed := make(chan struct{})
+	withServers(t, DefaultServers, func(ctx context.Context, c *lspClient) error {
+		// A server that never answers or exits
+		c.conn = &blockingConn{}
+		c.server = protocol.ServerDispatcher(c.conn, zap.NewNop())
+		go func() {
+			<-ctx.Done()
+			close(killed)
+		}()
+		return nil
+	})
+	client := GetLSP("a.go").(*lspClient)
+	waitForState(t, client, ServerReady)
+
+	ShutdownAll()
+	select {
+	case <-killed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the server killed")
+	}
+}
+
+func TestRestartServers(t *testing.T) {
+	failing := true
+	var mu sync.Mutex
+	withServers(t, DefaultServers, func(ctx context.Context, c *lspClient) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			return errors.New("bad flag")
+		}
+		c.conn = &fakeConn{}
+		return nil
+	})
+
+	GetLSP("a.go")
+	waitForServers()
+	if states := ServerStates("a.go"); len(states) != 1 || states[0].Name != "gopls" || states[0].State != ServerFailed {
+		t.Fatalf("expected gopls failed got %v", states)
+	}
+	if GetLSP("a.go") != nil {
+		t.Fatalf("expected no client once the server failed")
+	}
+
+	// A server given up on can be restarted by hand
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if n := RestartServers("a.go"); n != 1 {
+		t.Fatalf("expected one server restarted got %d", n)
+	}
+	waitForServers()
+	if states := ServerStates("a.go"); len(states) != 1 || states[0].State != ServerReady {
+		t.Fatalf("expected gopls ready got %v", states)
+	}
+	if GetLSP("a.go") == nil {
+		t.Fatalf("expected the client back")
+	}
+	if ServerStates("a.txt") != nil || RestartServers("a.txt") != 0 {
+		t.Fatalf("expected no servers for a text file")
+	}
+}
+
+func TestRestartServersReopensDocuments(t *testing.T) {
+	failing := true
+	var mu sync.Mutex
+	var conn *fakeConn
+	withServers(t, DefaultServers, func(ctx context.Context, c *lspClient) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			return errors.New("bad flag")
+		}
+		conn = &fakeConn{}
+		c.conn = conn
+		c.server = protocol.ServerDispatcher(conn, zap.NewNop())
+		c.serverTextDocumentSyncOptions = protocol.TextDocumentSyncOptions{OpenClose: true, Change: protocol.TextDocumentSyncKindIncremental}
+		return nil
+	})
+
+	DocumentLSP("a.go").DidOpen("a.go", 1, rope.NewRope("a"))
+	DocumentLSP("b.go").DidOpen("b.go", 1, rope.NewRope("b"))
+	waitForServers()
+	if GetLSP("a.go") != nil || DocumentLSP("a.go") == nil {
+		t.Fatalf("expected the failed server left out of requests only")
+	}
+
+	// Documents are kept up to date while the server has failed
+	DocumentLSP("a.go").DidChange("a.go", 2, Change{Start: Position{0, 1}, End: Position{0, 1}, Text: "x",
+		Before: rope.NewRope("a"), After: rope.NewRope("ax")})
+	DocumentLSP("b.go").DidClose("b.go")
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	RestartServers("a.go")
+	waitForServers()
+	written(DocumentLSP("a.go").(*lspClient))
+	mu.Lock()
+	defer mu.Unlock()
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	var opened []protocol.TextDocumentItem
+	for _, params := range conn.params {
+		if p, ok := params.(*protocol.DidOpenTextDocumentParams); ok {
+			opened = append(opened, p.TextDocument)
+		}
+	}
+	if len(opened) != 1 || opened[0].URI != documentURI("a.go") || opened[0].Text != "ax" || opened[0].Version != 2 {
+		t.Fatalf("expected a.go opened as edited got %+v", opened)
+	}
+}
@@ -0,0 +1,103 @@
+package lsp
+
+import (
+	"context"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+// Symbol is a named part of a program, such as a function or a type.
+type Symbol struct {
+	Name string
+	Kind protocol.SymbolKind
+	// Detail is more about the symbol, such as a function's signature, and
+	// Container the name of what it is declared in, such as a method's
+	// type. Either can be empty.
+	Detail    string
+	Container string
+	// Location is where the symbol's name is.
+	Location Location
+	// Children are the symbols declared inside it, such as a type's fields.
+	Children []Symbol
+}
+
+// symbolResult holds a DocumentSymbol, or a SymbolInformation, which servers
+// send for documents' symbols unless the client supports a tree, and for
+// workspace symbols.
+type symbolResult struct {
+	Name           string              `json:"name"`
+	Kind           protocol.SymbolKind `json:"kind"`
+	Detail         string              `json:"detail"`
+	ContainerName  string              `json:"containerName"`
+	SelectionRange *protocol.Range     `json:"selectionRange"`
+	Children       []symbolResult      `json:"children"`
+	Location       *protocol.Location  `json:"location"`
+}
+
+func (c *lspClient) DocumentSymbols(ctx context.Context, filename string) ([]Symbol, error) {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !supported(caps.DocumentSymbolProvider) {
+		return nil, ErrNotSupported
+	}
+	params := &protocol.DocumentSymbolParams{
+		TextDocument: protocol.TextDocumentIdentifier{URI: documentURI(filename)},
+	}
+	var results []symbolResult
+	if err := c.call(ctx, filename, protocol.MethodTextDocumentDocumentSymbol, params, &results); err != nil {
+		return nil, err
+	}
+	return c.convertSymbols(absPath(filename), results, map[string]rope.Rope{}), nil
+}
+
+func (c *lspClient) WorkspaceSymbols(ctx context.Context, filename, query string) ([]Symbol, error) {
+	caps, err := c.capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !supported(caps.WorkspaceSymbolProvider) {
+		return nil, ErrNotSupported
+	}
+	var results []symbolResult
+	if err := c.call(ctx, filename, protocol.MethodWorkspaceSymbol, &protocol.WorkspaceSymbolParams{Query: query}, &results); err != nil {
+		return nil, err
+	}
+	return c.convertSymbols("", results, map[string]rope.Rope{}), nil
+}
+
+// convertSymbols converts symbols from the LSP form. Those without a location
+// of their own are in filename. contents caches the files' contents.
+func (c *lspClient) convertSymbols(filename string, results []symbolResult, contents map[string]rope.Rope) []Symbol {
+	symbols := make([]Symbol, 0, len(results))
+	for _, result := range results {
+		symbolFilename := filename
+		var r protocol.Range
+		switch {
+		case result.SelectionRange != nil:
+			r = *result.SelectionRange
+		case result.Location != nil:
+			symbolFilename = uriFilename(result.Location.URI)
+			r = result.Location.Range
+		}
+		if _, ok := contents[symbolFilename]; !ok {
+			contents[symbolFilename] = c.contents(symbolFilename)
+		}
+		symbols = append(symbols, Symbol{
+			Name:      result.Name,
+			Kind:      result.Kind,
+			Detail:    result.Detail,
+			Container: result.ContainerName,
+			Location: Location{
+				Filename: symbolFilename,
+				Start:    c.position(contents[symbolFilename], r.Start),
+				End:      c.position(contents[symbolFilename], r.End),
+			},
+			Children: c.convertSymbols(symbolFilename, result.Children, contents),
+		})
+	}
+	return symbols
+}
@@ -0,0 +1,79 @@
+package lsp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+func TestDocumentSymbols(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	if _, err := c.DocumentSymbols(context.Background(), "a.go"); err != ErrNotSupported {
+		t.Fatalf("expected not supported got %v", err)
+	}
+
+	c.serverCapabilities.DocumentSymbolProvider = true
+	c.DidOpen("a.go", 1, rope.NewRope("type 🌟 struct {\n\tx int\n}\n"))
+
+	// A tree, converted using the open document
+	conn.results = map[string]string{
+		protocol.MethodTextDocumentDocumentSymbol: `[{"name": "🌟", "kind": 23, "detail": "struct{...}",
+			"range": {"start": {"line": 0, "character": 0}, "end": {"line": 2, "character": 1}},
+			"selectionRange": {"start": {"line": 0, "character": 5}, "end": {"line": 0, "character": 7}},
+			"children": [{"name": "x", "kind": 8, "detail": "int",
+				"range": {"start": {"line": 1, "character": 1}, "end": {"line": 1, "character": 6}},
+				"selectionRange": {"start": {"line": 1, "character": 1}, "end": {"line": 1, "character": 2}}}]}]`,
+	}
+	symbols, err := c.DocumentSymbols(context.Background(), "a.go")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(symbols) != 1 || symbols[0].Name != "🌟" || symbols[0].Kind != protocol.SymbolKindStruct || symbols[0].Detail != "struct{...}" {
+		t.Fatalf("unexpected symbols %+v", symbols)
+	}
+	want := Location{Filename: absPath("a.go"), Start: Position{0, 5}, End: Position{0, 9}}
+	if symbols[0].Location != want {
+		t.Fatalf("expected %+v got %+v", want, symbols[0].Location)
+	}
+	if children := symbols[0].Children; len(children) != 1 || children[0].Name != "x" || children[0].Location.Start != (Position{1, 1}) {
+		t.Fatalf("unexpected children %+v", children)
+	}
+
+	// Or a list with containers
+	conn.results[protocol.MethodTextDocumentDocumentSymbol] = `[{"name": "x", "kind": 8, "containerName": "🌟",
+		"location": {"uri": "` + string(documentURI("a.go")) + `", "range": {"start": {"line": 1, "character": 1}, "end": {"line": 1, "character": 2}}}}]`
+	symbols, _ = c.DocumentSymbols(context.Background(), "a.go")
+	if len(symbols) != 1 || symbols[0].Container != "🌟" || symbols[0].Location.Filename != absPath("a.go") || len(symbols[0].Children) != 0 {
+		t.Fatalf("unexpected symbols %+v", symbols)
+	}
+}
+
+func TestWorkspaceSymbols(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.serverCapabilities.WorkspaceSymbolProvider = true
+	c.DidOpen("a.go", 1, rope.NewRope("x"))
+	other := filepath.Join(t.TempDir(), "b.go")
+	os.WriteFile(other, []byte("func é() {}\n"), 0644)
+
+	// Symbols in files that aren't open are converted using the file on disk
+	conn.results = map[string]string{
+		protocol.MethodWorkspaceSymbol: `[{"name": "é", "kind": 12, "containerName": "main",
+			"location": {"uri": "` + string(documentURI(other)) + `", "range": {"start": {"line": 0, "character": 5}, "end": {"line": 0, "character": 6}}}}]`,
+	}
+	symbols, err := c.WorkspaceSymbols(context.Background(), "a.go", "e")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Location{Filename: other, Start: Position{0, 5}, End: Position{0, 7}}
+	if len(symbols) != 1 || symbols[0].Name != "é" || symbols[0].Container != "main" || symbols[0].Location != want {
+		t.Fatalf("unexpected symbols %+v", symbols)
+	}
+	if params := conn.params[len(conn.params)-1].(*protocol.WorkspaceSymbolParams); params.Query != "e" {
+		t.Fatalf("expected the query sent got %+v", params)
+	}
+}
@@ -0,0 +1,165 @@
+package lsp
+
+import (
+	"time"
+	"unicode/utf16"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+// Change describes an edit to a document: the text between Start and End in
+// the document before the edit was replaced by Text.
+type Change struct {
+	Start Position
+	End   Position
+	Text  string
+	// Before and After are the document before and after the edit. Before is
+	// used to convert positions to the form servers expect, and After is sent
+	// whole to servers that don't support incremental changes.
+	Before rope.Rope
+	After  rope.Rope
+}
+
+// Position is a location in a document as a line and a byte offset from the
+// start of the line.
+type Position struct {
+	Line   int
+	Offset int
+}
+
+// changeDelay is how long changes are held back so that a burst of edits,
+// like typing, is sent to the server in one notification.
+const changeDelay = 50 * time.Millisecond
+
+// pendingChanges are the changes to a document that haven't been sent yet.
+type pendingChanges struct {
+	version int32
+	changes []contentChange
+	// contents is the document after the last change, sent when the server
+	// only supports full document changes.
+	contents rope.Rope
+	timer    *time.Timer
+}
+
+// contentChange is protocol.TextDocumentContentChangeEvent with a range that
+// can be left out, which replaces the whole document.
+type contentChange struct {
+	Range *protocol.Range `json:"range,omitempty"`
+	Text  string          `json:"text"`
+}
+
+// didChangeParams is protocol.DidChangeTextDocumentParams using contentChange.
+type didChangeParams struct {
+	TextDocument   protocol.VersionedTextDocumentIdentifier `json:"textDocument"`
+	ContentChanges []contentChange                          `json:"contentChanges"`
+}
+
+func (c *lspClient) DidChange(filename string, version int32, change Change) {
+	filename = absPath(filename)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if doc := c.docs[filename]; doc != nil {
+		doc.version = version
+		doc.contents = change.After
+		shiftDiagnostics(doc.diagnostics, change)
+		shiftSemanticTokens(doc, change)
+	}
+
+	// A server that is starting is sent the document as it is then
+	if c.state != ServerReady || c.serverTextDocumentSyncOptions.Change == protocol.TextDocumentSyncKindNone {
+		return
+	}
+
+	if c.pending == nil {
+		c.pending = map[string]*pendingChanges{}
+	}
+	p := c.pending[filename]
+	if p == nil {
+		p = &pendingChanges{}
+		c.pending[filename] = p
+		p.timer = time.AfterFunc(changeDelay, func() { c.Flush(filename) })
+	}
+	p.version = version
+	p.contents = change.After
+	if c.serverTextDocumentSyncOptions.Change == protocol.TextDocumentSyncKindIncremental {
+		p.changes = append(p.changes, contentChange{
+			Range: &protocol.Range{
+				Start: utf16Position(change.Before, change.Start),
+				End:   utf16Position(change.Before, change.End),
+			},
+			Text: change.Text,
+		})
+	}
+}
+
+func (c *lspClient) Flush(filename string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked(filename)
+}
+
+// flushLocked queues the pending changes to a document to be sent. c.mu must
+// be held, which keeps the notifications for a document in order.
+func (c *lspClient) flushLocked(filename string) {
+	filename = absPath(filename)
+	p := c.pending[filename]
+	if p == nil {
+		return
+	}
+	delete(c.pending, filename)
+	p.timer.Stop()
+
+	changes := p.changes
+	if c.serverTextDocumentSyncOptions.Change != protocol.TextDocumentSyncKindIncremental {
+		changes = []contentChange{{Text: p.contents.String()}}
+	}
+	c.outbox.notify(protocol.MethodTextDocumentDidChange, filename, &didChangeParams{
+		TextDocument: protocol.VersionedTextDocumentIdentifier{
+			TextDocumentIdentifier: protocol.TextDocumentIdentifier{
+				URI: documentURI(filename),
+			},
+			Version: p.version,
+		},
+		ContentChanges: changes,
+	})
+}
+
+// utf16Position converts a position to the LSP form, where the character is
+// counted in UTF-16 code units.
+func utf16Position(r rope.Rope, pos Position) protocol.Position {
+	start, _ := r.LineStart(pos.Line)
+	return protocol.Position{
+		Line:      uint32(pos.Line),
+		Character: uint32(utf16Len(r.Slice(start, start+pos.Offset))),
+	}
+}
+
+// utf16Len returns the number of UTF-16 code units needed to encode s.
+// Invalid bytes count as one unit each, as they do once decoded.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += max(1, utf16.RuneLen(r))
+	}
+	return n
+}
+
+// bytePosition converts a position in the LSP form to a line and byte offset,
+// clamped to the document.
+func bytePosition(r rope.Rope, pos protocol.Position) Position {
+	line := min(int(pos.Line), r.LineCount()-1)
+	return Position{Line: line, Offset: utf16Offset(lineText(r, line), int(pos.Character))}
+}
+
+// lineText returns the text of a line, without its newline.
+func lineText(r rope.Rope, line int) string {
+	start, _ := r.LineStart(line)
+	end := r.Len()
+	if next, ok := r.LineStart(line + 1); ok {
+		end = next - 1
+	}
+	return r.Slice(start, end)
+}
@@ -0,0 +1,182 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.lsp.dev/jsonrpc2"
+	"go.lsp.dev/protocol"
+
+	"tked/internal/rope"
+)
+
+// fakeConn records the notifications sent to a server, and answers requests
+// with canned JSON results.
+type fakeConn struct {
+	mu      sync.Mutex
+	methods []string
+	params  []any
+	results map[string]string
+}
+
+func (f *fakeConn) Call(_ context.Context, method string, params, result any) (jsonrpc2.ID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.methods = append(f.methods, method)
+	f.params = append(f.params, params)
+	if data, ok := f.results[method]; ok {
+		return jsonrpc2.ID{}, json.Unmarshal([]byte(data), result)
+	}
+	return jsonrpc2.ID{}, nil
+}
+func (f *fakeConn) Notify(_ context.Context, method string, params any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.methods = append(f.methods, method)
+	f.params = append(f.params, params)
+	return nil
+}
+func (f *fakeConn) Go(context.Context, jsonrpc2.Handler) {}
+func (f *fakeConn) Close() error                         { return nil }
+func (f *fakeConn) Done() <-chan struct{}                { return nil }
+func (f *fakeConn) Err() error                           { return nil }
+
+func (f *fakeConn) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.params)
+}
+
+func newSyncClient(kind protocol.TextDocumentSyncKind) (*lspClient, *fakeConn) {
+	conn := &fakeConn{}
+	ready := make(chan struct{})
+	close(ready)
+	return &lspClient{
+		name:                          "fake",
+		state:                         ServerReady,
+		ready:                         ready,
+		conn:                          conn,
+		outbox:                        newOutbox("fake", conn),
+		serverTextDocumentSyncOptions: protocol.TextDocumentSyncOptions{Change: kind},
+	}, conn
+}
+
+// written waits for the notifications queued for a client's server to be
+// written to it.
+func written(c *lspClient) {
+	c.mu.Lock()
+	o := c.outbox
+	c.mu.Unlock()
+	if o != nil {
+		o.wait(context.Background())
+	}
+}
+
+func TestDidChangeIncremental(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	before := rope.NewRope("a🌟b\nxyz")
+	after := rope.NewRope("a🌟!\nxyz")
+	// Replace "b" with "!"; the emoji is four bytes and two UTF-16 units
+	c.DidChange("a.go", 2, Change{Start: Position{0, 5}, End: Position{0, 6}, Text: "!", Before: before, After: after})
+	c.DidChange("a.go", 3, Change{Start: Position{1, 3}, End: Position{1, 3}, Text: "\n", Before: after, After: rope.NewRope("a🌟!\nxyz\n")})
+	if conn.count() != 0 {
+		t.Fatalf("expected changes to be held back")
+	}
+
+	c.Flush("a.go")
+	written(c)
+	if conn.count() != 1 || conn.methods[0] != protocol.MethodTextDocumentDidChange {
+		t.Fatalf("expected one didChange notification got %v", conn.methods)
+	}
+	params := conn.params[0].(*didChangeParams)
+	if params.TextDocument.Version != 3 || len(params.ContentChanges) != 2 {
+		t.Fatalf("unexpected params %+v", params)
+	}
+	first := params.ContentChanges[0]
+	want := protocol.Range{Start: protocol.Position{Line: 0, Character: 3}, End: protocol.Position{Line: 0, Character: 4}}
+	if first.Range == nil || *first.Range != want || first.Text != "!" {
+		t.Fatalf("unexpected first change %+v", first)
+	}
+	second := params.ContentChanges[1]
+	if second.Range.Start != (protocol.Position{Line: 1, Character: 3}) {
+		t.Fatalf("unexpected second change %+v", second.Range)
+	}
+
+	// Nothing is left to send
+	c.Flush("a.go")
+	written(c)
+	if conn.count() != 1 {
+		t.Fatalf("expected no more notifications")
+	}
+}
+
+func TestDidChangeFull(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindFull)
+	c.DidChange("a.go", 1, Change{Start: Position{0, 0}, End: Position{0, 0}, Text: "x", Before: rope.NewRope(""), After: rope.NewRope("x")})
+	c.DidChange("a.go", 2, Change{Start: Position{0, 1}, End: Position{0, 1}, Text: "y", Before: rope.NewRope("x"), After: rope.NewRope("xy")})
+	c.Flush("a.go")
+	written(c)
+
+	data, err := json.Marshal(conn.params[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The whole document is sent without a range
+	if strings.Contains(string(data), "range") || !strings.Contains(string(data), `"text":"xy"`) {
+		t.Fatalf("unexpected full change %s", data)
+	}
+}
+
+func TestDidChangeNone(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindNone)
+	c.DidChange("a.go", 1, Change{Text: "x", Before: rope.NewRope(""), After: rope.NewRope("x")})
+	c.Flush("a.go")
+	written(c)
+	if conn.count() != 0 {
+		t.Fatalf("expected nothing sent")
+	}
+}
+
+func TestDidChangeSentAfterDelay(t *testing.T) {
+	c, conn := newSyncClient(protocol.TextDocumentSyncKindIncremental)
+	c.DidChange("a.go", 1, Change{Text: "x", Before: rope.NewRope(""), After: rope.NewRope("x")})
+	deadline := time.Now().Add(time.Second)
+	for conn.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(changeDelay / 5)
+	}
+	if conn.count() != 1 {
+		t.Fatalf("expected changes sent after the delay")
+	}
+}
+
+func TestUTF16Len(t *testing.T) {
+	tests := map[string]int{"": 0, "abc": 3, "é": 1, "🌟": 2, "a\xffb": 3}
+	for s, want := range tests {
+		if got := utf16Len(s); got != want {
+			t.Fatalf("utf16Len(%q) expected %d got %d", s, want, got)
+		}
+	}
+}
+
+func TestBytePosition(t *testing.T) {
+	r := rope.NewRope("a🌟b\nxyz")
+	tests := []struct {
+		pos  protocol.Position
+		want Position
+	}{
+		{protocol.Position{Line: 0, Character: 0}, Position{0, 0}},
+		{protocol.Position{Line: 0, Character: 3}, Position{0, 5}},
+		{protocol.Position{Line: 0, Character: 9}, Position{0, 6}}, // clamped to the line
+		{protocol.Position{Line: 1, Character: 2}, Position{1, 2}},
+		{protocol.Position{Line: 5, Character: 1}, Position{1, 1}}, // clamped to the document
+	}
+	for _, tt := range tests {
+		if got := bytePosition(r, tt.pos); got != tt.want {
+			t.Fatalf("bytePosition(%v) expected %v got %v", tt.pos, tt.want, got)
+		}
+	}
+}
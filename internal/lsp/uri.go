@@ -0,0 +1,61 @@
+package lsp
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// absPath returns the absolute form of a filename. Documents are known by
+// their absolute paths, so a file is the same document however it was named.
+func absPath(filename string) string {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return filename
+	}
+	return abs
+}
+
+// documentURI returns the file:// URI for a file.
+func documentURI(filename string) protocol.DocumentURI {
+	path := filepath.ToSlash(absPath(filename))
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path // a Windows drive letter
+	}
+	return protocol.DocumentURI((&url.URL{Scheme: "file", Path: path}).String())
+}
+
+// uriFilename returns the absolute path of the file a URI names.
+func uriFilename(uri protocol.DocumentURI) string {
+	u, err := url.Parse(string(uri))
+	if err != nil || u.Scheme != "file" {
+		return absPath(string(uri))
+	}
+	path := u.Path
+	if len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:] // a Windows drive letter
+	}
+	return filepath.FromSlash(path)
+}
+
+// findRoot returns the root of the project a file is in: the nearest
+// directory above it that holds one of the markers, or else the file's own
+// directory.
+func findRoot(filename string, markers []string) string {
+	dir := filepath.Dir(absPath(filename))
+	for d := dir; ; {
+		for _, marker := range markers {
+			if _, err := os.Stat(filepath.Join(d, marker)); err == nil {
+				return d
+			}
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return dir
+		}
+		d = parent
+	}
+}
@@ -0,0 +1,200 @@
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.lsp.dev/protocol"
+
+	"tked/internal/tklog"
+)
+
+// Message is a message a language server shows the user.
+type Message struct {
+	Server string
+	Type   protocol.MessageType
+	Text   string
+	// Actions are the titles of the choices the server offers, if it asks
+	// the user to choose one.
+	Actions []string
+}
+
+// messageHandler shows a message from a server on the editor's main
+// goroutine, returning the index of the action the user chose, or -1.
+var messageHandler func(msg Message) int
+
+// SetMessageHandler sets the function that shows messages from servers.
+func SetMessageHandler(handler func(msg Message) int) {
+	messageHandler = handler
+}
+
+func (c *lspClient) ShowMessage(_ context.Context, params *protocol.ShowMessageParams) error {
+	c.appendLog(params.Type, params.Message)
+	if messageHandler != nil {
+		msg := Message{Server: c.name, Type: params.Type, Text: params.Message}
+		dispatch(func() { messageHandler(msg) })
+	}
+	return nil
+}
+
+// ShowMessageRequest asks the user to choose one of the server's actions on
+// the editor's main goroutine, waiting for the choice.
+func (c *lspClient) ShowMessageRequest(ctx context.Context, params *protocol.ShowMessageRequestParams) (*protocol.MessageActionItem, error) {
+	c.appendLog(params.Type, params.Message)
+	if messageHandler == nil || dispatcher == nil {
+		return nil, nil
+	}
+	msg := Message{Server: c.name, Type: params.Type, Text: params.Message}
+	for _, action := range params.Actions {
+		msg.Actions = append(msg.Actions, action.Title)
+	}
+	choice := make(chan int, 1)
+	dispatch(func() { choice <- messageHandler(msg) })
+
+	select {
+	case i := <-choice:
+		if i < 0 || i >= len(params.Actions) {
+			return nil, nil
+		}
+		return &params.Actions[i], nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// maxLogLines is how many lines of each server's log are kept.
+const maxLogLines = 1000
+
+func (c *lspClient) LogMessage(_ context.Context, params *protocol.LogMessageParams) error {
+	c.appendLog(params.Type, params.Message)
+	return nil
+}
+
+// appendLog adds a message to the server's log, dropping the oldest lines
+// once there are too many. Messages without a type are from stderr.
+func (c *lspClient) appendLog(typ protocol.MessageType, message string) {
+	kind := "stderr"
+	if typ != 0 {
+		kind = typ.String()
+	}
+	prefix := time.Now().Format("15:04:05") + " [" + kind + "] "
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(message, "\n"), "\n") {
+		c.log = append(c.log, prefix+line)
+	}
+	if len(c.log) > maxLogLines {
+		c.log = slices.Clone(c.log[len(c.log)-maxLogLines:])
+	}
+}
+
+// logWriter adds what a server writes to stderr to its log, a line at a
+// time.
+type logWriter struct {
+	client  *lspClient
+	partial []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.client.appendLog(0, string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+}
+
+// Progress is long running work a server reports, such as loading a
+// project.
+type Progress struct {
+	Title   string
+	Message string
+	// Percentage is how much of the work is done, from 0 to 100, or -1 if
+	// the server doesn't say.
+	Percentage int
+}
+
+// workProgress is the progress of work the server created a token for,
+// which is shown once it begins.
+type workProgress struct {
+	token   string
+	begun   bool
+	current Progress
+}
+
+// progressValue holds the fields of the begin, report and end values sent
+// with $/progress.
+type progressValue struct {
+	Kind       protocol.WorkDoneProgressKind `json:"kind"`
+	Title      string                        `json:"title"`
+	Message    string                        `json:"message"`
+	Percentage *uint32                       `json:"percentage"`
+}
+
+func (c *lspClient) WorkDoneProgressCreate(_ context.Context, params *protocol.WorkDoneProgressCreateParams) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.progress = append(c.progress, &workProgress{token: params.Token.String()})
+	return nil
+}
+
+func (c *lspClient) Progress(_ context.Context, params *protocol.ProgressParams) error {
+	data, err := json.Marshal(params.Value)
+	if err != nil {
+		return err
+	}
+	var value progressValue
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("progress %s: %w", params.Token.String(), err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := slices.IndexFunc(c.progress, func(w *workProgress) bool { return w.token == params.Token.String() })
+	if i < 0 {
+		// Only work the server created a token for is reported
+		return nil
+	}
+	w := c.progress[i]
+	switch value.Kind {
+	case protocol.WorkDoneProgressKindBegin:
+		w.begun = true
+		w.current = Progress{Title: value.Title, Message: value.Message, Percentage: -1}
+	case protocol.WorkDoneProgressKindReport:
+		if value.Message != "" {
+			w.current.Message = value.Message
+		}
+	case protocol.WorkDoneProgressKindEnd:
+		c.progress = slices.Delete(c.progress, i, i+1)
+		if value.Message != "" {
+			tklog.Info("LSP %s: %s: %s", c.name, w.current.Title, value.Message)
+		}
+	}
+	if value.Percentage != nil && value.Kind != protocol.WorkDoneProgressKindEnd {
+		w.current.Percentage = int(min(*value.Percentage, 100))
+	}
+
+	// Redraw to show the progress
+	dispatch(func() {})
+	return nil
+}
+
+// progressLocked returns the work the server is doing, in the order it
+// was created. c.mu must be held.
+func (c *lspClient) progressLocked() []Progress {
+	var out []Progress
+	for _, w := range c.progress {
+		if w.begun {
+			out = append(out, w.current)
+		}
+	}
+	return out
+}
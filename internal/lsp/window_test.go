@@ -0,0 +1,98 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.lsp.dev/protocol"
+)
+
+func TestShowMessage(t *testing.T) {
+	var shown []Message
+	SetDispatcher(func(fn func()) { fn() })
+	SetMessageHandler(func(msg Message) int { shown = append(shown, msg); return 1 })
+	t.Cleanup(func() { SetDispatcher(nil); SetMessageHandler(nil) })
+	c, _ := newSyncClient(protocol.TextDocumentSyncKindFull)
+
+	c.ShowMessage(context.Background(), &protocol.ShowMessageParams{Type: protocol.MessageTypeWarning, Message: "go.mod is missing"})
+	if len(shown) != 1 || shown[0].Server != "fake" || shown[0].Type != protocol.MessageTypeWarning || shown[0].Text != "go.mod is missing" {
+		t.Fatalf("unexpected messages %+v", shown)
+	}
+
+	// The user's choice is sent back
+	actions := []protocol.MessageActionItem{{Title: "Ignore"}, {Title: "Run go mod init"}}
+	item, err := c.ShowMessageRequest(context.Background(), &protocol.ShowMessageRequestParams{Type: protocol.MessageTypeInfo, Message: "Create it?", Actions: actions})
+	if err != nil || item == nil || item.Title != "Run go mod init" {
+		t.Fatalf("expected the second action got %+v %v", item, err)
+	}
+	if len(shown) != 2 || len(shown[1].Actions) != 2 || shown[1].Actions[0] != "Ignore" {
+		t.Fatalf("expected the actions shown got %+v", shown)
+	}
+	SetMessageHandler(func(msg Message) int { return -1 })
+	if item, err := c.ShowMessageRequest(context.Background(), &protocol.ShowMessageRequestParams{Message: "Create it?", Actions: actions}); item != nil || err != nil {
+		t.Fatalf("expected no choice got %+v %v", item, err)
+	}
+
+	// Messages are logged too
+	if len(c.log) != 3 || !strings.HasSuffix(c.log[0], "[warning] go.mod is missing") {
+		t.Fatalf("unexpected log %q", c.log)
+	}
+}
+
+func TestLogMessage(t *testing.T) {
+	c, _ := newSyncClient(protocol.TextDocumentSyncKindFull)
+	c.LogMessage(context.Background(), &protocol.LogMessageParams{Type: protocol.MessageTypeError, Message: "failed:\nno packages\n"})
+	if len(c.log) != 2 || !strings.HasSuffix(c.log[0], " [error] failed:") || !strings.HasSuffix(c.log[1], " [error] no packages") {
+		t.Fatalf("expected a line each got %q", c.log)
+	}
+
+	// stderr is logged a line at a time
+	w := &logWriter{client: c}
+	fmt.Fprint(w, "panic: ")
+	fmt.Fprint(w, "oops\ngoroutine 1")
+	if len(c.log) != 3 || !strings.HasSuffix(c.log[2], " [stderr] panic: oops") {
+		t.Fatalf("expected the whole line logged got %q", c.log)
+	}
+
+	// Only the latest lines are kept
+	for i := range maxLogLines {
+		c.LogMessage(context.Background(), &protocol.LogMessageParams{Type: protocol.MessageTypeLog, Message: fmt.Sprint(i)})
+	}
+	if len(c.log) != maxLogLines || !strings.HasSuffix(c.log[0], " 0") {
+		t.Fatalf("expected the oldest lines dropped got %d lines from %q", len(c.log), c.log[0])
+	}
+}
+
+// progress sends a $/progress notification with a JSON value.
+func progress(c *lspClient, token, value string) {
+	var v any
+	json.Unmarshal([]byte(value), &v)
+	c.Progress(context.Background(), &protocol.ProgressParams{Token: *protocol.NewProgressToken(token), Value: v})
+}
+
+func TestProgress(t *testing.T) {
+	c, _ := newSyncClient(protocol.TextDocumentSyncKindFull)
+	c.WorkDoneProgressCreate(context.Background(), &protocol.WorkDoneProgressCreateParams{Token: *protocol.NewProgressToken("load")})
+	if got := c.progressLocked(); len(got) != 0 {
+		t.Fatalf("expected nothing shown before the work begins got %v", got)
+	}
+
+	progress(c, "load", `{"kind": "begin", "title": "Loading packages"}`)
+	if got := c.progressLocked(); len(got) != 1 || got[0] != (Progress{Title: "Loading packages", Percentage: -1}) {
+		t.Fatalf("unexpected progress %+v", got)
+	}
+	progress(c, "load", `{"kind": "report", "message": "3/4 packages", "percentage": 75}`)
+	if got := c.progressLocked(); len(got) != 1 || got[0] != (Progress{Title: "Loading packages", Message: "3/4 packages", Percentage: 75}) {
+		t.Fatalf("unexpected progress %+v", got)
+	}
+
+	// Tokens the server didn't create are ignored
+	progress(c, "other", `{"kind": "begin", "title": "Other"}`)
+	progress(c, "load", `{"kind": "end", "message": "done"}`)
+	if got := c.progressLocked(); len(got) != 0 {
+		t.Fatalf("expected the work finished got %+v", got)
+	}
+}
@@ -0,0 +1,245 @@
+package rope
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// ByteIterator walks the bytes of a rope in either direction. It sits between
+// two bytes: Next returns the byte after the iterator and Prev the byte before
+// it. Leaves are looked up only when the iterator moves into a new one, so
+// walking a rope costs O(1) per byte plus O(log n) per leaf.
+type ByteIterator struct {
+	root   *Node
+	length int
+	pos    int
+	// leaf is the value of the most recently visited leaf, starting at index
+	// start in the rope.
+	leaf  string
+	start int
+}
+
+// leafAt returns the value of the leaf containing idx and the index of its
+// first byte. idx must be within the subtree rooted at n.
+func leafAt(n *Node, idx int) (string, int) {
+	start := 0
+	for !n.isLeaf() {
+		if idx < n.weight {
+			n = n.left
+		} else {
+			idx -= n.weight
+			start += n.weight
+			n = n.right
+		}
+	}
+	return n.value, start
+}
+
+// newByteIterator creates an iterator over the subtree rooted at root
+// positioned at idx, which is clamped to the bounds of the subtree.
+func newByteIterator(root *Node, idx int) ByteIterator {
+	length := root.len()
+	return ByteIterator{root: root, length: length, pos: max(0, min(idx, length))}
+}
+
+// load makes the leaf containing idx the current leaf, if it isn't already.
+func (it *ByteIterator) load(idx int) {
+	if idx < it.start || idx >= it.start+len(it.leaf) {
+		it.leaf, it.start = leafAt(it.root, idx)
+	}
+}
+
+// Pos returns the index of the byte Next would return.
+func (it *ByteIterator) Pos() int {
+	return it.pos
+}
+
+// Next returns the byte after the iterator and advances past it. ok is false
+// at the end of the rope.
+func (it *ByteIterator) Next() (byte, bool) {
+	if it.pos >= it.length {
+		return 0, false
+	}
+	it.load(it.pos)
+	b := it.leaf[it.pos-it.start]
+	it.pos++
+	return b, true
+}
+
+// Prev returns the byte before the iterator and moves back over it. ok is
+// false at the start of the rope.
+func (it *ByteIterator) Prev() (byte, bool) {
+	if it.pos <= 0 {
+		return 0, false
+	}
+	it.load(it.pos - 1)
+	it.pos--
+	return it.leaf[it.pos-it.start], true
+}
+
+// chunk returns the bytes from the iterator to the end of the current leaf
+// without moving the iterator. It returns "" at the end of the rope.
+func (it *ByteIterator) chunk() string {
+	if it.pos >= it.length {
+		return ""
+	}
+	it.load(it.pos)
+	return it.leaf[it.pos-it.start:]
+}
+
+// RuneIterator walks the UTF-8 encoded runes of a rope in either direction,
+// decoding runes that are split across leaves. Invalid encodings are returned
+// as utf8.RuneError with a size of one byte.
+type RuneIterator struct {
+	bytes ByteIterator
+}
+
+// Pos returns the index of the first byte of the rune Next would return.
+func (it *RuneIterator) Pos() int {
+	return it.bytes.pos
+}
+
+// Next returns the rune after the iterator and its size in bytes, and advances
+// past it. ok is false at the end of the rope.
+func (it *RuneIterator) Next() (rune, int, bool) {
+	rest := it.bytes.chunk()
+	if rest == "" {
+		return 0, 0, false
+	}
+	if utf8.FullRuneInString(rest) {
+		r, size := utf8.DecodeRuneInString(rest)
+		it.bytes.pos += size
+		return r, size, true
+	}
+
+	// The rune continues into the next leaf.
+	start := it.bytes.pos
+	var buf [utf8.UTFMax]byte
+	n := 0
+	for n < len(buf) && !utf8.FullRune(buf[:n]) {
+		b, ok := it.bytes.Next()
+		if !ok {
+			break
+		}
+		buf[n] = b
+		n++
+	}
+	r, size := utf8.DecodeRune(buf[:n])
+	it.bytes.pos = start + size
+	return r, size, true
+}
+
+// Prev returns the rune before the iterator and its size in bytes, and moves
+// back over it. ok is false at the start of the rope.
+func (it *RuneIterator) Prev() (rune, int, bool) {
+	end := it.bytes.pos
+	if end <= 0 {
+		return 0, 0, false
+	}
+
+	// Collect up to UTFMax bytes before the iterator, stopping at the byte
+	// that starts a rune.
+	var buf [utf8.UTFMax]byte
+	n := len(buf)
+	for n > 0 {
+		b, ok := it.bytes.Prev()
+		if !ok {
+			break
+		}
+		n--
+		buf[n] = b
+		if utf8.RuneStart(b) {
+			break
+		}
+	}
+	r, size := utf8.DecodeLastRune(buf[n:])
+	it.bytes.pos = end - size
+	return r, size, true
+}
+
+// LineIterator walks the lines of a rope in either direction. Lines are
+// returned without their trailing newline.
+type LineIterator struct {
+	rope *binaryRope
+	line int
+}
+
+// Line returns the number of the line Next would return.
+func (it *LineIterator) Line() int {
+	return it.line
+}
+
+// Next returns the line after the iterator and advances past it. ok is false
+// after the last line.
+func (it *LineIterator) Next() (string, bool) {
+	if it.line >= it.rope.LineCount() {
+		return "", false
+	}
+	s := it.get(it.line)
+	it.line++
+	return s, true
+}
+
+// Prev returns the line before the iterator and moves back over it. ok is
+// false before the first line.
+func (it *LineIterator) Prev() (string, bool) {
+	if it.line <= 0 {
+		return "", false
+	}
+	it.line--
+	return it.get(it.line), true
+}
+
+// get returns the contents of the given line without its newline.
+func (it *LineIterator) get(line int) string {
+	start, _ := it.rope.LineStart(line)
+	end := it.rope.Len()
+	if next, ok := it.rope.LineStart(line + 1); ok {
+		end = next - 1
+	}
+	return it.rope.Slice(start, end)
+}
+
+// Reader implements io.Reader, io.ByteReader and io.RuneReader over the
+// contents of a rope, reading directly from its leaves.
+type Reader struct {
+	runes RuneIterator
+}
+
+// Read reads up to len(p) bytes into p.
+func (r *Reader) Read(p []byte) (int, error) {
+	it := &r.runes.bytes
+	if it.pos >= it.length {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) {
+		chunk := it.chunk()
+		if chunk == "" {
+			break
+		}
+		c := copy(p[n:], chunk)
+		it.pos += c
+		n += c
+	}
+	return n, nil
+}
+
+// ReadByte reads and returns the next byte.
+func (r *Reader) ReadByte() (byte, error) {
+	b, ok := r.runes.bytes.Next()
+	if !ok {
+		return 0, io.EOF
+	}
+	return b, nil
+}
+
+// ReadRune reads the next UTF-8 encoded rune and returns it with its size in
+// bytes.
+func (r *Reader) ReadRune() (rune, int, error) {
+	ch, size, ok := r.runes.Next()
+	if !ok {
+		return 0, 0, io.EOF
+	}
+	return ch, size, nil
+}
@@ -0,0 +1,175 @@
+package rope
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+)
+
+// multiLeafRope returns a rope containing s split into leaves of the given
+// size, so that iterators have to cross leaf boundaries.
+func multiLeafRope(s string, size int) Rope {
+	var b builder
+	for len(s) > 0 {
+		n := min(len(s), size)
+		b.push(leaf(s[:n]))
+		s = s[n:]
+	}
+	return &binaryRope{root: b.finish()}
+}
+
+const iterText = "héllo\nwörld 🌟\n\nend\xff"
+
+func TestByteIterator(t *testing.T) {
+	r := multiLeafRope(iterText, 3)
+	it := r.Bytes(0)
+	var got []byte
+	for {
+		b, ok := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, b)
+	}
+	if string(got) != iterText {
+		t.Fatalf("forward iteration mismatch: %q", got)
+	}
+	if it.Pos() != len(iterText) {
+		t.Fatalf("expected position %d got %d", len(iterText), it.Pos())
+	}
+
+	got = got[:0]
+	for {
+		b, ok := it.Prev()
+		if !ok {
+			break
+		}
+		got = append([]byte{b}, got...)
+	}
+	if string(got) != iterText {
+		t.Fatalf("backward iteration mismatch: %q", got)
+	}
+
+	it = r.Bytes(7)
+	if b, _ := it.Next(); b != iterText[7] {
+		t.Fatalf("expected %q got %q", iterText[7], b)
+	}
+	if b, _ := it.Prev(); b != iterText[7] {
+		t.Fatalf("expected %q got %q", iterText[7], b)
+	}
+	if it := r.Bytes(-5); it.Pos() != 0 {
+		t.Fatalf("expected negative index clamped to 0")
+	}
+}
+
+func TestRuneIterator(t *testing.T) {
+	var want []rune
+	for _, ch := range iterText {
+		want = append(want, ch)
+	}
+
+	// Leaf sizes of 1 and 3 split the multi-byte runes across leaves.
+	for _, size := range []int{1, 3, 64} {
+		r := multiLeafRope(iterText, size)
+		it := r.Runes(0)
+		var got []rune
+		for {
+			ch, n, ok := it.Next()
+			if !ok {
+				break
+			}
+			if n != utf8.RuneLen(ch) && ch != utf8.RuneError {
+				t.Fatalf("leaf size %d: bad size %d for %q", size, n, ch)
+			}
+			got = append(got, ch)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("leaf size %d: forward mismatch %q", size, string(got))
+		}
+
+		got = got[:0]
+		for {
+			ch, _, ok := it.Prev()
+			if !ok {
+				break
+			}
+			got = append([]rune{ch}, got...)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("leaf size %d: backward mismatch %q", size, string(got))
+		}
+	}
+}
+
+func TestLineIterator(t *testing.T) {
+	r := multiLeafRope(iterText, 2)
+	want := strings.Split(iterText, "\n")
+	it := r.Lines(0)
+	var got []string
+	for {
+		line, ok := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, line)
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected lines %q got %q", want, got)
+	}
+
+	it = r.Lines(2)
+	if line, ok := it.Prev(); !ok || line != want[1] {
+		t.Fatalf("expected %q got %q", want[1], line)
+	}
+	if it.Line() != 1 {
+		t.Fatalf("expected line 1 got %d", it.Line())
+	}
+}
+
+func TestReader(t *testing.T) {
+	r := multiLeafRope(iterText, 4)
+	if err := iotest.TestReader(r.Reader(0), []byte(iterText)); err != nil {
+		t.Fatalf("reader: %v", err)
+	}
+
+	data, err := io.ReadAll(r.Reader(7))
+	if err != nil || string(data) != iterText[7:] {
+		t.Fatalf("unexpected read from offset: %q %v", data, err)
+	}
+
+	rd := r.Reader(0)
+	if ch, size, err := rd.ReadRune(); ch != 'h' || size != 1 || err != nil {
+		t.Fatalf("unexpected rune %q %d %v", ch, size, err)
+	}
+	if ch, size, err := rd.ReadRune(); ch != 'é' || size != 2 || err != nil {
+		t.Fatalf("unexpected rune %q %d %v", ch, size, err)
+	}
+	if b, err := rd.ReadByte(); b != 'l' || err != nil {
+		t.Fatalf("unexpected byte %q %v", b, err)
+	}
+}
+
+func TestSlice(t *testing.T) {
+	r := multiLeafRope(iterText, 3)
+	for start := 0; start <= len(iterText); start++ {
+		for end := start; end <= len(iterText); end++ {
+			if got := r.Slice(start, end); got != iterText[start:end] {
+				t.Fatalf("slice %d:%d expected %q got %q", start, end, iterText[start:end], got)
+			}
+		}
+	}
+	if got := r.Slice(-3, 100); got != iterText {
+		t.Fatalf("expected slice clamped to rope, got %q", got)
+	}
+}
+
+func TestWriteMultiLeaf(t *testing.T) {
+	r := multiLeafRope(iterText, 5)
+	var buf strings.Builder
+	n, err := r.Write(&buf)
+	if err != nil || n != int64(len(iterText)) || buf.String() != iterText {
+		t.Fatalf("unexpected write %d %v %q", n, err, buf.String())
+	}
+}
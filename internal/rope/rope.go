@@ -1,6 +1,9 @@
 package rope
 
-import "io"
+import (
+	"io"
+	"strings"
+)
 
 // Rope describes the operations supported by a rope implementation.
 type Rope interface {
@@ -18,14 +21,46 @@ type Rope interface {
 	Index(idx int) (byte, bool)
 	// Write writes the contents of the rope to w.
 	Write(w io.Writer) (int64, error)
+	// LineCount returns the number of lines in the rope, which is one more
+	// than the number of newline characters it contains.
+	LineCount() int
+	// LineStart returns the index of the first byte of the given line. ok will
+	// be false if line is out of range.
+	LineStart(line int) (int, bool)
+	// LineAt returns the line containing the byte at idx. Indexes past the end
+	// of the rope return the last line.
+	LineAt(idx int) int
+	// Slice returns the contents of the range [start,end) as a string.
+	Slice(start, end int) string
+	// Bytes returns an iterator over the bytes of the rope positioned at idx.
+	Bytes(idx int) *ByteIterator
+	// Runes returns an iterator over the runes of the rope positioned at idx.
+	Runes(idx int) *RuneIterator
+	// Lines returns an iterator over the lines of the rope positioned at line.
+	Lines(line int) *LineIterator
+	// Reader returns a reader over the contents of the rope starting at idx.
+	Reader(idx int) *Reader
 }
 
+// maxLeafSize is the largest number of bytes stored in a single leaf. Adjacent
+// leaves are merged while their combined size stays within this limit.
+const maxLeafSize = 1024
+
 // Node represents a node in the rope tree. A node is either an internal
 // node with left/right children, or a leaf node that holds a substring.
+//
+// The tree is kept height balanced in the same way as an AVL tree: the heights
+// of the children of every internal node differ by at most one. Nodes are
+// shared between ropes, so they are never modified once created.
 type Node struct {
 	// weight is the number of bytes in the left subtree. For leaf nodes it is
 	// simply len(value).
 	weight int
+	// lineWeight is the number of newlines in the left subtree. For leaf nodes
+	// it is the number of newlines in value.
+	lineWeight int
+	// height is the length of the longest path from this node to a leaf.
+	height int
 	left   *Node
 	right  *Node
 	value  string
@@ -33,7 +68,7 @@ type Node struct {
 
 // leaf creates a new leaf node containing the provided string.
 func leaf(s string) *Node {
-	return &Node{weight: len(s), value: s}
+	return &Node{weight: len(s), lineWeight: strings.Count(s, "\n"), value: s}
 }
 
 // len returns the number of bytes in the subtree rooted at n.
@@ -47,7 +82,54 @@ func (n *Node) len() int {
 	return n.weight + n.right.len()
 }
 
-// concat concatenates two nodes into a new parent node.
+// lines returns the number of newlines in the subtree rooted at n.
+func (n *Node) lines() int {
+	if n == nil {
+		return 0
+	}
+	if n.left == nil && n.right == nil {
+		return n.lineWeight
+	}
+	return n.lineWeight + n.right.lines()
+}
+
+// isLeaf returns true if n is a leaf node.
+func (n *Node) isLeaf() bool {
+	return n.left == nil && n.right == nil
+}
+
+// branch creates a new internal node with the given children. The children
+// must both be non-nil.
+func branch(left, right *Node) *Node {
+	return &Node{
+		weight:     left.len(),
+		lineWeight: left.lines(),
+		height:     max(left.height, right.height) + 1,
+		left:       left,
+		right:      right,
+	}
+}
+
+// rotate creates a new internal node with the given children, rotating the
+// result when the heights of the children differ by two.
+func rotate(left, right *Node) *Node {
+	if left.height > right.height+1 {
+		if left.left.height >= left.right.height {
+			return branch(left.left, branch(left.right, right))
+		}
+		return branch(branch(left.left, left.right.left), branch(left.right.right, right))
+	}
+	if right.height > left.height+1 {
+		if right.right.height >= right.left.height {
+			return branch(branch(left, right.left), right.right)
+		}
+		return branch(branch(left, right.left.left), branch(right.left.right, right.right))
+	}
+	return branch(left, right)
+}
+
+// concat concatenates two nodes, keeping the resulting tree balanced. Small
+// leaves that meet are merged into a single leaf.
 func concat(left, right *Node) *Node {
 	if left == nil {
 		return right
@@ -55,7 +137,51 @@ func concat(left, right *Node) *Node {
 	if right == nil {
 		return left
 	}
-	return &Node{weight: left.len(), left: left, right: right}
+	if left.isLeaf() && right.isLeaf() && len(left.value)+len(right.value) <= maxLeafSize {
+		return leaf(left.value + right.value)
+	}
+	if left.height > right.height+1 {
+		return rotate(left.left, concat(left.right, right))
+	}
+	if right.height > left.height+1 {
+		return rotate(concat(left, right.left), right.right)
+	}
+	return branch(left, right)
+}
+
+// builder assembles a balanced tree from leaves supplied in order, without
+// needing to hold the complete list of leaves.
+type builder struct {
+	// stack holds complete subtrees in order, with strictly decreasing heights.
+	stack []*Node
+}
+
+// push appends a leaf to the tree being built.
+func (b *builder) push(n *Node) {
+	for len(b.stack) > 0 && b.stack[len(b.stack)-1].height == n.height {
+		n = branch(b.stack[len(b.stack)-1], n)
+		b.stack = b.stack[:len(b.stack)-1]
+	}
+	b.stack = append(b.stack, n)
+}
+
+// pushString appends s to the tree being built, split into leaves of at most
+// maxLeafSize bytes.
+func (b *builder) pushString(s string) {
+	for len(s) > 0 {
+		n := min(len(s), maxLeafSize)
+		b.push(leaf(s[:n]))
+		s = s[n:]
+	}
+}
+
+// finish returns the root of the tree built so far.
+func (b *builder) finish() *Node {
+	var n *Node
+	for i := len(b.stack) - 1; i >= 0; i-- {
+		n = concat(b.stack[i], n)
+	}
+	return n
 }
 
 // splitNode splits the node at the provided index and returns two new nodes.
@@ -135,23 +261,48 @@ func (r *binaryRope) Delete(start, end int) Rope {
 	return Concat(left, right)
 }
 
+// visit calls fn with the contents of each leaf overlapping the range
+// [start,end) of the subtree rooted at n, trimmed to the range, in order. It
+// stops early and returns false if fn returns false.
+func visit(n *Node, start, end int, fn func(s string) bool) bool {
+	if n == nil || start >= end {
+		return true
+	}
+	if n.isLeaf() {
+		return fn(n.value[max(0, start):min(len(n.value), end)])
+	}
+	if start < n.weight && !visit(n.left, start, end, fn) {
+		return false
+	}
+	if end > n.weight {
+		return visit(n.right, start-n.weight, end-n.weight, fn)
+	}
+	return true
+}
+
 // String returns the full contents of the rope as a string.
 func (r *binaryRope) String() string {
-	var b []byte
-	var traverse func(n *Node)
-	traverse = func(n *Node) {
-		if n == nil {
-			return
-		}
-		if n.left == nil && n.right == nil {
-			b = append(b, n.value...)
-			return
-		}
-		traverse(n.left)
-		traverse(n.right)
+	return r.Slice(0, r.Len())
+}
+
+// Slice returns the contents of the range [start,end) as a string. The range
+// is clamped to the bounds of the rope.
+func (r *binaryRope) Slice(start, end int) string {
+	if r == nil {
+		return ""
 	}
-	traverse(r.root)
-	return string(b)
+	start = max(0, start)
+	end = min(end, r.Len())
+	if start >= end {
+		return ""
+	}
+	var b strings.Builder
+	b.Grow(end - start)
+	visit(r.root, start, end, func(s string) bool {
+		b.WriteString(s)
+		return true
+	})
+	return b.String()
 }
 
 // Index returns the byte at position idx. It returns ok=false if the index is
@@ -175,32 +326,143 @@ func (r *binaryRope) Index(idx int) (byte, bool) {
 	return 0, false
 }
 
-// Write writes the contents of rp to w. It returns the number of bytes written
-// and any error encountered during the write.
+// LineCount returns the number of lines in the rope.
+func (r *binaryRope) LineCount() int {
+	if r == nil {
+		return 1
+	}
+	return r.root.lines() + 1
+}
+
+// LineStart returns the index of the first byte of line. It returns ok=false
+// if the line is out of range.
+func (r *binaryRope) LineStart(line int) (int, bool) {
+	if r == nil || line < 0 || line >= r.LineCount() {
+		return 0, false
+	}
+	if line == 0 {
+		return 0, true
+	}
+
+	// Find the node holding the line'th newline; the line starts just after it.
+	n := r.root
+	offset := 0
+	for n.left != nil || n.right != nil {
+		if line <= n.lineWeight {
+			n = n.left
+		} else {
+			line -= n.lineWeight
+			offset += n.weight
+			n = n.right
+		}
+	}
+	for i := 0; i < len(n.value); i++ {
+		if n.value[i] == '\n' {
+			line--
+			if line == 0 {
+				return offset + i + 1, true
+			}
+		}
+	}
+	return 0, false // unreachable if the line weights are correct
+}
+
+// LineAt returns the line containing the byte at idx.
+func (r *binaryRope) LineAt(idx int) int {
+	if r == nil || r.root == nil || idx <= 0 {
+		return 0
+	}
+	idx = min(idx, r.Len())
+
+	// Count the newlines before idx.
+	n := r.root
+	line := 0
+	for n.left != nil || n.right != nil {
+		if idx < n.weight {
+			n = n.left
+		} else {
+			line += n.lineWeight
+			idx -= n.weight
+			n = n.right
+		}
+	}
+	return line + strings.Count(n.value[:idx], "\n")
+}
+
+// Write writes the contents of rp to w one leaf at a time. It returns the
+// number of bytes written and any error encountered during the write.
 func (r *binaryRope) Write(w io.Writer) (int64, error) {
-	if w == nil {
+	if w == nil || r == nil {
 		return 0, nil
 	}
-	n, err := io.WriteString(w, r.String())
-	return int64(n), err
+	var total int64
+	var err error
+	visit(r.root, 0, r.Len(), func(s string) bool {
+		var n int
+		n, err = io.WriteString(w, s)
+		total += int64(n)
+		return err == nil
+	})
+	return total, err
+}
+
+// Bytes returns an iterator over the bytes of the rope positioned at idx.
+func (r *binaryRope) Bytes(idx int) *ByteIterator {
+	it := newByteIterator(r.root, idx)
+	return &it
+}
+
+// Runes returns an iterator over the runes of the rope positioned at idx.
+func (r *binaryRope) Runes(idx int) *RuneIterator {
+	return &RuneIterator{bytes: newByteIterator(r.root, idx)}
+}
+
+// Lines returns an iterator over the lines of the rope positioned at line.
+func (r *binaryRope) Lines(line int) *LineIterator {
+	return &LineIterator{rope: r, line: max(0, min(line, r.LineCount()))}
+}
+
+// Reader returns a reader over the contents of the rope starting at idx.
+func (r *binaryRope) Reader(idx int) *Reader {
+	return &Reader{runes: RuneIterator{bytes: newByteIterator(r.root, idx)}}
 }
 
 // New creates a new Rope containing the provided string.
 func NewRope(s string) Rope {
-	return &binaryRope{root: leaf(s)}
+	if len(s) <= maxLeafSize {
+		return &binaryRope{root: leaf(s)}
+	}
+	var b builder
+	b.pushString(s)
+	return &binaryRope{root: b.finish()}
 }
 
+// readChunkSize is the number of bytes NewFromReader reads at a time. Each
+// chunk is converted to a string once and shared by the leaves cut from it.
+const readChunkSize = 64 * maxLeafSize
+
 // Read consumes all data from r and returns a new Rope containing it.
-// Any error encountered while reading is returned.
+// Any error encountered while reading is returned. The data is read in chunks
+// and stored directly in leaves, so only one copy of it is held in memory.
 func NewFromReader(r io.Reader) (Rope, error) {
 	if r == nil {
 		return &binaryRope{}, nil
 	}
-	// TODO: This may waste a lot of memory
-	data, err := io.ReadAll(r)
-	if err != nil {
-		return nil, err
+
+	var b builder
+	chunk := make([]byte, readChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			b.pushString(string(chunk[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return NewRope(string(data)), nil
+	return &binaryRope{root: b.finish()}, nil
 }
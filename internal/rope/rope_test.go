@@ -2,8 +2,11 @@ package rope
 
 import (
 	"errors"
+	"math"
+	"math/rand"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestNewLenString(t *testing.T) {
@@ -29,6 +32,28 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestReadChunked(t *testing.T) {
+	data := strings.Repeat("0123456789abcdef\n", 20000)
+	r, err := NewFromReader(iotest.HalfReader(strings.NewReader(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := r.String(); got != data {
+		t.Fatalf("contents mismatch after chunked read")
+	}
+	if r.LineCount() != 20001 {
+		t.Fatalf("expected 20001 lines got %d", r.LineCount())
+	}
+	root := r.(*binaryRope).root
+	leaves := checkBalanced(t, root)
+	if leaves != (len(data)+maxLeafSize-1)/maxLeafSize {
+		t.Fatalf("expected full leaves, got %d leaves for %d bytes", leaves, len(data))
+	}
+	if root.height > maxDepth(leaves) {
+		t.Fatalf("depth %d exceeds bound %d", root.height, maxDepth(leaves))
+	}
+}
+
 type errReader struct{}
 
 func (errReader) Read([]byte) (int, error) {
@@ -161,3 +186,227 @@ func TestWriteNil(t *testing.T) {
 		t.Fatalf("expected 0 bytes written got %d", n)
 	}
 }
+
+func TestLineCount(t *testing.T) {
+	tests := []struct {
+		s     string
+		lines int
+	}{
+		{"", 1},
+		{"abc", 1},
+		{"a\n", 2},
+		{"a\nb\nc", 3},
+		{"\n\n\n", 4},
+	}
+	for _, tt := range tests {
+		if got := NewRope(tt.s).LineCount(); got != tt.lines {
+			t.Fatalf("%q: expected %d lines got %d", tt.s, tt.lines, got)
+		}
+	}
+}
+
+func TestLineStartAndLineAt(t *testing.T) {
+	// Build a rope spanning many leaves and edit it so the lookups have to
+	// walk internal nodes.
+	var sb strings.Builder
+	for i := 0; i < 2000; i++ {
+		sb.WriteString(strings.Repeat("x", i%7))
+		sb.WriteString("\n")
+	}
+	data := sb.String()
+	r := NewRope(data).Insert(500, "a\nb").Delete(1000, 1010)
+	data = data[:500] + "a\nb" + data[500:]
+	data = data[:1000] + data[1010:]
+
+	starts := []int{0}
+	for i := 0; i < len(data); i++ {
+		if data[i] == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	if r.LineCount() != len(starts) {
+		t.Fatalf("expected %d lines got %d", len(starts), r.LineCount())
+	}
+	for line, want := range starts {
+		got, ok := r.LineStart(line)
+		if !ok || got != want {
+			t.Fatalf("line %d: expected start %d got %d (ok %v)", line, want, got, ok)
+		}
+	}
+	if _, ok := r.LineStart(len(starts)); ok {
+		t.Fatalf("expected false for out of range line")
+	}
+	if _, ok := r.LineStart(-1); ok {
+		t.Fatalf("expected false for negative line")
+	}
+
+	line := 0
+	for idx := 0; idx <= len(data); idx++ {
+		if got := r.LineAt(idx); got != line {
+			t.Fatalf("index %d: expected line %d got %d", idx, line, got)
+		}
+		if idx < len(data) && data[idx] == '\n' {
+			line++
+		}
+	}
+	if got := r.LineAt(len(data) + 10); got != len(starts)-1 {
+		t.Fatalf("expected last line for index past end got %d", got)
+	}
+}
+
+func TestNewRopeLargeString(t *testing.T) {
+	data := strings.Repeat("hello\nworld ", 1000)
+	r := NewRope(data)
+	if got := r.String(); got != data {
+		t.Fatalf("large rope contents mismatch")
+	}
+	if r.Len() != len(data) {
+		t.Fatalf("expected length %d got %d", len(data), r.Len())
+	}
+}
+
+// checkBalanced verifies the structural invariants of the subtree rooted at n
+// and returns the number of leaves it contains.
+func checkBalanced(t testing.TB, n *Node) int {
+	t.Helper()
+	if n == nil {
+		return 0
+	}
+	if n.isLeaf() {
+		if n.height != 0 || n.weight != len(n.value) || n.lineWeight != strings.Count(n.value, "\n") {
+			t.Fatalf("bad leaf %+v", n)
+		}
+		if len(n.value) > maxLeafSize {
+			t.Fatalf("leaf of %d bytes exceeds limit", len(n.value))
+		}
+		return 1
+	}
+	if n.left == nil || n.right == nil {
+		t.Fatalf("internal node with a missing child")
+	}
+	if d := n.left.height - n.right.height; d < -1 || d > 1 {
+		t.Fatalf("unbalanced node: left height %d right height %d", n.left.height, n.right.height)
+	}
+	if n.height != max(n.left.height, n.right.height)+1 {
+		t.Fatalf("bad height %d", n.height)
+	}
+	if n.weight != n.left.len() || n.lineWeight != n.left.lines() {
+		t.Fatalf("bad weights")
+	}
+	return checkBalanced(t, n.left) + checkBalanced(t, n.right)
+}
+
+// maxDepth returns the largest height allowed for a balanced tree with the
+// provided number of leaves.
+func maxDepth(leaves int) int {
+	return int(1.45*math.Log2(float64(leaves+2))) + 1
+}
+
+func TestEditsKeepTreeBalanced(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	r := NewRope("")
+	var ref []byte
+	for i := 0; i < 20000; i++ {
+		if len(ref) > 0 && rng.Intn(4) == 0 {
+			start := rng.Intn(len(ref))
+			end := min(len(ref), start+rng.Intn(20))
+			r = r.Delete(start, end)
+			ref = append(ref[:start], ref[end:]...)
+		} else {
+			idx := rng.Intn(len(ref) + 1)
+			s := strings.Repeat(string(rune('a'+rng.Intn(26))), 1+rng.Intn(3))
+			if rng.Intn(10) == 0 {
+				s = "\n"
+			}
+			r = r.Insert(idx, s)
+			ref = append(ref[:idx], append([]byte(s), ref[idx:]...)...)
+		}
+	}
+
+	if got := r.String(); got != string(ref) {
+		t.Fatalf("contents mismatch after edits")
+	}
+	root := r.(*binaryRope).root
+	leaves := checkBalanced(t, root)
+	if root.height > maxDepth(leaves) {
+		t.Fatalf("depth %d exceeds bound %d for %d leaves", root.height, maxDepth(leaves), leaves)
+	}
+}
+
+func TestSingleCharInsertsStayShallow(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	r := NewRope("")
+	for i := 0; i < 200000; i++ {
+		r = r.Insert(rng.Intn(r.Len()+1), "x")
+	}
+	root := r.(*binaryRope).root
+	leaves := checkBalanced(t, root)
+	if root.height > maxDepth(leaves) {
+		t.Fatalf("depth %d exceeds bound %d for %d leaves", root.height, maxDepth(leaves), leaves)
+	}
+}
+
+func TestConcatBalanced(t *testing.T) {
+	r := NewRope("")
+	for i := 0; i < 5000; i++ {
+		r = Concat(r, NewRope(strings.Repeat("y", 700)))
+	}
+	root := r.(*binaryRope).root
+	leaves := checkBalanced(t, root)
+	if root.height > maxDepth(leaves) {
+		t.Fatalf("depth %d exceeds bound %d for %d leaves", root.height, maxDepth(leaves), leaves)
+	}
+}
+
+// benchmarkInserts performs n single character inserts at positions chosen by
+// pos and fails if the tree depth exceeds the balanced bound.
+func benchmarkInserts(b *testing.B, n int, pos func(rng *rand.Rand, length int) int) {
+	for i := 0; i < b.N; i++ {
+		rng := rand.New(rand.NewSource(int64(i)))
+		r := NewRope("")
+		for j := 0; j < n; j++ {
+			r = r.Insert(pos(rng, r.Len()), "x")
+		}
+		root := r.(*binaryRope).root
+		leaves := checkBalanced(b, root)
+		if root.height > maxDepth(leaves) {
+			b.Fatalf("depth %d exceeds bound %d for %d leaves", root.height, maxDepth(leaves), leaves)
+		}
+		b.ReportMetric(float64(root.height), "depth")
+		b.ReportMetric(float64(leaves), "leaves")
+	}
+}
+
+func BenchmarkMillionRandomInserts(b *testing.B) {
+	benchmarkInserts(b, 1000000, func(rng *rand.Rand, length int) int { return rng.Intn(length + 1) })
+}
+
+func BenchmarkMillionAppends(b *testing.B) {
+	benchmarkInserts(b, 1000000, func(_ *rand.Rand, length int) int { return length })
+}
+
+func BenchmarkMillionPrepends(b *testing.B) {
+	benchmarkInserts(b, 1000000, func(*rand.Rand, int) int { return 0 })
+}
+
+func BenchmarkInsertSingleChar(b *testing.B) {
+	rng := rand.New(rand.NewSource(3))
+	r := NewRope(strings.Repeat("hello world\n", 100000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r = r.Insert(rng.Intn(r.Len()+1), "x")
+	}
+	b.ReportMetric(float64(r.(*binaryRope).root.height), "depth")
+}
+
+func BenchmarkIndex(b *testing.B) {
+	rng := rand.New(rand.NewSource(4))
+	r := NewRope("")
+	for i := 0; i < 100000; i++ {
+		r = r.Insert(rng.Intn(r.Len()+1), "x")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Index(rng.Intn(r.Len()))
+	}
+}
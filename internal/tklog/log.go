@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"testing"
 )
 
 func Debug(msg string, args ...any) {
@@ -35,9 +36,22 @@ func Panic(msg string, args ...any) {
 
 var logger *log.Logger
 
+// logPath returns the file the log is written to, which is $TKED_LOG if it is
+// set and otherwise tked.log in the working directory. Tests' logs are
+// dropped unless TKED_LOG is set, so they don't leave files in the packages.
+func logPath() string {
+	if path := os.Getenv("TKED_LOG"); path != "" {
+		return path
+	}
+	if testing.Testing() {
+		return os.DevNull
+	}
+	return "tked.log"
+}
+
 func ensureLogger() *log.Logger {
 	if logger == nil {
-		f, err := os.Create("tked.log")
+		f, err := os.Create(logPath())
 		if err != nil {
 			panic(err)
 		}
@@ -17,6 +17,7 @@ func TestEnsureLoggerCreatesFile(t *testing.T) {
 	cwd, _ := os.Getwd()
 	defer os.Chdir(cwd)
 	os.Chdir(dir)
+	t.Setenv("TKED_LOG", "tked.log")
 	resetLogger()
 
 	l := ensureLogger()
@@ -33,6 +34,7 @@ func TestLoggingFunctionsWrite(t *testing.T) {
 	cwd, _ := os.Getwd()
 	defer os.Chdir(cwd)
 	os.Chdir(dir)
+	t.Setenv("TKED_LOG", "tked.log")
 	resetLogger()
 
 	Debug("debug")
@@ -59,11 +61,23 @@ func TestLoggingFunctionsWrite(t *testing.T) {
 	}
 }
 
+func TestLogPath(t *testing.T) {
+	t.Setenv("TKED_LOG", "")
+	if got := logPath(); got != os.DevNull {
+		t.Fatalf("expected tests' logs dropped got %q", got)
+	}
+	t.Setenv("TKED_LOG", "/tmp/tked.log")
+	if got := logPath(); got != "/tmp/tked.log" {
+		t.Fatalf("expected $TKED_LOG got %q", got)
+	}
+}
+
 func TestPanicLogsAndPanics(t *testing.T) {
 	dir := t.TempDir()
 	cwd, _ := os.Getwd()
 	defer os.Chdir(cwd)
 	os.Chdir(dir)
+	t.Setenv("TKED_LOG", "tked.log")
 	resetLogger()
 
 	defer func() {
@@ -91,7 +105,7 @@ func TestFatalLogsAndExits(t *testing.T) {
 
 	dir := t.TempDir()
 	cmd := exec.Command(os.Args[0], "-test.run=TestFatalLogsAndExits$")
-	cmd.Env = append(os.Environ(), "TKLOG_FATAL=1")
+	cmd.Env = append(os.Environ(), "TKLOG_FATAL=1", "TKED_LOG=tked.log")
 	cmd.Dir = dir
 	err := cmd.Run()
 	if err == nil {